@@ -0,0 +1,218 @@
+/**
+ * Copyright 2024 Boris Wolf
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	ROLE_NONE                = "none"
+	ROLE_READER              = "reader"
+	ROLE_EDITOR              = "editor"
+	ROLE_ADMIN               = "admin"
+	AGENT_CLI                = "cli"
+	AGENT_SLACK              = "slack"
+	AGENT_WEB                = "web"
+	AGENT_API                = "api"
+	AGENT_EMAIL              = "email"
+	AGENT_MATRIX             = "matrix"
+	AGENT_TEAMS              = "teams"
+	USERS_FILE_CONFIG        = "usersfile"
+	DEFAULT_USERS_FILE       = "users.json"
+	PASSWORD_HASH_SCHEME     = "sha256"
+	PASSWORD_HASH_ITERATIONS = 100000
+	PASSWORD_SALT_LEN        = 16
+)
+
+var ErrPermissionDenied = errors.New("permission denied")
+
+// role levels, a role includes the permissions of all roles with a lower level
+var roleLevels = map[string]int{
+	ROLE_NONE:   0,
+	ROLE_READER: 1,
+	ROLE_EDITOR: 2,
+	ROLE_ADMIN:  3,
+}
+
+type (
+	// AccessUser maps a user of an agent to a role, optionally overridden per knowledge base.
+	AccessUser struct {
+		Agent    string            `json:"agent"`    // agent the user id belongs to, empty for any agent
+		Id       string            `json:"id"`       // slack user id or login name
+		Role     string            `json:"role"`     // role for all knowledge bases
+		Bases    map[string]string `json:"bases"`    // roles for individual knowledge bases
+		Password string            `json:"password"` // password hash for web login
+	}
+	AccessConfig struct {
+		DefaultRole string            `json:"defaultRole"` // role of unknown users
+		AgentRoles  map[string]string `json:"agentRoles"`  // role of unknown users per agent
+		Users       []*AccessUser     `json:"users"`
+	}
+	JSONAccessProvider struct {
+		sync.RWMutex
+		filePath string
+		config   AccessConfig
+	}
+)
+
+type AccessProvider interface {
+	GetRole(user *User, baseName string) string
+	Authenticate(agent, id, password string) (*User, error)
+}
+
+// NewJSONAccessProvider loads users and roles from a json file. Without file unknown users are
+// readers, except for the local cli user who is admin.
+func NewJSONAccessProvider(filePath string) (AccessProvider, error) {
+	ap := JSONAccessProvider{
+		filePath: filePath,
+		config: AccessConfig{
+			DefaultRole: ROLE_READER,
+			AgentRoles:  map[string]string{AGENT_CLI: ROLE_ADMIN},
+		},
+	}
+	data, err := os.ReadFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return &ap, nil
+	}
+	if err != nil {
+		return &ap, err
+	}
+	var config AccessConfig
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return &ap, err
+	}
+	if config.DefaultRole == "" {
+		config.DefaultRole = ap.config.DefaultRole
+	}
+	if config.AgentRoles == nil {
+		config.AgentRoles = ap.config.AgentRoles
+	}
+	ap.config = config
+	for _, u := range ap.config.Users {
+		if _, ok := roleLevels[u.Role]; !ok {
+			return &ap, errors.New("invalid role " + u.Role + " for user " + u.Id)
+		}
+		for _, role := range u.Bases {
+			if _, ok := roleLevels[role]; !ok {
+				return &ap, errors.New("invalid role " + role + " for user " + u.Id)
+			}
+		}
+	}
+	return &ap, nil
+}
+
+func (ap *JSONAccessProvider) findUser(agent, id string) *AccessUser {
+	for _, u := range ap.config.Users {
+		if u.Id == id && (u.Agent == "" || u.Agent == agent) {
+			return u
+		}
+	}
+	return nil
+}
+
+func (ap *JSONAccessProvider) GetRole(user *User, baseName string) string {
+	ap.RLock()
+	defer ap.RUnlock()
+	if user == nil {
+		return ap.config.DefaultRole
+	}
+	u := ap.findUser(user.Agent, user.GetLogin())
+	if u == nil {
+		if role, ok := ap.config.AgentRoles[user.Agent]; ok {
+			return role
+		}
+		return ap.config.DefaultRole
+	}
+	if role, ok := u.Bases[baseName]; ok {
+		return role
+	}
+	return u.Role
+}
+
+func (ap *JSONAccessProvider) Authenticate(agent, id, password string) (*User, error) {
+	ap.RLock()
+	defer ap.RUnlock()
+	u := ap.findUser(agent, id)
+	if u == nil || u.Password == "" || !CheckPassword(u.Password, password) {
+		return nil, errors.New("invalid user or password")
+	}
+	user := NewUser(id, id, id).WithAgent(agent)
+	user.Login = id
+	return user, nil
+}
+
+// HasRole tells whether the user has at least the given role for the knowledge base.
+func HasRole(ap AccessProvider, user *User, baseName, role string) bool {
+	return roleLevels[ap.GetRole(user, baseName)] >= roleLevels[role]
+}
+
+func CheckRole(ap AccessProvider, user *User, baseName, role string) error {
+	if !HasRole(ap, user, baseName, role) {
+		return fmt.Errorf("%w, %s role required for knowledge base %s", ErrPermissionDenied, role, baseName)
+	}
+	return nil
+}
+
+func hashPassword(salt []byte, iterations int, password string) []byte {
+	sum := sha256.Sum256(append(salt, []byte(password)...))
+	for i := 1; i < iterations; i++ {
+		sum = sha256.Sum256(append(sum[:], salt...))
+	}
+	return sum[:]
+}
+
+// HashPassword returns an iterated salted sha256 hash of the password in the form
+// sha256$iterations$salt$hash for use in the users file.
+func HashPassword(password string) string {
+	salt := make([]byte, PASSWORD_SALT_LEN)
+	rand.Read(salt)
+	hash := hashPassword(salt, PASSWORD_HASH_ITERATIONS, password)
+	return fmt.Sprintf("%s$%d$%s$%s", PASSWORD_HASH_SCHEME, PASSWORD_HASH_ITERATIONS,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(hash))
+}
+
+func CheckPassword(passwordHash, password string) bool {
+	parts := strings.Split(passwordHash, "$")
+	if len(parts) != 4 || parts[0] != PASSWORD_HASH_SCHEME {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	hash, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(hash, hashPassword(salt, iterations, password)) == 1
+}
@@ -0,0 +1,149 @@
+/**
+ * Copyright 2024 Boris Wolf
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestAccessProvider(defaultRole string, users ...*AccessUser) AccessProvider {
+	return &JSONAccessProvider{config: AccessConfig{DefaultRole: defaultRole, Users: users}}
+}
+
+func TestAccessRoles(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "users.json")
+	ap, err := NewJSONAccessProvider(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ap.GetRole(NewUser("1", "one", "one").WithAgent(AGENT_SLACK), "system") != ROLE_READER {
+		t.Errorf("expected readers without users file")
+	}
+	if ap.GetRole(NewUser("1", "one", "one").WithAgent(AGENT_CLI), "system") != ROLE_ADMIN {
+		t.Errorf("expected cli user to be admin without users file")
+	}
+	hash := HashPassword("secret")
+	data := `{
+		"defaultRole": "none",
+		"agentRoles": {"web": "reader"},
+		"users": [
+			{"agent": "slack", "id": "U1", "role": "editor", "bases": {"hr": "reader"}},
+			{"agent": "web", "id": "alice", "role": "admin", "password": "` + hash + `"}
+		]
+	}`
+	os.WriteFile(file, []byte(data), 0644)
+	ap, err = NewJSONAccessProvider(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slackUser := NewUser("U1", "one", "one").WithAgent(AGENT_SLACK)
+	if !HasRole(ap, slackUser, "system", ROLE_EDITOR) || HasRole(ap, slackUser, "system", ROLE_ADMIN) {
+		t.Errorf("expected slack user to be editor")
+	}
+	if HasRole(ap, slackUser, "hr", ROLE_EDITOR) || !HasRole(ap, slackUser, "hr", ROLE_READER) {
+		t.Errorf("expected slack user to be reader of hr")
+	}
+	if HasRole(ap, NewUser("U1", "one", "one").WithAgent(AGENT_CLI), "system", ROLE_READER) {
+		t.Errorf("expected user ids to be scoped to their agent")
+	}
+	if ap.GetRole(NewUser("x", "x", "x").WithAgent(AGENT_WEB), "system") != ROLE_READER {
+		t.Errorf("expected agent role for unknown web user")
+	}
+	_, err = ap.Authenticate(AGENT_WEB, "alice", "wrong")
+	if err == nil {
+		t.Errorf("expected wrong password to be rejected")
+	}
+	user, err := ap.Authenticate(AGENT_WEB, "alice", "secret")
+	if err != nil || !HasRole(ap, user, "system", ROLE_ADMIN) {
+		t.Errorf("expected alice to log in as admin: %v", err)
+	}
+	_, err = ap.Authenticate(AGENT_SLACK, "alice", "secret")
+	if err == nil {
+		t.Errorf("expected web user not to log in to other agents")
+	}
+	os.WriteFile(file, []byte(`{"users": [{"id": "bob", "role": "boss"}]}`), 0644)
+	_, err = NewJSONAccessProvider(file)
+	if err == nil {
+		t.Errorf("expected invalid role to be rejected")
+	}
+}
+
+func TestAccessCommands(t *testing.T) {
+	_, server := newTestWebAgent(t)
+	ask := func(user, question string) (*ApiAskResponse, int) {
+		var resp ApiAskResponse
+		status := http.StatusOK
+		req, _ := http.NewRequest("POST", server.URL+"/api/v1/ask", strings.NewReader(`{"sessionId":"`+user+`","question":"`+question+`"}`))
+		req.SetBasicAuth(user, "secret")
+		httpResp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer httpResp.Body.Close()
+		status = httpResp.StatusCode
+		json.NewDecoder(httpResp.Body).Decode(&resp)
+		return &resp, status
+	}
+	resp, status := ask("bob", "rlistknowledgebases")
+	if status != http.StatusOK || len(resp.Answers) != 1 || strings.Contains(resp.Answers[0].Text, "startrek") {
+		t.Errorf("expected startrek to be hidden from bob: %d %+v", status, resp.Answers)
+	}
+	_, status = ask("bob", "rsetcurrentknowledgebase startrek")
+	if status != http.StatusUnprocessableEntity {
+		t.Errorf("expected bob not to select startrek, got %d", status)
+	}
+	_, status = ask("bob", "rdeletefact GREETING")
+	if status != http.StatusUnprocessableEntity {
+		t.Errorf("expected bob not to delete facts, got %d", status)
+	}
+	resp, status = ask("admin", "rdeletefact GREETING")
+	if status != http.StatusOK || !strings.Contains(resp.Answers[0].Text, "deleted fact") {
+		t.Errorf("expected admin to delete facts: %d %+v", status, resp)
+	}
+	_, status = ask("bob", "rnumfacts")
+	if status != http.StatusOK {
+		t.Errorf("expected bob to read facts, got %d", status)
+	}
+	_, status = ask("admin", "rnumfacts")
+	if status != http.StatusOK {
+		t.Errorf("expected admin to read facts, got %d", status)
+	}
+	req, _ := http.NewRequest("GET", server.URL+"/api/v1/knowledgebases/startrek/facts", nil)
+	req.SetBasicAuth("bob", "wrong")
+	httpResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected wrong password to be rejected, got %d", httpResp.StatusCode)
+	}
+	req.SetBasicAuth("bob", "secret")
+	httpResp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected bob not to read startrek, got %d", httpResp.StatusCode)
+	}
+}
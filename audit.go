@@ -0,0 +1,233 @@
+/**
+ * Copyright 2024 Boris Wolf
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	AUDIT_OUTCOME_OK     = "ok"
+	AUDIT_OUTCOME_ERROR  = "error"
+	AUDIT_OUTCOME_DENIED = "denied"
+	AUDIT_ADD_FACT       = "addfact"
+	AUDIT_UPDATE_FACT    = "updatefact"
+	AUDIT_DELETE_FACT    = "deletefact"
+	AUDIT_SYNC           = "sync"
+	AUDIT_FILE_CONFIG    = "auditfile"
+	DEFAULT_AUDIT_FILE   = "audit.jsonl"
+	DEFAULT_AUDIT_LIMIT  = 20
+	MAX_AUDIT_LINE       = 4 * 1024 * 1024
+)
+
+type (
+	AuditEntry struct {
+		Time          time.Time `json:"time"`
+		User          string    `json:"user"` // login or id of the user
+		UserName      string    `json:"userName"`
+		Agent         string    `json:"agent"`
+		KnowledgeBase string    `json:"knowledgeBase"`
+		Command       string    `json:"command"`
+		Args          []string  `json:"args,omitempty"`
+		FactName      string    `json:"factName,omitempty"`
+		Before        *Fact     `json:"before,omitempty"` // fact before the change, nil if it was added
+		After         *Fact     `json:"after,omitempty"`  // fact after the change, nil if it was deleted
+		Outcome       string    `json:"outcome"`          // ok, error or denied
+		Error         string    `json:"error,omitempty"`
+	}
+	AuditFilter struct {
+		KnowledgeBase string
+		User          string
+		FactName      string
+		Command       string
+		Since         time.Time
+		Limit         int // max number of entries, most recent first
+	}
+	JSONLAuditLog struct {
+		sync.Mutex
+		filePath string
+		file     *os.File
+	}
+)
+
+type AuditLog interface {
+	Record(entry *AuditEntry) error
+	Query(filter *AuditFilter) ([]*AuditEntry, error)
+	Close() error
+}
+
+func NewAuditEntry(user *User, baseName, command string, args ...string) *AuditEntry {
+	entry := AuditEntry{
+		Time:          time.Now(),
+		KnowledgeBase: baseName,
+		Command:       command,
+		Args:          args,
+		Outcome:       AUDIT_OUTCOME_OK,
+	}
+	if user != nil {
+		entry.User = user.GetLogin()
+		entry.UserName = user.Name
+		entry.Agent = user.Agent
+	}
+	return &entry
+}
+
+// WithFact remembers snapshots of a fact before and after the command, either may be nil.
+func (e *AuditEntry) WithFact(name string, before, after *Fact) *AuditEntry {
+	e.FactName = name
+	if before != nil {
+		f := *before
+		e.Before = &f
+	}
+	if after != nil {
+		f := *after
+		e.After = &f
+	}
+	return e
+}
+
+func (e *AuditEntry) WithOutcome(err error) *AuditEntry {
+	if err == nil {
+		e.Outcome = AUDIT_OUTCOME_OK
+		e.Error = ""
+	} else if errors.Is(err, ErrPermissionDenied) {
+		e.Outcome = AUDIT_OUTCOME_DENIED
+		e.Error = err.Error()
+	} else {
+		e.Outcome = AUDIT_OUTCOME_ERROR
+		e.Error = err.Error()
+	}
+	return e
+}
+
+func (e *AuditEntry) matches(filter *AuditFilter) bool {
+	if filter.KnowledgeBase != "" && e.KnowledgeBase != filter.KnowledgeBase {
+		return false
+	}
+	if filter.User != "" && e.User != filter.User && e.UserName != filter.User {
+		return false
+	}
+	if filter.FactName != "" && !strings.EqualFold(e.FactName, filter.FactName) {
+		return false
+	}
+	if filter.Command != "" && e.Command != filter.Command {
+		return false
+	}
+	if !filter.Since.IsZero() && e.Time.Before(filter.Since) {
+		return false
+	}
+	return true
+}
+
+// RecordAudit records an entry if there is an audit log, failures are logged but do not fail the command.
+func RecordAudit(al AuditLog, entry *AuditEntry) {
+	if al == nil {
+		return
+	}
+	err := al.Record(entry)
+	if err != nil {
+		log.Error().Err(err).Str("command", entry.Command).Msg("failed to record audit entry")
+	}
+}
+
+// NewJSONLAuditLog appends audit entries as json lines to the given file.
+func NewJSONLAuditLog(filePath string) (AuditLog, error) {
+	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	al := JSONLAuditLog{
+		filePath: filePath,
+		file:     file,
+	}
+	return &al, nil
+}
+
+func (al *JSONLAuditLog) Record(entry *AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	al.Lock()
+	defer al.Unlock()
+	if al.file == nil {
+		return errors.New("audit log closed")
+	}
+	_, err = al.file.Write(append(data, '\n'))
+	return err
+}
+
+func (al *JSONLAuditLog) Query(filter *AuditFilter) ([]*AuditEntry, error) {
+	if filter == nil {
+		filter = &AuditFilter{}
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = DEFAULT_AUDIT_LIMIT
+	}
+	al.Lock()
+	defer al.Unlock()
+	file, err := os.Open(al.filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	entries := make([]*AuditEntry, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), MAX_AUDIT_LINE)
+	for scanner.Scan() {
+		var entry AuditEntry
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			log.Warn().Err(err).Msg("skipping invalid audit entry")
+			continue
+		}
+		if entry.matches(filter) {
+			entries = append(entries, &entry)
+			// only the most recent entries are kept
+			if len(entries) > limit {
+				entries = entries[1:]
+			}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
+
+func (al *JSONLAuditLog) Close() error {
+	al.Lock()
+	defer al.Unlock()
+	if al.file == nil {
+		return nil
+	}
+	err := al.file.Close()
+	al.file = nil
+	return err
+}
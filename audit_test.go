@@ -0,0 +1,99 @@
+/**
+ * Copyright 2024 Boris Wolf
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	wa, server := newTestWebAgent(t)
+	ask := func(user, question string) *ApiAskResponse {
+		var resp ApiAskResponse
+		req, _ := http.NewRequest("POST", server.URL+"/api/v1/ask", strings.NewReader(`{"sessionId":"`+user+`","question":"`+question+`"}`))
+		req.SetBasicAuth(user, "secret")
+		httpResp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer httpResp.Body.Close()
+		json.NewDecoder(httpResp.Body).Decode(&resp)
+		return &resp
+	}
+	ask("bob", "rdeletefact GREETING")
+	ask("admin", "rdeletefact GREETING")
+	ask("admin", "raddfact hint")
+	ask("admin", "How do I get help?")
+	ask("admin", "Read the manual")
+	ask("admin", "done")
+	doTestRequest(t, "POST", server.URL+"/api/v1/knowledgebases/startrek/facts", &Fact{Name: "WARP", Question: "What is warp?", Answers: []string{"fast"}}, http.StatusCreated, nil)
+	entries, err := wa.audit.Query(&AuditFilter{KnowledgeBase: "system"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("expected 4 audit entries, got %d", len(entries))
+	}
+	done, added, deleted := entries[0], entries[1], entries[2]
+	if done.Command != S_DONE || done.User != "admin" || done.Agent != AGENT_WEB || done.After == nil || done.After.Name != "HINT" || done.Outcome != AUDIT_OUTCOME_OK {
+		t.Errorf("unexpected done entry: %+v", done)
+	}
+	if added.Command != R_ADD_FACT || added.FactName != "HINT" {
+		t.Errorf("unexpected add entry: %+v", added)
+	}
+	if deleted.Command != R_DELETE_FACT || deleted.Before == nil || deleted.Before.Answers[0] != "just say hello" || deleted.After != nil {
+		t.Errorf("unexpected delete entry: %+v", deleted)
+	}
+	if entries[3].User != "bob" || entries[3].Outcome != AUDIT_OUTCOME_DENIED || entries[3].Args[0] != "GREETING" {
+		t.Errorf("expected denied entry for bob: %+v", entries[3])
+	}
+	resp := ask("admin", "raudit greeting")
+	if len(resp.Answers) != 1 || !strings.Contains(resp.Answers[0].Text, "admin (web) rdeletefact GREETING: ok") {
+		t.Errorf("unexpected audit answer: %+v", resp.Answers)
+	}
+	resp = ask("bob", "raudit")
+	if len(resp.Answers) != 0 {
+		t.Errorf("expected bob not to see the audit log: %+v", resp.Answers)
+	}
+	var apiEntries []*AuditEntry
+	req, _ := http.NewRequest("GET", server.URL+"/api/v1/audit?knowledgeBase=startrek&limit=5", nil)
+	req.SetBasicAuth("admin", "secret")
+	httpResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.NewDecoder(httpResp.Body).Decode(&apiEntries)
+	httpResp.Body.Close()
+	if len(apiEntries) != 1 || apiEntries[0].Command != AUDIT_ADD_FACT || apiEntries[0].Agent != AGENT_API || apiEntries[0].After.Name != "WARP" {
+		t.Errorf("unexpected api audit entries: %+v", apiEntries)
+	}
+	if entries, _ = wa.audit.Query(&AuditFilter{FactName: "warp"}); len(entries) != 1 || entries[0].FactName != "WARP" {
+		t.Errorf("expected fact names to match regardless of case: %+v", entries)
+	}
+	req.SetBasicAuth("bob", "secret")
+	httpResp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected bob not to query the audit log, got %d", httpResp.StatusCode)
+	}
+}
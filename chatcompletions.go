@@ -0,0 +1,292 @@
+/**
+ * Copyright 2024 Boris Wolf
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	CHAT_PREFIX          = "/v1"
+	CHAT_DEFAULT_MODEL   = "agentsmith"
+	CHAT_USER_NAME       = "ChatUser"
+	CHAT_SESSION_PREFIX  = "chat-"
+	CHAT_OBJECT          = "chat.completion"
+	CHAT_CHUNK_OBJECT    = "chat.completion.chunk"
+	CHAT_ROLE_USER       = "user"
+	CHAT_ROLE_ASSISTANT  = "assistant"
+	CHAT_FINISH_STOP     = "stop"
+	CHAT_OWNER           = "agentsmith"
+	WEB_API_KEY          = "webApiKey"
+	CHAT_ERROR_INVALID   = "invalid_request_error"
+	CHAT_ERROR_NOT_FOUND = "model_not_found"
+	CHAT_CONTENT_TEXT    = "text"
+)
+
+type (
+	ChatMessage struct {
+		Role    string `json:"role,omitempty"`
+		Content string `json:"content"`
+	}
+	ChatCompletionsRequest struct {
+		Model    string        `json:"model"`
+		Messages []ChatMessage `json:"messages"`
+		Stream   bool          `json:"stream"`
+	}
+	ChatChoice struct {
+		Index        int          `json:"index"`
+		Message      *ChatMessage `json:"message,omitempty"`
+		Delta        *ChatMessage `json:"delta,omitempty"`
+		FinishReason *string      `json:"finish_reason"`
+	}
+	ChatUsage struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+		TotalTokens      int `json:"total_tokens"`
+	}
+	ChatCompletionsResponse struct {
+		ID      string        `json:"id"`
+		Object  string        `json:"object"`
+		Created int64         `json:"created"`
+		Model   string        `json:"model"`
+		Choices []*ChatChoice `json:"choices"`
+		Usage   *ChatUsage    `json:"usage,omitempty"`
+	}
+	ChatModel struct {
+		ID      string `json:"id"`
+		Object  string `json:"object"`
+		Created int64  `json:"created"`
+		OwnedBy string `json:"owned_by"`
+	}
+	ChatModelList struct {
+		Object string       `json:"object"`
+		Data   []*ChatModel `json:"data"`
+	}
+	ChatError struct {
+		Error *GptError `json:"error"`
+	}
+)
+
+// UnmarshalJSON accepts the content of a message as a string or as an array of content parts, of
+// which the text parts are joined.
+func (m *ChatMessage) UnmarshalJSON(data []byte) error {
+	var msg struct {
+		Role    string          `json:"role"`
+		Content json.RawMessage `json:"content"`
+	}
+	err := json.Unmarshal(data, &msg)
+	if err != nil {
+		return err
+	}
+	m.Role = msg.Role
+	m.Content = ""
+	if len(msg.Content) == 0 || string(msg.Content) == "null" {
+		return nil
+	}
+	if msg.Content[0] == '"' {
+		return json.Unmarshal(msg.Content, &m.Content)
+	}
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	err = json.Unmarshal(msg.Content, &parts)
+	if err != nil {
+		return errors.New("content must be a string or an array of content parts")
+	}
+	texts := make([]string, 0)
+	for _, part := range parts {
+		if part.Type == CHAT_CONTENT_TEXT {
+			texts = append(texts, part.Text)
+		}
+	}
+	m.Content = strings.Join(texts, "\n")
+	return nil
+}
+
+// addChatRoutes exposes the answer providers in the wire format of the OpenAI chat completions API,
+// the model selects the knowledge base.
+func (wa *WebAgent) addChatRoutes(r *mux.Router) {
+	chat := r.PathPrefix(CHAT_PREFIX).Subrouter()
+	chat.Use(wa.chatAuthMiddleware)
+	chat.HandleFunc("/models", wa.chatModelsHandler).Methods("GET")
+	chat.HandleFunc("/chat/completions", wa.chatCompletionsHandler).Methods("POST")
+}
+
+func (wa *WebAgent) writeChatError(w http.ResponseWriter, status int, errType string, err error) {
+	wa.writeJson(w, status, &ChatError{&GptError{Message: err.Error(), Type: errType}})
+}
+
+func (wa *WebAgent) chatAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := wa.secretProvider.GetSecret(WEB_API_KEY)
+		if key == "" {
+			wa.writeChatError(w, http.StatusUnauthorized, CHAT_ERROR_INVALID, errors.New("chat completions are disabled, missing secret webApiKey"))
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+key)) != 1 {
+			wa.writeChatError(w, http.StatusUnauthorized, CHAT_ERROR_INVALID, errors.New("invalid api key"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (wa *WebAgent) chatModelsHandler(w http.ResponseWriter, r *http.Request) {
+	models := &ChatModelList{"list", make([]*ChatModel, 0)}
+	user := NewUser(CHAT_USER_NAME, CHAT_USER_NAME, CHAT_USER_NAME).WithAgent(AGENT_API)
+	names := []string{CHAT_DEFAULT_MODEL}
+	for _, name := range wa.kbm.ListBaseNames() {
+		if HasRole(wa.ap, user, name, ROLE_READER) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names[1:])
+	for _, name := range names {
+		models.Data = append(models.Data, &ChatModel{name, "model", 0, CHAT_OWNER})
+	}
+	wa.writeJson(w, http.StatusOK, models)
+}
+
+// chatContent renders answers as markdown which is what most chat clients display.
+func (wa *WebAgent) chatContent(answers []*Answer) string {
+	parts := make([]string, 0)
+	for _, a := range answers {
+		if a.Text != "" {
+			parts = append(parts, a.Text)
+		}
+		if a.Link != "" {
+			parts = append(parts, "<"+a.Link+">")
+		}
+		if a.ImageLink != "" {
+			parts = append(parts, "![image]("+a.ImageLink+")")
+		}
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+func (wa *WebAgent) chatCompletionsHandler(w http.ResponseWriter, r *http.Request) {
+	var req ChatCompletionsRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		wa.writeChatError(w, http.StatusBadRequest, CHAT_ERROR_INVALID, errors.New("invalid json: "+err.Error()))
+		return
+	}
+	question := ""
+	for _, m := range req.Messages {
+		if m.Role == CHAT_ROLE_USER {
+			question = m.Content
+		}
+	}
+	if strings.TrimSpace(question) == "" {
+		wa.writeChatError(w, http.StatusBadRequest, CHAT_ERROR_INVALID, errors.New("missing user message"))
+		return
+	}
+	if req.Model == "" {
+		req.Model = CHAT_DEFAULT_MODEL
+	}
+	if req.Model != CHAT_DEFAULT_MODEL && wa.kbm.GetKnowledgeBase(req.Model) == nil {
+		wa.writeChatError(w, http.StatusNotFound, CHAT_ERROR_NOT_FOUND, errors.New("no knowledge base for model "+req.Model))
+		return
+	}
+	// clients send the conversation with every request, a session only lives for one request so that
+	// no caller can pick up the state of another
+	sessionId := CHAT_SESSION_PREFIX + wa.generateRandomString(API_SESSION_IDLEN)
+	defer wa.sessionMgr.DeleteSession(sessionId)
+	session := wa.sessionMgr.GetSession(NewUser(sessionId, CHAT_USER_NAME, CHAT_USER_NAME).WithAgent(AGENT_API))
+	if req.Model != CHAT_DEFAULT_MODEL {
+		err = CheckRole(wa.ap, session.User, req.Model, ROLE_READER)
+		if err != nil {
+			wa.writeChatError(w, http.StatusForbidden, CHAT_ERROR_INVALID, err)
+			return
+		}
+		session.Lock()
+		wa.kbm.SetSessionBaseName(session, req.Model)
+		session.Unlock()
+	}
+	content := ""
+	answers, err := wa.answerProvider.GetAnswers(session, NewQuestion(question))
+	if err != nil {
+		content = err.Error()
+	} else {
+		content = wa.chatContent(answers)
+	}
+	id := "chatcmpl-" + wa.generateRandomString(API_SESSION_IDLEN)
+	created := time.Now().Unix()
+	finishReason := CHAT_FINISH_STOP
+	if req.Stream {
+		wa.streamChatCompletion(w, &ChatCompletionsResponse{id, CHAT_CHUNK_OBJECT, created, req.Model, nil, nil}, content)
+		return
+	}
+	promptTokens := 0
+	for _, m := range req.Messages {
+		promptTokens += len(strings.Fields(m.Content))
+	}
+	completionTokens := len(strings.Fields(content))
+	wa.writeJson(w, http.StatusOK, &ChatCompletionsResponse{
+		ID:      id,
+		Object:  CHAT_OBJECT,
+		Created: created,
+		Model:   req.Model,
+		Choices: []*ChatChoice{{0, &ChatMessage{CHAT_ROLE_ASSISTANT, content}, nil, &finishReason}},
+		Usage:   &ChatUsage{promptTokens, completionTokens, promptTokens + completionTokens},
+	})
+}
+
+// streamChatCompletion sends the content as server sent events, one chunk per line of the answer.
+func (wa *WebAgent) streamChatCompletion(w http.ResponseWriter, chunk *ChatCompletionsResponse, content string) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	send := func(delta *ChatMessage, finishReason *string) {
+		chunk.Choices = []*ChatChoice{{0, nil, delta, finishReason}}
+		data, err := json.Marshal(chunk)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to marshal chat completion chunk")
+			return
+		}
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	send(&ChatMessage{Role: CHAT_ROLE_ASSISTANT}, nil)
+	lines := strings.SplitAfter(content, "\n")
+	for _, line := range lines {
+		if line != "" {
+			send(&ChatMessage{Content: line}, nil)
+		}
+	}
+	finishReason := CHAT_FINISH_STOP
+	send(&ChatMessage{}, &finishReason)
+	fmt.Fprint(w, "data: [DONE]\n\n")
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,132 @@
+/**
+ * Copyright 2024 Boris Wolf
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func doChatRequest(t *testing.T, key, method, url string, body interface{}, status int, resp interface{}) {
+	doTestRequestWith(t, func(req *http.Request) {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}, method, url, body, status, resp)
+}
+
+func TestChatCompletions(t *testing.T) {
+	wa, server := newTestWebAgent(t)
+	doTestRequest(t, "GET", server.URL+"/v1/models", nil, http.StatusUnauthorized, nil)
+	doChatRequest(t, "wrong-key", "GET", server.URL+"/v1/models", nil, http.StatusUnauthorized, nil)
+	var models ChatModelList
+	doChatRequest(t, "test-key", "GET", server.URL+"/v1/models", nil, http.StatusOK, &models)
+	if len(models.Data) != 3 || models.Data[0].ID != CHAT_DEFAULT_MODEL || models.Data[1].ID != "startrek" {
+		t.Errorf("unexpected models: %+v", models.Data)
+	}
+	req := &ChatCompletionsRequest{
+		Model: "startrek",
+		Messages: []ChatMessage{
+			{"system", "You are a helpful assistant."},
+			{CHAT_ROLE_USER, "Who are the Vulcans?"},
+		},
+	}
+	var resp ChatCompletionsResponse
+	doChatRequest(t, "test-key", "POST", server.URL+"/v1/chat/completions", req, http.StatusOK, &resp)
+	if resp.Object != CHAT_OBJECT || resp.Model != "startrek" || len(resp.Choices) != 1 || resp.Usage == nil {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+	msg := resp.Choices[0].Message
+	if msg.Role != CHAT_ROLE_ASSISTANT || !strings.HasPrefix(msg.Content, "a logical species") || !strings.Contains(msg.Content, "memory-alpha") {
+		t.Errorf("unexpected message: %+v", msg)
+	}
+	if *resp.Choices[0].FinishReason != CHAT_FINISH_STOP {
+		t.Errorf("unexpected finish reason: %s", *resp.Choices[0].FinishReason)
+	}
+	// content may be an array of parts, the user of the client does not select a session
+	parts := json.RawMessage(`{"model": "startrek", "user": "kirk", "messages": [{"role": "user", "content": [{"type": "text", "text": "Who are"}, {"type": "image_url", "image_url": {"url": "https://example.com/spock.png"}}, {"type": "text", "text": "the Vulcans?"}]}]}`)
+	resp = ChatCompletionsResponse{}
+	doChatRequest(t, "test-key", "POST", server.URL+"/v1/chat/completions", parts, http.StatusOK, &resp)
+	if len(resp.Choices) != 1 || !strings.HasPrefix(resp.Choices[0].Message.Content, "a logical species") {
+		t.Errorf("unexpected response to content parts: %+v", resp)
+	}
+	if wa.sessionMgr.FindSession(CHAT_SESSION_PREFIX+"kirk") != nil {
+		t.Errorf("expected no session kept for the user of the client")
+	}
+	doChatRequest(t, "test-key", "POST", server.URL+"/v1/chat/completions", json.RawMessage(`{"messages": [{"role": "user", "content": 42}]}`), http.StatusBadRequest, nil)
+	req.Model = "unknown"
+	doChatRequest(t, "test-key", "POST", server.URL+"/v1/chat/completions", req, http.StatusNotFound, nil)
+	req.Model = ""
+	req.Messages = req.Messages[:1]
+	doChatRequest(t, "test-key", "POST", server.URL+"/v1/chat/completions", req, http.StatusBadRequest, nil)
+	// without a key the chat completions are disabled
+	delete(wa.secretProvider.(testSecretProvider), WEB_API_KEY)
+	doChatRequest(t, "", "GET", server.URL+"/v1/models", nil, http.StatusUnauthorized, nil)
+}
+
+func TestChatCompletionsStream(t *testing.T) {
+	_, server := newTestWebAgent(t)
+	body, _ := json.Marshal(&ChatCompletionsRequest{
+		Model:    "startrek",
+		Messages: []ChatMessage{{CHAT_ROLE_USER, "Who are the Vulcans?"}},
+		Stream:   true,
+	})
+	req, _ := http.NewRequest("POST", server.URL+"/v1/chat/completions", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer test-key")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected content type %s", resp.Header.Get("Content-Type"))
+	}
+	content := ""
+	done := false
+	numChunks := 0
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		data := strings.TrimPrefix(line, "data: ")
+		if data == "[DONE]" {
+			done = true
+			break
+		}
+		var chunk ChatCompletionsResponse
+		err = json.Unmarshal([]byte(data), &chunk)
+		if err != nil {
+			t.Fatalf("invalid chunk %s: %v", data, err)
+		}
+		if chunk.Object != CHAT_CHUNK_OBJECT || len(chunk.Choices) != 1 {
+			t.Fatalf("unexpected chunk: %s", data)
+		}
+		content += chunk.Choices[0].Delta.Content
+		numChunks++
+	}
+	if !done || numChunks < 3 {
+		t.Errorf("expected at least 3 chunks and end of stream, got %d chunks", numChunks)
+	}
+	if !strings.HasPrefix(content, "a logical species") {
+		t.Errorf("unexpected streamed content: %s", content)
+	}
+}
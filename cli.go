@@ -18,68 +18,242 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"sort"
+	"strings"
 	"sync"
+	"text/tabwriter"
 
 	"github.com/rs/zerolog/log"
 )
 
+const (
+	CLI_HISTORY_FILE_CONFIG  = "clihistoryfile"
+	DEFAULT_CLI_HISTORY_FILE = "cli_history"
+	CLI_PROMPT               = "agentsmith> "
+	CLI_DEBUG                = "/debug"
+	CLI_HELP_COMMAND         = "/help"
+	CLI_QUIT                 = "/quit"
+	CLI_DEBUG_RANKS          = 5
+	CLI_COLOR_RESET          = "\x1b[0m"
+	CLI_COLOR_BOLD           = "\x1b[1m"
+	CLI_COLOR_RED            = "\x1b[31m"
+	CLI_COLOR_GREEN          = "\x1b[32m"
+	CLI_COLOR_YELLOW         = "\x1b[33m"
+	CLI_COLOR_BLUE           = "\x1b[34m"
+	CLI_COLOR_MAGENTA        = "\x1b[35m"
+	CLI_COLOR_CYAN           = "\x1b[36m"
+)
+
+const CLI_REPL_HELP = `ask a question or enter a command like rlistfacts, tab completes commands, fact and knowledge base names
+  /debug   toggle the ranking of facts for each question
+  /help    show this help
+  /quit    leave, as does ctrl-d
+`
+
+// arguments completed for commands
+var cliFactCommands = map[string]bool{R_GET_FACT: true, R_DELETE_FACT: true}
+
 type CliAgent struct {
+	configProvider ConfigProvider
 	secretProvider SecretProvider
 	answerProvider AnswerProvider
 	sessionMgr     SessionManager
+	kbm            *KnowledeBaseManager
+	in             io.Reader
+	out            io.Writer
+	user           *User
+	colors         bool
+	debug          bool
 }
 
-func NewCliAgent(secretProvider SecretProvider, answerProvider AnswerProvider, sessionManager SessionManager) Agent {
+func NewCliAgent(configProvider ConfigProvider, secretProvider SecretProvider, answerProvider AnswerProvider, sessionManager SessionManager, kbm *KnowledeBaseManager) Agent {
 	cli := CliAgent{
+		configProvider: configProvider,
 		secretProvider: secretProvider,
 		answerProvider: answerProvider,
 		sessionMgr:     sessionManager,
+		kbm:            kbm,
+		in:             os.Stdin,
+		out:            os.Stdout,
 	}
 	return &cli
 }
 
-func (wa *CliAgent) LaunchAgent(wg sync.WaitGroup) {
-	sessionId := ""
+// LaunchAgent answers questions until the input ends, reading the terminal is not interrupted by the context.
+func (wa *CliAgent) LaunchAgent(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
 	log.Info().Msg("launching cli agent")
-	fmt.Println("enter a question!")
+	wa.run()
+	log.Info().Msg("stopping cli agent")
+}
+
+// run offers line editing on a terminal and otherwise answers questions line by line until the input ends.
+func (wa *CliAgent) run() {
+	wa.user = NewUser(wa.generateRandomString(CLI_SESSION_IDLEN), CLI_USER_NAME, CLI_USER_NAME).WithAgent(AGENT_CLI)
+	file, ok := wa.in.(*os.File)
+	if ok && isTerminal(int(file.Fd())) {
+		restore, err := makeRaw(int(file.Fd()))
+		if err == nil {
+			defer restore()
+			wa.colors = os.Getenv("NO_COLOR") == ""
+			historyFile := wa.configProvider.GetConfig(CLI_HISTORY_FILE_CONFIG)
+			if historyFile == "" {
+				historyFile = DEFAULT_CLI_HISTORY_FILE
+			}
+			wa.runEditor(NewLineEditor(wa.in, wa.out, historyFile, wa.complete))
+			return
+		}
+		log.Warn().Err(err).Msg("no line editing")
+	}
+	wa.runLines()
+}
+
+func (wa *CliAgent) runLines() {
+	fmt.Fprintln(wa.out, "enter a question!")
+	scanner := bufio.NewScanner(wa.in)
+	for scanner.Scan() {
+		question := strings.TrimSpace(scanner.Text())
+		if question == "" {
+			continue
+		}
+		if !wa.handleLine(question) {
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Error().Err(err).Msg("failed to read input")
+	}
+}
+
+func (wa *CliAgent) runEditor(editor *LineEditor) {
+	fmt.Fprint(wa.out, CLI_REPL_HELP)
 	for {
-		scanner := bufio.NewScanner(os.Stdin)
-		question := ""
-		if scanner.Scan() {
-			question = scanner.Text()
-			fmt.Printf("you entered: %s\n", question)
+		line, err := editor.ReadLine(wa.color(CLI_COLOR_BOLD, CLI_PROMPT))
+		if errors.Is(err, ErrInterrupted) {
+			continue
 		}
-		if err := scanner.Err(); err != nil {
-			fmt.Println("error reading input: ", err)
+		if err != nil {
+			if err != io.EOF {
+				log.Error().Err(err).Msg("failed to read input")
+			}
+			return
 		}
-		if sessionId == "" {
-			sessionId = wa.generateRandomString(12)
+		question := strings.TrimSpace(line)
+		if question == "" {
+			continue
 		}
-		user := NewUser(sessionId, "CliUser", "CliUser")
-		session := wa.sessionMgr.GetSession(user)
-		answers, err := wa.answerProvider.GetAnswers(session, &Question{question})
+		err = editor.AddHistory(question)
 		if err != nil {
-			log.Error().Err(err)
+			log.Warn().Err(err).Msg("failed to save history")
+		}
+		if !wa.handleLine(question) {
 			return
 		}
-		for _, a := range answers {
-			if a.Text != "" {
-				fmt.Printf("%s\n", a.Text)
-			}
-			if a.Link != "" {
-				fmt.Printf("%s\n", a.Link)
-			}
-			if a.ImageLink != "" {
-				fmt.Printf("%s\n", a.ImageLink)
+	}
+}
+
+// handleLine answers a question or runs a command of the cli itself, returning false for leaving.
+func (wa *CliAgent) handleLine(question string) bool {
+	switch question {
+	case CLI_QUIT:
+		return false
+	case CLI_HELP_COMMAND:
+		fmt.Fprint(wa.out, CLI_REPL_HELP)
+	case CLI_DEBUG:
+		wa.debug = !wa.debug
+		if wa.debug {
+			fmt.Fprintln(wa.out, "debug on")
+		} else {
+			fmt.Fprintln(wa.out, "debug off")
+		}
+	default:
+		session := wa.sessionMgr.GetSession(wa.user)
+		if wa.debug {
+			wa.printRanking(session, question)
+		}
+		answers, err := wa.answerProvider.GetAnswers(session, NewQuestion(question))
+		if err != nil {
+			fmt.Fprintln(wa.out, wa.color(CLI_COLOR_RED, "error: "+err.Error()))
+		} else {
+			printAnswers(wa.out, answers, wa.colors)
+		}
+	}
+	return true
+}
+
+// printRanking shows the best matching facts of the knowledge base of the session with their relevance.
+func (wa *CliAgent) printRanking(session *UserSession, question string) {
+	if wa.kbm == nil {
+		fmt.Fprintln(wa.out, wa.color(CLI_COLOR_RED, "error: no knowledge bases loaded"))
+		return
+	}
+	baseName := wa.kbm.GetSessionBaseName(session)
+	ranking, err := wa.kbm.RankQuestion(baseName, NewQuestion(question))
+	if err != nil {
+		fmt.Fprintln(wa.out, wa.color(CLI_COLOR_RED, "error: "+err.Error()))
+		return
+	}
+	kb := wa.kbm.GetKnowledgeBase(baseName)
+	var table strings.Builder
+	tw := tabwriter.NewWriter(&table, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "rank\trelevance\tfact\tquestion (%s)\n", baseName)
+	for idx, e := range ranking.Embeddings {
+		if idx >= CLI_DEBUG_RANKS {
+			break
+		}
+		question := e.Source
+		if fact := kb.GetFact(e.FactName); fact != nil {
+			question = fact.Question
+		}
+		fmt.Fprintf(tw, "%d\t%.4f\t%s\t%s\n", idx+1, e.Relevance, e.FactName, question)
+	}
+	tw.Flush()
+	fmt.Fprint(wa.out, wa.color(CLI_COLOR_CYAN, table.String()))
+}
+
+// complete returns the commands, fact names or knowledge base names matching the word in front of the cursor.
+func (wa *CliAgent) complete(line string) []string {
+	words := strings.Fields(line)
+	if !strings.HasSuffix(line, " ") && len(words) > 0 {
+		words = words[:len(words)-1]
+	}
+	prefix := strings.TrimLeft(line[strings.LastIndex(line, " ")+1:], " ")
+	candidates := make([]string, 0)
+	if len(words) == 0 {
+		candidates = append(candidates, CLI_DEBUG, CLI_HELP_COMMAND, CLI_QUIT, S_DONE)
+		for command := range commandRoles {
+			candidates = append(candidates, command)
+		}
+	} else if len(words) == 1 && wa.kbm != nil {
+		command := strings.ToLower(words[0])
+		if cliFactCommands[command] {
+			session := wa.sessionMgr.GetSession(wa.user)
+			for _, fact := range wa.kbm.GetSessionKnowledgeBase(session).ListFacts() {
+				candidates = append(candidates, fact.Name)
 			}
+		} else if command == R_SET_CURRENT_KNOWLEDGE_BASE {
+			candidates = wa.kbm.ListBaseNames()
 		}
 	}
-	log.Info().Msg("stopping cli agent")
-	wg.Done()
+	matches := make([]string, 0)
+	for _, c := range candidates {
+		if strings.HasPrefix(strings.ToLower(c), strings.ToLower(prefix)) {
+			matches = append(matches, c)
+		}
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+func (wa *CliAgent) color(code, text string) string {
+	return colorize(wa.colors, code, text)
 }
 
 func (wa *CliAgent) generateRandomString(n int) string {
@@ -87,3 +261,27 @@ func (wa *CliAgent) generateRandomString(n int) string {
 	rand.Read(b)
 	return base64.URLEncoding.EncodeToString(b)[:n]
 }
+
+func colorize(colors bool, code, text string) string {
+	if !colors {
+		return text
+	}
+	return code + text + CLI_COLOR_RESET
+}
+
+func printAnswers(out io.Writer, answers []*Answer, colors bool) {
+	for _, a := range answers {
+		if a.Text != "" {
+			fmt.Fprintf(out, "%s\n", colorize(colors, CLI_COLOR_GREEN, a.Text))
+		}
+		for _, c := range a.Choices {
+			fmt.Fprintf(out, "  %s\n", colorize(colors, CLI_COLOR_YELLOW, c))
+		}
+		if a.Link != "" {
+			fmt.Fprintf(out, "%s\n", colorize(colors, CLI_COLOR_BLUE, a.Link))
+		}
+		if a.ImageLink != "" {
+			fmt.Fprintf(out, "%s\n", colorize(colors, CLI_COLOR_MAGENTA, a.ImageLink))
+		}
+	}
+}
@@ -0,0 +1,284 @@
+/**
+ * Copyright 2024 Boris Wolf
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestCliCommands(t *testing.T) (*CliCommands, *bytes.Buffer, *bytes.Buffer) {
+	args := `{}`
+	openai := newTestOpenAIServer(t, &args)
+	t.Cleanup(openai.Close)
+	oai := NewOpenAIHandler(testSecretProvider{OPEN_AI_TOKEN: "test"}).WithBaseUrl(openai.URL)
+	kbm := newTestKnowledgeBaseManager(t, *oai, map[string][]*Fact{
+		"system":   {{Name: "GREETING", Question: "How do I say hello?", Answers: []string{"just say hello"}}},
+		"startrek": {{Name: "VULCANS", Question: "Who are the Vulcans?", Answers: []string{"a logical species"}}},
+	})
+	audit, err := NewJSONLAuditLog(filepath.Join(t.TempDir(), "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { audit.Close() })
+	cc := NewCliCommands(kbm, new(testSlackAnswerProvider), NewSimpleSessionManager(time.Minute, 10), audit)
+	out, errOut := new(bytes.Buffer), new(bytes.Buffer)
+	cc.out = out
+	cc.errOut = errOut
+	return cc, out, errOut
+}
+
+func TestCliAsk(t *testing.T) {
+	cc, out, errOut := newTestCliCommands(t)
+	if code := cc.Run([]string{"ask", "who", "is", "spock?"}); code != EXIT_OK || !strings.HasPrefix(out.String(), "answer to who is spock?\nhttps://example.com\n") {
+		t.Errorf("unexpected answer %d: %s", code, out.String())
+	}
+	out.Reset()
+	cc.in = strings.NewReader("who is kirk?\n")
+	if code := cc.Run([]string{"ask", "-json", "-kb", "startrek"}); code != EXIT_OK {
+		t.Fatalf("expected question from stdin to be answered: %d %s", code, errOut.String())
+	}
+	var resp ApiAskResponse
+	json.Unmarshal(out.Bytes(), &resp)
+	if resp.Question != "who is kirk?" || resp.KnowledgeBase != "startrek" || len(resp.Answers) != 1 {
+		t.Errorf("unexpected json answer: %s", out.String())
+	}
+	if code := cc.Run([]string{"ask", "fail"}); code != EXIT_ERROR || !strings.Contains(errOut.String(), "knowledge base unavailable") {
+		t.Errorf("expected error exit code: %d %s", code, errOut.String())
+	}
+	if code := cc.Run([]string{"ask", "-kb", "unknown", "hello"}); code != EXIT_ERROR {
+		t.Errorf("expected error for unknown knowledge base: %d", code)
+	}
+	if code := cc.Run([]string{"ask", "-unknown"}); code != EXIT_USAGE {
+		t.Errorf("expected usage error: %d", code)
+	}
+	if code := cc.Run([]string{"unknown"}); code != EXIT_USAGE {
+		t.Errorf("expected usage error: %d", code)
+	}
+}
+
+func TestCliBatch(t *testing.T) {
+	cc, _, errOut := newTestCliCommands(t)
+	dir := t.TempDir()
+	input := filepath.Join(dir, "questions.txt")
+	output := filepath.Join(dir, "answers.jsonl")
+	os.WriteFile(input, []byte("who is spock?\n\n# comment\nfail\nwho is kirk?\n"), 0644)
+	if code := cc.Run([]string{"batch", "-kb", "startrek", "-o", output, input}); code != EXIT_ERROR || !strings.Contains(errOut.String(), "1 of 3 questions failed") {
+		t.Errorf("expected one failed question: %d %s", code, errOut.String())
+	}
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 results: %s", data)
+	}
+	results := make([]CliBatchResult, len(lines))
+	for i, line := range lines {
+		json.Unmarshal([]byte(line), &results[i])
+	}
+	if results[0].Line != 1 || len(results[0].Answers) != 1 || results[0].KnowledgeBase != "startrek" {
+		t.Errorf("unexpected first result: %+v", results[0])
+	}
+	if results[1].Line != 4 || results[1].Error != "knowledge base unavailable" || results[2].Line != 5 || results[2].Question != "who is kirk?" {
+		t.Errorf("unexpected results: %+v", results)
+	}
+}
+
+func TestCliKnowledgeBaseCommands(t *testing.T) {
+	// new knowledge bases are created in the working directory
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, DEFAULT_KNOWLEDGE_BASE_PATH), 0755)
+	os.MkdirAll(filepath.Join(dir, DEFAULT_EMBEDDING_BASE_PATH), 0755)
+	wd, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(wd)
+	cc, out, errOut := newTestCliCommands(t)
+	if code := cc.Run([]string{"kb", "list"}); code != EXIT_OK || out.String() != "startrek\t1\nsystem\t1\tcurrent\n" {
+		t.Errorf("unexpected list %d: %q", code, out.String())
+	}
+	out.Reset()
+	if code := cc.Run([]string{"fact", "add", "-kb", "startrek", "-question", "What is warp speed?", "-answer", "very fast", "-answer", "faster than light", "-label", "warp", "warp"}); code != EXIT_OK {
+		t.Fatalf("failed to add fact: %d %s", code, errOut.String())
+	}
+	fact := cc.kbm.GetKnowledgeBase("startrek").GetFact("WARP")
+	if fact == nil || len(fact.Answers) != 2 || fact.CreatedBy != CLI_USER_NAME || cc.kbm.GetEmbeddingStatus("startrek", fact) != EMBEDDING_STATUS_OK {
+		t.Fatalf("unexpected fact: %+v", fact)
+	}
+	if code := cc.Run([]string{"fact", "add", "-kb", "startrek", "-question", "again?", "WARP"}); code != EXIT_ERROR {
+		t.Errorf("expected duplicate fact to fail: %d", code)
+	}
+	if code := cc.Run([]string{"fact", "add", "-kb", "startrek", "NOQUESTION"}); code != EXIT_USAGE {
+		t.Errorf("expected missing question to be a usage error: %d", code)
+	}
+	export := filepath.Join(dir, "startrek-export.json")
+	if code := cc.Run([]string{"kb", "export", "startrek", export}); code != EXIT_OK {
+		t.Fatalf("failed to export: %d %s", code, errOut.String())
+	}
+	var facts []*Fact
+	data, _ := os.ReadFile(export)
+	json.Unmarshal(data, &facts)
+	if len(facts) != 2 || facts[0].Name != "VULCANS" || facts[1].Name != "WARP" {
+		t.Fatalf("unexpected export: %s", data)
+	}
+	facts[0].Answers = []string{"logical"}
+	data, _ = json.Marshal(facts)
+	os.WriteFile(export, data, 0644)
+	if code := cc.Run([]string{"kb", "import", "startrek", export}); code != EXIT_OK || !strings.Contains(out.String(), "0 added, 2 updated") {
+		t.Errorf("unexpected import into existing base %d: %s %s", code, out.String(), errOut.String())
+	}
+	if cc.kbm.GetKnowledgeBase("startrek").GetFact("VULCANS").Answers[0] != "logical" {
+		t.Errorf("expected fact to be updated")
+	}
+	if code := cc.Run([]string{"kb", "import", "voyager", export}); code != EXIT_OK || !strings.Contains(out.String(), "imported 2 facts into voyager, 2 added") {
+		t.Fatalf("unexpected import into new base %d: %s %s", code, out.String(), errOut.String())
+	}
+	if _, err := os.Stat(filepath.Join(DEFAULT_KNOWLEDGE_BASE_PATH, "voyager.json")); err != nil {
+		t.Errorf("expected new knowledge base to be saved: %v", err)
+	}
+	if eb := cc.kbm.GetEmbeddingsBase("voyager"); eb == nil || eb.GetNumEmbeddings() != 2 {
+		t.Errorf("expected embeddings of imported facts")
+	}
+	if code := cc.Run([]string{"fact", "delete", "-kb", "voyager", "warp"}); code != EXIT_OK || cc.kbm.GetKnowledgeBase("voyager").HasFact("WARP") {
+		t.Errorf("expected fact to be deleted: %d", code)
+	}
+	if code := cc.Run([]string{"fact", "delete", "-kb", "voyager", "warp"}); code != EXIT_ERROR {
+		t.Errorf("expected deleting missing fact to fail: %d", code)
+	}
+	out.Reset()
+	if code := cc.Run([]string{"kb", "sync"}); code != EXIT_OK || out.String() != "synced startrek\nsynced system\nsynced voyager\n" {
+		t.Errorf("unexpected sync %d: %s", code, out.String())
+	}
+	if code := cc.Run([]string{"kb", "sync", "unknown"}); code != EXIT_ERROR {
+		t.Errorf("expected sync of unknown base to fail: %d", code)
+	}
+	entries, err := cc.audit.Query(&AuditFilter{KnowledgeBase: "voyager", Command: AUDIT_DELETE_FACT})
+	if err != nil || len(entries) != 2 || entries[1].Outcome != AUDIT_OUTCOME_OK || entries[0].Outcome != AUDIT_OUTCOME_ERROR || entries[1].Agent != AGENT_CLI {
+		t.Errorf("unexpected audit entries: %+v %v", entries, err)
+	}
+}
+
+func TestCliAgent(t *testing.T) {
+	tap := new(testSlackAnswerProvider)
+	ca := NewCliAgent(testConfigProvider{}, testSecretProvider{}, tap, NewSimpleSessionManager(time.Minute, 10), nil).(*CliAgent)
+	out := new(bytes.Buffer)
+	ca.in = strings.NewReader("who is spock?\n\nfail\nwho is kirk?\n")
+	ca.out = out
+	ca.run()
+	if !strings.Contains(out.String(), "error: knowledge base unavailable\nanswer to who is kirk?") {
+		t.Errorf("expected errors not to end the session: %s", out.String())
+	}
+	if len(tap.sessions) != 3 || tap.sessions[0] != tap.sessions[2] {
+		t.Errorf("expected one session for all questions")
+	}
+}
+
+func TestLineEditor(t *testing.T) {
+	historyFile := filepath.Join(t.TempDir(), "history")
+	os.WriteFile(historyFile, []byte("rlistfacts\nwho is spock?\n"), 0600)
+	completer := func(line string) []string {
+		if line == "rg" || line == "rget" {
+			return []string{"rgetcurrentknowledgebase", "rgetfact"}
+		}
+		if line == "rgetf" {
+			return []string{"rgetfact"}
+		}
+		return nil
+	}
+	input := strings.Join([]string{
+		"helo\x1b[D\x1b[Dl\r",            // cursor left and insert
+		"\x1b[A\x1b[A\x1b[A\r",           // recall earlier history
+		"abc\x7f\x7fx\x01y\x05z\r",       // backspace, home and end
+		"one two\x17three\x02\x02\x0b\r", // delete word and kill to end of line
+		"rg\t\tf\t\r",                    // complete common prefix and single candidate
+		"some\x1b[1~x\x1b[3~\r",          // home and delete keys
+		"abandoned\x03",                  // ctrl-c
+		"\x04",                           // ctrl-d on empty line
+	}, "")
+	out := new(bytes.Buffer)
+	le := NewLineEditor(strings.NewReader(input), out, historyFile, completer)
+	expected := []string{"hello", "rlistfacts", "yaxz", "one thr", "rgetfact ", "xome"}
+	for _, e := range expected {
+		line, err := le.ReadLine("> ")
+		if err != nil || line != e {
+			t.Fatalf("expected %q, got %q %v", e, line, err)
+		}
+		le.AddHistory(line)
+	}
+	if _, err := le.ReadLine("> "); err != ErrInterrupted {
+		t.Errorf("expected interrupt: %v", err)
+	}
+	if _, err := le.ReadLine("> "); err != io.EOF {
+		t.Errorf("expected end of input: %v", err)
+	}
+	data, _ := os.ReadFile(historyFile)
+	if !strings.HasPrefix(string(data), "rlistfacts\nwho is spock?\nhello\nrlistfacts\nyaxz\n") {
+		t.Errorf("unexpected history file: %q", data)
+	}
+	if !strings.Contains(out.String(), "rgetcurrentknowledgebase  rgetfact") {
+		t.Errorf("expected candidates to be listed")
+	}
+}
+
+func TestCliCompletionAndDebug(t *testing.T) {
+	args := `{}`
+	openai := newTestOpenAIServer(t, &args)
+	t.Cleanup(openai.Close)
+	oai := NewOpenAIHandler(testSecretProvider{OPEN_AI_TOKEN: "test"}).WithBaseUrl(openai.URL)
+	kbm := newTestKnowledgeBaseManager(t, *oai, map[string][]*Fact{
+		"system":   {{Name: "GREETING", Question: "How do I say hello?"}, {Name: "GOODBYE", Question: "How do I say goodbye?"}},
+		"startrek": {{Name: "VULCANS", Question: "Who are the Vulcans?"}},
+	})
+	ca := NewCliAgent(testConfigProvider{}, testSecretProvider{}, new(testSlackAnswerProvider), NewSimpleSessionManager(time.Minute, 10), kbm).(*CliAgent)
+	out := new(bytes.Buffer)
+	ca.in = strings.NewReader("/debug\nhow do I say hello?\n/debug\nwho is spock?\n/quit\nnever asked\n")
+	ca.out = out
+	ca.run()
+	completions := map[string]string{
+		"rget":                       "rgetcurrentknowledgebase rgetfact",
+		"rgetfact g":                 "GOODBYE GREETING",
+		"rdeletefact GR":             "GREETING",
+		"rgetfact GREETING ":         "",
+		"rsetcurrentknowledgebase s": "startrek system",
+		"/d":                         "/debug",
+		"redit":                      "",
+		"reditfact GR":               "",
+		"what":                       "",
+	}
+	for line, expected := range completions {
+		if got := strings.Join(ca.complete(line), " "); got != expected {
+			t.Errorf("expected completions %q for %q, got %q", expected, line, got)
+		}
+	}
+	output := out.String()
+	if !strings.Contains(output, "debug on\nrank  relevance  fact      question (system)\n1     1.0000     GREETING  How do I say hello?\n2") {
+		t.Errorf("expected ranking table: %s", output)
+	}
+	if strings.Count(output, "rank  relevance") != 1 || !strings.Contains(output, "debug off\nanswer to who is spock?") || strings.Contains(output, "never asked") {
+		t.Errorf("unexpected output: %s", output)
+	}
+	if strings.Contains(output, CLI_COLOR_RESET) {
+		t.Errorf("expected no colors without a terminal")
+	}
+}
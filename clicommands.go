@@ -0,0 +1,498 @@
+/**
+ * Copyright 2024 Boris Wolf
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	EXIT_OK        = 0
+	EXIT_ERROR     = 1
+	EXIT_USAGE     = 2
+	EXIT_NO_ANSWER = 3
+)
+
+const (
+	CLI_ASK           = "ask"
+	CLI_BATCH         = "batch"
+	CLI_KB            = "kb"
+	CLI_FACT          = "fact"
+	CLI_HELP          = "help"
+	CLI_KB_LIST       = "list"
+	CLI_KB_IMPORT     = "import"
+	CLI_KB_EXPORT     = "export"
+	CLI_KB_SYNC       = "sync"
+	CLI_FACT_ADD      = "add"
+	CLI_FACT_DELETE   = "delete"
+	CLI_USER_NAME     = "CliUser"
+	CLI_STDIO         = "-"
+	CLI_SESSION_IDLEN = 12
+)
+
+const CLI_USAGE = `usage: agentsmith [command]
+
+without a command the agents enabled in configs.json are launched
+
+commands:
+  ask [-kb name] [-json] [question]        answer a question, read from stdin if not given
+  batch [-kb name] [-o file] [file]        answer one question per line, writing json lines
+  kb list                                  list knowledge bases with their number of facts
+  kb export <kb> [file]                    write the facts of a knowledge base as json
+  kb import <kb> <file>                    add or update facts from a json file, creating the knowledge base if needed
+  kb sync [kb...]                          update embeddings of all or the given knowledge bases
+  fact add [-kb name] [flags] <name>       add a fact, see fact add -h for flags
+  fact delete [-kb name] <name>            delete a fact
+  hashpassword <password>                  print a password hash for the users file
+
+exit codes: 0 ok, 1 error, 2 usage error, 3 no answer
+`
+
+type (
+	CliBatchResult struct {
+		Line          int       `json:"line"`
+		Question      string    `json:"question"`
+		Answers       []*Answer `json:"answers"`
+		KnowledgeBase string    `json:"knowledgeBase"`
+		Error         string    `json:"error,omitempty"`
+	}
+	// cliListFlag collects the values of a flag given several times.
+	cliListFlag []string
+)
+
+func (f *cliListFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *cliListFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// CliCommands runs one shot commands for scripts, returning exit codes rather than launching agents.
+type CliCommands struct {
+	kbm            *KnowledeBaseManager
+	answerProvider AnswerProvider
+	sessionMgr     SessionManager
+	audit          AuditLog
+	in             io.Reader
+	out            io.Writer
+	errOut         io.Writer
+}
+
+func NewCliCommands(kbm *KnowledeBaseManager, answerProvider AnswerProvider, sessionMgr SessionManager, audit AuditLog) *CliCommands {
+	cc := CliCommands{
+		kbm:            kbm,
+		answerProvider: answerProvider,
+		sessionMgr:     sessionMgr,
+		audit:          audit,
+		in:             os.Stdin,
+		out:            os.Stdout,
+		errOut:         os.Stderr,
+	}
+	return &cc
+}
+
+// Run runs the command given by the arguments and returns the exit code.
+func (cc *CliCommands) Run(args []string) int {
+	if len(args) == 0 || args[0] == CLI_HELP || args[0] == "-h" || args[0] == "--help" {
+		fmt.Fprint(cc.out, CLI_USAGE)
+		return EXIT_OK
+	}
+	if cc.kbm == nil {
+		return cc.fail(errors.New("no knowledge bases loaded"))
+	}
+	switch args[0] {
+	case CLI_ASK:
+		return cc.ask(args[1:])
+	case CLI_BATCH:
+		return cc.batch(args[1:])
+	case CLI_KB:
+		if len(args) > 1 {
+			switch args[1] {
+			case CLI_KB_LIST:
+				return cc.listBases(args[2:])
+			case CLI_KB_EXPORT:
+				return cc.exportBase(args[2:])
+			case CLI_KB_IMPORT:
+				return cc.importBase(args[2:])
+			case CLI_KB_SYNC:
+				return cc.syncBases(args[2:])
+			}
+		}
+	case CLI_FACT:
+		if len(args) > 1 {
+			switch args[1] {
+			case CLI_FACT_ADD:
+				return cc.addFact(args[2:])
+			case CLI_FACT_DELETE:
+				return cc.deleteFact(args[2:])
+			}
+		}
+	}
+	return cc.usage(errors.New("unknown command " + strings.Join(args, " ")))
+}
+
+func (cc *CliCommands) usage(err error) int {
+	fmt.Fprintf(cc.errOut, "%s\n\n%s", err.Error(), CLI_USAGE)
+	return EXIT_USAGE
+}
+
+func (cc *CliCommands) fail(err error) int {
+	fmt.Fprintf(cc.errOut, "error: %s\n", err.Error())
+	return EXIT_ERROR
+}
+
+func (cc *CliCommands) newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(cc.errOut)
+	return fs
+}
+
+func (cc *CliCommands) newUser() *User {
+	return NewUser(cc.generateRandomString(CLI_SESSION_IDLEN), CLI_USER_NAME, CLI_USER_NAME).WithAgent(AGENT_CLI)
+}
+
+func (cc *CliCommands) generateRandomString(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.URLEncoding.EncodeToString(b)[:n]
+}
+
+// newSession starts a session on the given knowledge base, or on the current one if no name is given.
+func (cc *CliCommands) newSession(baseName string) (*UserSession, error) {
+	session := cc.sessionMgr.GetSession(cc.newUser())
+	if baseName != "" {
+		session.Lock()
+		err := cc.kbm.SetSessionBaseName(session, baseName)
+		session.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return session, nil
+}
+
+func (cc *CliCommands) getBaseName(baseName string) (string, error) {
+	if baseName == "" {
+		return cc.kbm.GetCurrentBaseName(), nil
+	}
+	if cc.kbm.GetKnowledgeBase(baseName) == nil {
+		return "", errors.New("no knowledge base for " + baseName)
+	}
+	return baseName, nil
+}
+
+func (cc *CliCommands) ask(args []string) int {
+	fs := cc.newFlagSet(CLI_ASK)
+	baseName := fs.String("kb", "", "knowledge base, defaults to the current one")
+	asJson := fs.Bool("json", false, "print the answers as json")
+	if fs.Parse(args) != nil {
+		return EXIT_USAGE
+	}
+	text := strings.Join(fs.Args(), " ")
+	if text == "" {
+		data, err := io.ReadAll(cc.in)
+		if err != nil {
+			return cc.fail(err)
+		}
+		text = string(data)
+	}
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return cc.usage(errors.New("missing question"))
+	}
+	session, err := cc.newSession(*baseName)
+	if err != nil {
+		return cc.fail(err)
+	}
+	answers, err := cc.answerProvider.GetAnswers(session, NewQuestion(text))
+	if err != nil {
+		return cc.fail(err)
+	}
+	if *asJson {
+		resp := ApiAskResponse{session.User.Id, text, answers, session.State, cc.kbm.GetSessionBaseName(session)}
+		err = json.NewEncoder(cc.out).Encode(&resp)
+		if err != nil {
+			return cc.fail(err)
+		}
+	} else {
+		printAnswers(cc.out, answers, false)
+	}
+	if len(answers) == 0 {
+		return EXIT_NO_ANSWER
+	}
+	return EXIT_OK
+}
+
+// batch answers every question in a fresh session so that answers do not depend on earlier questions.
+func (cc *CliCommands) batch(args []string) int {
+	fs := cc.newFlagSet(CLI_BATCH)
+	baseName := fs.String("kb", "", "knowledge base, defaults to the current one")
+	outFile := fs.String("o", CLI_STDIO, "output file for the json lines")
+	if fs.Parse(args) != nil || fs.NArg() > 1 {
+		return EXIT_USAGE
+	}
+	in := cc.in
+	if fs.NArg() == 1 && fs.Arg(0) != CLI_STDIO {
+		file, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return cc.fail(err)
+		}
+		defer file.Close()
+		in = file
+	}
+	out := cc.out
+	if *outFile != CLI_STDIO {
+		file, err := os.Create(*outFile)
+		if err != nil {
+			return cc.fail(err)
+		}
+		defer file.Close()
+		out = file
+	}
+	encoder := json.NewEncoder(out)
+	failed, answered := 0, 0
+	line := 0
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		answered++
+		result := CliBatchResult{Line: line, Question: text, Answers: make([]*Answer, 0)}
+		session, err := cc.newSession(*baseName)
+		if err == nil {
+			result.KnowledgeBase = cc.kbm.GetSessionBaseName(session)
+			var answers []*Answer
+			answers, err = cc.answerProvider.GetAnswers(session, NewQuestion(text))
+			if answers != nil {
+				result.Answers = answers
+			}
+		}
+		if err != nil {
+			result.Error = err.Error()
+			failed++
+		}
+		err = encoder.Encode(&result)
+		if err != nil {
+			return cc.fail(err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return cc.fail(err)
+	}
+	if failed > 0 {
+		fmt.Fprintf(cc.errOut, "%d of %d questions failed\n", failed, answered)
+		return EXIT_ERROR
+	}
+	return EXIT_OK
+}
+
+func (cc *CliCommands) listBases(args []string) int {
+	if len(args) > 0 {
+		return cc.usage(errors.New("kb list takes no arguments"))
+	}
+	names := cc.kbm.ListBaseNames()
+	sort.Strings(names)
+	for _, name := range names {
+		current := ""
+		if name == cc.kbm.GetCurrentBaseName() {
+			current = "\tcurrent"
+		}
+		fmt.Fprintf(cc.out, "%s\t%d%s\n", name, cc.kbm.GetKnowledgeBase(name).GetNumFacts(), current)
+	}
+	return EXIT_OK
+}
+
+func (cc *CliCommands) exportBase(args []string) int {
+	if len(args) < 1 || len(args) > 2 {
+		return cc.usage(errors.New("kb export needs a knowledge base and an optional file"))
+	}
+	kb := cc.kbm.GetKnowledgeBase(args[0])
+	if kb == nil {
+		return cc.fail(errors.New("no knowledge base for " + args[0]))
+	}
+	facts := kb.ListFacts()
+	sort.Slice(facts, func(i, j int) bool {
+		return facts[i].Name < facts[j].Name
+	})
+	data, err := json.MarshalIndent(facts, "", "\t")
+	if err != nil {
+		return cc.fail(err)
+	}
+	data = append(data, '\n')
+	if len(args) == 2 && args[1] != CLI_STDIO {
+		err = os.WriteFile(args[1], data, 0644)
+	} else {
+		_, err = cc.out.Write(data)
+	}
+	if err != nil {
+		return cc.fail(err)
+	}
+	return EXIT_OK
+}
+
+func (cc *CliCommands) importBase(args []string) int {
+	if len(args) != 2 {
+		return cc.usage(errors.New("kb import needs a knowledge base and a file"))
+	}
+	baseName := args[0]
+	var data []byte
+	var err error
+	if args[1] == CLI_STDIO {
+		data, err = io.ReadAll(cc.in)
+	} else {
+		data, err = os.ReadFile(args[1])
+	}
+	if err != nil {
+		return cc.fail(err)
+	}
+	var facts []*Fact
+	err = json.Unmarshal(data, &facts)
+	if err != nil {
+		return cc.fail(fmt.Errorf("invalid facts file: %w", err))
+	}
+	for _, fact := range facts {
+		err = ValidateFact(fact)
+		if err != nil {
+			return cc.fail(err)
+		}
+	}
+	if cc.kbm.GetKnowledgeBase(baseName) == nil {
+		err = cc.kbm.CreateBase(baseName)
+		if err != nil {
+			return cc.fail(err)
+		}
+		fmt.Fprintf(cc.errOut, "created knowledge base %s\n", baseName)
+	}
+	kb := cc.kbm.GetKnowledgeBase(baseName)
+	user := cc.newUser()
+	added, updated := 0, 0
+	for _, fact := range facts {
+		isNew := !kb.HasFact(NormalizeFactName(fact.Name))
+		_, err = cc.kbm.SaveFact(nil, cc.audit, user, baseName, fact, isNew)
+		if err != nil {
+			return cc.fail(err)
+		}
+		if isNew {
+			added++
+		} else {
+			updated++
+		}
+	}
+	fmt.Fprintf(cc.out, "imported %d facts into %s, %d added, %d updated\n", len(facts), baseName, added, updated)
+	return EXIT_OK
+}
+
+func (cc *CliCommands) syncBases(args []string) int {
+	names := args
+	if len(names) == 0 {
+		names = cc.kbm.ListBaseNames()
+		sort.Strings(names)
+	}
+	user := cc.newUser()
+	failed := false
+	for _, name := range names {
+		err := cc.kbm.SyncBase(name)
+		RecordAudit(cc.audit, NewAuditEntry(user, name, AUDIT_SYNC).WithOutcome(err))
+		if err != nil {
+			fmt.Fprintf(cc.errOut, "error: failed to sync %s: %s\n", name, err.Error())
+			failed = true
+			continue
+		}
+		fmt.Fprintf(cc.out, "synced %s\n", name)
+	}
+	if failed {
+		return EXIT_ERROR
+	}
+	return EXIT_OK
+}
+
+func (cc *CliCommands) addFact(args []string) int {
+	fs := cc.newFlagSet(CLI_FACT + " " + CLI_FACT_ADD)
+	baseName := fs.String("kb", "", "knowledge base, defaults to the current one")
+	question := fs.String("question", "", "question used for matching the fact")
+	plugin := fs.String("plugin", "", "optional plugin action")
+	var answers, links, labels cliListFlag
+	fs.Var(&answers, "answer", "answer text, may be given several times")
+	fs.Var(&links, "link", "link, may be given several times")
+	fs.Var(&labels, "label", "label, may be given several times")
+	if fs.Parse(args) != nil {
+		return EXIT_USAGE
+	}
+	if fs.NArg() != 1 {
+		return cc.usage(errors.New("fact add needs exactly one fact name"))
+	}
+	if *question == "" {
+		return cc.usage(errors.New("fact needs question"))
+	}
+	name, err := cc.getBaseName(*baseName)
+	if err != nil {
+		return cc.fail(err)
+	}
+	fact := Fact{
+		Name:     fs.Arg(0),
+		Question: *question,
+		Labels:   labels,
+		Answers:  answers,
+		Links:    links,
+		Plugin:   *plugin,
+	}
+	_, err = cc.kbm.SaveFact(nil, cc.audit, cc.newUser(), name, &fact, true)
+	if err != nil {
+		return cc.fail(err)
+	}
+	fmt.Fprintf(cc.out, "added fact %s to %s\n", fact.Name, name)
+	return EXIT_OK
+}
+
+func (cc *CliCommands) deleteFact(args []string) int {
+	fs := cc.newFlagSet(CLI_FACT + " " + CLI_FACT_DELETE)
+	baseName := fs.String("kb", "", "knowledge base, defaults to the current one")
+	if fs.Parse(args) != nil {
+		return EXIT_USAGE
+	}
+	if fs.NArg() != 1 {
+		return cc.usage(errors.New("fact delete needs exactly one fact name"))
+	}
+	name, err := cc.getBaseName(*baseName)
+	if err != nil {
+		return cc.fail(err)
+	}
+	factName := NormalizeFactName(fs.Arg(0))
+	before := cc.kbm.GetKnowledgeBase(name).GetFact(factName)
+	err = cc.kbm.DeleteFact(name, factName)
+	RecordAudit(cc.audit, NewAuditEntry(cc.newUser(), name, AUDIT_DELETE_FACT).WithFact(factName, before, nil).WithOutcome(err))
+	if err != nil {
+		return cc.fail(err)
+	}
+	fmt.Fprintf(cc.out, "deleted fact %s from %s\n", factName, name)
+	return EXIT_OK
+}
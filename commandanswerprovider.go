@@ -20,6 +20,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -33,57 +34,180 @@ const (
 	R_SET_CURRENT_KNOWLEDGE_BASE = "rsetcurrentknowledgebase"
 	R_ADD_FACT                   = "raddfact"
 	R_DELETE_FACT                = "rdeletefact"
+	R_AUDIT                      = "raudit"
+	R_FEEDBACK                   = "rfeedback"
+	R_FEEDBACK_REPORT            = "rfeedbackreport"
+	R_MISSES                     = "rmisses"
+	R_RESOLVE_MISS               = "rresolvemiss"
+	R_DISMISS_MISS               = "rdismissmiss"
 )
 
+// roles required for running commands on the knowledge base of the session
+var commandRoles = map[string]string{
+	R_LIST_FACTS:                 ROLE_READER,
+	R_LIST_KNOWLEDGE_BASES:       ROLE_READER,
+	R_NUM_FACTS:                  ROLE_READER,
+	R_GET_FACT:                   ROLE_READER,
+	R_GET_CURRENT_KNOWLEDGE_BASE: ROLE_READER,
+	R_SET_CURRENT_KNOWLEDGE_BASE: ROLE_READER,
+	R_ADD_FACT:                   ROLE_EDITOR,
+	R_DELETE_FACT:                ROLE_EDITOR,
+	R_AUDIT:                      ROLE_ADMIN,
+	R_FEEDBACK:                   ROLE_READER,
+	R_FEEDBACK_REPORT:            ROLE_EDITOR,
+	R_MISSES:                     ROLE_EDITOR,
+	R_RESOLVE_MISS:               ROLE_EDITOR,
+	R_DISMISS_MISS:               ROLE_EDITOR,
+}
+
 type CommandAnswerProvider struct {
-	kbm *KnowledeBaseManager
+	kbm      *KnowledeBaseManager
+	ap       AccessProvider
+	audit    AuditLog
+	feedback FeedbackStore
+	misses   MissQueue
 }
 
-func NewCommandAnswerProvider(kbm *KnowledeBaseManager) AnswerProvider {
+func NewCommandAnswerProvider(kbm *KnowledeBaseManager, ap AccessProvider, audit AuditLog, feedback FeedbackStore, misses MissQueue) AnswerProvider {
 	answerProvider := CommandAnswerProvider{
 		kbm,
+		ap,
+		audit,
+		feedback,
+		misses,
 	}
 	return &answerProvider
 }
 
 func (sap *CommandAnswerProvider) GetAnswers(session *UserSession, question *Question) ([]*Answer, error) {
-	answers := make([]*Answer, 0)
-	answer := new(Answer)
 	tokens := strings.Fields(question.Text)
 	if len(tokens) > 0 && strings.HasPrefix(tokens[0], "<@") {
 		tokens = tokens[1:]
 	}
+	return sap.runCommand(session, question, tokens)
+}
+
+// GetPluginAnswers runs the command given by the parameters of a system fact in their declared order.
+func (sap *CommandAnswerProvider) GetPluginAnswers(session *UserSession, question *Question, fact *Fact, params map[string]interface{}) ([]*Answer, error) {
+	tokens := make([]string, 0)
+	for idx, param := range fact.Params {
+		v, ok := params[param.GetName(idx)]
+		if ok {
+			tokens = append(tokens, fmt.Sprint(v))
+		}
+	}
+	return sap.runCommand(session, question, tokens)
+}
+
+// GetFact returns a fact of the knowledge base of the session for editing it.
+func (sap *CommandAnswerProvider) GetFact(session *UserSession, name string) (*Fact, error) {
+	err := CheckRole(sap.ap, session.User, sap.kbm.GetSessionBaseName(session), ROLE_EDITOR)
+	if err != nil {
+		return nil, err
+	}
+	fact := sap.kbm.GetSessionKnowledgeBase(session).GetFact(NormalizeFactName(name))
+	if fact == nil {
+		return nil, errors.New("no fact by that name")
+	}
+	return fact, nil
+}
+
+// SaveFact adds a new fact to, or updates an existing fact of the knowledge base of the session.
+func (sap *CommandAnswerProvider) SaveFact(session *UserSession, fact *Fact, isNew bool) ([]*Answer, error) {
+	baseName := sap.kbm.GetSessionBaseName(session)
+	_, err := sap.kbm.SaveFact(sap.ap, sap.audit, session.User, baseName, fact, isNew)
+	if err != nil {
+		return nil, err
+	}
+	if isNew {
+		return []*Answer{NewAnswer("added fact " + fact.Name + " to knowledge base " + baseName + "\n")}, nil
+	}
+	return []*Answer{NewAnswer("updated fact " + fact.Name + " in knowledge base " + baseName + "\n")}, nil
+}
+
+// getRatedHistory returns the most recent answered question of the session which was not a command.
+func (sap *CommandAnswerProvider) getRatedHistory(session *UserSession) *HistoryEntry {
+	for idx := len(session.History) - 1; idx >= 0; idx-- {
+		entry := session.History[idx]
+		if entry.Error != "" || len(entry.Answers) == 0 || entry.Question == nil {
+			continue
+		}
+		tokens := strings.Fields(entry.Question.Text)
+		if len(tokens) > 0 && strings.HasPrefix(tokens[0], "<@") {
+			tokens = tokens[1:]
+		}
+		if len(tokens) > 0 {
+			_, isCommand := commandRoles[tokens[0]]
+			if isCommand {
+				continue
+			}
+		}
+		return entry
+	}
+	return nil
+}
+
+// runCommand checks the permissions for a command, runs it and records it in the audit log.
+func (sap *CommandAnswerProvider) runCommand(session *UserSession, question *Question, tokens []string) ([]*Answer, error) {
+	if len(tokens) == 0 {
+		return sap.executeCommand(session, question, tokens, nil)
+	}
+	role, ok := commandRoles[tokens[0]]
+	if !ok {
+		return sap.executeCommand(session, question, tokens, nil)
+	}
+	entry := NewAuditEntry(session.User, sap.kbm.GetSessionBaseName(session), tokens[0], tokens[1:]...)
+	err := CheckRole(sap.ap, session.User, entry.KnowledgeBase, role)
+	if err != nil {
+		RecordAudit(sap.audit, entry.WithOutcome(err))
+		return nil, err
+	}
+	answers, err := sap.executeCommand(session, question, tokens, entry)
+	RecordAudit(sap.audit, entry.WithOutcome(err))
+	return answers, err
+}
+
+func (sap *CommandAnswerProvider) executeCommand(session *UserSession, question *Question, tokens []string, entry *AuditEntry) ([]*Answer, error) {
+	answers := make([]*Answer, 0)
+	answer := new(Answer)
 	if len(tokens) > 0 && tokens[0] == R_LIST_FACTS {
-		for _, f := range sap.kbm.GetCurrentKnowledgeBase().ListFacts() {
+		for _, f := range sap.kbm.GetSessionKnowledgeBase(session).ListFacts() {
 			answer.Text += f.Name + "\n"
 		}
 		answers = append(answers, answer)
 	} else if len(tokens) > 0 && tokens[0] == R_LIST_KNOWLEDGE_BASES {
 		for _, name := range sap.kbm.ListBaseNames() {
-			answer.Text += name + "\n"
+			if HasRole(sap.ap, session.User, name, ROLE_READER) {
+				answer.Text += name + "\n"
+			}
 		}
 		answers = append(answers, answer)
 	} else if len(tokens) > 0 && tokens[0] == R_GET_CURRENT_KNOWLEDGE_BASE {
-		answer.Text += sap.kbm.GetCurrentBaseName() + "\n"
+		answer.Text += sap.kbm.GetSessionBaseName(session) + "\n"
 		answers = append(answers, answer)
 	} else if len(tokens) > 0 && tokens[0] == R_SET_CURRENT_KNOWLEDGE_BASE {
 		if len(tokens) < 2 {
 			return nil, errors.New("missing parameter knowledge base name")
 		}
-		err := sap.kbm.SetCurrentBaseName(tokens[1])
+		err := CheckRole(sap.ap, session.User, tokens[1], ROLE_READER)
+		if err != nil {
+			return nil, err
+		}
+		err = sap.kbm.SetSessionBaseName(session, tokens[1])
 		if err != nil {
 			return nil, err
 		}
 		answer.Text += "set current knowledge base to " + tokens[1] + "\n"
 		answers = append(answers, answer)
 	} else if len(tokens) > 0 && tokens[0] == R_NUM_FACTS {
-		answer.Text += fmt.Sprintf("%d", sap.kbm.GetCurrentKnowledgeBase().GetNumFacts())
+		answer.Text += fmt.Sprintf("%d", sap.kbm.GetSessionKnowledgeBase(session).GetNumFacts())
 		answers = append(answers, answer)
 	} else if len(tokens) > 0 && tokens[0] == R_GET_FACT {
 		if len(tokens) < 2 {
 			return nil, errors.New("missing parameter fact name")
 		}
-		fact := sap.kbm.GetCurrentKnowledgeBase().GetFact(tokens[1])
+		entry.WithFact(tokens[1], nil, nil)
+		fact := sap.kbm.GetSessionKnowledgeBase(session).GetFact(tokens[1])
 		if fact == nil {
 			return nil, errors.New("no fact by that name")
 		} else {
@@ -96,36 +220,159 @@ func (sap *CommandAnswerProvider) GetAnswers(session *UserSession, question *Que
 			return nil, errors.New("missing parameter fact name")
 		}
 		factName := tokens[1]
-		if sap.kbm.GetCurrentKnowledgeBase().HasFact(factName) {
+		entry.WithFact(strings.ToUpper(factName), nil, nil)
+		if sap.kbm.GetSessionKnowledgeBase(session).HasFact(factName) {
 			return nil, errors.New("already have fact with name " + factName)
 		}
-		answer.Text += "adding new fact " + factName + ", please state a question for this fact!\n"
+		answer.Text += "adding new fact " + factName + ", please state a question for this fact or type 'cancel' to abort!\n"
 		answers = append(answers, answer)
 		session.NewFact = new(Fact)
 		session.NewFact.Name = strings.ToUpper(factName)
 		session.NewFact.CreatedBy = session.User.Name
 		session.NewFact.CreatedAt = fmt.Sprint(time.Now().Format(time.RFC3339))
 		session.State = STATE_ADD_QUESTION
+		session.DraftUpdatedAt = time.Now()
 	} else if len(tokens) > 0 && tokens[0] == R_DELETE_FACT {
 		if len(tokens) < 2 {
 			return nil, errors.New("missing parameter fact name")
 		}
 		factName := tokens[1]
-		if !sap.kbm.GetCurrentKnowledgeBase().HasFact(factName) {
-			return nil, errors.New("no fact with name " + factName)
+		entry.WithFact(factName, sap.kbm.GetSessionKnowledgeBase(session).GetFact(factName), nil)
+		err := sap.kbm.DeleteFact(sap.kbm.GetSessionBaseName(session), factName)
+		if err != nil {
+			return nil, err
+		}
+		answer.Text += "deleted fact " + factName + " from knowledge base!\n"
+		answers = append(answers, answer)
+	} else if len(tokens) > 0 && tokens[0] == R_AUDIT {
+		filter := &AuditFilter{KnowledgeBase: sap.kbm.GetSessionBaseName(session)}
+		if len(tokens) > 1 {
+			filter.FactName = tokens[1]
 		}
-		err := sap.kbm.GetCurrentKnowledgeBase().DeleteFact(factName)
+		if sap.audit == nil {
+			return nil, errors.New("no audit log")
+		}
+		entries, err := sap.audit.Query(filter)
 		if err != nil {
 			return nil, err
 		}
-		err = sap.kbm.GetCurrentEmbeddingsBase().SyncEmbeddings(sap.kbm.GetCurrentKnowledgeBase())
+		for _, e := range entries {
+			answer.Text += e.Time.Format(time.RFC3339) + " " + e.User + " (" + e.Agent + ") " + e.Command
+			if e.FactName != "" {
+				answer.Text += " " + e.FactName
+			}
+			answer.Text += ": " + e.Outcome
+			if e.Error != "" {
+				answer.Text += " " + e.Error
+			}
+			answer.Text += "\n"
+		}
+		if len(entries) == 0 {
+			answer.Text = "no audit entries for knowledge base " + filter.KnowledgeBase + "\n"
+		}
+		answers = append(answers, answer)
+	} else if len(tokens) > 0 && tokens[0] == R_FEEDBACK {
+		if len(tokens) < 2 {
+			return nil, errors.New("missing parameter rating")
+		}
+		rating, err := ParseRating(strings.ToLower(tokens[1]))
 		if err != nil {
 			return nil, err
 		}
-		err = sap.kbm.GetCurrentKnowledgeBase().Save()
+		if sap.feedback == nil {
+			return nil, errors.New("no feedback store")
+		}
+		history := sap.getRatedHistory(session)
+		if history == nil {
+			return nil, errors.New("no answer to give feedback on")
+		}
+		feedback := NewFeedbackEntry(session.User, history, rating)
+		entry.WithFact(feedback.FactName, nil, nil)
+		err = sap.feedback.Record(feedback)
 		if err != nil {
 			return nil, err
 		}
+		answer.Text += "thanks for your feedback on: " + feedback.Question + "\n"
+		answers = append(answers, answer)
+	} else if len(tokens) > 0 && tokens[0] == R_FEEDBACK_REPORT {
+		if sap.feedback == nil {
+			return nil, errors.New("no feedback store")
+		}
+		report, err := sap.feedback.Report(sap.kbm.GetSessionBaseName(session), DEFAULT_REPORT_LIMIT)
+		if err != nil {
+			return nil, err
+		}
+		answer.Text += "facts with the worst feedback in knowledge base " + report.KnowledgeBase + ":\n"
+		for _, ff := range report.Facts {
+			answer.Text += fmt.Sprintf("%s: %d down, %d up (%.0f%% negative)\n", ff.FactName, ff.Down, ff.Up, ff.Ratio*100)
+		}
+		answer.Text += "questions with negative feedback:\n"
+		for _, e := range report.Negative {
+			answer.Text += e.Time.Format(time.RFC3339) + " " + e.Question
+			if e.FactName != "" {
+				answer.Text += " (" + e.FactName + ")"
+			}
+			answer.Text += "\n"
+		}
+		answers = append(answers, answer)
+	} else if len(tokens) > 0 && tokens[0] == R_MISSES {
+		if sap.misses == nil {
+			return nil, errors.New("no miss queue")
+		}
+		clusters, err := sap.misses.ListClusters(sap.kbm.GetSessionBaseName(session))
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range clusters {
+			answer.Text += fmt.Sprintf("#%d (%dx) %s\n", c.Id, c.Count, c.Question)
+			for _, m := range c.Misses[1:] {
+				answer.Text += fmt.Sprintf("\t(%dx) %s\n", m.Count, m.Question)
+			}
+		}
+		if len(clusters) == 0 {
+			answer.Text = "no unanswered questions in knowledge base " + sap.kbm.GetSessionBaseName(session) + "\n"
+		}
+		answers = append(answers, answer)
+	} else if len(tokens) > 0 && (tokens[0] == R_RESOLVE_MISS || tokens[0] == R_DISMISS_MISS) {
+		if sap.misses == nil {
+			return nil, errors.New("no miss queue")
+		}
+		if len(tokens) < 2 {
+			return nil, errors.New("missing parameter cluster id")
+		}
+		id, err := strconv.Atoi(strings.TrimPrefix(tokens[1], "#"))
+		if err != nil {
+			return nil, errors.New("invalid cluster id " + tokens[1])
+		}
+		baseName := sap.kbm.GetSessionBaseName(session)
+		cluster, err := sap.misses.GetCluster(baseName, id)
+		if err != nil {
+			return nil, err
+		}
+		if tokens[0] == R_RESOLVE_MISS {
+			if len(tokens) < 4 {
+				return nil, errors.New("missing parameters fact name and answer")
+			}
+			if sap.kbm.GetSessionKnowledgeBase(session).HasFact(strings.ToUpper(tokens[2])) {
+				return nil, errors.New("already have fact with name " + strings.ToUpper(tokens[2]))
+			}
+			fact := NewFactFromCluster(cluster, tokens[2], []string{strings.Join(tokens[3:], " ")})
+			fact.CreatedBy = session.User.Name
+			fact.CreatedAt = time.Now().Format(time.RFC3339)
+			entry.WithFact(fact.Name, nil, fact)
+			err = sap.kbm.AddFact(baseName, fact)
+			if err != nil {
+				return nil, err
+			}
+			answer.Text += fmt.Sprintf("added fact %s answering %d unanswered questions\n", fact.Name, len(cluster.Misses))
+		} else {
+			answer.Text += fmt.Sprintf("dismissed %d unanswered questions\n", len(cluster.Misses))
+		}
+		err = sap.misses.Remove(baseName, cluster.GetMissIds())
+		if err != nil {
+			return nil, err
+		}
+		answers = append(answers, answer)
 	}
 	session.LastQuestion = question
 	session.LastAnswer = answers
@@ -0,0 +1,212 @@
+/**
+ * Copyright 2024 Boris Wolf
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	D_BACK = "back"
+	D_SKIP = "skip"
+)
+
+// Validate checks that all steps are named uniquely and only refer to existing steps.
+func (d *Dialog) Validate() error {
+	if len(d.Steps) == 0 {
+		return errors.New("dialog without steps")
+	}
+	names := make(map[string]bool)
+	for _, step := range d.Steps {
+		if step.Name == "" {
+			return errors.New("dialog step needs name")
+		}
+		if names[step.Name] {
+			return errors.New("duplicate dialog step " + step.Name)
+		}
+		names[step.Name] = true
+	}
+	if d.Start != "" && !names[d.Start] {
+		return errors.New("unknown start step " + d.Start)
+	}
+	for _, step := range d.Steps {
+		if step.Next != "" && !names[step.Next] {
+			return errors.New("unknown next step " + step.Next + " in step " + step.Name)
+		}
+		for _, branch := range step.Branches {
+			if branch.Next != "" && !names[branch.Next] {
+				return errors.New("unknown next step " + branch.Next + " in step " + step.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func (d *Dialog) GetStep(name string) *DialogStep {
+	for idx := range d.Steps {
+		if d.Steps[idx].Name == name {
+			return &d.Steps[idx]
+		}
+	}
+	return nil
+}
+
+func (d *Dialog) GetStartStep() string {
+	if d.Start != "" {
+		return d.Start
+	}
+	return d.Steps[0].Name
+}
+
+// GetNextStep returns the step following the given one for the collected value, blank if the dialog is complete.
+func (step *DialogStep) GetNextStep(value interface{}) string {
+	if value != nil {
+		for _, branch := range step.Branches {
+			if strings.EqualFold(branch.Value, fmt.Sprint(value)) {
+				return branch.Next
+			}
+		}
+	}
+	return step.Next
+}
+
+// StartDialog begins collecting the values of a fact with a dialog step by step.
+func (pm *PluginManager) StartDialog(session *UserSession, question *Question, fact *Fact) ([]*Answer, error) {
+	err := fact.Dialog.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid dialog for fact %s: %w", fact.Name, err)
+	}
+	session.Dialog = &DialogState{
+		Fact:     fact,
+		Question: question,
+		Step:     fact.Dialog.GetStartStep(),
+		Values:   make(map[string]interface{}),
+		Visited:  []string{},
+	}
+	session.State = STATE_DIALOG
+	session.DraftUpdatedAt = time.Now()
+	return pm.promptDialogStep(session, "")
+}
+
+// ContinueDialog takes the reply to the current step and moves on to the next step or the final action.
+func (pm *PluginManager) ContinueDialog(session *UserSession, question *Question) ([]*Answer, error) {
+	d := session.Dialog
+	if d == nil || d.Fact == nil || d.Fact.Dialog == nil {
+		session.State = STATE_QA
+		return nil, errors.New("no pending dialog")
+	}
+	session.DraftUpdatedAt = time.Now()
+	step := d.Fact.Dialog.GetStep(d.Step)
+	if step == nil {
+		session.Dialog = nil
+		session.State = STATE_QA
+		return nil, errors.New("unknown dialog step " + d.Step)
+	}
+	name := step.Param.Name
+	if name == "" {
+		name = step.Name
+	}
+	text := strings.TrimSpace(question.Text)
+	var value interface{}
+	if strings.EqualFold(text, D_BACK) {
+		if len(d.Visited) == 0 {
+			return pm.promptDialogStep(session, "this is the first step, type 'cancel' to abort!\n")
+		}
+		d.Step = d.Visited[len(d.Visited)-1]
+		d.Visited = d.Visited[:len(d.Visited)-1]
+		return pm.promptDialogStep(session, "")
+	} else if strings.EqualFold(text, D_SKIP) && !step.Param.Required {
+		if step.Param.Default != "" {
+			v, err := step.Param.Validate(step.Param.Default)
+			if err != nil {
+				return nil, fmt.Errorf("invalid default for dialog step %s: %w", step.Name, err)
+			}
+			value = v
+			d.Values[name] = value
+		} else {
+			delete(d.Values, name)
+		}
+	} else {
+		v, err := step.Param.Validate(text)
+		if err != nil {
+			return pm.promptDialogStep(session, "invalid "+name+": "+err.Error()+"\n")
+		}
+		value = v
+		d.Values[name] = value
+	}
+	d.Visited = append(d.Visited, d.Step)
+	d.Step = step.GetNextStep(value)
+	if d.Step != "" {
+		return pm.promptDialogStep(session, "")
+	}
+	return pm.finishDialog(session)
+}
+
+func (pm *PluginManager) promptDialogStep(session *UserSession, prefix string) ([]*Answer, error) {
+	d := session.Dialog
+	step := d.Fact.Dialog.GetStep(d.Step)
+	if step == nil {
+		return nil, errors.New("unknown dialog step " + d.Step)
+	}
+	prompt := step.Prompt
+	if prompt == "" {
+		prompt = "please provide " + step.Name
+	}
+	text, err := renderPluginTemplate("dialog prompt", prompt, nil, &PluginData{Question: d.Question.Text, User: session.User, Params: d.Values})
+	if err != nil {
+		return nil, err
+	}
+	if !step.Param.Required {
+		text += " (type 'skip' to leave it out)"
+	}
+	answers := []*Answer{NewAnswer(prefix + text + "\n")}
+	session.LastAnswer = answers
+	return answers, nil
+}
+
+// finishDialog hands the collected values to the plugin of the fact, or renders its answers for facts without plugin.
+func (pm *PluginManager) finishDialog(session *UserSession) ([]*Answer, error) {
+	d := session.Dialog
+	session.Dialog = nil
+	session.State = STATE_QA
+	session.DraftUpdatedAt = time.Time{}
+	if d.Fact.Plugin != "" {
+		call := &PluginCall{
+			Fact:     d.Fact,
+			Question: d.Question,
+			Params:   d.Values,
+			Errors:   make(map[string]string),
+		}
+		return pm.callPlugin(session, call)
+	}
+	answers := make([]*Answer, 0)
+	for _, a := range d.Fact.Answers {
+		text, err := renderPluginTemplate("dialog answer", a, nil, &PluginData{Question: d.Question.Text, User: session.User, Params: d.Values})
+		if err != nil {
+			return nil, err
+		}
+		answers = append(answers, NewAnswer(text))
+	}
+	for _, link := range d.Fact.Links {
+		answers = append(answers, NewAnswer("").WithLink(link))
+	}
+	session.LastAnswer = answers
+	return answers, nil
+}
@@ -0,0 +1,417 @@
+/**
+ * Copyright 2024 Boris Wolf
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	EMAIL_IMAP_ADDR = "emailImapAddr"
+	EMAIL_SMTP_ADDR = "emailSmtpAddr"
+	EMAIL_USER      = "emailUser"
+	EMAIL_PASSWORD  = "emailPassword"
+	EMAIL_ADDRESS   = "emailAddress"
+)
+
+const (
+	EMAIL_POLL_CONFIG               = "emailpoll"
+	EMAIL_TLS_CONFIG                = "emailtls"
+	EMAIL_AUTHSERV_CONFIG           = "emailauthserv" // authserv-id of the receiving mail server, whose authentication results are trusted
+	DEFAULT_EMAIL_POLL              = 1 * time.Minute
+	EMAIL_SESSION_PREFIX            = "email-"
+	EMAIL_UNVERIFIED_SESSION_PREFIX = "email-unverified-"
+	EMAIL_REPLY_PREFIX              = "Re: "
+	EMAIL_ID_LEN                    = 16
+)
+
+type EmailAgent struct {
+	configProvider ConfigProvider
+	secretProvider SecretProvider
+	answerProvider AnswerProvider
+	sessionMgr     SessionManager
+}
+
+// emailHeader is implemented by the headers of messages and of their parts.
+type emailHeader interface {
+	Get(key string) string
+}
+
+func NewEmailAgent(configProvider ConfigProvider, secretProvider SecretProvider, answerProvider AnswerProvider, sessionManager SessionManager) Agent {
+	ea := EmailAgent{
+		configProvider: configProvider,
+		secretProvider: secretProvider,
+		answerProvider: answerProvider,
+		sessionMgr:     sessionManager,
+	}
+	return &ea
+}
+
+func (ea *EmailAgent) LaunchAgent(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	err := ea.run(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("email agent failed")
+	}
+}
+
+// run polls the mailbox until the context is cancelled, failed polls are retried with the next one.
+func (ea *EmailAgent) run(ctx context.Context) error {
+	if ea.secretProvider.GetSecret(EMAIL_IMAP_ADDR) == "" {
+		return errors.New("missing secret emailImapAddr")
+	}
+	if ea.secretProvider.GetSecret(EMAIL_SMTP_ADDR) == "" {
+		return errors.New("missing secret emailSmtpAddr")
+	}
+	if ea.secretProvider.GetSecret(EMAIL_ADDRESS) == "" {
+		return errors.New("missing secret emailAddress")
+	}
+	interval, err := time.ParseDuration(ea.configProvider.GetConfig(EMAIL_POLL_CONFIG))
+	if err != nil || interval <= 0 {
+		interval = DEFAULT_EMAIL_POLL
+	}
+	log.Info().Str("interval", interval.String()).Msg("launching email agent")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err = ea.poll()
+		if err != nil {
+			log.Error().Err(err).Msg("failed to poll mailbox")
+		}
+		select {
+		case <-ctx.Done():
+			log.Info().Msg("stopping email agent")
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll answers all unseen messages. They are fetched and marked as seen before any of them is answered
+// so that a question is not answered twice if the reply cannot be sent, and so that the mailbox is
+// not kept open while answering.
+func (ea *EmailAgent) poll() error {
+	messages, err := ea.fetchUnseen()
+	for _, raw := range messages {
+		answerErr := ea.handleMessage(raw)
+		if answerErr != nil {
+			log.Error().Err(answerErr).Msg("failed to answer email")
+		}
+	}
+	return err
+}
+
+// fetchUnseen returns the unseen messages and marks them as seen, on failure the messages fetched
+// and marked so far are returned along with the error.
+func (ea *EmailAgent) fetchUnseen() ([][]byte, error) {
+	messages := make([][]byte, 0)
+	ic, err := DialImap(ea.secretProvider.GetSecret(EMAIL_IMAP_ADDR), ea.configProvider.GetConfig(EMAIL_TLS_CONFIG) != "no")
+	if err != nil {
+		return messages, err
+	}
+	defer ic.Logout()
+	err = ic.Login(ea.secretProvider.GetSecret(EMAIL_USER), ea.secretProvider.GetSecret(EMAIL_PASSWORD))
+	if err != nil {
+		return messages, err
+	}
+	err = ic.Select(IMAP_INBOX)
+	if err != nil {
+		return messages, err
+	}
+	uids, err := ic.SearchUnseen()
+	if err != nil {
+		return messages, err
+	}
+	for _, uid := range uids {
+		raw, err := ic.Fetch(uid)
+		if err != nil {
+			return messages, err
+		}
+		err = ic.MarkSeen(uid)
+		if err != nil {
+			return messages, err
+		}
+		messages = append(messages, raw)
+	}
+	return messages, nil
+}
+
+func (ea *EmailAgent) handleMessage(raw []byte) error {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		// a message that cannot be parsed will not get any better
+		log.Warn().Err(err).Msg("ignoring invalid email")
+		return nil
+	}
+	from, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil {
+		log.Warn().Err(err).Msg("ignoring email without sender")
+		return nil
+	}
+	if ea.isAutomated(msg.Header, from) {
+		log.Info().Str("from", from.Address).Msg("ignoring automated email")
+		return nil
+	}
+	text, err := ea.getText(msg.Header, msg.Body)
+	if err != nil {
+		return err
+	}
+	question := ea.getQuestion(text, msg.Header.Get("Subject"))
+	if question == "" {
+		return nil
+	}
+	session := ea.sessionMgr.GetSession(ea.getUser(from, ea.isVerifiedSender(msg.Header, from)))
+	answers, err := ea.answerProvider.GetAnswers(session, NewQuestion(question))
+	var body string
+	if err != nil {
+		body = "Sorry, I could not answer your question: " + err.Error() + "\n"
+	} else {
+		body = ea.formatAnswers(answers)
+	}
+	return ea.sendReply(msg.Header, from, body)
+}
+
+// isAutomated tells mails from the agent itself, auto replies and mailing lists, which must not be answered
+// to avoid loops.
+func (ea *EmailAgent) isAutomated(header mail.Header, from *mail.Address) bool {
+	if strings.EqualFold(from.Address, ea.secretProvider.GetSecret(EMAIL_ADDRESS)) {
+		return true
+	}
+	autoSubmitted := strings.ToLower(header.Get("Auto-Submitted"))
+	if autoSubmitted != "" && autoSubmitted != "no" {
+		return true
+	}
+	precedence := strings.ToLower(header.Get("Precedence"))
+	return precedence == "bulk" || precedence == "list" || precedence == "junk"
+}
+
+// isVerifiedSender tells if the receiving mail server found the sender domain to pass DMARC, that is
+// SPF or DKIM aligned with the From header. Only the topmost results of the configured server count,
+// it has to remove results claiming to be its own from incoming mails.
+func (ea *EmailAgent) isVerifiedSender(header mail.Header, from *mail.Address) bool {
+	authServ := ea.configProvider.GetConfig(EMAIL_AUTHSERV_CONFIG)
+	if authServ == "" {
+		return false
+	}
+	domain := strings.ToLower(from.Address[strings.LastIndex(from.Address, "@")+1:])
+	for _, results := range header["Authentication-Results"] {
+		fields := strings.Split(results, ";")
+		id := strings.Fields(fields[0])
+		if len(id) == 0 || !strings.EqualFold(id[0], authServ) {
+			continue
+		}
+		for _, result := range fields[1:] {
+			tokens := strings.Fields(strings.ToLower(result))
+			if len(tokens) == 0 || tokens[0] != "dmarc=pass" {
+				continue
+			}
+			for _, token := range tokens[1:] {
+				if token == "header.from="+domain {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// sessions are kept per sender address, only verified senders log in with their address and get
+// the roles granted to it, anyone can claim any address in the From header
+func (ea *EmailAgent) getUser(from *mail.Address, verified bool) *User {
+	address := strings.ToLower(from.Address)
+	name := from.Name
+	if name == "" {
+		name = address
+	}
+	if !verified {
+		return NewUser(EMAIL_UNVERIFIED_SESSION_PREFIX+address, address, name).WithAgent(AGENT_EMAIL)
+	}
+	user := NewUser(EMAIL_SESSION_PREFIX+address, address, name).WithAgent(AGENT_EMAIL)
+	user.Login = address
+	return user
+}
+
+// getText returns the first plain text part of a message.
+func (ea *EmailAgent) getText(header emailHeader, body io.Reader) (string, error) {
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return "", nil
+			}
+			if err != nil {
+				return "", err
+			}
+			text, err := ea.getText(part.Header, part)
+			if err != nil {
+				return "", err
+			}
+			if text != "" {
+				return text, nil
+			}
+		}
+	}
+	if mediaType != "text/plain" {
+		return "", nil
+	}
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// getQuestion drops quoted text and signatures from the body, falling back to the subject.
+func (ea *EmailAgent) getQuestion(text, subject string) string {
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	kept := make([]string, 0)
+	for idx, line := range lines {
+		if line == "-- " {
+			break
+		}
+		if strings.HasPrefix(line, ">") {
+			continue
+		}
+		// the attribution line of a quote like "On Monday, Kirk wrote:"
+		if strings.HasSuffix(strings.TrimSpace(line), "wrote:") && idx+1 < len(lines) && strings.HasPrefix(lines[idx+1], ">") {
+			continue
+		}
+		kept = append(kept, strings.TrimSpace(line))
+	}
+	question := strings.TrimSpace(strings.Join(kept, " "))
+	if question == "" {
+		decoded, err := new(mime.WordDecoder).DecodeHeader(subject)
+		if err == nil {
+			subject = decoded
+		}
+		question = strings.TrimSpace(subject)
+		for strings.HasPrefix(strings.ToLower(question), "re:") {
+			question = strings.TrimSpace(question[3:])
+		}
+	}
+	return strings.Join(strings.Fields(question), " ")
+}
+
+func (ea *EmailAgent) formatAnswers(answers []*Answer) string {
+	var sb strings.Builder
+	for _, a := range answers {
+		if a.Text != "" {
+			sb.WriteString(a.Text + "\n")
+		}
+		for _, c := range a.Choices {
+			sb.WriteString("- " + c + "\n")
+		}
+		if a.Link != "" {
+			sb.WriteString(a.Link + "\n")
+		}
+		if a.ImageLink != "" {
+			sb.WriteString(a.ImageLink + "\n")
+		}
+		sb.WriteString("\n")
+	}
+	if sb.Len() == 0 {
+		return "Sorry, I do not know the answer to your question.\n"
+	}
+	return sb.String()
+}
+
+// sendReply answers in the thread of the original message, to its reply-to address if there is one.
+func (ea *EmailAgent) sendReply(header mail.Header, from *mail.Address, body string) error {
+	to := from
+	if replyTo, err := mail.ParseAddress(header.Get("Reply-To")); err == nil {
+		to = replyTo
+	}
+	subject := header.Get("Subject")
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(subject); err == nil {
+		subject = decoded
+	}
+	if !strings.HasPrefix(strings.ToLower(subject), "re:") {
+		subject = EMAIL_REPLY_PREFIX + subject
+	}
+	address := ea.secretProvider.GetSecret(EMAIL_ADDRESS)
+	messageId := header.Get("Message-ID")
+	references := strings.TrimSpace(header.Get("References") + " " + messageId)
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", (&mail.Address{Address: address}).String())
+	fmt.Fprintf(&msg, "To: %s\r\n", to.String())
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: %s\r\n", ea.newMessageId(address))
+	if messageId != "" {
+		fmt.Fprintf(&msg, "In-Reply-To: %s\r\n", messageId)
+		fmt.Fprintf(&msg, "References: %s\r\n", references)
+	}
+	fmt.Fprintf(&msg, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&msg, "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	qp := quotedprintable.NewWriter(&msg)
+	qp.Write([]byte(strings.ReplaceAll(body, "\n", "\r\n")))
+	qp.Close()
+	var auth smtp.Auth
+	if ea.secretProvider.GetSecret(EMAIL_USER) != "" {
+		host, _, err := net.SplitHostPort(ea.secretProvider.GetSecret(EMAIL_SMTP_ADDR))
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", ea.secretProvider.GetSecret(EMAIL_USER), ea.secretProvider.GetSecret(EMAIL_PASSWORD), host)
+	}
+	return smtp.SendMail(ea.secretProvider.GetSecret(EMAIL_SMTP_ADDR), auth, address, []string{to.Address}, msg.Bytes())
+}
+
+func (ea *EmailAgent) newMessageId(address string) string {
+	b := make([]byte, EMAIL_ID_LEN)
+	rand.Read(b)
+	domain := "agentsmith"
+	if idx := strings.LastIndex(address, "@"); idx >= 0 {
+		domain = address[idx+1:]
+	}
+	return "<" + base64.RawURLEncoding.EncodeToString(b) + "@" + domain + ">"
+}
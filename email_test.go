@@ -0,0 +1,469 @@
+/**
+ * Copyright 2024 Boris Wolf
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type (
+	fakeImapMessage struct {
+		uid  uint32
+		raw  string
+		seen bool
+	}
+	// fakeImapServer stands in for an imap server with a single inbox.
+	fakeImapServer struct {
+		sync.Mutex
+		listener net.Listener
+		user     string
+		password string
+		messages []*fakeImapMessage
+		sessions int // logged in and not yet logged out
+	}
+	fakeSmtpMessage struct {
+		auth string
+		from string
+		to   []string
+		data string
+	}
+	// fakeSmtpServer stands in for an smtp server, recording the delivered messages.
+	fakeSmtpServer struct {
+		sync.Mutex
+		listener net.Listener
+		messages []*fakeSmtpMessage
+	}
+)
+
+func newFakeImapServer(t *testing.T, user, password string) *fakeImapServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeImapServer{listener: listener, user: user, password: password}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeImapServer) add(raw string) {
+	s.Lock()
+	defer s.Unlock()
+	s.messages = append(s.messages, &fakeImapMessage{uid: uint32(len(s.messages) + 101), raw: strings.ReplaceAll(raw, "\n", "\r\n")})
+}
+
+func (s *fakeImapServer) unseen() int {
+	s.Lock()
+	defer s.Unlock()
+	count := 0
+	for _, m := range s.messages {
+		if !m.seen {
+			count++
+		}
+	}
+	return count
+}
+
+func (s *fakeImapServer) loggedIn() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.sessions
+}
+
+func (s *fakeImapServer) find(uid string) (int, *fakeImapMessage) {
+	for idx, m := range s.messages {
+		if strconv.Itoa(int(m.uid)) == uid {
+			return idx + 1, m
+		}
+	}
+	return 0, nil
+}
+
+func (s *fakeImapServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	fmt.Fprint(conn, "* OK fake imap ready\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			fmt.Fprint(conn, "* BAD missing command\r\n")
+			continue
+		}
+		tag, command := fields[0], strings.ToUpper(strings.Join(fields[1:], " "))
+		s.Lock()
+		switch {
+		case strings.HasPrefix(command, "LOGIN "):
+			if fields[2] == strconv.Quote(s.user) && fields[3] == strconv.Quote(s.password) {
+				s.sessions++
+				fmt.Fprintf(conn, "%s OK logged in\r\n", tag)
+			} else {
+				fmt.Fprintf(conn, "%s NO invalid credentials\r\n", tag)
+			}
+		case strings.HasPrefix(command, "SELECT "):
+			fmt.Fprintf(conn, "* %d EXISTS\r\n%s OK [READ-WRITE] selected\r\n", len(s.messages), tag)
+		case command == "UID SEARCH UNSEEN":
+			uids := make([]string, 0)
+			for _, m := range s.messages {
+				if !m.seen {
+					uids = append(uids, strconv.Itoa(int(m.uid)))
+				}
+			}
+			fmt.Fprintf(conn, "* SEARCH %s\r\n%s OK search done\r\n", strings.Join(uids, " "), tag)
+		case strings.HasPrefix(command, "UID FETCH ") && fields[4] == "BODY.PEEK[]":
+			seq, m := s.find(fields[3])
+			if m != nil {
+				fmt.Fprintf(conn, "* %d FETCH (UID %d BODY[] {%d}\r\n%s)\r\n", seq, m.uid, len(m.raw), m.raw)
+			}
+			fmt.Fprintf(conn, "%s OK fetch done\r\n", tag)
+		case strings.HasPrefix(command, "UID STORE ") && strings.Contains(command, `+FLAGS (\SEEN)`):
+			seq, m := s.find(fields[3])
+			if m != nil {
+				m.seen = true
+				fmt.Fprintf(conn, "* %d FETCH (UID %d FLAGS (\\Seen))\r\n", seq, m.uid)
+			}
+			fmt.Fprintf(conn, "%s OK store done\r\n", tag)
+		case command == "LOGOUT":
+			s.sessions--
+			fmt.Fprintf(conn, "* BYE\r\n%s OK logged out\r\n", tag)
+			s.Unlock()
+			return
+		default:
+			fmt.Fprintf(conn, "%s BAD unknown command\r\n", tag)
+		}
+		s.Unlock()
+	}
+}
+
+func newFakeSmtpServer(t *testing.T) *fakeSmtpServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSmtpServer{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSmtpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	fmt.Fprint(conn, "220 localhost fake smtp\r\n")
+	msg := &fakeSmtpMessage{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		command := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(command, "EHLO"):
+			fmt.Fprint(conn, "250-localhost\r\n250 AUTH PLAIN\r\n")
+		case strings.HasPrefix(command, "AUTH PLAIN "):
+			auth, _ := base64.StdEncoding.DecodeString(line[len("AUTH PLAIN "):])
+			msg.auth = string(auth)
+			fmt.Fprint(conn, "235 authenticated\r\n")
+		case strings.HasPrefix(command, "MAIL FROM:"):
+			msg.from = strings.Trim(line[len("MAIL FROM:"):], "<> ")
+			fmt.Fprint(conn, "250 ok\r\n")
+		case strings.HasPrefix(command, "RCPT TO:"):
+			msg.to = append(msg.to, strings.Trim(line[len("RCPT TO:"):], "<> "))
+			fmt.Fprint(conn, "250 ok\r\n")
+		case command == "DATA":
+			fmt.Fprint(conn, "354 go ahead\r\n")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(line, "."))
+			}
+			msg.data = data.String()
+			s.Lock()
+			s.messages = append(s.messages, msg)
+			s.Unlock()
+			msg = &fakeSmtpMessage{auth: msg.auth}
+			fmt.Fprint(conn, "250 queued\r\n")
+		case command == "QUIT":
+			fmt.Fprint(conn, "221 bye\r\n")
+			return
+		default:
+			fmt.Fprint(conn, "250 ok\r\n")
+		}
+	}
+}
+
+func (s *fakeSmtpServer) sent() []*fakeSmtpMessage {
+	s.Lock()
+	defer s.Unlock()
+	return append([]*fakeSmtpMessage{}, s.messages...)
+}
+
+func newTestEmailAgent(t *testing.T, tap AnswerProvider) (*EmailAgent, *fakeImapServer, *fakeSmtpServer) {
+	imap := newFakeImapServer(t, "smith", "secret")
+	smtp := newFakeSmtpServer(t)
+	secrets := testSecretProvider{
+		EMAIL_IMAP_ADDR: imap.listener.Addr().String(),
+		EMAIL_SMTP_ADDR: smtp.listener.Addr().String(),
+		EMAIL_USER:      "smith",
+		EMAIL_PASSWORD:  "secret",
+		EMAIL_ADDRESS:   "smith@matrix.example",
+	}
+	configs := testConfigProvider{EMAIL_TLS_CONFIG: "no", EMAIL_POLL_CONFIG: "10ms", EMAIL_AUTHSERV_CONFIG: "mx.matrix.example"}
+	ea := NewEmailAgent(configs, secrets, tap, NewSimpleSessionManager(time.Minute, 10)).(*EmailAgent)
+	return ea, imap, smtp
+}
+
+// mailboxCheckingAnswerProvider counts questions answered while the agent is logged in to the mailbox.
+type mailboxCheckingAnswerProvider struct {
+	AnswerProvider
+	imap      *fakeImapServer
+	whileOpen int
+}
+
+func (mcap *mailboxCheckingAnswerProvider) GetAnswers(session *UserSession, question *Question) ([]*Answer, error) {
+	if mcap.imap.loggedIn() > 0 {
+		mcap.whileOpen++
+	}
+	return mcap.AnswerProvider.GetAnswers(session, question)
+}
+
+func TestEmailAgent(t *testing.T) {
+	tap := new(testSlackAnswerProvider)
+	ea, imap, smtp := newTestEmailAgent(t, tap)
+	mcap := &mailboxCheckingAnswerProvider{AnswerProvider: tap, imap: imap}
+	ea.answerProvider = mcap
+	imap.add(`Authentication-Results: mx.matrix.example; spf=pass smtp.mailfrom=enterprise.example;
+ dmarc=pass (p=reject) header.from=enterprise.example
+From: James Kirk <Kirk@Enterprise.example>
+To: smith@matrix.example
+Subject: Vulcans
+Message-ID: <1@enterprise.example>
+
+Who are the
+Vulcans?
+-- 
+Captain Kirk
+`)
+	imap.add(`From: spock@enterprise.example
+Reply-To: science@enterprise.example
+To: smith@matrix.example
+Subject: Re: =?utf-8?q?Warp_=C3=BCber_alles?=
+Message-ID: <2@enterprise.example>
+References: <0@enterprise.example>
+MIME-Version: 1.0
+Content-Type: multipart/alternative; boundary="XYZ"
+
+--XYZ
+Content-Type: text/html
+
+<p>ignored</p>
+--XYZ
+Content-Type: text/plain; charset=utf-8
+Content-Transfer-Encoding: quoted-printable
+
+How fast is warp =
+ten?
+
+On Monday, Kirk wrote:
+> earlier question
+--XYZ--
+`)
+	imap.add(`From: kirk@enterprise.example
+To: smith@matrix.example
+Subject: Out of office
+Auto-Submitted: auto-replied
+
+I am on shore leave.
+`)
+	imap.add(`From: smith@matrix.example
+To: smith@matrix.example
+Subject: loop
+
+Answering myself?
+`)
+	imap.add(`Authentication-Results: mx.matrix.example; dmarc=pass header.from=enterprise.example
+From: kirk@enterprise.example
+To: smith@matrix.example
+Subject: Re: Vulcans
+Message-ID: <3@enterprise.example>
+Content-Type: text/plain
+Content-Transfer-Encoding: base64
+
+ZmFpbA==
+`)
+	err := ea.poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := smtp.sent()
+	if len(sent) != 3 {
+		t.Fatalf("expected 3 replies, got %d", len(sent))
+	}
+	replies := make([]*mail.Message, len(sent))
+	for idx, s := range sent {
+		if s.from != "smith@matrix.example" || s.auth != "\x00smith\x00secret" {
+			t.Errorf("unexpected envelope: %+v", s)
+		}
+		replies[idx], err = mail.ReadMessage(strings.NewReader(s.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	body := func(msg *mail.Message) string {
+		text, _ := ea.getText(msg.Header, msg.Body)
+		return text
+	}
+	if sent[0].to[0] != "Kirk@Enterprise.example" || replies[0].Header.Get("Subject") != "Re: Vulcans" || replies[0].Header.Get("In-Reply-To") != "<1@enterprise.example>" {
+		t.Errorf("unexpected first reply: %v", replies[0].Header)
+	}
+	if !strings.HasPrefix(body(replies[0]), "answer to Who are the Vulcans?\r\nhttps://example.com\r\n") {
+		t.Errorf("unexpected first answer: %q", body(replies[0]))
+	}
+	if sent[1].to[0] != "science@enterprise.example" || replies[1].Header.Get("References") != "<0@enterprise.example> <2@enterprise.example>" {
+		t.Errorf("expected reply in thread to reply-to address: %v %v", sent[1].to, replies[1].Header)
+	}
+	if decoded, _ := new(mime.WordDecoder).DecodeHeader(replies[1].Header.Get("Subject")); decoded != "Re: Warp über alles" {
+		t.Errorf("unexpected subject: %s", decoded)
+	}
+	if !strings.HasPrefix(body(replies[1]), "answer to How fast is warp ten?") {
+		t.Errorf("unexpected second answer: %q", body(replies[1]))
+	}
+	if !strings.Contains(body(replies[2]), "could not answer your question: knowledge base unavailable") {
+		t.Errorf("expected error reply: %q", body(replies[2]))
+	}
+	if len(tap.sessions) != 3 || tap.sessions[0] != tap.sessions[2] || tap.sessions[0].User.Id != "email-kirk@enterprise.example" || tap.sessions[0].User.Agent != AGENT_EMAIL || tap.sessions[0].User.RealName != "James Kirk" {
+		t.Errorf("expected one session per sender: %+v", tap.sessions[0].User)
+	}
+	if tap.sessions[0].User.GetLogin() != "kirk@enterprise.example" || tap.sessions[1].User.GetLogin() == "spock@enterprise.example" {
+		t.Errorf("expected only verified senders to log in: %+v %+v", tap.sessions[0].User, tap.sessions[1].User)
+	}
+	if imap.unseen() != 0 {
+		t.Errorf("expected all messages to be seen")
+	}
+	if mcap.whileOpen != 0 {
+		t.Errorf("expected mailbox to be closed while answering, %d questions were answered with open mailbox", mcap.whileOpen)
+	}
+	err = ea.poll()
+	if err != nil || len(smtp.sent()) != 3 {
+		t.Errorf("expected no more replies: %v", err)
+	}
+	// messages are not answered again if replies cannot be sent
+	smtp.listener.Close()
+	imap.add("From: kirk@enterprise.example\nSubject: Klingons\n\nWho are the Klingons?\n")
+	err = ea.poll()
+	if err != nil || imap.unseen() != 0 || len(tap.sessions) != 4 {
+		t.Errorf("expected message to be seen: %v", err)
+	}
+	err = ea.poll()
+	if err != nil || len(tap.sessions) != 4 {
+		t.Errorf("expected message not to be answered again: %v", err)
+	}
+}
+
+func TestEmailVerifiedSender(t *testing.T) {
+	ea, _, _ := newTestEmailAgent(t, new(testSlackAnswerProvider))
+	from := &mail.Address{Address: "kirk@enterprise.example"}
+	tests := []struct {
+		header   string
+		verified bool
+	}{
+		{"Authentication-Results: mx.matrix.example; dmarc=pass header.from=enterprise.example\n", true},
+		{"Authentication-Results: mx.matrix.example; dmarc=fail header.from=enterprise.example\n", false},
+		{"Authentication-Results: mx.matrix.example; spf=pass smtp.mailfrom=enterprise.example\n", false},
+		{"Authentication-Results: mx.matrix.example; dmarc=pass header.from=klingon.example\n", false},
+		{"Authentication-Results: mx.evil.example; dmarc=pass header.from=enterprise.example\n", false},
+		{"Authentication-Results: mx.matrix.example; dmarc=fail header.from=enterprise.example\nAuthentication-Results: mx.matrix.example; dmarc=pass header.from=enterprise.example\n", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		msg, err := mail.ReadMessage(strings.NewReader(test.header + "From: kirk@enterprise.example\n\nhi\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ea.isVerifiedSender(msg.Header, from) != test.verified {
+			t.Errorf("expected verified %v for %q", test.verified, test.header)
+		}
+	}
+}
+
+func TestEmailAgentRun(t *testing.T) {
+	ea, imap, smtp := newTestEmailAgent(t, new(testSlackAnswerProvider))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- ea.run(ctx)
+	}()
+	imap.add("From: kirk@enterprise.example\nSubject: Romulans\n\n")
+	for deadline := time.Now().Add(5 * time.Second); len(smtp.sent()) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("expected agent to stop cleanly: %v", err)
+	}
+	if len(smtp.sent()) != 1 || !strings.Contains(smtp.sent()[0].data, "answer to Romulans") {
+		t.Errorf("expected subject to be answered: %+v", smtp.sent())
+	}
+	ea.secretProvider = testSecretProvider{}
+	if err := ea.run(context.Background()); err == nil || err.Error() != "missing secret emailImapAddr" {
+		t.Errorf("expected missing secret error: %v", err)
+	}
+	ic, err := DialImap(imap.listener.Addr().String(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ic.Logout()
+	if err = ic.Login("smith", "wrong"); err == nil || !strings.Contains(err.Error(), "invalid credentials") {
+		t.Errorf("expected login to fail: %v", err)
+	}
+}
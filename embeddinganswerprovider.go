@@ -21,39 +21,74 @@ import (
 	"strings"
 )
 
+const (
+	DISAMBIGUATION_MARGIN_CONFIG = "disambiguationmargin"
+	MAX_DISAMBIGUATION_CHOICES   = 3
+)
+
+var ErrNoMatchingFact = errors.New("no matching fact")
+
 type EmbeddingAnswerProvider struct {
-	kbm *KnowledeBaseManager
-	oai OpenAIHandler
-	pm  *PluginManager
+	kbm    *KnowledeBaseManager
+	oai    OpenAIHandler
+	pm     *PluginManager
+	ap     AccessProvider
+	margin float64 // facts ranked within this margin of the best one are offered as choices, 0 to disable
 }
 
-func NewEmbeddingAnswerProvider(kbm *KnowledeBaseManager, oai OpenAIHandler) AnswerProvider {
+func NewEmbeddingAnswerProvider(kbm *KnowledeBaseManager, oai OpenAIHandler, pm *PluginManager, ap AccessProvider, margin float64) AnswerProvider {
 	answerProvider := EmbeddingAnswerProvider{
 		kbm,
 		oai,
-		NewPluginManger(kbm, oai),
+		pm,
+		ap,
+		margin,
 	}
 	return &answerProvider
 }
 
 func (sap *EmbeddingAnswerProvider) GetAnswers(session *UserSession, question *Question) ([]*Answer, error) {
 	answers := make([]*Answer, 0)
+	err := CheckRole(sap.ap, session.User, sap.kbm.GetSessionBaseName(session), ROLE_READER)
+	if err != nil {
+		return nil, err
+	}
+	if sap.kbm.GetSessionKnowledgeBase(session).GetNumFacts() == 0 {
+		return nil, ErrNoMatchingFact
+	}
 	embedding, err := sap.oai.GptGetEmbedding(question)
 	if err != nil {
 		return nil, err
 	}
-	ranking, err := sap.kbm.GetCurrentEmbeddingsBase().RankEmbeddings(embedding)
+	// kept for recording the question if it cannot be answered
+	question.Embedding = embedding
+	ranking, err := sap.kbm.GetSessionEmbeddingsBase(session).RankEmbeddings(embedding)
 	if err != nil {
 		return nil, err
 	}
 	if len(ranking.Embeddings) == 0 {
-		return nil, errors.New("no matching fact")
+		return nil, ErrNoMatchingFact
+	}
+	choices := sap.getChoices(session, ranking)
+	if len(choices) > 1 {
+		answer := NewAnswer("did you mean one of the following?\n" + strings.Join(choices, "\n") + "\n").WithChoices(choices)
+		answer.Score = ranking.Embeddings[0].Relevance
+		answer.Rank = 1
+		answers = append(answers, answer)
+		session.LastQuestion = question
+		session.LastAnswer = answers
+		return answers, nil
 	}
-	fact := sap.kbm.GetCurrentKnowledgeBase().GetFact(ranking.Embeddings[0].FactName)
+	fact := sap.kbm.GetSessionKnowledgeBase(session).GetFact(ranking.Embeddings[0].FactName)
 	if fact == nil {
-		return nil, errors.New("no matching fact")
+		return nil, ErrNoMatchingFact
 	}
-	if fact.Plugin != "" {
+	if fact.Dialog != nil {
+		answers, err = sap.pm.StartDialog(session, question, fact)
+		if err != nil {
+			return nil, err
+		}
+	} else if fact.Plugin != "" {
 		answers, err = sap.pm.GetAnswers(session, question, fact)
 		if err != nil {
 			return nil, err
@@ -64,10 +99,13 @@ func (sap *EmbeddingAnswerProvider) GetAnswers(session *UserSession, question *Q
 		plausabilityPrompt += "Question:\n" + question.Text + "\n"
 		plausabilityPrompt += "Answer:\n"
 		for _, a := range fact.Answers {
-			answers = append(answers, &Answer{a, "", "", 0, 0})
+			answers = append(answers, &Answer{a, "", "", 0, 0, "", nil})
 			plausabilityPrompt += a + "\n"
 		}
-		plausabilityAnswers, err := sap.oai.GptGetCompletions(&Question{plausabilityPrompt})
+		for _, link := range fact.Links {
+			answers = append(answers, NewAnswer("").WithLink(link))
+		}
+		plausabilityAnswers, err := sap.oai.GptGetCompletions(NewQuestion(plausabilityPrompt))
 		if err != nil {
 			return nil, err
 		}
@@ -76,7 +114,36 @@ func (sap *EmbeddingAnswerProvider) GetAnswers(session *UserSession, question *Q
 			answers = make([]*Answer, 0)
 		}
 	}
+	for idx, a := range answers {
+		a.FactName = fact.Name
+		a.Score = ranking.Embeddings[0].Relevance
+		a.Rank = idx + 1
+	}
 	session.LastQuestion = question
 	session.LastAnswer = answers
 	return answers, nil
 }
+
+// getChoices returns the questions of the distinct facts ranked close to the best one.
+func (sap *EmbeddingAnswerProvider) getChoices(session *UserSession, ranking *EmbeddingsRanking) []string {
+	choices := make([]string, 0)
+	if sap.margin <= 0 {
+		return choices
+	}
+	kb := sap.kbm.GetSessionKnowledgeBase(session)
+	seen := make(map[string]bool)
+	for _, e := range ranking.Embeddings {
+		if ranking.Embeddings[0].Relevance-e.Relevance > sap.margin || len(choices) >= MAX_DISAMBIGUATION_CHOICES {
+			break
+		}
+		if seen[e.FactName] {
+			continue
+		}
+		seen[e.FactName] = true
+		fact := kb.GetFact(e.FactName)
+		if fact != nil && fact.Question != "" {
+			choices = append(choices, fact.Question)
+		}
+	}
+	return choices
+}
@@ -0,0 +1,43 @@
+/**
+ * Copyright 2024 Boris Wolf
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+func TestEmbeddingDisambiguation(t *testing.T) {
+	args := `{}`
+	openai := newTestOpenAIServer(t, &args)
+	t.Cleanup(openai.Close)
+	oai := NewOpenAIHandler(testSecretProvider{OPEN_AI_TOKEN: "test"}).WithBaseUrl(openai.URL)
+	kbm := newTestKnowledgeBaseManager(t, *oai, map[string][]*Fact{
+		DEFAULT_KNOWLEDGE_BASE_NAME: {
+			{Name: "VULCANS", Question: "Who are the Vulcans?", Answers: []string{"a logical species"}},
+			{Name: "ROMULANS", Question: "Who are the Romulans?", Answers: []string{"distant cousins of the vulcans"}},
+		},
+	})
+	session := &UserSession{User: NewUser("1", "test", "test"), State: STATE_QA}
+	answers, err := NewEmbeddingAnswerProvider(kbm, *oai, nil, newTestAccessProvider(ROLE_READER), 0).GetAnswers(session, NewQuestion("Who are the Vulcans?"))
+	if err != nil || len(answers) != 1 || answers[0].FactName != "VULCANS" || len(answers[0].Choices) != 0 {
+		t.Fatalf("expected best answer without margin: %+v %v", answers, err)
+	}
+	answers, err = NewEmbeddingAnswerProvider(kbm, *oai, nil, newTestAccessProvider(ROLE_READER), 2).GetAnswers(session, NewQuestion("Who are the Vulcans?"))
+	if err != nil || len(answers) != 1 || len(answers[0].Choices) != 2 || answers[0].Choices[0] != "Who are the Vulcans?" {
+		t.Fatalf("expected choices within margin: %+v %v", answers, err)
+	}
+}
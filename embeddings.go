@@ -112,7 +112,7 @@ func (e *Embedding) UpdateEmbedding(openaiHandler OpenAIHandler) error {
 		return errors.New("no source to embed")
 	}
 	log.Info().Str("fact", e.FactName).Msg("updating embedding")
-	newEmbedding, err := openaiHandler.GptGetEmbedding(&Question{e.Source})
+	newEmbedding, err := openaiHandler.GptGetEmbedding(NewQuestion(e.Source))
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,305 @@
+/**
+ * Copyright 2024 Boris Wolf
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	EXTERNAL_PLUGIN_PROTOCOL_STDIO = "stdio"
+	EXTERNAL_PLUGIN_PROTOCOL_HTTP  = "http"
+	EXTERNAL_PLUGIN_HANDSHAKE      = "handshake"
+	EXTERNAL_PLUGIN_ANSWER         = "answer"
+	EXTERNAL_PLUGIN_TIMEOUT        = 30
+)
+
+type (
+	// ExternalPluginManifest describes how to reach an out-of-process plugin, one json file per plugin in the plugins dir.
+	ExternalPluginManifest struct {
+		Protocol string   `json:"protocol"` // stdio or http
+		Command  string   `json:"command"`  // executable for stdio plugins, relative to the plugins dir
+		Args     []string `json:"args"`
+		Url      string   `json:"url"` // base url for http plugins
+		Timeout  int      `json:"timeout"`
+	}
+	ExternalPluginRequest struct {
+		Type     string                 `json:"type"`
+		Question string                 `json:"question,omitempty"`
+		User     *User                  `json:"user,omitempty"`
+		Fact     *Fact                  `json:"fact,omitempty"`
+		Params   map[string]interface{} `json:"params,omitempty"`
+	}
+	ExternalPluginHandshake struct {
+		Name        string      `json:"name"`
+		Description string      `json:"description"`
+		Parameters  []Parameter `json:"parameters"`
+		Error       string      `json:"error"`
+	}
+	ExternalPluginAnswer struct {
+		Text      string `json:"text"`
+		Link      string `json:"link"`
+		ImageLink string `json:"imageLink"`
+	}
+	ExternalPluginResponse struct {
+		Answers []ExternalPluginAnswer `json:"answers"`
+		Error   string                 `json:"error"`
+	}
+	ExternalAnswerProvider struct {
+		sync.Mutex
+		dir       string
+		manifest  ExternalPluginManifest
+		handshake ExternalPluginHandshake
+		cmd       *exec.Cmd
+		stdin     io.WriteCloser
+		stdout    *bufio.Reader
+	}
+)
+
+// DiscoverPlugins registers an external plugin for every manifest found in the given directory,
+// plugins which cannot be launched are logged and skipped.
+func (pm *PluginManager) DiscoverPlugins(dir string) error {
+	files, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			log.Error().Err(err).Str("manifest", file.Name()).Msg("failed to read plugin manifest")
+			continue
+		}
+		var manifest ExternalPluginManifest
+		err = json.Unmarshal(data, &manifest)
+		if err != nil {
+			log.Error().Err(err).Str("manifest", file.Name()).Msg("invalid plugin manifest")
+			continue
+		}
+		eap, err := NewExternalAnswerProvider(dir, manifest)
+		if err != nil {
+			log.Error().Err(err).Str("manifest", file.Name()).Msg("failed to launch plugin")
+			continue
+		}
+		err = pm.RegisterPlugin(eap.GetName(), eap)
+		if err != nil {
+			eap.Close()
+			log.Error().Err(err).Str("manifest", file.Name()).Msg("failed to register plugin")
+			continue
+		}
+		log.Info().Str("plugin", eap.GetName()).Str("protocol", manifest.Protocol).Msg("registered external plugin")
+	}
+	return nil
+}
+
+// NewExternalAnswerProvider connects to an out-of-process plugin and performs the handshake.
+func NewExternalAnswerProvider(dir string, manifest ExternalPluginManifest) (*ExternalAnswerProvider, error) {
+	eap := &ExternalAnswerProvider{
+		dir:      dir,
+		manifest: manifest,
+	}
+	if manifest.Protocol != EXTERNAL_PLUGIN_PROTOCOL_STDIO && manifest.Protocol != EXTERNAL_PLUGIN_PROTOCOL_HTTP {
+		return nil, errors.New("unsupported plugin protocol " + manifest.Protocol)
+	}
+	var handshake ExternalPluginHandshake
+	err := eap.call(&ExternalPluginRequest{Type: EXTERNAL_PLUGIN_HANDSHAKE}, &handshake)
+	if err != nil {
+		eap.Close()
+		return nil, err
+	}
+	if handshake.Error != "" {
+		eap.Close()
+		return nil, errors.New(handshake.Error)
+	}
+	if handshake.Name == "" {
+		eap.Close()
+		return nil, errors.New("plugin handshake without name")
+	}
+	eap.handshake = handshake
+	return eap, nil
+}
+
+func (eap *ExternalAnswerProvider) GetName() string {
+	return eap.handshake.Name
+}
+
+func (eap *ExternalAnswerProvider) GetParams() []Parameter {
+	return eap.handshake.Parameters
+}
+
+func (eap *ExternalAnswerProvider) GetAnswers(session *UserSession, question *Question) ([]*Answer, error) {
+	return eap.GetPluginAnswers(session, question, nil, nil)
+}
+
+func (eap *ExternalAnswerProvider) GetPluginAnswers(session *UserSession, question *Question, fact *Fact, params map[string]interface{}) ([]*Answer, error) {
+	req := &ExternalPluginRequest{
+		Type:     EXTERNAL_PLUGIN_ANSWER,
+		Question: question.Text,
+		User:     session.User,
+		Fact:     fact,
+		Params:   params,
+	}
+	var resp ExternalPluginResponse
+	err := eap.call(req, &resp)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	answers := make([]*Answer, 0)
+	for _, a := range resp.Answers {
+		answers = append(answers, NewAnswer(a.Text).WithLink(a.Link).WithImageLink(a.ImageLink))
+	}
+	session.LastQuestion = question
+	session.LastAnswer = answers
+	return answers, nil
+}
+
+func (eap *ExternalAnswerProvider) Close() error {
+	eap.Lock()
+	defer eap.Unlock()
+	return eap.stop()
+}
+
+func (eap *ExternalAnswerProvider) timeout() time.Duration {
+	if eap.manifest.Timeout > 0 {
+		return time.Duration(eap.manifest.Timeout) * time.Second
+	}
+	return EXTERNAL_PLUGIN_TIMEOUT * time.Second
+}
+
+func (eap *ExternalAnswerProvider) call(req *ExternalPluginRequest, resp interface{}) error {
+	if eap.manifest.Protocol == EXTERNAL_PLUGIN_PROTOCOL_HTTP {
+		return eap.callHttp(req, resp)
+	}
+	return eap.callStdio(req, resp)
+}
+
+func (eap *ExternalAnswerProvider) callHttp(req *ExternalPluginRequest, resp interface{}) error {
+	buf, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	client := http.Client{Timeout: eap.timeout()}
+	httpResp, err := client.Post(strings.TrimSuffix(eap.manifest.Url, "/")+"/"+req.Type, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("plugin %s returned status %d", eap.manifest.Url, httpResp.StatusCode)
+	}
+	return json.NewDecoder(httpResp.Body).Decode(resp)
+}
+
+// callStdio exchanges one line of json with the plugin process, (re)starting it if needed.
+func (eap *ExternalAnswerProvider) callStdio(req *ExternalPluginRequest, resp interface{}) error {
+	eap.Lock()
+	defer eap.Unlock()
+	if eap.cmd == nil {
+		err := eap.start()
+		if err != nil {
+			return err
+		}
+	}
+	buf, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	_, err = eap.stdin.Write(append(buf, '\n'))
+	if err != nil {
+		eap.stop()
+		return err
+	}
+	lines := make(chan []byte, 1)
+	errs := make(chan error, 1)
+	go func(r *bufio.Reader) {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			errs <- err
+			return
+		}
+		lines <- line
+	}(eap.stdout)
+	select {
+	case line := <-lines:
+		return json.Unmarshal(line, resp)
+	case err = <-errs:
+		eap.stop()
+		return fmt.Errorf("plugin %s failed: %w", eap.manifest.Command, err)
+	case <-time.After(eap.timeout()):
+		eap.stop()
+		return fmt.Errorf("plugin %s timed out", eap.manifest.Command)
+	}
+}
+
+func (eap *ExternalAnswerProvider) start() error {
+	command := eap.manifest.Command
+	if !filepath.IsAbs(command) {
+		command = filepath.Join(eap.dir, command)
+	}
+	cmd := exec.Command(command, eap.manifest.Args...)
+	cmd.Dir = eap.dir
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	eap.cmd = cmd
+	eap.stdin = stdin
+	eap.stdout = bufio.NewReader(stdout)
+	return nil
+}
+
+func (eap *ExternalAnswerProvider) stop() error {
+	if eap.cmd == nil {
+		return nil
+	}
+	eap.stdin.Close()
+	err := eap.cmd.Process.Kill()
+	eap.cmd.Wait()
+	eap.cmd = nil
+	return err
+}
@@ -0,0 +1,283 @@
+/**
+ * Copyright 2024 Boris Wolf
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	FEEDBACK_UP           = "up"
+	FEEDBACK_DOWN         = "down"
+	FEEDBACK_FILE_CONFIG  = "feedbackfile"
+	DEFAULT_FEEDBACK_FILE = "feedback.jsonl"
+	DEFAULT_REPORT_LIMIT  = 10
+)
+
+type (
+	FeedbackEntry struct {
+		Time          time.Time `json:"time"`
+		User          string    `json:"user"` // login or id of the user giving the feedback
+		UserName      string    `json:"userName"`
+		Agent         string    `json:"agent"`
+		KnowledgeBase string    `json:"knowledgeBase"`
+		Question      string    `json:"question"`
+		FactName      string    `json:"factName,omitempty"` // fact the answer was taken from, if any
+		Score         float64   `json:"score"`
+		Rating        string    `json:"rating"` // up or down
+	}
+	FeedbackFilter struct {
+		KnowledgeBase string
+		FactName      string
+		Rating        string
+		Since         time.Time
+		Limit         int // max number of entries, most recent first
+	}
+	FactFeedback struct {
+		FactName string  `json:"factName"`
+		Up       int     `json:"up"`
+		Down     int     `json:"down"`
+		Ratio    float64 `json:"ratio"` // share of negative feedback
+	}
+	FeedbackReport struct {
+		KnowledgeBase string           `json:"knowledgeBase"`
+		Facts         []*FactFeedback  `json:"facts"`    // facts with the worst feedback ratio first
+		Negative      []*FeedbackEntry `json:"negative"` // most recent negative feedback first
+	}
+	JSONLFeedbackStore struct {
+		sync.Mutex
+		filePath string
+		file     *os.File
+	}
+)
+
+type FeedbackStore interface {
+	Record(entry *FeedbackEntry) error
+	Query(filter *FeedbackFilter) ([]*FeedbackEntry, error)
+	Report(baseName string, limit int) (*FeedbackReport, error)
+	Close() error
+}
+
+// ParseRating accepts thumbs and similar synonyms for up and down.
+func ParseRating(rating string) (string, error) {
+	switch rating {
+	case FEEDBACK_UP, "+1", "+", "thumbsup", "yes", "good", "\U0001F44D":
+		return FEEDBACK_UP, nil
+	case FEEDBACK_DOWN, "-1", "-", "thumbsdown", "no", "bad", "\U0001F44E":
+		return FEEDBACK_DOWN, nil
+	}
+	return "", errors.New("invalid rating " + rating + ", expected up or down")
+}
+
+// NewFeedbackEntry rates the answers of a question from the history of a session.
+func NewFeedbackEntry(user *User, history *HistoryEntry, rating string) *FeedbackEntry {
+	entry := FeedbackEntry{
+		Time:          time.Now(),
+		KnowledgeBase: history.KnowledgeBase,
+		Rating:        rating,
+	}
+	if history.Question != nil {
+		entry.Question = history.Question.Text
+	}
+	for _, a := range history.Answers {
+		if a.FactName != "" {
+			entry.FactName = a.FactName
+			entry.Score = a.Score
+			break
+		}
+	}
+	if user != nil {
+		entry.User = user.GetLogin()
+		entry.UserName = user.Name
+		entry.Agent = user.Agent
+	}
+	return &entry
+}
+
+func (e *FeedbackEntry) matches(filter *FeedbackFilter) bool {
+	if filter.KnowledgeBase != "" && e.KnowledgeBase != filter.KnowledgeBase {
+		return false
+	}
+	if filter.FactName != "" && e.FactName != filter.FactName {
+		return false
+	}
+	if filter.Rating != "" && e.Rating != filter.Rating {
+		return false
+	}
+	if !filter.Since.IsZero() && e.Time.Before(filter.Since) {
+		return false
+	}
+	return true
+}
+
+// RecordFeedback records an entry if there is a feedback store, failures are logged.
+func RecordFeedback(fs FeedbackStore, entry *FeedbackEntry) {
+	if fs == nil {
+		return
+	}
+	err := fs.Record(entry)
+	if err != nil {
+		log.Error().Err(err).Str("question", entry.Question).Msg("failed to record feedback")
+	}
+}
+
+// NewJSONLFeedbackStore appends feedback entries as json lines to the given file.
+func NewJSONLFeedbackStore(filePath string) (FeedbackStore, error) {
+	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	fs := JSONLFeedbackStore{
+		filePath: filePath,
+		file:     file,
+	}
+	return &fs, nil
+}
+
+func (fs *JSONLFeedbackStore) Record(entry *FeedbackEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	fs.Lock()
+	defer fs.Unlock()
+	if fs.file == nil {
+		return errors.New("feedback store closed")
+	}
+	_, err = fs.file.Write(append(data, '\n'))
+	return err
+}
+
+// scan calls fn for every entry matching the filter in the order they were recorded.
+func (fs *JSONLFeedbackStore) scan(filter *FeedbackFilter, fn func(entry *FeedbackEntry)) error {
+	fs.Lock()
+	defer fs.Unlock()
+	file, err := os.Open(fs.filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry FeedbackEntry
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			log.Warn().Err(err).Msg("skipping invalid feedback entry")
+			continue
+		}
+		if entry.matches(filter) {
+			fn(&entry)
+		}
+	}
+	return scanner.Err()
+}
+
+func (fs *JSONLFeedbackStore) Query(filter *FeedbackFilter) ([]*FeedbackEntry, error) {
+	if filter == nil {
+		filter = &FeedbackFilter{}
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = DEFAULT_REPORT_LIMIT
+	}
+	entries := make([]*FeedbackEntry, 0)
+	err := fs.scan(filter, func(entry *FeedbackEntry) {
+		entries = append(entries, entry)
+		// only the most recent entries are kept
+		if len(entries) > limit {
+			entries = entries[1:]
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
+
+// Report aggregates the feedback of a knowledge base by fact and lists the most recent questions
+// with negative feedback.
+func (fs *JSONLFeedbackStore) Report(baseName string, limit int) (*FeedbackReport, error) {
+	if limit <= 0 {
+		limit = DEFAULT_REPORT_LIMIT
+	}
+	facts := make(map[string]*FactFeedback)
+	err := fs.scan(&FeedbackFilter{KnowledgeBase: baseName}, func(entry *FeedbackEntry) {
+		if entry.FactName == "" {
+			return
+		}
+		ff, ok := facts[entry.FactName]
+		if !ok {
+			ff = &FactFeedback{FactName: entry.FactName}
+			facts[entry.FactName] = ff
+		}
+		if entry.Rating == FEEDBACK_DOWN {
+			ff.Down++
+		} else {
+			ff.Up++
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	report := FeedbackReport{
+		KnowledgeBase: baseName,
+		Facts:         make([]*FactFeedback, 0),
+	}
+	for _, ff := range facts {
+		ff.Ratio = float64(ff.Down) / float64(ff.Up+ff.Down)
+		report.Facts = append(report.Facts, ff)
+	}
+	sort.Slice(report.Facts, func(i, j int) bool {
+		if report.Facts[i].Ratio != report.Facts[j].Ratio {
+			return report.Facts[i].Ratio > report.Facts[j].Ratio
+		}
+		if report.Facts[i].Down != report.Facts[j].Down {
+			return report.Facts[i].Down > report.Facts[j].Down
+		}
+		return report.Facts[i].FactName < report.Facts[j].FactName
+	})
+	if len(report.Facts) > limit {
+		report.Facts = report.Facts[:limit]
+	}
+	report.Negative, err = fs.Query(&FeedbackFilter{KnowledgeBase: baseName, Rating: FEEDBACK_DOWN, Limit: limit})
+	if err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+func (fs *JSONLFeedbackStore) Close() error {
+	fs.Lock()
+	defer fs.Unlock()
+	if fs.file == nil {
+		return nil
+	}
+	err := fs.file.Close()
+	fs.file = nil
+	return err
+}
@@ -0,0 +1,96 @@
+/**
+ * Copyright 2024 Boris Wolf
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestFeedback(t *testing.T) {
+	wa, server := newTestWebAgent(t)
+	client := newTestLoginClient(t, server.URL, "admin", "secret")
+	resp, err := client.PostForm(server.URL+"/agentsmith/stream", url.Values{"question": {"How do I say hello?"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var done map[string]interface{}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if scanner.Text() == "event: "+WEB_EVENT_DONE && scanner.Scan() {
+			json.Unmarshal([]byte(strings.TrimPrefix(scanner.Text(), "data: ")), &done)
+		}
+	}
+	resp.Body.Close()
+	if done["history"] != float64(1) {
+		t.Fatalf("expected history id in done event: %v", done)
+	}
+	feedback := func(history, rating string) int {
+		req, _ := http.NewRequest("POST", server.URL+"/agentsmith/feedback", strings.NewReader(url.Values{"history": {history}, "rating": {rating}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := feedback("1", "down"); status != http.StatusNoContent {
+		t.Errorf("unexpected status of feedback: %d", status)
+	}
+	if status := feedback("2", "down"); status != http.StatusNotFound {
+		t.Errorf("expected unknown history to be rejected: %d", status)
+	}
+	if status := feedback("1", "meh"); status != http.StatusBadRequest {
+		t.Errorf("expected invalid rating to be rejected: %d", status)
+	}
+	ask := func(question string) *ApiAskResponse {
+		var resp ApiAskResponse
+		doTestRequest(t, "POST", server.URL+"/api/v1/ask", &ApiAskRequest{SessionId: "cli", Question: question}, http.StatusOK, &resp)
+		return &resp
+	}
+	ask("How do I say hello?")
+	resp2 := ask("rfeedback up")
+	if len(resp2.Answers) != 1 || !strings.Contains(resp2.Answers[0].Text, "How do I say hello?") {
+		t.Errorf("unexpected feedback answer: %+v", resp2.Answers)
+	}
+	// feedback commands are skipped when looking for the answer to rate
+	ask("rfeedback -1")
+	report, err := wa.feedback.Report("system", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Facts) != 1 || report.Facts[0].FactName != "GREETING" || report.Facts[0].Up != 1 || report.Facts[0].Down != 2 {
+		t.Fatalf("unexpected report: %+v", report.Facts)
+	}
+	if len(report.Negative) != 2 || report.Negative[0].Agent != AGENT_API || report.Negative[1].User != "admin" || report.Negative[1].Score <= 0 {
+		t.Errorf("unexpected negative feedback: %+v", report.Negative)
+	}
+	resp2 = ask("rfeedbackreport")
+	if len(resp2.Answers) != 1 || !strings.Contains(resp2.Answers[0].Text, "GREETING: 2 down, 1 up (67% negative)") {
+		t.Errorf("unexpected report answer: %+v", resp2.Answers)
+	}
+	page := doAdminRequest(t, client, "GET", server.URL+"/admin/kb/system/feedback", nil, http.StatusOK)
+	if !strings.Contains(page, "GREETING") || !strings.Contains(page, "67%") {
+		t.Errorf("expected feedback report page: %s", page)
+	}
+}
@@ -3,11 +3,14 @@ module github.com/boriwo/agentsmith
 go 1.23.2
 
 require (
-	github.com/gorilla/mux v1.8.1 // indirect
-	github.com/gorilla/websocket v1.4.2 // indirect
+	github.com/gorilla/mux v1.8.1
+	github.com/gorilla/websocket v1.4.2
+	github.com/rs/zerolog v1.33.0
+	github.com/slack-go/slack v0.15.0
+	golang.org/x/sys v0.12.0
+)
+
+require (
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.19 // indirect
-	github.com/rs/zerolog v1.33.0 // indirect
-	github.com/slack-go/slack v0.15.0 // indirect
-	golang.org/x/sys v0.12.0 // indirect
 )
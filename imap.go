@@ -0,0 +1,189 @@
+/**
+ * Copyright 2024 Boris Wolf
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	IMAP_TIMEOUT = 1 * time.Minute
+	IMAP_INBOX   = "INBOX"
+)
+
+var imapLiteral = regexp.MustCompile(`\{(\d+)\}$`)
+
+type (
+	// ImapClient speaks just enough imap for polling a mailbox for unseen messages.
+	ImapClient struct {
+		conn net.Conn
+		r    *bufio.Reader
+		tag  int
+	}
+	imapResponse struct {
+		Line    string
+		Literal []byte
+	}
+)
+
+func DialImap(addr string, useTls bool) (*ImapClient, error) {
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: IMAP_TIMEOUT}
+	if useTls {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, nil)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(IMAP_TIMEOUT))
+	ic := ImapClient{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+	}
+	greeting, err := ic.readLine()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(greeting, "* OK") {
+		conn.Close()
+		return nil, errors.New("unexpected imap greeting: " + greeting)
+	}
+	return &ic, nil
+}
+
+func (ic *ImapClient) readLine() (string, error) {
+	line, err := ic.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// command sends a command and collects the untagged responses until the tagged completion.
+func (ic *ImapClient) command(format string, args ...interface{}) ([]*imapResponse, error) {
+	ic.tag++
+	tag := fmt.Sprintf("A%03d", ic.tag)
+	ic.conn.SetDeadline(time.Now().Add(IMAP_TIMEOUT))
+	_, err := fmt.Fprintf(ic.conn, "%s %s\r\n", tag, fmt.Sprintf(format, args...))
+	if err != nil {
+		return nil, err
+	}
+	responses := make([]*imapResponse, 0)
+	for {
+		line, err := ic.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(line, tag+" ") {
+			status := strings.TrimPrefix(line, tag+" ")
+			if !strings.HasPrefix(status, "OK") {
+				return nil, errors.New("imap command failed: " + status)
+			}
+			return responses, nil
+		}
+		resp := &imapResponse{Line: line}
+		// a literal is followed by the rest of the response on the next line
+		if m := imapLiteral.FindStringSubmatch(line); m != nil {
+			size, _ := strconv.Atoi(m[1])
+			resp.Literal = make([]byte, size)
+			_, err = io.ReadFull(ic.r, resp.Literal)
+			if err != nil {
+				return nil, err
+			}
+			rest, err := ic.readLine()
+			if err != nil {
+				return nil, err
+			}
+			resp.Line += rest
+		}
+		responses = append(responses, resp)
+	}
+}
+
+func (ic *ImapClient) quote(s string) string {
+	return `"` + strings.ReplaceAll(strings.ReplaceAll(s, `\`, `\\`), `"`, `\"`) + `"`
+}
+
+func (ic *ImapClient) Login(user, password string) error {
+	_, err := ic.command("LOGIN %s %s", ic.quote(user), ic.quote(password))
+	return err
+}
+
+func (ic *ImapClient) Select(mailbox string) error {
+	_, err := ic.command("SELECT %s", ic.quote(mailbox))
+	return err
+}
+
+// SearchUnseen returns the uids of all messages not yet seen.
+func (ic *ImapClient) SearchUnseen() ([]uint32, error) {
+	responses, err := ic.command("UID SEARCH UNSEEN")
+	if err != nil {
+		return nil, err
+	}
+	uids := make([]uint32, 0)
+	for _, resp := range responses {
+		if !strings.HasPrefix(resp.Line, "* SEARCH") {
+			continue
+		}
+		for _, field := range strings.Fields(strings.TrimPrefix(resp.Line, "* SEARCH")) {
+			uid, err := strconv.ParseUint(field, 10, 32)
+			if err != nil {
+				return nil, errors.New("invalid uid in search response: " + resp.Line)
+			}
+			uids = append(uids, uint32(uid))
+		}
+	}
+	return uids, nil
+}
+
+// Fetch returns the raw message without marking it as seen.
+func (ic *ImapClient) Fetch(uid uint32) ([]byte, error) {
+	responses, err := ic.command("UID FETCH %d BODY.PEEK[]", uid)
+	if err != nil {
+		return nil, err
+	}
+	for _, resp := range responses {
+		if strings.Contains(resp.Line, "FETCH") && resp.Literal != nil {
+			return resp.Literal, nil
+		}
+	}
+	return nil, fmt.Errorf("no message with uid %d", uid)
+}
+
+func (ic *ImapClient) MarkSeen(uid uint32) error {
+	_, err := ic.command(`UID STORE %d +FLAGS (\Seen)`, uid)
+	return err
+}
+
+func (ic *ImapClient) Logout() error {
+	_, err := ic.command("LOGOUT")
+	ic.conn.Close()
+	return err
+}
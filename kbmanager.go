@@ -18,18 +18,29 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 const (
+	EMBEDDING_STATUS_OK         = "ok"
+	EMBEDDING_STATUS_MISSING    = "missing"
+	EMBEDDING_STATUS_STALE      = "stale"
 	DEFAULT_KNOWLEDGE_BASE_NAME = "system"
 	DEFAULT_EMBEDDING_BASE_NAME = "system"
 	DEFAULT_KNOWLEDGE_BASE_PATH = "kb/facts"
 	DEFAULT_EMBEDDING_BASE_PATH = "kb/embeddings"
 )
 
+var (
+	ErrInvalidFact = errors.New("invalid fact")
+	ErrFactExists  = errors.New("already have fact")
+	ErrNoFact      = errors.New("no fact")
+)
+
 type (
 	KnowledeBaseManager struct {
 		currentBaseName string
@@ -80,6 +91,253 @@ func (kbm *KnowledeBaseManager) SetCurrentBaseName(name string) error {
 	return nil
 }
 
+func (kbm *KnowledeBaseManager) GetKnowledgeBase(name string) KnowledeBaseProvider {
+	return kbm.factsStores[name]
+}
+
+func (kbm *KnowledeBaseManager) GetEmbeddingsBase(name string) EmbeddingsBaseProvider {
+	return kbm.embeddingStores[name]
+}
+
+// GetSessionBaseName returns the knowledge base selected for the session, falling back to the current one.
+func (kbm *KnowledeBaseManager) GetSessionBaseName(session *UserSession) string {
+	if session != nil && session.BaseName != "" {
+		_, ok := kbm.factsStores[session.BaseName]
+		if ok {
+			return session.BaseName
+		}
+	}
+	return kbm.currentBaseName
+}
+
+func (kbm *KnowledeBaseManager) SetSessionBaseName(session *UserSession, name string) error {
+	_, ok := kbm.factsStores[name]
+	if !ok {
+		return errors.New("no knowledge base for " + name)
+	}
+	_, ok = kbm.embeddingStores[name]
+	if !ok {
+		return errors.New("no embeddings base for " + name)
+	}
+	session.BaseName = name
+	return nil
+}
+
+func (kbm *KnowledeBaseManager) GetSessionKnowledgeBase(session *UserSession) KnowledeBaseProvider {
+	return kbm.factsStores[kbm.GetSessionBaseName(session)]
+}
+
+func (kbm *KnowledeBaseManager) GetSessionEmbeddingsBase(session *UserSession) EmbeddingsBaseProvider {
+	return kbm.embeddingStores[kbm.GetSessionBaseName(session)]
+}
+
+// NormalizeFactName returns the name under which a fact is stored, fact names are upper case.
+func NormalizeFactName(name string) string {
+	return strings.ToUpper(strings.TrimSpace(name))
+}
+
+// ValidateFact checks that a fact has a name and a question and that its dialog is well formed.
+func ValidateFact(fact *Fact) error {
+	if fact == nil {
+		return fmt.Errorf("%w: empty fact", ErrInvalidFact)
+	}
+	if fact.Name == "" {
+		return fmt.Errorf("%w: fact needs name", ErrInvalidFact)
+	}
+	if fact.Question == "" {
+		return fmt.Errorf("%w: fact needs question", ErrInvalidFact)
+	}
+	if fact.Dialog != nil {
+		err := fact.Dialog.Validate()
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidFact, err)
+		}
+	}
+	return nil
+}
+
+// SaveFact adds a new fact to, or updates an existing fact of the named knowledge base on behalf of
+// the user and records the change in the audit log. The user needs the editor role, unless no access
+// provider is given as for the local cli. It returns the fact as it was before the change.
+func (kbm *KnowledeBaseManager) SaveFact(ap AccessProvider, audit AuditLog, user *User, baseName string, fact *Fact, isNew bool) (*Fact, error) {
+	command := AUDIT_UPDATE_FACT
+	if isNew {
+		command = AUDIT_ADD_FACT
+	}
+	if fact != nil {
+		fact.Name = NormalizeFactName(fact.Name)
+	}
+	var existing *Fact
+	var err error
+	if ap != nil {
+		err = CheckRole(ap, user, baseName, ROLE_EDITOR)
+	}
+	if err == nil {
+		err = ValidateFact(fact)
+	}
+	kb := kbm.GetKnowledgeBase(baseName)
+	if err == nil && kb == nil {
+		err = errors.New("no knowledge base for " + baseName)
+	}
+	if err == nil {
+		existing = kb.GetFact(fact.Name)
+		if isNew && existing != nil {
+			err = fmt.Errorf("%w with name %s", ErrFactExists, fact.Name)
+		} else if !isNew && existing == nil {
+			err = fmt.Errorf("%w with name %s", ErrNoFact, fact.Name)
+		} else if isNew {
+			if fact.CreatedBy == "" {
+				fact.CreatedBy = user.Name
+			}
+			if fact.CreatedAt == "" {
+				fact.CreatedAt = time.Now().Format(time.RFC3339)
+			}
+			err = kbm.AddFact(baseName, fact)
+		} else {
+			if fact.CreatedBy == "" {
+				fact.CreatedBy = existing.CreatedBy
+			}
+			if fact.CreatedAt == "" {
+				fact.CreatedAt = existing.CreatedAt
+			}
+			err = kbm.UpdateFact(baseName, fact)
+		}
+	}
+	entry := NewAuditEntry(user, baseName, command)
+	if fact != nil {
+		entry.WithFact(fact.Name, existing, fact)
+	}
+	RecordAudit(audit, entry.WithOutcome(err))
+	return existing, err
+}
+
+// AddFact adds a fact to the named knowledge base, updates its embeddings and saves it.
+func (kbm *KnowledeBaseManager) AddFact(baseName string, fact *Fact) error {
+	kb := kbm.GetKnowledgeBase(baseName)
+	if kb == nil {
+		return errors.New("no knowledge base for " + baseName)
+	}
+	err := kb.AddFact(fact)
+	if err != nil {
+		return err
+	}
+	return kbm.SyncBase(baseName)
+}
+
+// UpdateFact replaces an existing fact of the named knowledge base.
+func (kbm *KnowledeBaseManager) UpdateFact(baseName string, fact *Fact) error {
+	kb := kbm.GetKnowledgeBase(baseName)
+	if kb == nil {
+		return errors.New("no knowledge base for " + baseName)
+	}
+	if fact == nil {
+		return errors.New("empty fact")
+	}
+	if fact.Name == "" {
+		return errors.New("fact needs name")
+	}
+	existing := kb.GetFact(fact.Name)
+	if existing == nil {
+		return errors.New("no fact with name " + fact.Name)
+	}
+	err := kb.DeleteFact(fact.Name)
+	if err != nil {
+		return err
+	}
+	err = kb.AddFact(fact)
+	if err != nil {
+		// keep the existing fact if the new one cannot be added
+		kb.AddFact(existing)
+		return err
+	}
+	return kbm.SyncBase(baseName)
+}
+
+func (kbm *KnowledeBaseManager) DeleteFact(baseName, name string) error {
+	kb := kbm.GetKnowledgeBase(baseName)
+	if kb == nil {
+		return errors.New("no knowledge base for " + baseName)
+	}
+	if !kb.HasFact(name) {
+		return errors.New("no fact with name " + name)
+	}
+	err := kb.DeleteFact(name)
+	if err != nil {
+		return err
+	}
+	return kbm.SyncBase(baseName)
+}
+
+// CreateBase adds an empty knowledge base with its embeddings base and saves both.
+func (kbm *KnowledeBaseManager) CreateBase(baseName string) error {
+	if baseName == "" || strings.ContainsAny(baseName, "./\\") {
+		return errors.New("invalid knowledge base name " + baseName)
+	}
+	_, ok := kbm.factsStores[baseName]
+	if ok {
+		return errors.New("already have knowledge base " + baseName)
+	}
+	kb := NewFileKnowledgeBase(baseName)
+	err := kb.Save()
+	if err != nil {
+		return err
+	}
+	eb := NewFileEmbeddingBase(kbm.secretProvider, kbm.oai, baseName)
+	err = eb.Save()
+	if err != nil {
+		return err
+	}
+	kbm.factsStores[baseName] = kb
+	kbm.embeddingStores[baseName] = eb
+	return nil
+}
+
+// SyncBase brings the embeddings of the named knowledge base up to date and saves the facts.
+func (kbm *KnowledeBaseManager) SyncBase(baseName string) error {
+	kb := kbm.GetKnowledgeBase(baseName)
+	if kb == nil {
+		return errors.New("no knowledge base for " + baseName)
+	}
+	eb := kbm.GetEmbeddingsBase(baseName)
+	if eb == nil {
+		return errors.New("no embeddings base for " + baseName)
+	}
+	err := eb.SyncEmbeddings(kb)
+	if err != nil {
+		return err
+	}
+	return kb.Save()
+}
+
+// GetEmbeddingStatus tells whether the embedding of a fact is missing or out of date with its question.
+func (kbm *KnowledeBaseManager) GetEmbeddingStatus(baseName string, fact *Fact) string {
+	eb := kbm.GetEmbeddingsBase(baseName)
+	if eb == nil {
+		return EMBEDDING_STATUS_MISSING
+	}
+	emb := eb.GetEmbedding(fact.Name)
+	if emb == nil || len(emb.Embedding) == 0 {
+		return EMBEDDING_STATUS_MISSING
+	}
+	if emb.Source != fact.Question || len(emb.Embedding) != emb.NumDimensions {
+		return EMBEDDING_STATUS_STALE
+	}
+	return EMBEDDING_STATUS_OK
+}
+
+// RankQuestion ranks all facts of the named knowledge base by relevance for the given question.
+func (kbm *KnowledeBaseManager) RankQuestion(baseName string, question *Question) (*EmbeddingsRanking, error) {
+	eb := kbm.GetEmbeddingsBase(baseName)
+	if eb == nil {
+		return nil, errors.New("no embeddings base for " + baseName)
+	}
+	embedding, err := kbm.oai.GptGetEmbedding(question)
+	if err != nil {
+		return nil, err
+	}
+	return eb.RankEmbeddings(embedding)
+}
+
 func (kbm *KnowledeBaseManager) ListBaseNames() []string {
 	names := make([]string, 0)
 	for k, _ := range kbm.factsStores {
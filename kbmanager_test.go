@@ -0,0 +1,103 @@
+/**
+ * Copyright 2024 Boris Wolf
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpdateFact(t *testing.T) {
+	args := `{}`
+	openai := newTestOpenAIServer(t, &args)
+	defer openai.Close()
+	oai := NewOpenAIHandler(testSecretProvider{OPEN_AI_TOKEN: "test"}).WithBaseUrl(openai.URL)
+	kbm := newTestKnowledgeBaseManager(t, *oai, map[string][]*Fact{
+		"system": {{Name: "GREETING", Question: "How do I say hello?", Answers: []string{"just say hello"}}},
+	})
+	if err := kbm.UpdateFact("system", nil); err == nil {
+		t.Error("expected empty fact to be rejected")
+	}
+	if err := kbm.UpdateFact("system", &Fact{Name: "UNKNOWN", Question: "?"}); err == nil {
+		t.Error("expected unknown fact to be rejected")
+	}
+	if err := kbm.UpdateFact("unknown", &Fact{Name: "GREETING"}); err == nil {
+		t.Error("expected unknown knowledge base to be rejected")
+	}
+	err := kbm.UpdateFact("system", &Fact{Name: "GREETING", Question: "How do I say hello?", Answers: []string{"hi"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fact := kbm.GetKnowledgeBase("system").GetFact("GREETING")
+	if fact == nil || fact.Answers[0] != "hi" {
+		t.Errorf("expected updated fact: %+v", fact)
+	}
+}
+
+func TestSaveFact(t *testing.T) {
+	args := `{}`
+	openai := newTestOpenAIServer(t, &args)
+	defer openai.Close()
+	oai := NewOpenAIHandler(testSecretProvider{OPEN_AI_TOKEN: "test"}).WithBaseUrl(openai.URL)
+	kbm := newTestKnowledgeBaseManager(t, *oai, map[string][]*Fact{
+		"system": {{Name: "GREETING", Question: "How do I say hello?", Answers: []string{"just say hello"}, CreatedBy: "kirk", CreatedAt: "2024-01-01T00:00:00Z"}},
+	})
+	audit, err := NewJSONLAuditLog(filepath.Join(t.TempDir(), "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := NewUser("U1", "spock", "Spock").WithAgent(AGENT_SLACK)
+	_, err = kbm.SaveFact(newTestAccessProvider(ROLE_READER), audit, user, "system", &Fact{Name: "warp", Question: "What is warp?"}, true)
+	if !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("expected readers to be denied: %v", err)
+	}
+	ap := newTestAccessProvider(ROLE_EDITOR)
+	for _, fact := range []*Fact{nil, {Name: " "}, {Name: "warp"}} {
+		if _, err = kbm.SaveFact(ap, audit, user, "system", fact, true); !errors.Is(err, ErrInvalidFact) {
+			t.Errorf("expected invalid fact %+v to be rejected: %v", fact, err)
+		}
+	}
+	if _, err = kbm.SaveFact(ap, audit, user, "system", &Fact{Name: "greeting", Question: "Hello?"}, true); !errors.Is(err, ErrFactExists) {
+		t.Errorf("expected existing fact to be rejected: %v", err)
+	}
+	if _, err = kbm.SaveFact(ap, audit, user, "system", &Fact{Name: "unknown", Question: "?"}, false); !errors.Is(err, ErrNoFact) {
+		t.Errorf("expected unknown fact to be rejected: %v", err)
+	}
+	fact := &Fact{Name: " warp ", Question: "What is warp?", Answers: []string{"fast"}}
+	if _, err = kbm.SaveFact(ap, audit, user, "system", fact, true); err != nil {
+		t.Fatal(err)
+	}
+	if fact.Name != "WARP" || fact.CreatedBy != "spock" || fact.CreatedAt == "" || kbm.GetKnowledgeBase("system").GetFact("WARP") != fact {
+		t.Errorf("expected added fact with upper case name: %+v", fact)
+	}
+	existing, err := kbm.SaveFact(nil, audit, user, "system", &Fact{Name: "Greeting", Question: "How do I say hello?", Answers: []string{"hi"}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fact = kbm.GetKnowledgeBase("system").GetFact("GREETING")
+	if existing == nil || existing.Answers[0] != "just say hello" || fact.Answers[0] != "hi" || fact.CreatedBy != "kirk" || fact.CreatedAt != "2024-01-01T00:00:00Z" {
+		t.Errorf("expected updated fact to keep its creation: %+v", fact)
+	}
+	entries, err := audit.Query(&AuditFilter{KnowledgeBase: "system"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 8 || entries[0].Command != AUDIT_UPDATE_FACT || entries[0].Before == nil || entries[1].FactName != "WARP" || entries[7].Outcome != AUDIT_OUTCOME_DENIED {
+		t.Errorf("expected all changes and attempts to be audited: %+v", entries)
+	}
+}
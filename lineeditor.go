@@ -0,0 +1,304 @@
+/**
+ * Copyright 2024 Boris Wolf
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+)
+
+const (
+	CLI_MAX_HISTORY = 1000
+	KEY_CTRL_A      = 1
+	KEY_CTRL_B      = 2
+	KEY_CTRL_C      = 3
+	KEY_CTRL_D      = 4
+	KEY_CTRL_E      = 5
+	KEY_CTRL_F      = 6
+	KEY_CTRL_H      = 8
+	KEY_TAB         = 9
+	KEY_LF          = 10
+	KEY_CTRL_K      = 11
+	KEY_CTRL_L      = 12
+	KEY_CR          = 13
+	KEY_CTRL_N      = 14
+	KEY_CTRL_P      = 16
+	KEY_CTRL_U      = 21
+	KEY_CTRL_W      = 23
+	KEY_ESC         = 27
+	KEY_BACKSPACE   = 127
+)
+
+var ErrInterrupted = errors.New("interrupted")
+
+// Completer returns the candidates for the word in front of the cursor, given the line up to the cursor.
+type Completer func(line string) []string
+
+// LineEditor reads lines from a terminal in raw mode with cursor movement, history and tab completion.
+type LineEditor struct {
+	in          *bufio.Reader
+	out         io.Writer
+	history     []string
+	historyFile string
+	completer   Completer
+}
+
+func NewLineEditor(in io.Reader, out io.Writer, historyFile string, completer Completer) *LineEditor {
+	le := LineEditor{
+		in:          bufio.NewReader(in),
+		out:         out,
+		history:     make([]string, 0),
+		historyFile: historyFile,
+		completer:   completer,
+	}
+	le.loadHistory()
+	return &le
+}
+
+func (le *LineEditor) loadHistory() {
+	if le.historyFile == "" {
+		return
+	}
+	data, err := os.ReadFile(le.historyFile)
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			le.history = append(le.history, line)
+		}
+	}
+	if len(le.history) > CLI_MAX_HISTORY {
+		le.history = le.history[len(le.history)-CLI_MAX_HISTORY:]
+	}
+}
+
+// AddHistory remembers a line and saves the history, repeated lines are only kept once.
+func (le *LineEditor) AddHistory(line string) error {
+	if strings.TrimSpace(line) == "" || (len(le.history) > 0 && le.history[len(le.history)-1] == line) {
+		return nil
+	}
+	le.history = append(le.history, line)
+	if len(le.history) > CLI_MAX_HISTORY {
+		le.history = le.history[len(le.history)-CLI_MAX_HISTORY:]
+	}
+	if le.historyFile == "" {
+		return nil
+	}
+	return os.WriteFile(le.historyFile, []byte(strings.Join(le.history, "\n")+"\n"), 0600)
+}
+
+func (le *LineEditor) GetHistory() []string {
+	return le.history
+}
+
+// ReadLine reads a line, returning io.EOF for ctrl-d on an empty line and ErrInterrupted for ctrl-c.
+func (le *LineEditor) ReadLine(prompt string) (string, error) {
+	line := make([]rune, 0)
+	pos := 0
+	historyIdx := len(le.history)
+	draft := ""
+	refresh := func() {
+		fmt.Fprintf(le.out, "\r%s%s\x1b[K", prompt, string(line))
+		if pos < len(line) {
+			fmt.Fprintf(le.out, "\x1b[%dD", len(line)-pos)
+		}
+	}
+	recall := func(idx int) {
+		if idx < 0 || idx > len(le.history) {
+			return
+		}
+		if historyIdx == len(le.history) {
+			draft = string(line)
+		}
+		historyIdx = idx
+		if idx == len(le.history) {
+			line = []rune(draft)
+		} else {
+			line = []rune(le.history[idx])
+		}
+		pos = len(line)
+	}
+	refresh()
+	for {
+		r, _, err := le.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch r {
+		case KEY_CR, KEY_LF:
+			fmt.Fprint(le.out, "\n")
+			return string(line), nil
+		case KEY_CTRL_C:
+			fmt.Fprint(le.out, "^C\n")
+			return "", ErrInterrupted
+		case KEY_CTRL_D:
+			if len(line) == 0 {
+				fmt.Fprint(le.out, "\n")
+				return "", io.EOF
+			}
+			if pos < len(line) {
+				line = append(line[:pos], line[pos+1:]...)
+			}
+		case KEY_BACKSPACE, KEY_CTRL_H:
+			if pos > 0 {
+				line = append(line[:pos-1], line[pos:]...)
+				pos--
+			}
+		case KEY_CTRL_A:
+			pos = 0
+		case KEY_CTRL_E:
+			pos = len(line)
+		case KEY_CTRL_B:
+			if pos > 0 {
+				pos--
+			}
+		case KEY_CTRL_F:
+			if pos < len(line) {
+				pos++
+			}
+		case KEY_CTRL_K:
+			line = line[:pos]
+		case KEY_CTRL_U:
+			line = line[pos:]
+			pos = 0
+		case KEY_CTRL_W:
+			start := le.wordStart(line, pos)
+			line = append(line[:start], line[pos:]...)
+			pos = start
+		case KEY_CTRL_L:
+			fmt.Fprint(le.out, "\x1b[H\x1b[2J")
+		case KEY_CTRL_P:
+			recall(historyIdx - 1)
+		case KEY_CTRL_N:
+			recall(historyIdx + 1)
+		case KEY_TAB:
+			line, pos = le.complete(line, pos)
+		case KEY_ESC:
+			switch le.readEscape() {
+			case 'A':
+				recall(historyIdx - 1)
+			case 'B':
+				recall(historyIdx + 1)
+			case 'C':
+				if pos < len(line) {
+					pos++
+				}
+			case 'D':
+				if pos > 0 {
+					pos--
+				}
+			case 'H':
+				pos = 0
+			case 'F':
+				pos = len(line)
+			case '~':
+				if pos < len(line) {
+					line = append(line[:pos], line[pos+1:]...)
+				}
+			}
+		default:
+			if unicode.IsPrint(r) {
+				line = append(line[:pos], append([]rune{r}, line[pos:]...)...)
+				pos++
+			}
+		}
+		refresh()
+	}
+}
+
+// readEscape reads the rest of an escape sequence and returns the key, '~' stands for delete.
+func (le *LineEditor) readEscape() rune {
+	r, _, err := le.in.ReadRune()
+	if err != nil || (r != '[' && r != 'O') {
+		return 0
+	}
+	r, _, err = le.in.ReadRune()
+	if err != nil {
+		return 0
+	}
+	if r < '0' || r > '9' {
+		return r
+	}
+	// numbered keys like delete are terminated by a tilde
+	code := r
+	for r != '~' {
+		r, _, err = le.in.ReadRune()
+		if err != nil || !(r == '~' || (r >= '0' && r <= '9') || r == ';') {
+			return 0
+		}
+	}
+	switch code {
+	case '1', '7':
+		return 'H'
+	case '4', '8':
+		return 'F'
+	case '3':
+		return '~'
+	}
+	return 0
+}
+
+func (le *LineEditor) wordStart(line []rune, pos int) int {
+	start := pos
+	for start > 0 && line[start-1] == ' ' {
+		start--
+	}
+	for start > 0 && line[start-1] != ' ' {
+		start--
+	}
+	return start
+}
+
+// complete replaces the word in front of the cursor with the only candidate or the common prefix of all
+// candidates, listing them if there is nothing to add.
+func (le *LineEditor) complete(line []rune, pos int) ([]rune, int) {
+	if le.completer == nil {
+		return line, pos
+	}
+	start := pos
+	for start > 0 && line[start-1] != ' ' {
+		start--
+	}
+	word := string(line[start:pos])
+	candidates := le.completer(string(line[:pos]))
+	if len(candidates) == 0 {
+		return line, pos
+	}
+	completion := candidates[0]
+	if len(candidates) == 1 {
+		completion += " "
+	} else {
+		for _, c := range candidates[1:] {
+			for !strings.HasPrefix(c, completion) {
+				completion = completion[:len(completion)-1]
+			}
+		}
+	}
+	if len(completion) <= len(word) {
+		fmt.Fprintf(le.out, "\n%s\n", strings.Join(candidates, "  "))
+		return line, pos
+	}
+	rest := append([]rune(completion), line[pos:]...)
+	line = append(line[:start], rest...)
+	return line, start + len([]rune(completion))
+}
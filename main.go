@@ -17,17 +17,33 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"os"
+	"os/signal"
+	"strconv"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
+const SHUTDOWN_TIMEOUT = 10 * time.Second
+
 func main() {
 	var err error
 	log.Logger = zerolog.New(os.Stdout).With().Timestamp().Logger()
-	sessionMgr := NewSimpleSessionManager()
+	// print a password hash for the users file
+	if len(os.Args) == 3 && os.Args[1] == "hashpassword" {
+		fmt.Println(HashPassword(os.Args[2]))
+		return
+	}
+	// commands print their results to stdout, so logs go to stderr
+	if len(os.Args) > 1 {
+		log.Logger = log.Logger.Output(os.Stderr)
+	}
 	secretProvider, err := NewJSONSecretProvider("secrets.json")
 	if err != nil {
 		log.Error().Err(err).Msg("failed to create secret provider")
@@ -45,30 +61,140 @@ func main() {
 	} else {
 		zerolog.SetGlobalLevel(zerolog.InfoLevel)
 	}
-	openaiHandler := NewOpenAIHandler(secretProvider)
+	sessionTTL, err := time.ParseDuration(configProvider.GetConfig(SESSION_TTL_CONFIG))
 	if err != nil {
-		log.Error().Err(err).Msg("failed to synchronize embeddings base")
+		sessionTTL = DEFAULT_SESSION_TTL
 	}
+	maxSessions, err := strconv.Atoi(configProvider.GetConfig(MAX_SESSIONS_CONFIG))
+	if err != nil {
+		maxSessions = DEFAULT_MAX_SESSIONS
+	}
+	var sessionMgr SessionManager
+	if configProvider.GetConfig(SESSION_FILE_CONFIG) != "" {
+		flushInterval, err := time.ParseDuration(configProvider.GetConfig(SESSION_FLUSH_CONFIG))
+		if err != nil {
+			flushInterval = DEFAULT_SESSION_FLUSH_INTERVAL
+		}
+		sessionMgr, err = NewFileSessionManager(configProvider.GetConfig(SESSION_FILE_CONFIG), sessionTTL, maxSessions, flushInterval)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to restore sessions")
+			sessionMgr = NewSimpleSessionManager(sessionTTL, maxSessions)
+		}
+	} else {
+		sessionMgr = NewSimpleSessionManager(sessionTTL, maxSessions)
+	}
+	openaiHandler := NewOpenAIHandler(secretProvider)
 	kbMgr, err := NewKnowledgeBaseManager(secretProvider, *openaiHandler)
 	if err != nil {
 		log.Error().Err(err).Msg("failed to load knowledge base")
 	}
-	answerProvider := NewUberAnswerProvider(kbMgr, *openaiHandler)
+	usersFile := configProvider.GetConfig(USERS_FILE_CONFIG)
+	if usersFile == "" {
+		usersFile = DEFAULT_USERS_FILE
+	}
+	accessProvider, err := NewJSONAccessProvider(usersFile)
+	if err != nil {
+		log.Error().Err(err).Str("file", usersFile).Msg("failed to load users")
+	}
+	auditFile := configProvider.GetConfig(AUDIT_FILE_CONFIG)
+	if auditFile == "" {
+		auditFile = DEFAULT_AUDIT_FILE
+	}
+	auditLog, err := NewJSONLAuditLog(auditFile)
+	if err != nil {
+		log.Error().Err(err).Str("file", auditFile).Msg("failed to open audit log")
+	}
+	feedbackFile := configProvider.GetConfig(FEEDBACK_FILE_CONFIG)
+	if feedbackFile == "" {
+		feedbackFile = DEFAULT_FEEDBACK_FILE
+	}
+	feedbackStore, err := NewJSONLFeedbackStore(feedbackFile)
+	if err != nil {
+		log.Error().Err(err).Str("file", feedbackFile).Msg("failed to open feedback store")
+	}
+	missesFile := configProvider.GetConfig(MISSES_FILE_CONFIG)
+	if missesFile == "" {
+		missesFile = DEFAULT_MISSES_FILE
+	}
+	missQueue, err := NewJSONMissQueue(missesFile, *openaiHandler)
+	if err != nil {
+		log.Error().Err(err).Str("file", missesFile).Msg("failed to load unanswered questions")
+	}
+	answerProvider := NewUberAnswerProvider(kbMgr, *openaiHandler, configProvider, secretProvider, accessProvider, auditLog, feedbackStore, missQueue)
+	if len(os.Args) > 1 {
+		code := NewCliCommands(kbMgr, answerProvider, sessionMgr, auditLog).Run(os.Args[1:])
+		sessionMgr.Close()
+		if auditLog != nil {
+			auditLog.Close()
+		}
+		if missQueue != nil {
+			missQueue.Close()
+		}
+		os.Exit(code)
+	}
+	if uap, ok := answerProvider.(*UberAnswerProvider); ok {
+		uap.GetPluginManager().StartPlugins()
+	}
+	// agents are stopped on interrupt, the stores are closed once they have stopped
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 	var wg sync.WaitGroup
 	if configProvider.GetConfig("slackagent") == "yes" {
-		slackAgent := NewSlackAgent(secretProvider, answerProvider, sessionMgr)
+		slackAgent := NewSlackAgent(secretProvider, answerProvider, sessionMgr, feedbackStore)
 		wg.Add(1)
-		go slackAgent.LaunchAgent(wg)
+		go slackAgent.LaunchAgent(ctx, &wg)
 	}
 	if configProvider.GetConfig("webagent") == "yes" {
-		webAgent := NewWebAgent(configProvider, secretProvider, answerProvider, sessionMgr)
+		webAgent := NewWebAgent(configProvider, secretProvider, answerProvider, sessionMgr, kbMgr, accessProvider, auditLog, feedbackStore, missQueue)
+		wg.Add(1)
+		go webAgent.LaunchAgent(ctx, &wg)
+	}
+	if configProvider.GetConfig("matrixagent") == "yes" {
+		matrixAgent := NewMatrixAgent(secretProvider, answerProvider, sessionMgr, feedbackStore)
+		wg.Add(1)
+		go matrixAgent.LaunchAgent(ctx, &wg)
+	}
+	if configProvider.GetConfig("teamsagent") == "yes" {
+		teamsAgent := NewTeamsAgent(configProvider, secretProvider, answerProvider, sessionMgr, feedbackStore)
 		wg.Add(1)
-		go webAgent.LaunchAgent(wg)
+		go teamsAgent.LaunchAgent(ctx, &wg)
+	}
+	if configProvider.GetConfig("emailagent") == "yes" {
+		emailAgent := NewEmailAgent(configProvider, secretProvider, answerProvider, sessionMgr)
+		wg.Add(1)
+		go emailAgent.LaunchAgent(ctx, &wg)
 	}
 	if configProvider.GetConfig("cliagent") == "yes" {
-		cliAgent := NewCliAgent(secretProvider, answerProvider, sessionMgr)
+		cliAgent := NewCliAgent(configProvider, secretProvider, answerProvider, sessionMgr, kbMgr)
 		wg.Add(1)
-		go cliAgent.LaunchAgent(wg)
+		go cliAgent.LaunchAgent(ctx, &wg)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		log.Info().Msg("stopping agents")
+		select {
+		case <-stopped:
+		case <-time.After(SHUTDOWN_TIMEOUT):
+			log.Warn().Msg("agents did not stop in time")
+		}
+	}
+	err = sessionMgr.Close()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to close session manager")
+	}
+	if auditLog != nil {
+		auditLog.Close()
+	}
+	if feedbackStore != nil {
+		feedbackStore.Close()
+	}
+	if missQueue != nil {
+		missQueue.Close()
 	}
-	wg.Wait()
 }
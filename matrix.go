@@ -0,0 +1,451 @@
+/**
+ * Copyright 2024 Boris Wolf
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	MATRIX_HOMESERVER   = "matrixHomeserver"
+	MATRIX_ACCESS_TOKEN = "matrixAccessToken"
+	MATRIX_USER_ID      = "matrixUserId"
+)
+
+const (
+	MATRIX_API_PREFIX      = "/_matrix/client/v3"
+	MATRIX_SYNC_TIMEOUT    = 30 * time.Second
+	MATRIX_RETRY_INTERVAL  = 5 * time.Second
+	MATRIX_MAX_ANSWERED    = 1000
+	MATRIX_EVENT_MESSAGE   = "m.room.message"
+	MATRIX_EVENT_REACTION  = "m.reaction"
+	MATRIX_MSGTYPE_TEXT    = "m.text"
+	MATRIX_REL_THREAD      = "m.thread"
+	MATRIX_REL_ANNOTATION  = "m.annotation"
+	MATRIX_FORMAT_HTML     = "org.matrix.custom.html"
+	MATRIX_SESSION_PREFIX  = "matrix-"
+	MATRIX_DIRECT_MEMBERS  = 2
+	MATRIX_WARNING         = "\u26a0\ufe0f "
+	MATRIX_EMOJI_VARIATION = '\uFE0F'
+)
+
+type (
+	matrixSyncResponse struct {
+		NextBatch string `json:"next_batch"`
+		Rooms     struct {
+			Join   map[string]*matrixJoinedRoom `json:"join"`
+			Invite map[string]json.RawMessage   `json:"invite"`
+		} `json:"rooms"`
+	}
+	matrixJoinedRoom struct {
+		Summary struct {
+			JoinedMemberCount *int `json:"m.joined_member_count"`
+		} `json:"summary"`
+		Timeline struct {
+			Events []*matrixEvent `json:"events"`
+		} `json:"timeline"`
+	}
+	matrixEvent struct {
+		Type    string          `json:"type"`
+		Sender  string          `json:"sender"`
+		EventId string          `json:"event_id"`
+		Content json.RawMessage `json:"content"`
+	}
+	matrixContent struct {
+		MsgType       string          `json:"msgtype,omitempty"`
+		Body          string          `json:"body,omitempty"`
+		Format        string          `json:"format,omitempty"`
+		FormattedBody string          `json:"formatted_body,omitempty"`
+		Mentions      *matrixMentions `json:"m.mentions,omitempty"`
+		RelatesTo     *matrixRelation `json:"m.relates_to,omitempty"`
+	}
+	matrixMentions struct {
+		UserIds []string `json:"user_ids"`
+	}
+	matrixRelation struct {
+		RelType       string          `json:"rel_type,omitempty"`
+		EventId       string          `json:"event_id,omitempty"`
+		Key           string          `json:"key,omitempty"`
+		IsFallingBack bool            `json:"is_falling_back,omitempty"`
+		InReplyTo     *matrixEventRef `json:"m.in_reply_to,omitempty"`
+	}
+	matrixEventRef struct {
+		EventId string `json:"event_id"`
+	}
+	matrixError struct {
+		ErrCode string `json:"errcode"`
+		Error   string `json:"error"`
+	}
+)
+
+type MatrixAgent struct {
+	sync.Mutex
+	secretProvider SecretProvider
+	answerProvider AnswerProvider
+	sessionMgr     SessionManager
+	feedback       FeedbackStore
+	client         *http.Client
+	syncTimeout    time.Duration
+	since          string
+	txnId          int
+	members        map[string]int           // number of joined members by room
+	answered       map[string]*HistoryEntry // answered questions by room and event id of the answer messages
+	answeredOrder  []string
+}
+
+func NewMatrixAgent(secretProvider SecretProvider, answerProvider AnswerProvider, sessionManager SessionManager, feedback FeedbackStore) Agent {
+	ma := MatrixAgent{
+		secretProvider: secretProvider,
+		answerProvider: answerProvider,
+		sessionMgr:     sessionManager,
+		feedback:       feedback,
+		client:         &http.Client{Timeout: 2 * MATRIX_SYNC_TIMEOUT},
+		syncTimeout:    MATRIX_SYNC_TIMEOUT,
+		members:        make(map[string]int),
+		answered:       make(map[string]*HistoryEntry),
+		answeredOrder:  make([]string, 0),
+	}
+	return &ma
+}
+
+func (ma *MatrixAgent) LaunchAgent(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	err := ma.run(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("matrix agent failed")
+	}
+}
+
+// run syncs with the homeserver until the context is cancelled, messages sent before the agent started
+// are not answered.
+func (ma *MatrixAgent) run(ctx context.Context) error {
+	if ma.secretProvider.GetSecret(MATRIX_HOMESERVER) == "" {
+		return errors.New("missing secret matrixHomeserver")
+	}
+	if ma.secretProvider.GetSecret(MATRIX_ACCESS_TOKEN) == "" {
+		return errors.New("missing secret matrixAccessToken")
+	}
+	if ma.secretProvider.GetSecret(MATRIX_USER_ID) == "" {
+		return errors.New("missing secret matrixUserId")
+	}
+	log.Info().Str("user", ma.secretProvider.GetSecret(MATRIX_USER_ID)).Msg("launching matrix agent")
+	for {
+		resp, err := ma.sync(ctx)
+		if ctx.Err() != nil {
+			log.Info().Msg("stopping matrix agent")
+			return nil
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("failed to sync with matrix homeserver")
+			select {
+			case <-ctx.Done():
+				log.Info().Msg("stopping matrix agent")
+				return nil
+			case <-time.After(MATRIX_RETRY_INTERVAL):
+			}
+			continue
+		}
+		ma.handleSync(ctx, resp, ma.since == "")
+		ma.since = resp.NextBatch
+	}
+}
+
+func (ma *MatrixAgent) sync(ctx context.Context) (*matrixSyncResponse, error) {
+	query := url.Values{}
+	query.Set("timeout", strconv.FormatInt(ma.syncTimeout.Milliseconds(), 10))
+	if ma.since != "" {
+		query.Set("since", ma.since)
+	}
+	var resp matrixSyncResponse
+	err := ma.request(ctx, http.MethodGet, "/sync", query, nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// request calls the client server api and decodes the json result, errors of the homeserver are returned as errors.
+func (ma *MatrixAgent) request(ctx context.Context, method, path string, query url.Values, body, result interface{}) error {
+	u := strings.TrimSuffix(ma.secretProvider.GetSecret(MATRIX_HOMESERVER), "/") + MATRIX_API_PREFIX + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	var reqBody bytes.Buffer
+	if body != nil {
+		err := json.NewEncoder(&reqBody).Encode(body)
+		if err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, &reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+ma.secretProvider.GetSecret(MATRIX_ACCESS_TOKEN))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := ma.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var me matrixError
+		json.NewDecoder(resp.Body).Decode(&me)
+		return fmt.Errorf("matrix request %s %s failed with %d: %s %s", method, path, resp.StatusCode, me.ErrCode, me.Error)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// handleSync joins rooms the agent is invited to and handles new events of joined rooms, the timeline
+// of the initial sync only holds old events.
+func (ma *MatrixAgent) handleSync(ctx context.Context, resp *matrixSyncResponse, initial bool) {
+	for roomId := range resp.Rooms.Invite {
+		err := ma.request(ctx, http.MethodPost, "/rooms/"+url.PathEscape(roomId)+"/join", nil, struct{}{}, nil)
+		if err != nil {
+			log.Error().Err(err).Str("room", roomId).Msg("failed to join matrix room")
+			continue
+		}
+		log.Info().Str("room", roomId).Msg("joined matrix room")
+	}
+	for roomId, room := range resp.Rooms.Join {
+		if room.Summary.JoinedMemberCount != nil {
+			ma.members[roomId] = *room.Summary.JoinedMemberCount
+		}
+		if initial {
+			continue
+		}
+		for _, event := range room.Timeline.Events {
+			err := ma.handleEvent(ctx, roomId, event)
+			if err != nil {
+				log.Error().Err(err).Str("room", roomId).Str("event", event.EventId).Msg("failed to handle matrix event")
+			}
+		}
+	}
+}
+
+func (ma *MatrixAgent) handleEvent(ctx context.Context, roomId string, event *matrixEvent) error {
+	if event.Sender == ma.secretProvider.GetSecret(MATRIX_USER_ID) {
+		return nil
+	}
+	var content matrixContent
+	err := json.Unmarshal(event.Content, &content)
+	if err != nil {
+		return err
+	}
+	switch event.Type {
+	case MATRIX_EVENT_MESSAGE:
+		if content.MsgType != MATRIX_MSGTYPE_TEXT {
+			return nil
+		}
+		threadRoot := ""
+		if content.RelatesTo != nil && content.RelatesTo.RelType == MATRIX_REL_THREAD {
+			threadRoot = content.RelatesTo.EventId
+		}
+		// in group rooms the agent only answers mentions, always in the thread of the mention
+		if ma.members[roomId] != MATRIX_DIRECT_MEMBERS {
+			if !ma.isMentioned(&content) {
+				return nil
+			}
+			if threadRoot == "" {
+				threadRoot = event.EventId
+			}
+		}
+		return ma.handleQuestion(ctx, roomId, event, threadRoot, ma.stripMention(content.Body))
+	case MATRIX_EVENT_REACTION:
+		return ma.handleReaction(roomId, event, &content)
+	}
+	return nil
+}
+
+func (ma *MatrixAgent) isMentioned(content *matrixContent) bool {
+	userId := ma.secretProvider.GetSecret(MATRIX_USER_ID)
+	if content.Mentions != nil {
+		for _, id := range content.Mentions.UserIds {
+			if id == userId {
+				return true
+			}
+		}
+	}
+	return strings.Contains(content.Body, userId) || strings.HasPrefix(strings.ToLower(content.Body), strings.ToLower(ma.getLocalpart(userId))+":")
+}
+
+// getLocalpart returns the name of a user id like @agentsmith:example.org
+func (ma *MatrixAgent) getLocalpart(userId string) string {
+	return strings.Split(strings.TrimPrefix(userId, "@"), ":")[0]
+}
+
+// stripMention removes the mention of the agent, which clients put in front of the question.
+func (ma *MatrixAgent) stripMention(body string) string {
+	userId := ma.secretProvider.GetSecret(MATRIX_USER_ID)
+	body = strings.ReplaceAll(body, userId, "")
+	localpart := ma.getLocalpart(userId) + ":"
+	if strings.HasPrefix(strings.ToLower(body), strings.ToLower(localpart)) {
+		body = body[len(localpart):]
+	}
+	return strings.TrimLeft(strings.TrimSpace(body), ": ")
+}
+
+// getSessionId returns the id of the session of a user in a thread, or in a room outside of threads.
+func (ma *MatrixAgent) getSessionId(userId, roomId, threadRoot string) string {
+	id := MATRIX_SESSION_PREFIX + roomId + "-" + userId
+	if threadRoot != "" {
+		id += "-" + threadRoot
+	}
+	return id
+}
+
+func (ma *MatrixAgent) getUser(userId, sessionId string) *User {
+	user := NewUser(sessionId, ma.getLocalpart(userId), userId).WithAgent(AGENT_MATRIX)
+	// roles are granted to the matrix user rather than to the thread
+	user.Login = userId
+	return user
+}
+
+func (ma *MatrixAgent) handleQuestion(ctx context.Context, roomId string, event *matrixEvent, threadRoot, text string) error {
+	if text == "" {
+		return nil
+	}
+	session := ma.sessionMgr.GetSession(ma.getUser(event.Sender, ma.getSessionId(event.Sender, roomId, threadRoot)))
+	question := NewQuestion(text)
+	answers, err := ma.answerProvider.GetAnswers(session, question)
+	if err != nil {
+		_, err = ma.sendMessage(ctx, roomId, event.EventId, threadRoot, ma.errorContent(err))
+		return err
+	}
+	history := session.GetQuestionHistory(question)
+	for _, a := range answers {
+		eventId, err := ma.sendMessage(ctx, roomId, event.EventId, threadRoot, ma.answerContent(a))
+		if err != nil {
+			return err
+		}
+		if history != nil {
+			ma.rememberAnswer(roomId, eventId, history)
+		}
+	}
+	return nil
+}
+
+// sendMessage sends a message into the thread, if there is one, and returns its event id.
+func (ma *MatrixAgent) sendMessage(ctx context.Context, roomId, replyTo, threadRoot string, content *matrixContent) (string, error) {
+	if threadRoot != "" {
+		content.RelatesTo = &matrixRelation{RelType: MATRIX_REL_THREAD, EventId: threadRoot, IsFallingBack: true, InReplyTo: &matrixEventRef{replyTo}}
+	}
+	ma.Lock()
+	ma.txnId++
+	txnId := fmt.Sprintf("agentsmith-%d-%d", time.Now().UnixNano(), ma.txnId)
+	ma.Unlock()
+	var resp struct {
+		EventId string `json:"event_id"`
+	}
+	err := ma.request(ctx, http.MethodPut, "/rooms/"+url.PathEscape(roomId)+"/send/"+MATRIX_EVENT_MESSAGE+"/"+txnId, nil, content, &resp)
+	if err != nil {
+		return "", err
+	}
+	return resp.EventId, nil
+}
+
+// matrixHtml escapes text for the formatted body of a message, keeping its line breaks.
+func matrixHtml(text string) string {
+	return strings.ReplaceAll(html.EscapeString(text), "\n", "<br/>")
+}
+
+func (ma *MatrixAgent) answerContent(a *Answer) *matrixContent {
+	lines := make([]string, 0)
+	htmlLines := make([]string, 0)
+	if a.Text != "" {
+		lines = append(lines, a.Text)
+		htmlLines = append(htmlLines, matrixHtml(strings.TrimRight(a.Text, "\n")))
+	}
+	if len(a.Choices) > 0 {
+		items := make([]string, 0)
+		for _, c := range a.Choices {
+			lines = append(lines, "- "+c)
+			items = append(items, "<li>"+matrixHtml(c)+"</li>")
+		}
+		htmlLines = append(htmlLines, "<ul>"+strings.Join(items, "")+"</ul>")
+	}
+	for _, link := range []string{a.Link, a.ImageLink} {
+		if link != "" {
+			lines = append(lines, link)
+			htmlLines = append(htmlLines, `<a href="`+html.EscapeString(link)+`">`+html.EscapeString(link)+`</a>`)
+		}
+	}
+	return &matrixContent{
+		MsgType:       MATRIX_MSGTYPE_TEXT,
+		Body:          strings.Join(lines, "\n"),
+		Format:        MATRIX_FORMAT_HTML,
+		FormattedBody: strings.Join(htmlLines, "<br/>"),
+	}
+}
+
+func (ma *MatrixAgent) errorContent(err error) *matrixContent {
+	return &matrixContent{MsgType: MATRIX_MSGTYPE_TEXT, Body: MATRIX_WARNING + err.Error()}
+}
+
+// rememberAnswer keeps the question of an answer message for collecting feedback by reactions.
+func (ma *MatrixAgent) rememberAnswer(roomId, eventId string, history *HistoryEntry) {
+	ma.Lock()
+	defer ma.Unlock()
+	key := roomId + "-" + eventId
+	ma.answered[key] = history
+	ma.answeredOrder = append(ma.answeredOrder, key)
+	if len(ma.answeredOrder) > MATRIX_MAX_ANSWERED {
+		delete(ma.answered, ma.answeredOrder[0])
+		ma.answeredOrder = ma.answeredOrder[1:]
+	}
+}
+
+func (ma *MatrixAgent) handleReaction(roomId string, event *matrixEvent, content *matrixContent) error {
+	if content.RelatesTo == nil || content.RelatesTo.RelType != MATRIX_REL_ANNOTATION {
+		return nil
+	}
+	// emoji keys may carry a variation selector and a skin tone
+	key := strings.Map(func(r rune) rune {
+		if r == MATRIX_EMOJI_VARIATION || (r >= 0x1F3FB && r <= 0x1F3FF) {
+			return -1
+		}
+		return r
+	}, content.RelatesTo.Key)
+	rating, err := ParseRating(key)
+	if err != nil {
+		return nil
+	}
+	ma.Lock()
+	history := ma.answered[roomId+"-"+content.RelatesTo.EventId]
+	ma.Unlock()
+	if history == nil {
+		return nil
+	}
+	RecordFeedback(ma.feedback, NewFeedbackEntry(ma.getUser(event.Sender, ma.getSessionId(event.Sender, roomId, "")), history, rating))
+	return nil
+}
@@ -0,0 +1,229 @@
+/**
+ * Copyright 2024 Boris Wolf
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type (
+	mockMatrixMessage struct {
+		RoomId  string
+		EventId string
+		Content matrixContent
+	}
+	// mockHomeserver serves queued sync responses and records joined rooms and sent messages.
+	mockHomeserver struct {
+		*httptest.Server
+		sync.Mutex
+		syncs  chan string
+		sinces []string
+		joined []string
+		sent   []*mockMatrixMessage
+	}
+)
+
+func newMockHomeserver(t *testing.T, token string) *mockHomeserver {
+	ms := &mockHomeserver{syncs: make(chan string, 10)}
+	mux := http.NewServeMux()
+	authorized := func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"errcode":"M_UNKNOWN_TOKEN","error":"invalid access token"}`)
+			return false
+		}
+		return true
+	}
+	mux.HandleFunc("GET /_matrix/client/v3/sync", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(w, r) {
+			return
+		}
+		since := r.URL.Query().Get("since")
+		ms.Lock()
+		ms.sinces = append(ms.sinces, since)
+		ms.Unlock()
+		timeout, _ := strconv.Atoi(r.URL.Query().Get("timeout"))
+		select {
+		case resp := <-ms.syncs:
+			fmt.Fprint(w, resp)
+		case <-time.After(time.Duration(timeout) * time.Millisecond):
+			fmt.Fprintf(w, `{"next_batch":%q}`, since)
+		case <-r.Context().Done():
+		}
+	})
+	mux.HandleFunc("POST /_matrix/client/v3/rooms/{room}/join", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(w, r) {
+			return
+		}
+		ms.Lock()
+		ms.joined = append(ms.joined, r.PathValue("room"))
+		ms.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"room_id": r.PathValue("room")})
+	})
+	mux.HandleFunc("PUT /_matrix/client/v3/rooms/{room}/send/m.room.message/{txn}", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(w, r) {
+			return
+		}
+		msg := &mockMatrixMessage{RoomId: r.PathValue("room")}
+		json.NewDecoder(r.Body).Decode(&msg.Content)
+		ms.Lock()
+		ms.sent = append(ms.sent, msg)
+		msg.EventId = fmt.Sprintf("$answer%d", len(ms.sent))
+		ms.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"event_id": msg.EventId})
+	})
+	ms.Server = httptest.NewServer(mux)
+	t.Cleanup(ms.Close)
+	return ms
+}
+
+// waitForMessages waits until n messages have been sent and returns them.
+func (ms *mockHomeserver) waitForMessages(t *testing.T, n int) []*mockMatrixMessage {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		ms.Lock()
+		sent := append([]*mockMatrixMessage{}, ms.sent...)
+		ms.Unlock()
+		if len(sent) >= n {
+			return sent
+		}
+	}
+	t.Fatalf("expected %d messages to be sent", n)
+	return nil
+}
+
+func matrixMessage(id, sender, body, extra string) string {
+	return fmt.Sprintf(`{"type":"m.room.message","event_id":%q,"sender":%q,"content":{"msgtype":"m.text","body":%q%s}}`, id, sender, body, extra)
+}
+
+func TestMatrixAgent(t *testing.T) {
+	ms := newMockHomeserver(t, "token")
+	feedback, err := NewJSONLFeedbackStore(filepath.Join(t.TempDir(), "feedback.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer feedback.Close()
+	secrets := testSecretProvider{MATRIX_HOMESERVER: ms.URL + "/", MATRIX_ACCESS_TOKEN: "token", MATRIX_USER_ID: "@smith:example.org"}
+	tap := new(testSlackAnswerProvider)
+	ma := NewMatrixAgent(secrets, tap, NewSimpleSessionManager(time.Minute, 10), feedback).(*MatrixAgent)
+	ma.syncTimeout = 20 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- ma.run(ctx)
+	}()
+	// old messages of the initial sync are not answered
+	ms.syncs <- `{"next_batch":"s1","rooms":{"join":{
+		"!dm:example.org":{"summary":{"m.joined_member_count":2},"timeline":{"events":[` + matrixMessage("$old", "@kirk:example.org", "old question", "") + `]}},
+		"!bridge:example.org":{"summary":{"m.joined_member_count":5},"timeline":{"events":[]}}}}}`
+	ms.syncs <- `{"next_batch":"s2","rooms":{"invite":{"!new:example.org":{}},"join":{
+		"!dm:example.org":{"timeline":{"events":[` + strings.Join([]string{
+		matrixMessage("$q1", "@kirk:example.org", "who is spock?", ""),
+		matrixMessage("$own", "@smith:example.org", "answering myself", ""),
+		matrixMessage("$notice", "@kirk:example.org", "a notice", `,"msgtype":"m.notice"`),
+	}, ",") + `]}},
+		"!bridge:example.org":{"timeline":{"events":[` + strings.Join([]string{
+		matrixMessage("$chatter", "@kirk:example.org", "no mention here", ""),
+		matrixMessage("$q2", "@kirk:example.org", "Smith: what is warp?", `,"m.mentions":{"user_ids":["@smith:example.org"]}`),
+		matrixMessage("$q3", "@scotty:example.org", "smith: fail", `,"m.relates_to":{"rel_type":"m.thread","event_id":"$root"}`),
+	}, ",") + `]}}}}}`
+	sent := ms.waitForMessages(t, 3)
+	var dm, group, failed *mockMatrixMessage
+	for _, msg := range sent {
+		if msg.RoomId == "!dm:example.org" {
+			dm = msg
+		} else if strings.Contains(msg.Content.Body, "unavailable") {
+			failed = msg
+		} else {
+			group = msg
+		}
+	}
+	if dm == nil || dm.Content.Body != "answer to who is spock?\nhttps://example.com\nhttps://example.com/img.png" || dm.Content.RelatesTo != nil || !strings.Contains(dm.Content.FormattedBody, `<a href="https://example.com">`) {
+		t.Fatalf("expected direct message answer outside of threads: %+v", dm)
+	}
+	if group == nil || !strings.HasPrefix(group.Content.Body, "answer to what is warp?") || group.Content.RelatesTo == nil || group.Content.RelatesTo.RelType != MATRIX_REL_THREAD || group.Content.RelatesTo.EventId != "$q2" || group.Content.RelatesTo.InReplyTo.EventId != "$q2" {
+		t.Errorf("expected answer to mention in new thread: %+v", group)
+	}
+	if failed == nil || failed.Content.Body != MATRIX_WARNING+"knowledge base unavailable" || failed.Content.RelatesTo.EventId != "$root" {
+		t.Errorf("expected error in existing thread: %+v", failed)
+	}
+	ms.syncs <- `{"next_batch":"s3","rooms":{"join":{"!dm:example.org":{"timeline":{"events":[
+		{"type":"m.reaction","event_id":"$r1","sender":"@kirk:example.org","content":{"m.relates_to":{"rel_type":"m.annotation","event_id":"` + dm.EventId + `","key":"👍🏽"}}},
+		{"type":"m.reaction","event_id":"$r2","sender":"@kirk:example.org","content":{"m.relates_to":{"rel_type":"m.annotation","event_id":"$unknown","key":"👎"}}},
+		{"type":"m.reaction","event_id":"$r3","sender":"@kirk:example.org","content":{"m.relates_to":{"rel_type":"m.annotation","event_id":"` + dm.EventId + `","key":"🎉"}}}]}}}}}`
+	var entries []*FeedbackEntry
+	for deadline := time.Now().Add(5 * time.Second); len(entries) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		entries, _ = feedback.Query(nil)
+	}
+	// the agent syncs again after handling the reactions
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		ms.Lock()
+		synced := len(ms.sinces) >= 4
+		ms.Unlock()
+		if synced {
+			break
+		}
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected agent to stop cleanly: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not stop")
+	}
+	if len(entries) != 1 || entries[0].Rating != FEEDBACK_UP || entries[0].User != "@kirk:example.org" || entries[0].Question != "who is spock?" {
+		t.Errorf("unexpected feedback: %+v", entries)
+	}
+	ms.Lock()
+	if len(ms.sent) != 3 || len(ms.joined) != 1 || ms.joined[0] != "!new:example.org" {
+		t.Errorf("unexpected messages or joined rooms: %d %v", len(ms.sent), ms.joined)
+	}
+	if len(ms.sinces) < 4 || strings.Join(ms.sinces[:4], ",") != ",s1,s2,s3" {
+		t.Errorf("unexpected sync tokens: %v", ms.sinces)
+	}
+	ms.Unlock()
+	if len(tap.sessions) != 3 || tap.sessions[0].User.Agent != AGENT_MATRIX || tap.sessions[0].User.GetLogin() != "@kirk:example.org" || tap.sessions[0].User.Id == tap.sessions[1].User.Id {
+		t.Errorf("expected sessions per room and thread: %+v", tap.sessions)
+	}
+	ma.secretProvider = testSecretProvider{MATRIX_HOMESERVER: ms.URL, MATRIX_ACCESS_TOKEN: "wrong", MATRIX_USER_ID: "@smith:example.org"}
+	if _, err := ma.sync(context.Background()); err == nil || !strings.Contains(err.Error(), "M_UNKNOWN_TOKEN") {
+		t.Errorf("expected homeserver error: %v", err)
+	}
+}
+
+func TestMatrixAnswerContent(t *testing.T) {
+	ma := &MatrixAgent{}
+	content := ma.answerContent(&Answer{Text: "<b>warp</b> & more\nsecond line\n", Choices: []string{"a<b"}, Link: `https://example.com/?a="1"`})
+	expected := `&lt;b&gt;warp&lt;/b&gt; &amp; more<br/>second line<br/><ul><li>a&lt;b</li></ul><br/><a href="https://example.com/?a=&#34;1&#34;">https://example.com/?a=&#34;1&#34;</a>`
+	if content.FormattedBody != expected {
+		t.Errorf("unexpected formatted body: %s", content.FormattedBody)
+	}
+	if content.Body != "<b>warp</b> & more\nsecond line\n\n- a<b\nhttps://example.com/?a=\"1\"" {
+		t.Errorf("unexpected body: %q", content.Body)
+	}
+}
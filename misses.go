@@ -0,0 +1,401 @@
+/**
+ * Copyright 2024 Boris Wolf
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	MISS_UNANSWERED         = "unanswered"  // no fact matched the question
+	MISS_IMPLAUSIBLE        = "implausible" // the best matching fact was rejected by the plausibility check
+	MISSES_FILE_CONFIG      = "missesfile"
+	DEFAULT_MISSES_FILE     = "misses.json"
+	MISS_CLUSTER_SIMILARITY = 0.8
+	MAX_MISSES              = 1000                // least recently asked questions are dropped beyond this
+	MISS_MAX_AGE            = 90 * 24 * time.Hour // questions not asked for this long are dropped
+	MISSES_FLUSH_INTERVAL   = 10 * time.Second
+)
+
+type (
+	Miss struct {
+		Id            int       `json:"id"`
+		KnowledgeBase string    `json:"knowledgeBase"`
+		Question      string    `json:"question"`
+		Reason        string    `json:"reason"`
+		Count         int       `json:"count"` // how often the question was asked
+		FirstSeen     time.Time `json:"firstSeen"`
+		LastSeen      time.Time `json:"lastSeen"`
+		Embedding     []float64 `json:"embedding,omitempty"`
+	}
+	// MissCluster groups misses with similar questions, the most frequent one represents the cluster
+	// and the oldest one identifies it.
+	MissCluster struct {
+		Id            int       `json:"id"`
+		KnowledgeBase string    `json:"knowledgeBase"`
+		Question      string    `json:"question"`
+		Count         int       `json:"count"`
+		LastSeen      time.Time `json:"lastSeen"`
+		Misses        []*Miss   `json:"misses"`
+	}
+	// JSONMissQueue keeps misses in memory and writes them to a json file in the background.
+	JSONMissQueue struct {
+		sync.Mutex
+		filePath string
+		oai      OpenAIHandler
+		lastId   int
+		misses   []*Miss
+		dirty    bool
+		done     chan struct{}
+		flushed  chan struct{}
+	}
+)
+
+type MissQueue interface {
+	Record(baseName string, question *Question, reason string) error
+	ListClusters(baseName string) ([]*MissCluster, error)
+	GetCluster(baseName string, id int) (*MissCluster, error)
+	Remove(baseName string, ids []int) error
+	Close() error
+}
+
+// RecordMiss records an unanswered question if there is a miss queue, failures are logged.
+func RecordMiss(mq MissQueue, baseName string, question *Question, reason string) {
+	if mq == nil {
+		return
+	}
+	err := mq.Record(baseName, question, reason)
+	if err != nil {
+		log.Error().Err(err).Str("question", question.Text).Msg("failed to record miss")
+	}
+}
+
+// NewFactFromCluster drafts a fact answering the questions of a cluster.
+func NewFactFromCluster(cluster *MissCluster, name string, answers []string) *Fact {
+	fact := Fact{
+		Name:     strings.ToUpper(name),
+		Question: cluster.Question,
+		Labels:   []string{},
+		Answers:  answers,
+		Links:    []string{},
+	}
+	return &fact
+}
+
+// GetMissIds returns the ids of the misses of a cluster.
+func (c *MissCluster) GetMissIds() []int {
+	ids := make([]int, 0, len(c.Misses))
+	for _, m := range c.Misses {
+		ids = append(ids, m.Id)
+	}
+	return ids
+}
+
+// Select returns a copy of the cluster with only the misses of the given ids.
+func (c *MissCluster) Select(ids []int) *MissCluster {
+	keep := make(map[int]bool)
+	for _, id := range ids {
+		keep[id] = true
+	}
+	selected := &MissCluster{Id: c.Id, KnowledgeBase: c.KnowledgeBase}
+	for _, m := range c.Misses {
+		if !keep[m.Id] {
+			continue
+		}
+		if len(selected.Misses) == 0 {
+			selected.Question = m.Question
+		}
+		selected.Misses = append(selected.Misses, m)
+		selected.Count += m.Count
+		if m.LastSeen.After(selected.LastSeen) {
+			selected.LastSeen = m.LastSeen
+		}
+	}
+	return selected
+}
+
+// NewJSONMissQueue keeps misses in a json file, embeddings of the questions are used for clustering.
+func NewJSONMissQueue(filePath string, oai OpenAIHandler) (MissQueue, error) {
+	mq := JSONMissQueue{
+		filePath: filePath,
+		oai:      oai,
+		misses:   make([]*Miss, 0),
+		done:     make(chan struct{}),
+		flushed:  make(chan struct{}),
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &mq.misses)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, m := range mq.misses {
+		if m.Id > mq.lastId {
+			mq.lastId = m.Id
+		}
+	}
+	mq.prune(time.Now())
+	go mq.flusher()
+	return &mq, nil
+}
+
+func (mq *JSONMissQueue) save() error {
+	data, err := json.MarshalIndent(mq.misses, "", "\t")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(mq.filePath), 0755)
+	if err != nil {
+		return err
+	}
+	tmpFile := mq.filePath + ".tmp"
+	err = os.WriteFile(tmpFile, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, mq.filePath)
+}
+
+// Flush writes the misses to disk if they changed since the last flush.
+func (mq *JSONMissQueue) Flush() error {
+	mq.Lock()
+	defer mq.Unlock()
+	if !mq.dirty {
+		return nil
+	}
+	err := mq.save()
+	if err != nil {
+		return err
+	}
+	mq.dirty = false
+	return nil
+}
+
+func (mq *JSONMissQueue) flusher() {
+	defer close(mq.flushed)
+	ticker := time.NewTicker(MISSES_FLUSH_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-mq.done:
+			return
+		case <-ticker.C:
+			err := mq.Flush()
+			if err != nil {
+				log.Error().Err(err).Str("file", mq.filePath).Msg("failed to persist unanswered questions")
+			}
+		}
+	}
+}
+
+// Close stops the background flusher and writes the final state of the misses.
+func (mq *JSONMissQueue) Close() error {
+	close(mq.done)
+	<-mq.flushed
+	return mq.Flush()
+}
+
+// Record counts repeated questions, new questions are embedded for clustering unless the question
+// already carries its embedding. Misses are written to disk in the background.
+func (mq *JSONMissQueue) Record(baseName string, question *Question, reason string) error {
+	text := strings.TrimSpace(question.Text)
+	if text == "" {
+		return nil
+	}
+	if mq.count(baseName, text, reason) {
+		return nil
+	}
+	embedding := question.Embedding
+	if embedding == nil {
+		var err error
+		embedding, err = mq.oai.GptGetEmbedding(NewQuestion(text))
+		if err != nil {
+			log.Warn().Err(err).Str("question", text).Msg("failed to embed miss, it will not be clustered")
+		}
+	}
+	mq.Lock()
+	defer mq.Unlock()
+	// the question may have been recorded while it was embedded
+	if mq.countLocked(baseName, text, reason) {
+		return nil
+	}
+	now := time.Now()
+	miss := Miss{
+		KnowledgeBase: baseName,
+		Question:      text,
+		Reason:        reason,
+		Count:         1,
+		FirstSeen:     now,
+		LastSeen:      now,
+	}
+	if embedding != nil {
+		miss.Embedding = embedding.Embedding
+	}
+	mq.lastId++
+	miss.Id = mq.lastId
+	mq.misses = append(mq.misses, &miss)
+	mq.prune(now)
+	mq.dirty = true
+	return nil
+}
+
+// count counts another occurrence of an already recorded question, returns false for new questions.
+func (mq *JSONMissQueue) count(baseName, text, reason string) bool {
+	mq.Lock()
+	defer mq.Unlock()
+	return mq.countLocked(baseName, text, reason)
+}
+
+func (mq *JSONMissQueue) countLocked(baseName, text, reason string) bool {
+	for _, m := range mq.misses {
+		if m.KnowledgeBase == baseName && strings.EqualFold(m.Question, text) {
+			m.Count++
+			m.LastSeen = time.Now()
+			m.Reason = reason
+			mq.dirty = true
+			return true
+		}
+	}
+	return false
+}
+
+// prune drops questions which have not been asked for a long time and the least recently asked
+// questions beyond the maximum number of misses.
+func (mq *JSONMissQueue) prune(now time.Time) {
+	misses := make([]*Miss, 0, len(mq.misses))
+	for _, m := range mq.misses {
+		if now.Sub(m.LastSeen) <= MISS_MAX_AGE {
+			misses = append(misses, m)
+		}
+	}
+	if len(misses) > MAX_MISSES {
+		sort.SliceStable(misses, func(i, j int) bool {
+			return misses[i].LastSeen.After(misses[j].LastSeen)
+		})
+		misses = misses[:MAX_MISSES]
+		sort.SliceStable(misses, func(i, j int) bool {
+			return misses[i].Id < misses[j].Id
+		})
+	}
+	if len(misses) != len(mq.misses) {
+		mq.misses = misses
+		mq.dirty = true
+	}
+}
+
+func (mq *JSONMissQueue) similarity(m1, m2 *Miss) float64 {
+	e1 := &Embedding{Embedding: m1.Embedding}
+	e2 := &Embedding{Embedding: m2.Embedding}
+	p, err := e1.DotProd(e2)
+	if err != nil {
+		return 0
+	}
+	return p
+}
+
+// ListClusters greedily clusters the misses of a knowledge base, most frequent first.
+func (mq *JSONMissQueue) ListClusters(baseName string) ([]*MissCluster, error) {
+	mq.Lock()
+	defer mq.Unlock()
+	misses := make([]*Miss, 0)
+	for _, m := range mq.misses {
+		if m.KnowledgeBase == baseName {
+			mc := *m
+			misses = append(misses, &mc)
+		}
+	}
+	sort.SliceStable(misses, func(i, j int) bool {
+		if misses[i].Count != misses[j].Count {
+			return misses[i].Count > misses[j].Count
+		}
+		return misses[i].LastSeen.After(misses[j].LastSeen)
+	})
+	clusters := make([]*MissCluster, 0)
+	for _, m := range misses {
+		var cluster *MissCluster
+		for _, c := range clusters {
+			if mq.similarity(c.Misses[0], m) >= MISS_CLUSTER_SIMILARITY {
+				cluster = c
+				break
+			}
+		}
+		if cluster == nil {
+			cluster = &MissCluster{Id: m.Id, KnowledgeBase: baseName, Question: m.Question}
+			clusters = append(clusters, cluster)
+		}
+		// the oldest question identifies the cluster, it does not change when others are asked more often
+		cluster.Id = min(cluster.Id, m.Id)
+		cluster.Misses = append(cluster.Misses, m)
+		cluster.Count += m.Count
+		if m.LastSeen.After(cluster.LastSeen) {
+			cluster.LastSeen = m.LastSeen
+		}
+	}
+	sort.SliceStable(clusters, func(i, j int) bool {
+		return clusters[i].Count > clusters[j].Count
+	})
+	return clusters, nil
+}
+
+func (mq *JSONMissQueue) GetCluster(baseName string, id int) (*MissCluster, error) {
+	clusters, err := mq.ListClusters(baseName)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range clusters {
+		if c.Id == id {
+			return c, nil
+		}
+	}
+	return nil, errors.New("no cluster of unanswered questions by that id")
+}
+
+func (mq *JSONMissQueue) Remove(baseName string, ids []int) error {
+	remove := make(map[int]bool)
+	for _, id := range ids {
+		remove[id] = true
+	}
+	mq.Lock()
+	defer mq.Unlock()
+	misses := make([]*Miss, 0, len(mq.misses))
+	for _, m := range mq.misses {
+		if m.KnowledgeBase != baseName || !remove[m.Id] {
+			misses = append(misses, m)
+		}
+	}
+	mq.misses = misses
+	mq.dirty = true
+	err := mq.save()
+	if err != nil {
+		return err
+	}
+	mq.dirty = false
+	return nil
+}
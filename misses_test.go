@@ -0,0 +1,203 @@
+/**
+ * Copyright 2024 Boris Wolf
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMissQueue(t *testing.T) {
+	args := `{}`
+	openai := newTestOpenAIServer(t, &args)
+	t.Cleanup(openai.Close)
+	secretProvider := testSecretProvider{OPEN_AI_TOKEN: "test"}
+	oai := NewOpenAIHandler(secretProvider).WithBaseUrl(openai.URL)
+	kbm := newTestKnowledgeBaseManager(t, *oai, map[string][]*Fact{DEFAULT_KNOWLEDGE_BASE_NAME: {}})
+	misses, err := NewJSONMissQueue(filepath.Join(t.TempDir(), "misses.json"), *oai)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { misses.Close() })
+	uap := NewUberAnswerProvider(kbm, *oai, testConfigProvider{"pluginsdir": t.TempDir()}, secretProvider, newTestAccessProvider(ROLE_EDITOR), nil, nil, misses)
+	session := &UserSession{User: NewUser("1", "test", "test"), State: STATE_QA}
+	ask := func(question string) string {
+		answers, err := uap.GetAnswers(session, NewQuestion(question))
+		if err != nil {
+			return err.Error()
+		}
+		text := ""
+		for _, a := range answers {
+			text += a.Text
+		}
+		return text
+	}
+	for _, q := range []string{"How do I reset my password?", "how do I reset my password?", "How do I reset the password", "What is warp speed?"} {
+		if answer := ask(q); answer != ErrNoMatchingFact.Error() {
+			t.Fatalf("expected no matching fact for %s: %s", q, answer)
+		}
+	}
+	clusters, err := misses.ListClusters(DEFAULT_KNOWLEDGE_BASE_NAME)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clusters) != 2 || clusters[0].Count != 3 || len(clusters[0].Misses) != 2 || clusters[0].Question != "How do I reset my password?" || clusters[0].Misses[0].Reason != MISS_UNANSWERED {
+		t.Fatalf("unexpected clusters: %+v", clusters)
+	}
+	answer := ask("rmisses")
+	if !strings.Contains(answer, "(3x) How do I reset my password?\n\t(1x) How do I reset the password") || !strings.Contains(answer, "(1x) What is warp speed?") {
+		t.Errorf("unexpected list of misses: %s", answer)
+	}
+	answer = ask("rresolvemiss #1 password use the reset link")
+	fact := kbm.GetKnowledgeBase(DEFAULT_KNOWLEDGE_BASE_NAME).GetFact("PASSWORD")
+	if fact == nil || fact.Question != "How do I reset my password?" || fact.Answers[0] != "use the reset link" || !strings.Contains(answer, "2 unanswered questions") {
+		t.Fatalf("expected fact to be created from cluster: %+v %s", fact, answer)
+	}
+	if answer = ask("How do I reset my password?"); answer != "use the reset link" {
+		t.Errorf("expected new fact to answer: %s", answer)
+	}
+	answer = ask("rmisses")
+	if strings.Contains(answer, "password") || !strings.Contains(answer, "What is warp speed?") {
+		t.Errorf("expected resolved misses to be removed: %s", answer)
+	}
+	ask("rdismissmiss " + strings.Fields(strings.TrimPrefix(answer, "#"))[0])
+	if answer = ask("rmisses"); !strings.Contains(answer, "no unanswered questions") {
+		t.Errorf("expected misses to be dismissed: %s", answer)
+	}
+}
+
+func TestMissSmallTalk(t *testing.T) {
+	oai := NewOpenAIHandler(testSecretProvider{})
+	misses, err := NewJSONMissQueue(filepath.Join(t.TempDir(), "misses.json"), *oai)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { misses.Close() })
+	kbm := newTestKnowledgeBaseManager(t, *oai, map[string][]*Fact{})
+	uap := NewUberAnswerProvider(kbm, *oai, testConfigProvider{}, testSecretProvider{}, newTestAccessProvider(ROLE_EDITOR), nil, nil, misses).(*UberAnswerProvider)
+	// only the last provider of the chain, which answers anything
+	uap.answerChain = []AnswerProvider{NewSimpleAnswerProvider()}
+	session := &UserSession{User: NewUser("1", "test", "test"), State: STATE_QA}
+	for _, q := range []string{"hi there", "Hello!", "bye", "which port does this ship use?", "is there anything on the hull?"} {
+		_, err = uap.GetAnswers(session, NewQuestion(q))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	clusters, _ := misses.ListClusters(DEFAULT_KNOWLEDGE_BASE_NAME)
+	if len(clusters) != 2 || clusters[0].Misses[0].Reason != MISS_UNANSWERED {
+		t.Errorf("expected questions but not small talk to be recorded: %+v", clusters)
+	}
+}
+
+func TestMissQueueRecord(t *testing.T) {
+	args := `{}`
+	openai := newTestOpenAIServer(t, &args)
+	t.Cleanup(openai.Close)
+	oai := NewOpenAIHandler(testSecretProvider{OPEN_AI_TOKEN: "test"}).WithBaseUrl(openai.URL)
+	file := filepath.Join(t.TempDir(), "misses.json")
+	old := []*Miss{{Id: 7, KnowledgeBase: "startrek", Question: "Who is Khan?", Count: 1, LastSeen: time.Now().Add(-MISS_MAX_AGE - time.Hour)}}
+	data, _ := json.Marshal(old)
+	os.WriteFile(file, data, 0600)
+	mq, err := NewJSONMissQueue(file, *oai)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mq.Record("startrek", NewQuestion("Who are the Klingons?"), MISS_UNANSWERED)
+		}()
+	}
+	wg.Wait()
+	// the embedding of the question is used as is, the handler without token would fail
+	question := NewQuestion("Who are the Romulans?")
+	question.Embedding = &Embedding{Embedding: []float64{1, 0}}
+	mq.(*JSONMissQueue).oai = *NewOpenAIHandler(testSecretProvider{})
+	mq.Record("startrek", question, MISS_IMPLAUSIBLE)
+	clusters, _ := mq.ListClusters("startrek")
+	if len(clusters) != 2 || clusters[0].Count != 10 || len(clusters[0].Misses) != 1 || len(clusters[1].Misses[0].Embedding) != 2 {
+		t.Fatalf("unexpected clusters: %+v", clusters)
+	}
+	if data, _ := os.ReadFile(file); !strings.Contains(string(data), "Khan") {
+		t.Errorf("expected misses not to be written on every record: %s", data)
+	}
+	for i := 0; i < MAX_MISSES; i++ {
+		mq.Record("startrek", question, MISS_IMPLAUSIBLE)
+		mq.Record("startrek", &Question{Text: fmt.Sprintf("question %d", i), Embedding: question.Embedding}, MISS_IMPLAUSIBLE)
+	}
+	err = mq.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mq, err = NewJSONMissQueue(file, *oai)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mq.Close()
+	misses := mq.(*JSONMissQueue).misses
+	if len(misses) != MAX_MISSES || misses[0].Question != "Who are the Romulans?" || misses[len(misses)-1].Question != fmt.Sprintf("question %d", MAX_MISSES-1) {
+		t.Errorf("expected least recently asked questions to be dropped: %d %s", len(misses), misses[0].Question)
+	}
+}
+
+func TestWebAdminMisses(t *testing.T) {
+	wa, server := newTestWebAgent(t)
+	wa.misses.Record("startrek", NewQuestion("Who are the Klingons?"), MISS_IMPLAUSIBLE)
+	wa.misses.Record("startrek", NewQuestion("Who are the Klingons?"), MISS_IMPLAUSIBLE)
+	client := newTestLoginClient(t, server.URL, "admin", "secret")
+	page := doAdminRequest(t, client, "GET", server.URL+"/admin/kb/startrek/misses", nil, http.StatusOK)
+	if !strings.Contains(page, "Who are the Klingons?") || !strings.Contains(page, "2x, implausible") || !strings.Contains(page, `name="miss" value="1"`) {
+		t.Fatalf("expected unanswered questions in page: %s", page)
+	}
+	// a similar question asked more often after the page was shown neither changes the cluster id nor is resolved
+	for i := 0; i < 3; i++ {
+		wa.misses.Record("startrek", NewQuestion("Who are the Klingons"), MISS_IMPLAUSIBLE)
+	}
+	clusters, _ := wa.misses.ListClusters("startrek")
+	if len(clusters) != 1 || clusters[0].Id != 1 || clusters[0].Question != "Who are the Klingons" || len(clusters[0].Misses) != 2 {
+		t.Fatalf("expected cluster to be identified by its oldest question: %+v", clusters)
+	}
+	doAdminRequest(t, client, "POST", server.URL+"/admin/kb/startrek/misses/1/resolve", url.Values{"name": {"klingons"}, "answers": {"a warrior species\n"}}, http.StatusConflict)
+	page = doAdminRequest(t, client, "POST", server.URL+"/admin/kb/startrek/misses/1/resolve", url.Values{"name": {"klingons"}, "answers": {"a warrior species\n"}, "miss": {"1"}}, http.StatusOK)
+	fact := wa.kbm.GetKnowledgeBase("startrek").GetFact("KLINGONS")
+	if fact == nil || fact.Question != "Who are the Klingons?" || len(fact.Answers) != 1 || fact.CreatedBy != "admin" {
+		t.Fatalf("expected fact to be created: %+v", fact)
+	}
+	if !strings.Contains(page, "a warrior species") {
+		t.Errorf("expected fact form after creating the fact: %s", page)
+	}
+	clusters, _ = wa.misses.ListClusters("startrek")
+	if len(clusters) != 1 || clusters[0].Id != 2 || len(clusters[0].Misses) != 1 {
+		t.Errorf("expected only the shown misses to be resolved: %+v", clusters)
+	}
+	doAdminRequest(t, client, "POST", server.URL+"/admin/kb/startrek/misses/1/dismiss", url.Values{"miss": {"1"}}, http.StatusNotFound)
+	doAdminRequest(t, client, "POST", server.URL+"/admin/kb/startrek/misses/2/dismiss", url.Values{"miss": {"2"}}, http.StatusOK)
+	if clusters, _ = wa.misses.ListClusters("startrek"); len(clusters) != 0 {
+		t.Errorf("expected misses to be dismissed: %+v", clusters)
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 
@@ -36,9 +37,11 @@ const (
 	GPT_TEMPERATURE                  = 0.5
 	GTP_ENCODING_FLOAT               = "float"
 	GPT_IMAGE_SIZE                   = "1024x1024"
-	OPEN_AI_COMPLETIONS_URL          = "https://api.openai.com/v1/chat/completions"
-	OPEN_AI_EMBEDDINGS_URL           = "https://api.openai.com/v1/embeddings"
-	OPEN_AI_IMAGES_URL               = "https://api.openai.com/v1/images/generations"
+	GPT_TOOL_TYPE_FUNCTION           = "function"
+	OPEN_AI_BASE_URL                 = "https://api.openai.com/v1"
+	OPEN_AI_COMPLETIONS_PATH         = "/chat/completions"
+	OPEN_AI_EMBEDDINGS_PATH          = "/embeddings"
+	OPEN_AI_IMAGES_PATH              = "/images/generations"
 	OPEN_AI_TOKEN                    = "openai"
 )
 
@@ -54,10 +57,39 @@ type GptMessage struct {
 	Content string `json:"content"`
 }
 
+type GptFunction struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	Parameters  map[string]interface{} `json:"parameters"`
+}
+
+type GptTool struct {
+	Type     string      `json:"type"`
+	Function GptFunction `json:"function"`
+}
+
+type GptToolChoice struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name string `json:"name"`
+	} `json:"function"`
+}
+
+type GptToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
 type GptCompletionsRequest struct {
-	Model       string       `json:"model"`
-	Messages    []GptMessage `json:"messages"`
-	Temperature float64      `json:"temperature"`
+	Model       string         `json:"model"`
+	Messages    []GptMessage   `json:"messages"`
+	Temperature float64        `json:"temperature"`
+	Tools       []GptTool      `json:"tools,omitempty"`
+	ToolChoice  *GptToolChoice `json:"tool_choice,omitempty"`
 }
 
 type GptCompletionsResponse struct {
@@ -77,8 +109,9 @@ type GptCompletionsResponse struct {
 	} `json:"usage"`
 	Choices []struct {
 		Message struct {
-			Role    string `json:"role"`
-			Content string `json:"content"`
+			Role      string        `json:"role"`
+			Content   string        `json:"content"`
+			ToolCalls []GptToolCall `json:"tool_calls"`
 		} `json:"message"`
 		Logprobs     interface{} `json:"logprobs"`
 		FinishReason string      `json:"finish_reason"`
@@ -125,14 +158,21 @@ type GptImageResponse struct {
 
 type OpenAIHandler struct {
 	secretProvider SecretProvider
+	baseUrl        string
 }
 
 func NewOpenAIHandler(secretProvider SecretProvider) *OpenAIHandler {
 	return &OpenAIHandler{
 		secretProvider: secretProvider,
+		baseUrl:        OPEN_AI_BASE_URL,
 	}
 }
 
+func (h *OpenAIHandler) WithBaseUrl(url string) *OpenAIHandler {
+	h.baseUrl = url
+	return h
+}
+
 func (h *OpenAIHandler) getHttp(url string, reqObj interface{}) ([]byte, error) {
 	if h.secretProvider.GetSecret(OPEN_AI_TOKEN) == "" {
 		log.Error().Msg("missing secret openai")
@@ -173,7 +213,7 @@ func (h *OpenAIHandler) GptGetCompletions(question *Question) ([]*Answer, error)
 			},
 		},
 	}
-	body, err := h.getHttp(OPEN_AI_COMPLETIONS_URL, reqObj)
+	body, err := h.getHttp(h.baseUrl+OPEN_AI_COMPLETIONS_PATH, reqObj)
 	if err != nil {
 		return nil, err
 	}
@@ -197,13 +237,66 @@ func (h *OpenAIHandler) GptGetCompletions(question *Question) ([]*Answer, error)
 	return answers, nil
 }
 
+// GptGetFunctionArguments forces a single call of the given function and returns its decoded arguments.
+func (h *OpenAIHandler) GptGetFunctionArguments(instructions string, question *Question, function GptFunction) (map[string]interface{}, error) {
+	reqObj := GptCompletionsRequest{
+		Model: GPT_CURRENT_MODEL,
+		Messages: []GptMessage{
+			{
+				Content: instructions,
+				Role:    GPT_ROLE_SYSTEM,
+			},
+			{
+				Content: question.Text,
+				Role:    GPT_ROLE_USER,
+			},
+		},
+		Tools: []GptTool{
+			{
+				Type:     GPT_TOOL_TYPE_FUNCTION,
+				Function: function,
+			},
+		},
+		ToolChoice: &GptToolChoice{
+			Type: GPT_TOOL_TYPE_FUNCTION,
+		},
+	}
+	reqObj.ToolChoice.Function.Name = function.Name
+	body, err := h.getHttp(h.baseUrl+OPEN_AI_COMPLETIONS_PATH, reqObj)
+	if err != nil {
+		return nil, err
+	}
+	var respObj GptCompletionsResponse
+	err = json.Unmarshal(body, &respObj)
+	if err != nil {
+		return nil, err
+	}
+	if respObj.Error != nil {
+		return nil, errors.New(respObj.Error.Message)
+	}
+	if len(respObj.Choices) == 0 || len(respObj.Choices[0].Message.ToolCalls) == 0 {
+		return nil, fmt.Errorf("model did not call function %s to extract the parameters", function.Name)
+	}
+	args := make(map[string]interface{})
+	for _, call := range respObj.Choices[0].Message.ToolCalls {
+		if call.Function.Name != function.Name || call.Function.Arguments == "" {
+			continue
+		}
+		err = json.Unmarshal([]byte(call.Function.Arguments), &args)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return args, nil
+}
+
 func (h *OpenAIHandler) GptGetEmbedding(question *Question) (*Embedding, error) {
 	reqObj := GptEmbeddingRequest{
 		Input:          question.Text,
 		Model:          GPT_MODEL_TEXT_EMBEDDING_ADA_002,
 		EncodingFormat: GTP_ENCODING_FLOAT,
 	}
-	body, err := h.getHttp(OPEN_AI_EMBEDDINGS_URL, reqObj)
+	body, err := h.getHttp(h.baseUrl+OPEN_AI_EMBEDDINGS_PATH, reqObj)
 	if err != nil {
 		return nil, err
 	}
@@ -229,7 +322,7 @@ func (h *OpenAIHandler) GptGetImage(question *Question) ([]*Answer, error) {
 		1,
 		GPT_IMAGE_SIZE,
 	}
-	body, err := h.getHttp(OPEN_AI_IMAGES_URL, reqObj)
+	body, err := h.getHttp(h.baseUrl+OPEN_AI_IMAGES_PATH, reqObj)
 	if err != nil {
 		return nil, err
 	}
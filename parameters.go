@@ -0,0 +1,156 @@
+/**
+ * Copyright 2024 Boris Wolf
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	PARAM_DATA_TYPE_STRING = "string"
+	PARAM_DATA_TYPE_INT    = "int"
+	PARAM_DATA_TYPE_FLOAT  = "float"
+	PARAM_DATA_TYPE_ENUM   = "enum"
+	PARAM_DATA_TYPE_DATE   = "date"
+	PARAM_DATE_FORMAT      = "2006-01-02"
+)
+
+func (p *Parameter) GetName(idx int) string {
+	if p.Name != "" {
+		return p.Name
+	}
+	return fmt.Sprintf("param%d", idx)
+}
+
+func (p *Parameter) GetDescription() string {
+	if p.Description != "" {
+		return p.Description
+	}
+	if p.ExtractionPrompt != "" {
+		return p.ExtractionPrompt
+	}
+	return p.Value
+}
+
+// Schema expresses the parameter as JSON schema property.
+func (p *Parameter) Schema() map[string]interface{} {
+	schema := map[string]interface{}{
+		"type":        "string",
+		"description": p.GetDescription(),
+	}
+	switch p.DataType {
+	case PARAM_DATA_TYPE_INT:
+		schema["type"] = "integer"
+	case PARAM_DATA_TYPE_FLOAT:
+		schema["type"] = "number"
+	case PARAM_DATA_TYPE_ENUM:
+		schema["enum"] = p.Enum
+	case PARAM_DATA_TYPE_DATE:
+		schema["format"] = "date"
+	}
+	if p.Pattern != "" {
+		schema["pattern"] = p.Pattern
+	}
+	return schema
+}
+
+// Validate checks a raw value against the data type and constraints of the parameter and
+// returns it converted to its type.
+func (p *Parameter) Validate(v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, errors.New("missing value")
+	}
+	s, isString := v.(string)
+	s = strings.TrimSpace(s)
+	if isString && s == "" {
+		return nil, errors.New("missing value")
+	}
+	var value interface{}
+	switch p.DataType {
+	case "", PARAM_DATA_TYPE_STRING:
+		if !isString {
+			return nil, fmt.Errorf("%v is not a text", v)
+		}
+		value = s
+	case PARAM_DATA_TYPE_INT:
+		f, ok := v.(float64)
+		if isString {
+			i, err := strconv.Atoi(s)
+			if err != nil {
+				return nil, fmt.Errorf("%s is not a whole number", s)
+			}
+			f, ok = float64(i), true
+		}
+		if !ok || f != math.Trunc(f) {
+			return nil, fmt.Errorf("%v is not a whole number", v)
+		}
+		value = int(f)
+	case PARAM_DATA_TYPE_FLOAT:
+		f, ok := v.(float64)
+		if isString {
+			var err error
+			f, err = strconv.ParseFloat(s, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s is not a number", s)
+			}
+			ok = true
+		}
+		if !ok {
+			return nil, fmt.Errorf("%v is not a number", v)
+		}
+		value = f
+	case PARAM_DATA_TYPE_ENUM:
+		if !isString {
+			return nil, fmt.Errorf("%v is not one of %s", v, strings.Join(p.Enum, ", "))
+		}
+		for _, e := range p.Enum {
+			if strings.EqualFold(e, s) {
+				value = e
+			}
+		}
+		if value == nil {
+			return nil, fmt.Errorf("%s is not one of %s", s, strings.Join(p.Enum, ", "))
+		}
+	case PARAM_DATA_TYPE_DATE:
+		if !isString {
+			return nil, fmt.Errorf("%v is not a date", v)
+		}
+		d, err := time.Parse(PARAM_DATE_FORMAT, s)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a date of the form YYYY-MM-DD", s)
+		}
+		value = d.Format(PARAM_DATE_FORMAT)
+	default:
+		return nil, errors.New("unsupported data type " + p.DataType)
+	}
+	if p.Pattern != "" {
+		re, err := regexp.Compile("^(?:" + p.Pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %s: %w", p.Pattern, err)
+		}
+		if !re.MatchString(fmt.Sprint(value)) {
+			return nil, fmt.Errorf("%v does not match %s", value, p.Pattern)
+		}
+	}
+	return value, nil
+}
@@ -18,32 +18,116 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
 )
 
 const (
 	COMMAND_PLUGIN      = "COMMAND_PLUGIN"
 	IMAGE_PLUGIN        = "IMAGE_PLUGIN"
+	WEBHOOK_PLUGIN      = "WEBHOOK_PLUGIN"
+	SCRIPT_PLUGIN       = "SCRIPT_PLUGIN"
 	PARAM_TYPE_CONSTANT = "constant"
 	PARAM_TYPE_PROMPT   = "prompt"
+	DEFAULT_PLUGINS_DIR = "plugins"
+	PARAM_INSTRUCTIONS  = "Extract the parameters of the function from the question of the user. Leave out any parameter which is not stated in the question, do not guess."
 )
 
 type PluginManager struct {
-	kbm     *KnowledeBaseManager
-	oai     OpenAIHandler
-	plugins map[string]AnswerProvider
+	sync.RWMutex
+	kbm      *KnowledeBaseManager
+	oai      OpenAIHandler
+	dir      string
+	plugins  map[string]AnswerProvider
+	builtins map[string]bool
 }
 
-func NewPluginManger(kbm *KnowledeBaseManager, oai OpenAIHandler) *PluginManager {
+func NewPluginManger(kbm *KnowledeBaseManager, oai OpenAIHandler, configProvider ConfigProvider, secretProvider SecretProvider, ap AccessProvider, audit AuditLog, feedback FeedbackStore, misses MissQueue) *PluginManager {
 	mgr := &PluginManager{
-		kbm,
-		oai,
-		make(map[string]AnswerProvider),
+		kbm:      kbm,
+		oai:      oai,
+		dir:      configProvider.GetConfig("pluginsdir"),
+		plugins:  make(map[string]AnswerProvider),
+		builtins: make(map[string]bool),
+	}
+	if mgr.dir == "" {
+		mgr.dir = DEFAULT_PLUGINS_DIR
 	}
-	mgr.plugins[COMMAND_PLUGIN] = NewCommandAnswerProvider(kbm)
+	mgr.plugins[COMMAND_PLUGIN] = NewCommandAnswerProvider(kbm, ap, audit, feedback, misses)
 	mgr.plugins[IMAGE_PLUGIN] = NewImageAnswerProvider(oai)
+	mgr.plugins[WEBHOOK_PLUGIN] = NewWebhookAnswerProvider(configProvider, secretProvider)
+	mgr.plugins[SCRIPT_PLUGIN] = NewScriptAnswerProvider(configProvider)
+	for name := range mgr.plugins {
+		mgr.builtins[name] = true
+	}
 	return mgr
 }
 
+// StartPlugins launches the external plugins of the configured plugins dir, only needed when running the agents.
+func (pm *PluginManager) StartPlugins() {
+	err := pm.DiscoverPlugins(pm.dir)
+	if err != nil {
+		log.Error().Err(err).Str("dir", pm.dir).Msg("failed to discover external plugins")
+	}
+}
+
+// RegisterPlugin makes an answer provider available to facts referring to it by name.
+func (pm *PluginManager) RegisterPlugin(name string, answerProvider AnswerProvider) error {
+	pm.Lock()
+	defer pm.Unlock()
+	if name == "" {
+		return errors.New("plugin needs name")
+	}
+	if answerProvider == nil {
+		return errors.New("missing answer provider for plugin " + name)
+	}
+	_, ok := pm.plugins[name]
+	if ok {
+		return errors.New("plugin already registered " + name)
+	}
+	pm.plugins[name] = answerProvider
+	return nil
+}
+
+func (pm *PluginManager) UnregisterPlugin(name string) error {
+	pm.Lock()
+	defer pm.Unlock()
+	answerProvider, ok := pm.plugins[name]
+	if !ok {
+		return errors.New("unknown plugin " + name)
+	}
+	if pm.builtins[name] {
+		return errors.New("cannot unregister built-in plugin " + name)
+	}
+	delete(pm.plugins, name)
+	if closer, ok := answerProvider.(interface{ Close() error }); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (pm *PluginManager) GetPlugin(name string) AnswerProvider {
+	pm.RLock()
+	defer pm.RUnlock()
+	return pm.plugins[name]
+}
+
+func (pm *PluginManager) ListPlugins() []string {
+	pm.RLock()
+	defer pm.RUnlock()
+	names := make([]string, 0)
+	for name := range pm.plugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func (pm *PluginManager) GetAnswers(session *UserSession, question *Question, fact *Fact) ([]*Answer, error) {
 	if question == nil || question.Text == "" {
 		return nil, errors.New("missing question")
@@ -51,35 +135,187 @@ func (pm *PluginManager) GetAnswers(session *UserSession, question *Question, fa
 	if fact == nil || fact.Plugin == "" {
 		return nil, errors.New("missing fact or blank plugin")
 	}
-	answerProvider, ok := pm.plugins[fact.Plugin]
-	if !ok {
+	answerProvider := pm.GetPlugin(fact.Plugin)
+	if answerProvider == nil {
 		return nil, errors.New("unknown plugin " + fact.Plugin)
 	}
-	// rewrite question
-	q := question.Text
-	if len(fact.Params) > 0 {
-		q = ""
-		for idx, param := range fact.Params {
-			if param.Type == PARAM_TYPE_CONSTANT {
-				q += param.Value
-				if idx < len(fact.Params)-1 {
-					q += " "
-				}
-			} else if param.Type == PARAM_TYPE_PROMPT {
-				answers, err := pm.oai.GptGetCompletions(&Question{param.Value + " " + question.Text})
-				if err != nil {
-					return nil, err
-				}
-				if len(answers) > 0 {
-					q += answers[0].Text
-					if idx < len(fact.Params)-1 {
-						q += " "
-					}
+	// plugins may declare their own parameters for facts which do not bring any
+	paramsProvider, ok := answerProvider.(PluginParamsProvider)
+	if ok && len(fact.Params) == 0 && len(paramsProvider.GetParams()) > 0 {
+		f := *fact
+		f.Params = paramsProvider.GetParams()
+		fact = &f
+	}
+	call := &PluginCall{
+		Fact:     fact,
+		Question: question,
+		Params:   make(map[string]interface{}),
+		Errors:   make(map[string]string),
+	}
+	err := pm.extractParams(call, question, pm.promptParams(fact, call.Params))
+	if err != nil {
+		return nil, err
+	}
+	return pm.callPlugin(session, call)
+}
+
+// ContinueAnswers completes a plugin call which was put on hold because of missing parameters.
+func (pm *PluginManager) ContinueAnswers(session *UserSession, question *Question) ([]*Answer, error) {
+	call := session.PluginCall
+	if call == nil {
+		session.State = STATE_QA
+		return nil, errors.New("no pending plugin call")
+	}
+	missing := pm.promptParams(call.Fact, call.Params)
+	err := pm.extractParams(call, question, missing)
+	if err != nil {
+		return nil, err
+	}
+	// a single missing parameter may simply be stated as is, unless any text would be a valid value
+	if len(missing) == 1 {
+		param := call.Fact.Params[missing[0]]
+		name := param.GetName(missing[0])
+		constrained := (param.DataType != "" && param.DataType != PARAM_DATA_TYPE_STRING) || param.Pattern != ""
+		if _, ok := call.Params[name]; !ok && constrained && strings.TrimSpace(question.Text) != "" {
+			pm.setParam(call, &param, name, question.Text)
+		}
+	}
+	return pm.callPlugin(session, call)
+}
+
+func (pm *PluginManager) callPlugin(session *UserSession, call *PluginCall) ([]*Answer, error) {
+	answerProvider := pm.GetPlugin(call.Fact.Plugin)
+	if answerProvider == nil {
+		return nil, errors.New("unknown plugin " + call.Fact.Plugin)
+	}
+	for idx, param := range call.Fact.Params {
+		name := param.GetName(idx)
+		if param.Type == PARAM_TYPE_CONSTANT {
+			call.Params[name] = param.Value
+		} else if _, ok := call.Params[name]; !ok && param.Default != "" {
+			value, err := param.Validate(param.Default)
+			if err != nil {
+				return nil, fmt.Errorf("invalid default for parameter %s: %w", name, err)
+			}
+			call.Params[name] = value
+		}
+	}
+	missing := pm.missingParams(call.Fact, call.Params)
+	if len(missing) > 0 || len(call.Errors) > 0 {
+		text := ""
+		for idx, param := range call.Fact.Params {
+			if msg, ok := call.Errors[param.GetName(idx)]; ok {
+				text += "invalid " + param.GetName(idx) + ": " + msg + "\n"
+				if _, ok := call.Params[param.GetName(idx)]; !ok && !param.Required {
+					missing = append(missing, param.GetName(idx))
 				}
-			} else {
-				return nil, errors.New("unsupported param type " + param.Type)
 			}
 		}
+		call.Errors = make(map[string]string)
+		session.PluginCall = call
+		session.State = STATE_ADD_PARAMS
+		session.DraftUpdatedAt = time.Now()
+		answer := NewAnswer(text + "please provide " + strings.Join(missing, ", ") + " (type 'cancel' to discard the request)!\n")
+		session.LastAnswer = []*Answer{answer}
+		return session.LastAnswer, nil
+	}
+	session.PluginCall = nil
+	session.State = STATE_QA
+	session.DraftUpdatedAt = time.Time{}
+	pluginAnswerProvider, ok := answerProvider.(PluginAnswerProvider)
+	if ok {
+		return pluginAnswerProvider.GetPluginAnswers(session, call.Question, call.Fact, call.Params)
+	}
+	// rewrite question for plugins which only understand plain text
+	q := call.Question.Text
+	if len(call.Fact.Params) > 0 {
+		values := make([]string, 0)
+		for idx, param := range call.Fact.Params {
+			if v, ok := call.Params[param.GetName(idx)]; ok {
+				values = append(values, fmt.Sprint(v))
+			}
+		}
+		q = strings.Join(values, " ")
+	}
+	return answerProvider.GetAnswers(session, NewQuestion(q))
+}
+
+// promptParams returns the indexes of all prompt parameters without a value yet.
+func (pm *PluginManager) promptParams(fact *Fact, values map[string]interface{}) []int {
+	idxs := make([]int, 0)
+	for idx, param := range fact.Params {
+		if param.Type != PARAM_TYPE_PROMPT {
+			continue
+		}
+		if _, ok := values[param.GetName(idx)]; !ok {
+			idxs = append(idxs, idx)
+		}
+	}
+	return idxs
+}
+
+func (pm *PluginManager) missingParams(fact *Fact, values map[string]interface{}) []string {
+	names := make([]string, 0)
+	for _, idx := range pm.promptParams(fact, values) {
+		if fact.Params[idx].Required {
+			name := fact.Params[idx].GetName(idx)
+			if fact.Params[idx].Description != "" {
+				name += " (" + fact.Params[idx].Description + ")"
+			}
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// paramsSchema expresses the given prompt parameters of a fact as JSON schema. Parameters are
+// deliberately not marked as required in the schema so that the model leaves out what the user
+// did not say rather than making something up, missing parameters are asked for instead.
+func (pm *PluginManager) paramsSchema(fact *Fact, idxs []int) map[string]interface{} {
+	properties := make(map[string]interface{})
+	for _, idx := range idxs {
+		properties[fact.Params[idx].GetName(idx)] = fact.Params[idx].Schema()
+	}
+	return map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+}
+
+func (pm *PluginManager) extractParams(call *PluginCall, question *Question, idxs []int) error {
+	if len(idxs) == 0 {
+		return nil
+	}
+	function := GptFunction{
+		Name:        strings.ToLower(call.Fact.Name),
+		Description: call.Fact.Question,
+		Parameters:  pm.paramsSchema(call.Fact, idxs),
+	}
+	args, err := pm.oai.GptGetFunctionArguments(PARAM_INSTRUCTIONS, question, function)
+	if err != nil {
+		return err
+	}
+	for _, idx := range idxs {
+		name := call.Fact.Params[idx].GetName(idx)
+		v, ok := args[name]
+		if !ok || v == nil || v == "" {
+			continue
+		}
+		pm.setParam(call, &call.Fact.Params[idx], name, v)
+	}
+	return nil
+}
+
+// setParam stores the validated value of a parameter or remembers why it was rejected.
+func (pm *PluginManager) setParam(call *PluginCall, param *Parameter, name string, v interface{}) {
+	if call.Errors == nil {
+		call.Errors = make(map[string]string)
+	}
+	value, err := param.Validate(v)
+	if err != nil {
+		call.Errors[name] = err.Error()
+		return
 	}
-	return answerProvider.GetAnswers(session, &Question{q})
+	call.Params[name] = value
+	delete(call.Errors, name)
 }
@@ -0,0 +1,453 @@
+/**
+ * Copyright 2024 Boris Wolf
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode"
+)
+
+type testSecretProvider map[string]string
+
+func (sp testSecretProvider) GetSecret(name string) string {
+	return sp[name]
+}
+
+type testConfigProvider map[string]string
+
+func (cp testConfigProvider) GetConfig(name string) string {
+	return cp[name]
+}
+
+type testAnswerProvider struct {
+	questions []string
+}
+
+func (tap *testAnswerProvider) GetAnswers(session *UserSession, question *Question) ([]*Answer, error) {
+	tap.questions = append(tap.questions, question.Text)
+	return []*Answer{NewAnswer("ok")}, nil
+}
+
+// newTestOpenAIServer answers every function call with the given arguments, every other completion
+// with yes and computes bag of words embeddings so that questions sharing words rank close.
+func newTestOpenAIServer(t *testing.T, args *string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == OPEN_AI_EMBEDDINGS_PATH {
+			var reqObj GptEmbeddingRequest
+			json.NewDecoder(r.Body).Decode(&reqObj)
+			vector := make([]float64, 16)
+			for _, word := range strings.FieldsFunc(strings.ToLower(reqObj.Input), func(r rune) bool { return !unicode.IsLetter(r) }) {
+				h := fnv.New32a()
+				h.Write([]byte(word))
+				vector[h.Sum32()%16] += 1
+			}
+			length := 0.0
+			for _, v := range vector {
+				length += v * v
+			}
+			for idx := range vector {
+				vector[idx] /= math.Sqrt(length)
+			}
+			resp := map[string]interface{}{
+				"data": []interface{}{map[string]interface{}{"embedding": vector}},
+			}
+			json.NewEncoder(w).Encode(resp)
+			return
+		}
+		var reqObj GptCompletionsRequest
+		err := json.NewDecoder(r.Body).Decode(&reqObj)
+		if err != nil {
+			t.Errorf("failed to decode request: %v", err)
+			return
+		}
+		message := map[string]interface{}{
+			"role":    GPT_ROLE_USER,
+			"content": "yes",
+		}
+		if len(reqObj.Tools) > 0 {
+			if reqObj.ToolChoice == nil || len(reqObj.Tools) != 1 || reqObj.ToolChoice.Function.Name != reqObj.Tools[0].Function.Name {
+				t.Errorf("expected forced function call: %+v", reqObj)
+			}
+			message["tool_calls"] = []interface{}{
+				map[string]interface{}{
+					"id":   "call_1",
+					"type": GPT_TOOL_TYPE_FUNCTION,
+					"function": map[string]interface{}{
+						"name":      reqObj.Tools[0].Function.Name,
+						"arguments": *args,
+					},
+				},
+			}
+		}
+		resp := map[string]interface{}{
+			"choices": []interface{}{
+				map[string]interface{}{
+					"message": message,
+				},
+			},
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+}
+
+func newTestPluginManager(t *testing.T, args *string) (*PluginManager, *testAnswerProvider, func()) {
+	server := newTestOpenAIServer(t, args)
+	secretProvider := testSecretProvider{OPEN_AI_TOKEN: "test"}
+	oai := NewOpenAIHandler(secretProvider).WithBaseUrl(server.URL)
+	pm := NewPluginManger(nil, *oai, testConfigProvider{}, secretProvider, newTestAccessProvider(ROLE_ADMIN), nil, nil, nil)
+	tap := new(testAnswerProvider)
+	err := pm.RegisterPlugin("TEST_PLUGIN", tap)
+	if err != nil {
+		t.Fatalf("failed to register plugin: %v", err)
+	}
+	return pm, tap, server.Close
+}
+
+func newTestPluginFact() *Fact {
+	return &Fact{
+		Name:     "RGETFACT",
+		Question: "Get a fact by name!",
+		Plugin:   "TEST_PLUGIN",
+		Params: []Parameter{
+			{Name: "command", Value: "rgetfact", Type: PARAM_TYPE_CONSTANT},
+			{Name: "factName", Value: "the name of the fact", Type: PARAM_TYPE_PROMPT, Required: true},
+		},
+	}
+}
+
+func TestPluginParamsExtraction(t *testing.T) {
+	args := `{"factName":"SETTING"}`
+	pm, tap, stop := newTestPluginManager(t, &args)
+	defer stop()
+	session := &UserSession{User: NewUser("1", "test", "test"), State: STATE_QA}
+	_, err := pm.GetAnswers(session, NewQuestion("show me the setting fact"), newTestPluginFact())
+	if err != nil {
+		t.Fatalf("failed to get answers: %v", err)
+	}
+	if len(tap.questions) != 1 || tap.questions[0] != "rgetfact SETTING" {
+		t.Errorf("unexpected plugin questions: %v", tap.questions)
+	}
+	if session.State != STATE_QA {
+		t.Errorf("unexpected state %s", session.State)
+	}
+}
+
+func TestPluginParamsMissing(t *testing.T) {
+	args := `{}`
+	pm, tap, stop := newTestPluginManager(t, &args)
+	defer stop()
+	session := &UserSession{User: NewUser("1", "test", "test"), State: STATE_QA}
+	answers, err := pm.GetAnswers(session, NewQuestion("show me a fact"), newTestPluginFact())
+	if err != nil {
+		t.Fatalf("failed to get answers: %v", err)
+	}
+	if len(tap.questions) != 0 {
+		t.Errorf("plugin called despite missing parameter: %v", tap.questions)
+	}
+	if session.State != STATE_ADD_PARAMS || len(answers) != 1 {
+		t.Fatalf("expected to be asked for missing parameter, state %s", session.State)
+	}
+	answers, err = pm.ContinueAnswers(session, NewQuestion("what is the weather like?"))
+	if err != nil {
+		t.Fatalf("failed to continue answers: %v", err)
+	}
+	if len(tap.questions) != 0 || session.State != STATE_ADD_PARAMS || !strings.Contains(answers[0].Text, "please provide factName") {
+		t.Fatalf("expected unrelated text not to be taken as parameter: %v %+v", tap.questions, answers)
+	}
+	args = `{"factName":"SETTING"}`
+	_, err = pm.ContinueAnswers(session, NewQuestion("SETTING"))
+	if err != nil {
+		t.Fatalf("failed to continue answers: %v", err)
+	}
+	if len(tap.questions) != 1 || tap.questions[0] != "rgetfact SETTING" {
+		t.Errorf("unexpected plugin questions: %v", tap.questions)
+	}
+	if session.State != STATE_QA || session.PluginCall != nil {
+		t.Errorf("expected pending plugin call to be cleared, state %s", session.State)
+	}
+}
+
+func TestWebhookPlugin(t *testing.T) {
+	bodies := make([]map[string]interface{}, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/status/billing/eu 1" || r.URL.Query().Get("q") != "how is billing doing?&admin=1" || r.URL.Query().Get("admin") != "" {
+			t.Errorf("unexpected url: %s", r.URL.String())
+		}
+		if r.Header.Get("Authorization") != "Bearer s3cret" {
+			t.Errorf("unexpected authorization header: %s", r.Header.Get("Authorization"))
+		}
+		var body map[string]interface{}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			t.Errorf("invalid body: %v", err)
+		}
+		bodies = append(bodies, body)
+		w.Write([]byte(`{"services":[{"name":"billing","status":{"state":"degraded"}}]}`))
+	}))
+	defer server.Close()
+	configs := testConfigProvider{WEBHOOK_SECRETS_CONFIG: "status.example.com=otherToken, 127.0.0.1=statusToken"}
+	wap := NewWebhookAnswerProvider(configs, testSecretProvider{"statusToken": "s3cret", "openai": "sk-1"}).(*WebhookAnswerProvider)
+	fact := &Fact{
+		Name:   "SERVICE_STATUS",
+		Plugin: WEBHOOK_PLUGIN,
+		Webhook: &Webhook{
+			Url:          server.URL + "/status/billing/{{.Params.region}}?q={{.Question}}",
+			Method:       "post",
+			Headers:      map[string]string{"Authorization": `Bearer {{secret "statusToken"}}`},
+			Body:         `{"service": {{json .Params.service}}, "region": {{json .Params.region}}}`,
+			ResponsePath: "$.services[0].status",
+			Response:     `{{.Params.service}} is {{.Response.state}}`,
+		},
+	}
+	session := &UserSession{User: NewUser("1", "test", "test"), State: STATE_QA}
+	params := map[string]interface{}{"service": "billing", "region": "eu 1"}
+	answers, err := wap.GetPluginAnswers(session, NewQuestion("how is billing doing?&admin=1"), fact, params)
+	if err != nil {
+		t.Fatalf("failed to get webhook answers: %v", err)
+	}
+	if len(answers) != 1 || answers[0].Text != "billing is degraded" {
+		t.Errorf("unexpected answers: %+v", answers)
+	}
+	params["service"] = `billing", "admin": true, "x": "`
+	_, err = wap.GetPluginAnswers(session, NewQuestion("how is billing doing?&admin=1"), fact, params)
+	if err != nil {
+		t.Fatalf("failed to get webhook answers: %v", err)
+	}
+	if len(bodies) != 2 || bodies[0]["service"] != "billing" || bodies[1]["service"] != params["service"] || bodies[1]["admin"] != nil {
+		t.Errorf("expected params to be quoted in json body: %v", bodies)
+	}
+	for _, header := range []string{`{{secret "openai"}}`, `{{secret "otherToken"}}`} {
+		fact.Webhook.Headers = map[string]string{"Authorization": header}
+		_, err = wap.GetPluginAnswers(session, NewQuestion("how is billing doing?"), fact, params)
+		if err == nil || !strings.Contains(err.Error(), "not allowed") {
+			t.Errorf("expected secret not configured for the host to be rejected: %v", err)
+		}
+	}
+	fact.Webhook.Headers = nil
+	fact.Webhook.Url = server.URL + `/status?token={{secret "statusToken"}}`
+	_, err = wap.GetPluginAnswers(session, NewQuestion("how is billing doing?"), fact, params)
+	if err == nil || !strings.Contains(err.Error(), "may not be used in the webhook url") {
+		t.Errorf("expected secret in url to be rejected: %v", err)
+	}
+	if len(bodies) != 2 {
+		t.Errorf("expected rejected webhooks not to be called: %d", len(bodies))
+	}
+}
+
+func TestScriptPlugin(t *testing.T) {
+	jail := t.TempDir()
+	err := os.WriteFile(filepath.Join(jail, "greet.sh"), []byte("#!/bin/sh\necho \"hello $1 from $AGENTSMITH_PARAM_TEAM\"\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(jail, "sleep.sh"), []byte("#!/bin/sh\nsleep 5\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sap := NewScriptAnswerProvider(testConfigProvider{"scriptdir": jail, "scriptallowlist": "greet.sh, sleep.sh"}).(*ScriptAnswerProvider)
+	session := &UserSession{User: NewUser("1", "test", "test"), State: STATE_QA}
+	params := map[string]interface{}{"name": "world", "team": "ops"}
+	fact := &Fact{Name: "GREET", Plugin: SCRIPT_PLUGIN, Script: &Script{Command: "greet.sh", Args: []string{"{{.Params.name}}"}}}
+	answers, err := sap.GetPluginAnswers(session, NewQuestion("greet the world"), fact, params)
+	if err != nil {
+		t.Fatalf("failed to run script: %v", err)
+	}
+	if len(answers) != 1 || answers[0].Text != "hello world from ops\n" {
+		t.Errorf("unexpected answers: %+v", answers)
+	}
+	fact.Script.MaxOutput = 5
+	answers, err = sap.GetPluginAnswers(session, NewQuestion("greet the world"), fact, params)
+	if err != nil || !strings.HasPrefix(answers[0].Text, "hello\n[output truncated]") {
+		t.Errorf("expected truncated output: %q %v", answers[0].Text, err)
+	}
+	for _, command := range []string{"/bin/sh", "../greet.sh", "other.sh"} {
+		fact.Script = &Script{Command: command}
+		_, err = sap.GetPluginAnswers(session, NewQuestion("greet the world"), fact, params)
+		if err == nil {
+			t.Errorf("expected command %s to be rejected", command)
+		}
+	}
+	fact.Script = &Script{Command: "greet.sh", Env: map[string]string{"GREETING": "hi"}}
+	_, err = sap.GetPluginAnswers(session, NewQuestion("greet the world"), fact, params)
+	if err != nil {
+		t.Errorf("failed to run script with env: %v", err)
+	}
+	for _, name := range []string{"PATH", "LD_PRELOAD", "ld_library_path", "AGENTSMITH_PARAM_TEAM", "BASH_FUNC_x%%", "A=B"} {
+		fact.Script = &Script{Command: "greet.sh", Env: map[string]string{name: "/tmp"}}
+		_, err = sap.GetPluginAnswers(session, NewQuestion("greet the world"), fact, params)
+		if err == nil {
+			t.Errorf("expected script env %s to be rejected", name)
+		}
+	}
+	fact.Script = &Script{Command: "greet.sh", Dir: ".."}
+	_, err = sap.GetPluginAnswers(session, NewQuestion("greet the world"), fact, params)
+	if err == nil {
+		t.Errorf("expected working dir outside of jail to be rejected")
+	}
+	fact.Script = &Script{Command: "sleep.sh", Timeout: 1}
+	_, err = sap.GetPluginAnswers(session, NewQuestion("sleep"), fact, params)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("expected timeout: %v", err)
+	}
+}
+
+func TestExternalPlugins(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ExternalPluginRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if r.URL.Path == "/handshake" {
+			json.NewEncoder(w).Encode(ExternalPluginHandshake{Name: "HTTP_PLUGIN"})
+		} else {
+			json.NewEncoder(w).Encode(ExternalPluginResponse{Answers: []ExternalPluginAnswer{{Text: "http " + req.Question}}})
+		}
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	script := "#!/bin/sh\n" +
+		"while read -r line; do\n" +
+		"  case \"$line\" in\n" +
+		"    *handshake*) echo '{\"name\":\"STDIO_PLUGIN\",\"parameters\":[{\"name\":\"ticket\",\"type\":\"prompt\",\"required\":true}]}' ;;\n" +
+		"    *) echo '{\"answers\":[{\"text\":\"stdio answer\",\"link\":\"http://example.com\"}]}' ;;\n" +
+		"  esac\n" +
+		"done\n"
+	err := os.WriteFile(filepath.Join(dir, "stdio.sh"), []byte(script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "stdio.json"), []byte(`{"protocol":"stdio","command":"stdio.sh"}`), 0644)
+	os.WriteFile(filepath.Join(dir, "http.json"), []byte(`{"protocol":"http","url":"`+server.URL+`"}`), 0644)
+	os.WriteFile(filepath.Join(dir, "broken.json"), []byte(`{"protocol":`), 0644)
+	os.WriteFile(filepath.Join(dir, "unknown.json"), []byte(`{"protocol":"carrier pigeon"}`), 0644)
+	args := `{"ticket":"OPS-1"}`
+	openai := newTestOpenAIServer(t, &args)
+	defer openai.Close()
+	secretProvider := testSecretProvider{OPEN_AI_TOKEN: "test"}
+	oai := NewOpenAIHandler(secretProvider).WithBaseUrl(openai.URL)
+	pm := NewPluginManger(nil, *oai, testConfigProvider{"pluginsdir": dir}, secretProvider, newTestAccessProvider(ROLE_ADMIN), nil, nil, nil)
+	if pm.GetPlugin("HTTP_PLUGIN") != nil {
+		t.Fatalf("external plugins registered before start: %v", pm.ListPlugins())
+	}
+	pm.StartPlugins()
+	defer pm.UnregisterPlugin("STDIO_PLUGIN")
+	if pm.GetPlugin("HTTP_PLUGIN") == nil || pm.GetPlugin("STDIO_PLUGIN") == nil {
+		t.Fatalf("external plugins not registered: %v", pm.ListPlugins())
+	}
+	session := &UserSession{User: NewUser("1", "test", "test"), State: STATE_QA}
+	answers, err := pm.GetAnswers(session, NewQuestion("ping"), &Fact{Name: "PING", Plugin: "HTTP_PLUGIN"})
+	if err != nil || len(answers) != 1 || answers[0].Text != "http ping" {
+		t.Errorf("unexpected http plugin answers: %+v %v", answers, err)
+	}
+	answers, err = pm.GetAnswers(session, NewQuestion("look at ticket OPS-1"), &Fact{Name: "TICKET", Plugin: "STDIO_PLUGIN"})
+	if err != nil || len(answers) != 1 || answers[0].Text != "stdio answer" || answers[0].Link != "http://example.com" {
+		t.Errorf("unexpected stdio plugin answers: %+v %v", answers, err)
+	}
+	err = pm.RegisterPlugin("HTTP_PLUGIN", new(testAnswerProvider))
+	if err == nil {
+		t.Errorf("expected duplicate registration to fail")
+	}
+	err = pm.UnregisterPlugin(WEBHOOK_PLUGIN)
+	if err == nil || pm.GetPlugin(WEBHOOK_PLUGIN) == nil {
+		t.Errorf("expected built-in plugin not to be unregistered")
+	}
+}
+
+type testPluginAnswerProvider struct {
+	params []map[string]interface{}
+}
+
+func (tpap *testPluginAnswerProvider) GetAnswers(session *UserSession, question *Question) ([]*Answer, error) {
+	return nil, nil
+}
+
+func (tpap *testPluginAnswerProvider) GetPluginAnswers(session *UserSession, question *Question, fact *Fact, params map[string]interface{}) ([]*Answer, error) {
+	tpap.params = append(tpap.params, params)
+	return []*Answer{NewAnswer("ok")}, nil
+}
+
+func TestPluginParamsValidation(t *testing.T) {
+	args := `{"count":"many","env":"PROD"}`
+	pm, _, stop := newTestPluginManager(t, &args)
+	defer stop()
+	tpap := new(testPluginAnswerProvider)
+	pm.RegisterPlugin("TYPED_PLUGIN", tpap)
+	fact := &Fact{
+		Name:   "SCALE",
+		Plugin: "TYPED_PLUGIN",
+		Params: []Parameter{
+			{Name: "command", Value: "scale", Type: PARAM_TYPE_CONSTANT},
+			{Name: "count", Type: PARAM_TYPE_PROMPT, DataType: PARAM_DATA_TYPE_INT, Required: true},
+			{Name: "env", Type: PARAM_TYPE_PROMPT, DataType: PARAM_DATA_TYPE_ENUM, Enum: []string{"dev", "prod"}},
+			{Name: "region", Type: PARAM_TYPE_PROMPT, Default: "eu-1", Pattern: `[a-z]+-[0-9]`},
+		},
+	}
+	session := &UserSession{User: NewUser("1", "test", "test"), State: STATE_QA}
+	answers, err := pm.GetAnswers(session, NewQuestion("scale prod to many instances"), fact)
+	if err != nil {
+		t.Fatalf("failed to get answers: %v", err)
+	}
+	if session.State != STATE_ADD_PARAMS || !strings.Contains(answers[0].Text, "invalid count: many is not a whole number") {
+		t.Fatalf("expected validation error, got %q", answers[0].Text)
+	}
+	args = `{}`
+	_, err = pm.ContinueAnswers(session, NewQuestion("3"))
+	if err != nil {
+		t.Fatalf("failed to continue answers: %v", err)
+	}
+	if len(tpap.params) != 1 {
+		t.Fatalf("expected plugin to be called once, got %d", len(tpap.params))
+	}
+	expected := map[string]interface{}{"command": "scale", "count": 3, "env": "prod", "region": "eu-1"}
+	for k, v := range expected {
+		if tpap.params[0][k] != v {
+			t.Errorf("unexpected value for %s: %v (%T)", k, tpap.params[0][k], tpap.params[0][k])
+		}
+	}
+}
+
+func TestParameterValidate(t *testing.T) {
+	tests := []struct {
+		param Parameter
+		value interface{}
+		valid bool
+	}{
+		{Parameter{}, "text", true},
+		{Parameter{}, " ", false},
+		{Parameter{}, 42.0, false},
+		{Parameter{DataType: PARAM_DATA_TYPE_INT}, 42.0, true},
+		{Parameter{DataType: PARAM_DATA_TYPE_INT}, 4.2, false},
+		{Parameter{DataType: PARAM_DATA_TYPE_FLOAT}, "4.2", true},
+		{Parameter{DataType: PARAM_DATA_TYPE_ENUM, Enum: []string{"a", "b"}}, "c", false},
+		{Parameter{DataType: PARAM_DATA_TYPE_DATE}, "2024-02-30", false},
+		{Parameter{DataType: PARAM_DATA_TYPE_DATE}, "2024-02-28", true},
+		{Parameter{Pattern: `OPS-[0-9]+`}, "OPS-12", true},
+		{Parameter{Pattern: `OPS-[0-9]+`}, "see OPS-12", false},
+	}
+	for _, test := range tests {
+		_, err := test.param.Validate(test.value)
+		if (err == nil) != test.valid {
+			t.Errorf("unexpected validation result for %v with %+v: %v", test.value, test.param, err)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+/**
+ * Copyright 2024 Boris Wolf
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	SCRIPT_DEFAULT_DIR        = "scripts"
+	SCRIPT_DEFAULT_TIMEOUT    = 10
+	SCRIPT_DEFAULT_MAX_OUTPUT = 4096
+	SCRIPT_PARAM_ENV_PREFIX   = "AGENTSMITH_PARAM_"
+)
+
+var scriptEnvNameRegexp = regexp.MustCompile(`[^A-Z0-9_]`)
+
+var scriptEnvValidNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// environment variables which change how the script or the loader are run, may not be set by facts
+var scriptReservedEnv = []string{"PATH", "HOME", "SHELL", "IFS", "ENV", "BASH_ENV", "SHELLOPTS", "BASHOPTS", "PS4", "GCONV_PATH",
+	"PYTHONPATH", "PYTHONSTARTUP", "PERL5LIB", "PERL5OPT", "RUBYLIB", "RUBYOPT", "NODE_OPTIONS"}
+
+var scriptReservedEnvPrefixes = []string{"LD_", "DYLD_", "BASH_FUNC_", SCRIPT_PARAM_ENV_PREFIX}
+
+type ScriptAnswerProvider struct {
+	configProvider ConfigProvider
+}
+
+func NewScriptAnswerProvider(configProvider ConfigProvider) AnswerProvider {
+	answerProvider := ScriptAnswerProvider{
+		configProvider,
+	}
+	return &answerProvider
+}
+
+func (sap *ScriptAnswerProvider) GetAnswers(session *UserSession, question *Question) ([]*Answer, error) {
+	return nil, errors.New("script plugin requires a fact")
+}
+
+func (sap *ScriptAnswerProvider) GetPluginAnswers(session *UserSession, question *Question, fact *Fact, params map[string]interface{}) ([]*Answer, error) {
+	script := fact.Script
+	if script == nil || script.Command == "" {
+		return nil, errors.New("missing script config for fact " + fact.Name)
+	}
+	jail, err := sap.getJail()
+	if err != nil {
+		return nil, err
+	}
+	command, err := sap.resolveCommand(jail, script.Command)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := sap.resolvePath(jail, script.Dir)
+	if err != nil {
+		return nil, err
+	}
+	data := &PluginData{
+		Question: question.Text,
+		User:     session.User,
+		Params:   params,
+	}
+	args := make([]string, 0)
+	for _, a := range script.Args {
+		arg, err := renderPluginTemplate("script argument", a, nil, data)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	env := []string{"PATH=" + os.Getenv("PATH")}
+	for name, value := range params {
+		env = append(env, SCRIPT_PARAM_ENV_PREFIX+scriptEnvNameRegexp.ReplaceAllString(strings.ToUpper(name), "_")+"="+fmt.Sprint(value))
+	}
+	for name, value := range script.Env {
+		err = checkScriptEnvName(name)
+		if err != nil {
+			return nil, err
+		}
+		v, err := renderPluginTemplate("script env "+name, value, nil, data)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, name+"="+v)
+	}
+	timeout := script.Timeout
+	if timeout <= 0 {
+		timeout = SCRIPT_DEFAULT_TIMEOUT
+	}
+	maxOutput := script.MaxOutput
+	if maxOutput <= 0 {
+		maxOutput = SCRIPT_DEFAULT_MAX_OUTPUT
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Dir = dir
+	cmd.Env = env
+	cmd.WaitDelay = time.Second
+	stdout := &limitedBuffer{max: maxOutput}
+	stderr := &limitedBuffer{max: maxOutput}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err = cmd.Run()
+	if stderr.buf.Len() > 0 {
+		log.Warn().Err(err).Str("fact", fact.Name).Str("command", script.Command).Str("stderr", stderr.String()).Msg("script wrote to stderr")
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("script for fact %s timed out after %d seconds", fact.Name, timeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("script for fact %s failed: %w", fact.Name, err)
+	}
+	text := stdout.String()
+	if stdout.truncated {
+		text += "\n[output truncated]"
+	}
+	answers := []*Answer{NewAnswer(text)}
+	session.LastQuestion = question
+	session.LastAnswer = answers
+	return answers, nil
+}
+
+func checkScriptEnvName(name string) error {
+	if !scriptEnvValidNameRegexp.MatchString(name) {
+		return errors.New("invalid script env name " + name)
+	}
+	upper := strings.ToUpper(name)
+	for _, reserved := range scriptReservedEnv {
+		if upper == reserved {
+			return errors.New("script env " + name + " is reserved")
+		}
+	}
+	for _, prefix := range scriptReservedEnvPrefixes {
+		if strings.HasPrefix(upper, prefix) {
+			return errors.New("script env " + name + " is reserved")
+		}
+	}
+	return nil
+}
+
+func (sap *ScriptAnswerProvider) getJail() (string, error) {
+	jail := sap.configProvider.GetConfig("scriptdir")
+	if jail == "" {
+		jail = SCRIPT_DEFAULT_DIR
+	}
+	jail, err := filepath.Abs(jail)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(jail)
+}
+
+// resolvePath resolves a path relative to the jail and makes sure it does not escape it.
+func (sap *ScriptAnswerProvider) resolvePath(jail, path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(filepath.Join(jail, path))
+	if err != nil {
+		return "", err
+	}
+	if resolved != jail && !strings.HasPrefix(resolved, jail+string(filepath.Separator)) {
+		return "", errors.New("path " + path + " is outside of script dir")
+	}
+	return resolved, nil
+}
+
+func (sap *ScriptAnswerProvider) resolveCommand(jail, command string) (string, error) {
+	allowed := false
+	for _, c := range strings.Split(sap.configProvider.GetConfig("scriptallowlist"), ",") {
+		if strings.TrimSpace(c) == command {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return "", errors.New("script " + command + " is not allow-listed")
+	}
+	resolved, err := sap.resolvePath(jail, command)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() || info.Mode()&0111 == 0 {
+		return "", errors.New("script " + command + " is not executable")
+	}
+	return resolved, nil
+}
+
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (lb *limitedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if lb.buf.Len()+len(p) > lb.max {
+		p = p[:lb.max-lb.buf.Len()]
+		lb.truncated = true
+	}
+	lb.buf.Write(p)
+	return n, nil
+}
+
+func (lb *limitedBuffer) String() string {
+	return lb.buf.String()
+}
@@ -16,18 +16,62 @@
 
 package main
 
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_SESSION_TTL     = 30 * time.Minute
+	DEFAULT_MAX_SESSIONS    = 10000
+	MAX_JANITOR_INTERVAL    = time.Minute
+	SESSION_TTL_CONFIG      = "sessionttl"
+	MAX_SESSIONS_CONFIG     = "maxsessions"
+	SESSION_JANITOR_DIVISOR = 4
+)
+
+// SimpleSessionManager keeps sessions in memory. Sessions idle for longer than the ttl are
+// removed by a background janitor and the least recently used session is evicted once the
+// maximum number of sessions is reached.
 type SimpleSessionManager struct {
-	sessions map[string]*UserSession
+	sync.Mutex
+	sessions    map[string]*list.Element
+	lru         *list.List
+	ttl         time.Duration
+	maxSessions int
+	done        chan struct{}
+	closeOnce   sync.Once
+}
+
+type sessionEntry struct {
+	id         string
+	session    *UserSession
+	lastAccess time.Time
 }
 
 type SessionManager interface {
 	GetSession(user *User) *UserSession
+	FindSession(id string) *UserSession
 	DeleteSession(id string)
+	Close() error
 }
 
-func NewSimpleSessionManager() SessionManager {
-	mgr := new(SimpleSessionManager)
-	mgr.sessions = make(map[string]*UserSession, 0)
+func NewSimpleSessionManager(ttl time.Duration, maxSessions int) SessionManager {
+	if ttl <= 0 {
+		ttl = DEFAULT_SESSION_TTL
+	}
+	if maxSessions <= 0 {
+		maxSessions = DEFAULT_MAX_SESSIONS
+	}
+	mgr := &SimpleSessionManager{
+		sessions:    make(map[string]*list.Element, 0),
+		lru:         list.New(),
+		ttl:         ttl,
+		maxSessions: maxSessions,
+		done:        make(chan struct{}),
+	}
+	go mgr.janitor()
 	return mgr
 }
 
@@ -35,16 +79,94 @@ func (mgr *SimpleSessionManager) GetSession(user *User) *UserSession {
 	if user == nil || user.Id == "" {
 		return nil
 	}
-	session, ok := mgr.sessions[user.Id]
-	if !ok {
-		session = new(UserSession)
-		session.User = user
-		session.State = STATE_QA
-		mgr.sessions[user.Id] = session
+	mgr.Lock()
+	defer mgr.Unlock()
+	elem, ok := mgr.sessions[user.Id]
+	if ok {
+		entry := elem.Value.(*sessionEntry)
+		entry.lastAccess = time.Now()
+		mgr.lru.MoveToFront(elem)
+		return entry.session
 	}
+	session := new(UserSession)
+	session.User = user
+	session.State = STATE_QA
+	mgr.addSession(user.Id, session, time.Now())
 	return session
 }
 
+// FindSession returns an existing session without creating one or counting as access.
+func (mgr *SimpleSessionManager) FindSession(id string) *UserSession {
+	mgr.Lock()
+	defer mgr.Unlock()
+	elem, ok := mgr.sessions[id]
+	if !ok {
+		return nil
+	}
+	return elem.Value.(*sessionEntry).session
+}
+
+// addSession stores a session and evicts least recently used sessions beyond the maximum, must be called with lock held.
+func (mgr *SimpleSessionManager) addSession(id string, session *UserSession, lastAccess time.Time) {
+	elem := mgr.lru.PushFront(&sessionEntry{id, session, lastAccess})
+	mgr.sessions[id] = elem
+	for mgr.lru.Len() > mgr.maxSessions {
+		mgr.removeElement(mgr.lru.Back())
+	}
+}
+
+func (mgr *SimpleSessionManager) removeElement(elem *list.Element) {
+	mgr.lru.Remove(elem)
+	delete(mgr.sessions, elem.Value.(*sessionEntry).id)
+}
+
 func (mgr *SimpleSessionManager) DeleteSession(id string) {
-	delete(mgr.sessions, id)
+	mgr.Lock()
+	defer mgr.Unlock()
+	elem, ok := mgr.sessions[id]
+	if ok {
+		mgr.removeElement(elem)
+	}
+}
+
+func (mgr *SimpleSessionManager) GetNumSessions() int {
+	mgr.Lock()
+	defer mgr.Unlock()
+	return len(mgr.sessions)
+}
+
+// expireSessions removes all sessions idle since before the given time.
+func (mgr *SimpleSessionManager) expireSessions(now time.Time) {
+	mgr.Lock()
+	defer mgr.Unlock()
+	for elem := mgr.lru.Back(); elem != nil; elem = mgr.lru.Back() {
+		if now.Sub(elem.Value.(*sessionEntry).lastAccess) < mgr.ttl {
+			return
+		}
+		mgr.removeElement(elem)
+	}
+}
+
+func (mgr *SimpleSessionManager) janitor() {
+	interval := mgr.ttl / SESSION_JANITOR_DIVISOR
+	if interval > MAX_JANITOR_INTERVAL {
+		interval = MAX_JANITOR_INTERVAL
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-mgr.done:
+			return
+		case now := <-ticker.C:
+			mgr.expireSessions(now)
+		}
+	}
+}
+
+func (mgr *SimpleSessionManager) Close() error {
+	mgr.closeOnce.Do(func() {
+		close(mgr.done)
+	})
+	return nil
 }
@@ -0,0 +1,167 @@
+/**
+ * Copyright 2024 Boris Wolf
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSessionManagerConcurrentAccess(t *testing.T) {
+	mgr := NewSimpleSessionManager(time.Minute, 50).(*SimpleSessionManager)
+	defer mgr.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				id := fmt.Sprintf("user%d", (i*j)%100)
+				session := mgr.GetSession(NewUser(id, id, id))
+				if session == nil || session.User.Id != id {
+					t.Errorf("unexpected session for %s", id)
+					return
+				}
+				if j%7 == 0 {
+					mgr.DeleteSession(id)
+				}
+				mgr.expireSessions(time.Now())
+			}
+		}(i)
+	}
+	wg.Wait()
+	if mgr.GetNumSessions() > 50 {
+		t.Errorf("too many sessions: %d", mgr.GetNumSessions())
+	}
+}
+
+func TestSessionManagerLRUEviction(t *testing.T) {
+	mgr := NewSimpleSessionManager(time.Minute, 2).(*SimpleSessionManager)
+	defer mgr.Close()
+	first := mgr.GetSession(NewUser("1", "one", "one"))
+	mgr.GetSession(NewUser("2", "two", "two"))
+	// touch first session so that the second one is least recently used
+	if mgr.GetSession(NewUser("1", "one", "one")) != first {
+		t.Errorf("expected same session for same user")
+	}
+	mgr.GetSession(NewUser("3", "three", "three"))
+	if mgr.GetNumSessions() != 2 {
+		t.Errorf("expected 2 sessions, got %d", mgr.GetNumSessions())
+	}
+	if mgr.GetSession(NewUser("1", "one", "one")) != first {
+		t.Errorf("expected recently used session to survive eviction")
+	}
+	_, ok := mgr.sessions["2"]
+	if ok {
+		t.Errorf("expected least recently used session to be evicted")
+	}
+}
+
+func TestSessionManagerExpiry(t *testing.T) {
+	mgr := NewSimpleSessionManager(40*time.Millisecond, 10).(*SimpleSessionManager)
+	defer mgr.Close()
+	first := mgr.GetSession(NewUser("1", "one", "one"))
+	first.State = STATE_ADD_QUESTION
+	deadline := time.Now().Add(2 * time.Second)
+	for mgr.GetNumSessions() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if mgr.GetNumSessions() != 0 {
+		t.Fatalf("expected janitor to expire idle session")
+	}
+	if mgr.GetSession(NewUser("1", "one", "one")).State != STATE_QA {
+		t.Errorf("expected fresh session after expiry")
+	}
+}
+
+func TestFileSessionManagerRestore(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "sessions.json")
+	mgr, err := NewFileSessionManager(filePath, time.Minute, 10, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create session manager: %v", err)
+	}
+	session := mgr.GetSession(NewUser("1", "one", "One"))
+	session.State = STATE_ADD_ANSWER
+	session.BaseName = "startrek"
+	session.NewFact = &Fact{Name: "WARP", Question: "What is warp speed?", Answers: []string{"fast"}}
+	session.AddHistory(NewQuestion("raddfact warp"), []*Answer{NewAnswer("adding new fact")}, nil)
+	intParam := Parameter{Name: "count", DataType: PARAM_DATA_TYPE_INT}
+	session.PluginCall = &PluginCall{
+		Fact:   &Fact{Name: "COUNT", Params: []Parameter{intParam, {Name: "unit"}}},
+		Params: map[string]interface{}{"count": 3, "unit": "km"},
+	}
+	session.Dialog = &DialogState{
+		Fact:   &Fact{Name: "ORDER", Dialog: &Dialog{Steps: []DialogStep{{Name: "count", Param: intParam}}}},
+		Values: map[string]interface{}{"count": 5},
+	}
+	err = mgr.Close()
+	if err != nil {
+		t.Fatalf("failed to close session manager: %v", err)
+	}
+	mgr, err = NewFileSessionManager(filePath, time.Minute, 10, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to restore session manager: %v", err)
+	}
+	defer mgr.Close()
+	restored := mgr.GetSession(NewUser("1", "one", "One"))
+	if restored.State != STATE_ADD_ANSWER || restored.BaseName != "startrek" || restored.User.RealName != "One" {
+		t.Errorf("unexpected restored session: %+v", restored)
+	}
+	if restored.NewFact == nil || restored.NewFact.Name != "WARP" || len(restored.NewFact.Answers) != 1 {
+		t.Errorf("unexpected restored fact draft: %+v", restored.NewFact)
+	}
+	if len(restored.History) != 1 || restored.History[0].Question.Text != "raddfact warp" {
+		t.Errorf("unexpected restored history: %+v", restored.History)
+	}
+	if restored.PluginCall.Params["count"] != 3 || restored.PluginCall.Params["unit"] != "km" || restored.Dialog.Values["count"] != 5 {
+		t.Errorf("expected values of their parameter types: %#v %#v", restored.PluginCall.Params, restored.Dialog.Values)
+	}
+}
+
+func TestFileSessionManagerFlushWhileAnswering(t *testing.T) {
+	mgr, err := NewFileSessionManager(filepath.Join(t.TempDir(), "sessions.json"), time.Minute, 10, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create session manager: %v", err)
+	}
+	defer mgr.Close()
+	session := mgr.GetSession(NewUser("1", "one", "One"))
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				// agents change sessions while holding their lock, as the answer provider does
+				session.Lock()
+				session.AddHistory(NewQuestion(fmt.Sprintf("question %d %d", i, j)), nil, nil)
+				session.State = STATE_ADD_ANSWER
+				session.NewFact = &Fact{Name: fmt.Sprintf("FACT%d", j)}
+				session.Unlock()
+			}
+		}(i)
+	}
+	for i := 0; i < 20; i++ {
+		err = mgr.(*FileSessionManager).Flush()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,201 @@
+/**
+ * Copyright 2024 Boris Wolf
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	DEFAULT_SESSION_FLUSH_INTERVAL = 10 * time.Second
+	SESSION_FILE_CONFIG            = "sessionfile"
+	SESSION_FLUSH_CONFIG           = "sessionflush"
+)
+
+// FileSessionManager keeps sessions in memory like the SimpleSessionManager and periodically
+// writes them to a json file from which they are restored on startup.
+type FileSessionManager struct {
+	*SimpleSessionManager
+	filePath      string
+	flushInterval time.Duration
+	lastFlushed   []byte
+	flushed       chan struct{}
+}
+
+type persistedSession struct {
+	Id         string       `json:"id"`
+	LastAccess time.Time    `json:"lastAccess"`
+	Session    *UserSession `json:"session"`
+}
+
+// sessionSnapshot is a persisted session with the session already marshalled.
+type sessionSnapshot struct {
+	Id         string          `json:"id"`
+	LastAccess time.Time       `json:"lastAccess"`
+	Session    json.RawMessage `json:"session"`
+}
+
+func NewFileSessionManager(filePath string, ttl time.Duration, maxSessions int, flushInterval time.Duration) (SessionManager, error) {
+	if flushInterval <= 0 {
+		flushInterval = DEFAULT_SESSION_FLUSH_INTERVAL
+	}
+	mgr := &FileSessionManager{
+		SimpleSessionManager: NewSimpleSessionManager(ttl, maxSessions).(*SimpleSessionManager),
+		filePath:             filePath,
+		flushInterval:        flushInterval,
+		flushed:              make(chan struct{}),
+	}
+	err := mgr.load()
+	if err != nil {
+		mgr.SimpleSessionManager.Close()
+		return nil, err
+	}
+	go mgr.flusher()
+	return mgr, nil
+}
+
+func (mgr *FileSessionManager) load() error {
+	data, err := os.ReadFile(mgr.filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var persisted []*persistedSession
+	err = json.Unmarshal(data, &persisted)
+	if err != nil {
+		return err
+	}
+	mgr.Lock()
+	defer mgr.Unlock()
+	now := time.Now()
+	// oldest first so that the most recent sessions win when over the limit
+	for i := len(persisted) - 1; i >= 0; i-- {
+		p := persisted[i]
+		if p.Id == "" || p.Session == nil || now.Sub(p.LastAccess) >= mgr.ttl {
+			continue
+		}
+		restoreValueTypes(p.Session)
+		mgr.addSession(p.Id, p.Session, p.LastAccess)
+	}
+	mgr.lastFlushed = data
+	log.Info().Int("sessions", len(mgr.sessions)).Str("file", mgr.filePath).Msg("restored sessions")
+	return nil
+}
+
+// restoreValueTypes converts the values of unfinished plugin calls and dialogs back to the data types
+// of their parameters, json decodes all numbers as float64.
+func restoreValueTypes(session *UserSession) {
+	if call := session.PluginCall; call != nil && call.Fact != nil && call.Params != nil {
+		for idx := range call.Fact.Params {
+			name := call.Fact.Params[idx].GetName(idx)
+			if v, ok := call.Params[name]; ok {
+				value, err := call.Fact.Params[idx].Validate(v)
+				if err == nil {
+					call.Params[name] = value
+				}
+			}
+		}
+	}
+	if d := session.Dialog; d != nil && d.Fact != nil && d.Fact.Dialog != nil && d.Values != nil {
+		for idx := range d.Fact.Dialog.Steps {
+			step := &d.Fact.Dialog.Steps[idx]
+			if v, ok := d.Values[step.Name]; ok {
+				value, err := step.Param.Validate(v)
+				if err == nil {
+					d.Values[step.Name] = value
+				}
+			}
+		}
+	}
+}
+
+// Flush writes all sessions to disk unless nothing changed since the last flush. Each session is
+// marshalled under its own lock, the lock of the manager is not held meanwhile as sessions are locked
+// while answering questions, which may need the manager.
+func (mgr *FileSessionManager) Flush() error {
+	mgr.Lock()
+	entries := make([]sessionEntry, 0, mgr.lru.Len())
+	for elem := mgr.lru.Front(); elem != nil; elem = elem.Next() {
+		entries = append(entries, *elem.Value.(*sessionEntry))
+	}
+	mgr.Unlock()
+	snapshots := make([]*sessionSnapshot, 0, len(entries))
+	for _, entry := range entries {
+		entry.session.Lock()
+		data, err := json.Marshal(entry.session)
+		entry.session.Unlock()
+		if err != nil {
+			return err
+		}
+		snapshots = append(snapshots, &sessionSnapshot{entry.id, entry.lastAccess, data})
+	}
+	data, err := json.MarshalIndent(snapshots, "", "\t")
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(data, mgr.lastFlushed) {
+		return nil
+	}
+	tmpFile := mgr.filePath + ".tmp"
+	err = os.MkdirAll(filepath.Dir(mgr.filePath), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(tmpFile, data, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpFile, mgr.filePath)
+	if err != nil {
+		return err
+	}
+	mgr.lastFlushed = data
+	return nil
+}
+
+func (mgr *FileSessionManager) flusher() {
+	defer close(mgr.flushed)
+	ticker := time.NewTicker(mgr.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-mgr.done:
+			return
+		case <-ticker.C:
+			err := mgr.Flush()
+			if err != nil {
+				log.Error().Err(err).Str("file", mgr.filePath).Msg("failed to persist sessions")
+			}
+		}
+	}
+}
+
+// Close stops the background flusher and writes the final state of all sessions.
+func (mgr *FileSessionManager) Close() error {
+	mgr.SimpleSessionManager.Close()
+	<-mgr.flushed
+	return mgr.Flush()
+}
@@ -19,6 +19,7 @@ package main
 import (
 	"fmt"
 	"strings"
+	"unicode"
 )
 
 type SimpleAnswerProvider struct {
@@ -28,11 +29,36 @@ func NewSimpleAnswerProvider() AnswerProvider {
 	return new(SimpleAnswerProvider)
 }
 
+// IsSmallTalk tells whether the simple answer provider greets rather than admitting it has no answer.
+func IsSmallTalk(question *Question) bool {
+	return isGreeting(question) || isFarewell(question)
+}
+
+func isGreeting(question *Question) bool {
+	return hasWord(question, "hello", "hi")
+}
+
+func isFarewell(question *Question) bool {
+	return hasWord(question, "bye")
+}
+
+// hasWord matches whole words only, so that e.g. "which" does not count as a greeting.
+func hasWord(question *Question, words ...string) bool {
+	for _, field := range strings.FieldsFunc(strings.ToLower(question.Text), func(r rune) bool { return !unicode.IsLetter(r) }) {
+		for _, word := range words {
+			if field == word {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (sap *SimpleAnswerProvider) GetAnswers(session *UserSession, question *Question) ([]*Answer, error) {
 	answer := new(Answer)
-	if strings.Contains(question.Text, "hello") || strings.Contains(question.Text, "hi") {
+	if isGreeting(question) {
 		answer.Text = fmt.Sprintf("Hello %s", session.User.RealName)
-	} else if strings.Contains(question.Text, "bye") {
+	} else if isFarewell(question) {
 		answer.Text = fmt.Sprintf("Good bye %s", session.User.RealName)
 	} else {
 		answer.Text = fmt.Sprintf("Sorry, I don't have the answers yet, %s", session.User.RealName)
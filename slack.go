@@ -18,8 +18,10 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 	"sync"
 
 	"github.com/rs/zerolog/log"
@@ -32,44 +34,90 @@ const (
 	SLACK_OAUTH_TOKEN = "slackOauthToken"
 	SLACK_APP_TOKEN   = "slackAppToken"
 	SLACK_CHANNEL_ID  = "slackChannelId"
+	SLACK_API_URL     = "slackApiUrl" // optional, e.g. a local mock of the slack api
 )
 
+const (
+	SLACK_CHANNEL_TYPE_IM  = "im"
+	SLACK_IMAGE_TEXT       = "image generated by OpenAI"
+	SLACK_MAX_SECTION_TEXT = 3000
+	SLACK_MAX_BUTTON_TEXT  = 75
+	SLACK_MAX_BLOCKS       = 50
+	SLACK_EDIT_FACT        = "reditfact"
+	SLACK_ACTION_CHOICE    = "agentsmith_choice"
+	SLACK_FACT_VIEW        = "agentsmith_fact"
+	SLACK_FACT_NAME        = "name"
+	SLACK_FACT_QUESTION    = "question"
+	SLACK_FACT_ANSWERS     = "answers"
+	SLACK_FACT_LINKS       = "links"
+	SLACK_FACT_LABELS      = "labels"
+	SLACK_FACT_PLUGIN      = "plugin"
+	SLACK_MAX_ANSWERED     = 1000
+)
+
+// slackFactView is kept in the private metadata of the modal for adding and editing facts.
+type slackFactView struct {
+	Channel  string `json:"channel"`
+	FactName string `json:"factName"`
+	IsNew    bool   `json:"isNew"`
+}
+
 type SlackAgent struct {
+	sync.Mutex
 	client         *slack.Client
 	secretProvider SecretProvider
 	answerProvider AnswerProvider
 	sessionMgr     SessionManager
+	feedback       FeedbackStore
+	answered       map[string]*HistoryEntry // answered questions by channel and timestamp of the answer messages
+	answeredOrder  []string
 }
 
-func NewSlackAgent(secretProvider SecretProvider, answerProvider AnswerProvider, sessionManager SessionManager) Agent {
+func NewSlackAgent(secretProvider SecretProvider, answerProvider AnswerProvider, sessionManager SessionManager, feedback FeedbackStore) Agent {
 	sa := SlackAgent{
 		secretProvider: secretProvider,
 		answerProvider: answerProvider,
 		sessionMgr:     sessionManager,
+		feedback:       feedback,
+		answered:       make(map[string]*HistoryEntry),
+		answeredOrder:  make([]string, 0),
 	}
 	return &sa
 }
 
-func (sa *SlackAgent) LaunchAgent(wg sync.WaitGroup) {
+func (sa *SlackAgent) LaunchAgent(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	err := sa.run(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("slack agent failed")
+	}
+}
+
+// run connects to slack in socket mode and handles events until the context is cancelled.
+func (sa *SlackAgent) run(ctx context.Context) error {
 	if sa.secretProvider.GetSecret(SLACK_OAUTH_TOKEN) == "" {
-		log.Error().Msg("missing secret slackOauthToken")
-		return
+		return errors.New("missing secret slackOauthToken")
 	}
 	if sa.secretProvider.GetSecret(SLACK_APP_TOKEN) == "" {
-		log.Error().Msg("missing secret slackAppToken")
-		return
+		return errors.New("missing secret slackAppToken")
 	}
 	if sa.secretProvider.GetSecret(SLACK_CHANNEL_ID) == "" {
-		log.Error().Msg("missing secret slackChannelId")
-		return
+		return errors.New("missing secret slackChannelId")
 	}
-	sa.client = slack.New(sa.secretProvider.GetSecret(SLACK_OAUTH_TOKEN), slack.OptionDebug(true), slack.OptionAppLevelToken(sa.secretProvider.GetSecret(SLACK_APP_TOKEN)))
+	options := []slack.Option{slack.OptionDebug(true), slack.OptionAppLevelToken(sa.secretProvider.GetSecret(SLACK_APP_TOKEN))}
+	if apiUrl := sa.secretProvider.GetSecret(SLACK_API_URL); apiUrl != "" {
+		if !strings.HasSuffix(apiUrl, "/") {
+			apiUrl += "/"
+		}
+		options = append(options, slack.OptionAPIURL(apiUrl))
+	}
+	sa.client = slack.New(sa.secretProvider.GetSecret(SLACK_OAUTH_TOKEN), options...)
 	socketClient := socketmode.New(
 		sa.client,
 		socketmode.OptionDebug(true),
 		//socketmode.OptionLog(log.Logger),
 	)
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	go func(ctx context.Context, client *slack.Client, socketClient *socketmode.Client) {
 		for {
@@ -90,16 +138,44 @@ func (sa *SlackAgent) LaunchAgent(wg sync.WaitGroup) {
 					if err != nil {
 						log.Printf("%s\n", err.Error())
 					}
+				case socketmode.EventTypeSlashCommand:
+					cmd, ok := event.Data.(slack.SlashCommand)
+					if !ok {
+						log.Printf("Could not type cast the event to a slash command: %v\n", event)
+						continue
+					}
+					socketClient.Ack(*event.Request)
+					err := sa.handleSlashCommand(cmd, client)
+					if err != nil {
+						log.Printf("%s\n", err.Error())
+					}
+				case socketmode.EventTypeInteractive:
+					callback, ok := event.Data.(slack.InteractionCallback)
+					if !ok {
+						log.Printf("Could not type cast the event to an interaction: %v\n", event)
+						continue
+					}
+					socketClient.Ack(*event.Request)
+					err := sa.handleInteraction(callback, client)
+					if err != nil {
+						log.Printf("%s\n", err.Error())
+					}
 				}
 			}
 		}
 	}(ctx, sa.client, socketClient)
-	sa.postAttachment("Bot Message", "agent launched")
+	err := sa.postAttachment("Bot Message", "agent launched")
+	if err != nil {
+		log.Error().Err(err).Msg("failed to post launch message")
+	}
 	log.Info().Msg("launching slack agent")
-	socketClient.Run()
+	err = socketClient.RunContext(ctx)
 	log.Info().Msg("stopping slack agent")
 	sa.postAttachment("Bot Message", "agent stopped")
-	wg.Done()
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
 }
 
 func (sa *SlackAgent) handleEventMessage(event slackevents.EventsAPIEvent, client *slack.Client) error {
@@ -108,10 +184,23 @@ func (sa *SlackAgent) handleEventMessage(event slackevents.EventsAPIEvent, clien
 		innerEvent := event.InnerEvent
 		switch evnt := innerEvent.Data.(type) {
 		case *slackevents.AppMentionEvent:
-			err := sa.handleAppMentionEventToBot(evnt, client)
-			if err != nil {
-				return err
+			if evnt.BotID != "" {
+				return nil
+			}
+			// answers to mentions in a channel always go to the thread of the mention
+			threadTs := evnt.ThreadTimeStamp
+			if threadTs == "" {
+				threadTs = evnt.TimeStamp
+			}
+			return sa.handleQuestion(client, evnt.User, evnt.Channel, threadTs, evnt.Text)
+		case *slackevents.MessageEvent:
+			// direct messages, ignoring edits, bot messages and other sub types
+			if evnt.ChannelType != SLACK_CHANNEL_TYPE_IM || evnt.BotID != "" || evnt.SubType != "" || evnt.User == "" {
+				return nil
 			}
+			return sa.handleQuestion(client, evnt.User, evnt.Channel, evnt.ThreadTimeStamp, evnt.Text)
+		case *slackevents.ReactionAddedEvent:
+			return sa.handleReaction(client, evnt)
 		}
 	default:
 		return errors.New("unsupported event type")
@@ -119,58 +208,321 @@ func (sa *SlackAgent) handleEventMessage(event slackevents.EventsAPIEvent, clien
 	return nil
 }
 
-func (sa *SlackAgent) handleAppMentionEventToBot(event *slackevents.AppMentionEvent, client *slack.Client) error {
-	slackUser, err := client.GetUserInfo(event.User)
+// getSessionId returns the id of the session of a user in a thread, or in a direct message channel
+// outside of threads.
+func (sa *SlackAgent) getSessionId(userId, channel, threadTs string) string {
+	id := "slack-" + channel + "-" + userId
+	if threadTs != "" {
+		id += "-" + threadTs
+	}
+	return id
+}
+
+func (sa *SlackAgent) getUser(client *slack.Client, userId, sessionId string) (*User, error) {
+	slackUser, err := client.GetUserInfo(userId)
+	if err != nil {
+		return nil, err
+	}
+	user := NewUser(sessionId, slackUser.Name, slackUser.RealName).WithAgent(AGENT_SLACK)
+	// roles are granted to the slack user rather than to the thread
+	user.Login = slackUser.ID
+	return user, nil
+}
+
+func (sa *SlackAgent) getSession(client *slack.Client, userId, channel, threadTs string) (*UserSession, error) {
+	user, err := sa.getUser(client, userId, sa.getSessionId(userId, channel, threadTs))
+	if err != nil {
+		return nil, err
+	}
+	return sa.sessionMgr.GetSession(user), nil
+}
+
+func (sa *SlackAgent) handleQuestion(client *slack.Client, userId, channel, threadTs, text string) error {
+	session, err := sa.getSession(client, userId, channel, threadTs)
 	if err != nil {
 		return err
 	}
-	user := NewUser(slackUser.ID, slackUser.Name, slackUser.RealName)
-	session := sa.sessionMgr.GetSession(user)
-	question := NewQuestion(event.Text)
+	question := NewQuestion(text)
 	answers, err := sa.answerProvider.GetAnswers(session, question)
 	if err != nil {
-		attachment := slack.Attachment{}
-		attachment.Text = err.Error()
-		attachment.Color = "#4a3030"
-		_, _, err = client.PostMessage(event.Channel, slack.MsgOptionAttachments(attachment))
+		return sa.postError(client, channel, threadTs, err)
+	}
+	history := session.GetQuestionHistory(question)
+	return sa.postAnswers(client, channel, threadTs, answers, history)
+}
+
+// rememberAnswer keeps the question of an answer message for collecting feedback by reactions.
+func (sa *SlackAgent) rememberAnswer(channel, ts string, history *HistoryEntry) {
+	sa.Lock()
+	defer sa.Unlock()
+	key := channel + "-" + ts
+	sa.answered[key] = history
+	sa.answeredOrder = append(sa.answeredOrder, key)
+	if len(sa.answeredOrder) > SLACK_MAX_ANSWERED {
+		delete(sa.answered, sa.answeredOrder[0])
+		sa.answeredOrder = sa.answeredOrder[1:]
+	}
+}
+
+// handleReaction records thumbs up and down reactions to answers as feedback.
+func (sa *SlackAgent) handleReaction(client *slack.Client, evnt *slackevents.ReactionAddedEvent) error {
+	// skin tones are appended to the name of the reaction, e.g. +1::skin-tone-2
+	rating, err := ParseRating(strings.Split(evnt.Reaction, "::")[0])
+	if err != nil || evnt.Item.Type != "message" {
+		return nil
+	}
+	sa.Lock()
+	history := sa.answered[evnt.Item.Channel+"-"+evnt.Item.Timestamp]
+	sa.Unlock()
+	if history == nil {
+		return nil
+	}
+	user, err := sa.getUser(client, evnt.User, sa.getSessionId(evnt.User, evnt.Item.Channel, ""))
+	if err != nil {
+		return err
+	}
+	RecordFeedback(sa.feedback, NewFeedbackEntry(user, history, rating))
+	return nil
+}
+
+// handleSlashCommand opens the fact form for adding or editing facts and asks any other text like a
+// mention of the bot.
+func (sa *SlackAgent) handleSlashCommand(cmd slack.SlashCommand, client *slack.Client) error {
+	tokens := strings.Fields(cmd.Text)
+	if len(tokens) == 0 || (tokens[0] != R_ADD_FACT && tokens[0] != SLACK_EDIT_FACT) {
+		return sa.handleQuestion(client, cmd.UserID, cmd.ChannelID, "", cmd.Text)
+	}
+	session, err := sa.getSession(client, cmd.UserID, cmd.ChannelID, "")
+	if err != nil {
+		return err
+	}
+	fe, ok := sa.answerProvider.(FactEditor)
+	if !ok {
+		return sa.postError(client, cmd.ChannelID, "", errors.New("editing facts is not supported"))
+	}
+	fact := new(Fact)
+	isNew := tokens[0] == R_ADD_FACT
+	if len(tokens) > 1 {
+		fact.Name = strings.ToUpper(tokens[1])
+	}
+	if !isNew {
+		if len(tokens) < 2 {
+			return sa.postError(client, cmd.ChannelID, "", errors.New("missing parameter fact name"))
+		}
+		fact, err = fe.GetFact(session, tokens[1])
 		if err != nil {
-			return fmt.Errorf("failed to post message: %w", err)
+			return sa.postError(client, cmd.ChannelID, "", err)
 		}
-	} else {
-		for _, a := range answers {
-			if a.Text != "" {
-				attachment := slack.Attachment{}
-				attachment.Text = a.Text
-				attachment.Color = "#4af030"
-				_, _, err = client.PostMessage(event.Channel, slack.MsgOptionAttachments(attachment))
-				if err != nil {
-					return fmt.Errorf("failed to post message: %w", err)
-				}
-			}
-			if a.ImageLink != "" {
-				attachment := slack.Attachment{}
-				attachment.Text = "image generated by OpenAI"
-				attachment.ImageURL = a.ImageLink
-				attachment.Color = "#4af030"
-				_, _, err = client.PostMessage(event.Channel, slack.MsgOptionAttachments(attachment))
-				if err != nil {
-					return fmt.Errorf("failed to post message: %w", err)
-				}
-			}
-			if a.Link != "" {
-				attachment := slack.Attachment{}
-				attachment.Text = a.Link
-				attachment.Color = "#4af030"
-				_, _, err = client.PostMessage(event.Channel, slack.MsgOptionAttachments(attachment))
-				if err != nil {
-					return fmt.Errorf("failed to post message: %w", err)
-				}
+	}
+	_, err = client.OpenView(cmd.TriggerID, sa.factView(cmd.ChannelID, fact, isNew))
+	if err != nil {
+		return fmt.Errorf("failed to open view: %w", err)
+	}
+	return nil
+}
+
+func (sa *SlackAgent) handleInteraction(callback slack.InteractionCallback, client *slack.Client) error {
+	if callback.Type == slack.InteractionTypeBlockActions {
+		for _, action := range callback.ActionCallback.BlockActions {
+			if strings.HasPrefix(action.ActionID, SLACK_ACTION_CHOICE) {
+				// a picked choice is asked in the thread the choices were offered in
+				return sa.handleQuestion(client, callback.User.ID, callback.Channel.ID, callback.Message.ThreadTimestamp, action.Value)
 			}
 		}
+	} else if callback.Type == slack.InteractionTypeViewSubmission && callback.View.CallbackID == SLACK_FACT_VIEW {
+		return sa.submitFactView(callback, client)
 	}
 	return nil
 }
 
+// factView creates the modal form for adding a new fact or editing an existing one.
+func (sa *SlackAgent) factView(channel string, fact *Fact, isNew bool) slack.ModalViewRequest {
+	metadata, _ := json.Marshal(slackFactView{channel, fact.Name, isNew})
+	title := "Edit Fact"
+	if isNew {
+		title = "Add Fact"
+	}
+	blocks := make([]slack.Block, 0)
+	if isNew {
+		blocks = append(blocks, sa.inputBlock(SLACK_FACT_NAME, "Name", fact.Name, false, false))
+	} else {
+		blocks = append(blocks, slack.NewSectionBlock(slack.NewTextBlockObject(slack.MarkdownType, "*"+fact.Name+"*", false, false), nil, nil))
+	}
+	blocks = append(blocks,
+		sa.inputBlock(SLACK_FACT_QUESTION, "Question", fact.Question, false, false),
+		sa.inputBlock(SLACK_FACT_ANSWERS, "Answers, one per line", strings.Join(fact.Answers, "\n"), true, true),
+		sa.inputBlock(SLACK_FACT_LINKS, "Links, one per line", strings.Join(fact.Links, "\n"), true, true),
+		sa.inputBlock(SLACK_FACT_LABELS, "Labels, comma separated", strings.Join(fact.Labels, ", "), false, true),
+		sa.inputBlock(SLACK_FACT_PLUGIN, "Plugin", fact.Plugin, false, true),
+	)
+	return slack.ModalViewRequest{
+		Type:            slack.VTModal,
+		Title:           slack.NewTextBlockObject(slack.PlainTextType, title, false, false),
+		Submit:          slack.NewTextBlockObject(slack.PlainTextType, "Save", false, false),
+		Close:           slack.NewTextBlockObject(slack.PlainTextType, "Cancel", false, false),
+		Blocks:          slack.Blocks{BlockSet: blocks},
+		PrivateMetadata: string(metadata),
+		CallbackID:      SLACK_FACT_VIEW,
+	}
+}
+
+func (sa *SlackAgent) inputBlock(id, label, value string, multiline, optional bool) *slack.InputBlock {
+	element := slack.NewPlainTextInputBlockElement(nil, id).WithInitialValue(value).WithMultiline(multiline)
+	block := slack.NewInputBlock(id, slack.NewTextBlockObject(slack.PlainTextType, label, false, false), nil, element)
+	block.Optional = optional
+	return block
+}
+
+// submitFactView saves the fact of a submitted form and posts the outcome to the channel the form
+// was opened from.
+func (sa *SlackAgent) submitFactView(callback slack.InteractionCallback, client *slack.Client) error {
+	var view slackFactView
+	err := json.Unmarshal([]byte(callback.View.PrivateMetadata), &view)
+	if err != nil {
+		return err
+	}
+	session, err := sa.getSession(client, callback.User.ID, view.Channel, "")
+	if err != nil {
+		return err
+	}
+	fe, ok := sa.answerProvider.(FactEditor)
+	if !ok {
+		return sa.postError(client, view.Channel, "", errors.New("editing facts is not supported"))
+	}
+	values := make(map[string]map[string]slack.BlockAction)
+	if callback.View.State != nil {
+		values = callback.View.State.Values
+	}
+	getValue := func(id string) string {
+		return strings.TrimSpace(values[id][id].Value)
+	}
+	fact := new(Fact)
+	if view.IsNew {
+		fact.Name = getValue(SLACK_FACT_NAME)
+	} else {
+		existing, err := fe.GetFact(session, view.FactName)
+		if err != nil {
+			return sa.postError(client, view.Channel, "", err)
+		}
+		// keep params, webhooks and other settings the form does not show
+		*fact = *existing
+	}
+	fact.Question = getValue(SLACK_FACT_QUESTION)
+	fact.Answers = sa.splitValue(getValue(SLACK_FACT_ANSWERS), "\n")
+	fact.Links = sa.splitValue(getValue(SLACK_FACT_LINKS), "\n")
+	fact.Labels = sa.splitValue(getValue(SLACK_FACT_LABELS), ",")
+	fact.Plugin = getValue(SLACK_FACT_PLUGIN)
+	answers, err := fe.SaveFact(session, fact, view.IsNew)
+	if err != nil {
+		return sa.postError(client, view.Channel, "", err)
+	}
+	return sa.postAnswers(client, view.Channel, "", answers, nil)
+}
+
+func (sa *SlackAgent) splitValue(value, sep string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(value, sep) {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// postAnswers posts all answers of a reply in one message, which is only split where slack limits
+// the number of blocks of a message.
+func (sa *SlackAgent) postAnswers(client *slack.Client, channel, threadTs string, answers []*Answer, history *HistoryEntry) error {
+	blocks := make([]slack.Block, 0)
+	fallbacks := make([]string, 0)
+	for _, a := range answers {
+		blocks = append(blocks, sa.answerBlocks(a)...)
+		if a.Text != "" {
+			fallbacks = append(fallbacks, a.Text)
+		} else if a.Link != "" {
+			fallbacks = append(fallbacks, a.Link)
+		} else if a.ImageLink != "" {
+			fallbacks = append(fallbacks, SLACK_IMAGE_TEXT)
+		}
+	}
+	fallback := strings.Join(fallbacks, "\n")
+	for len(blocks) > 0 {
+		n := min(len(blocks), SLACK_MAX_BLOCKS)
+		ts, err := sa.postBlocks(client, channel, threadTs, fallback, blocks[:n])
+		if err != nil {
+			return err
+		}
+		if history != nil {
+			sa.rememberAnswer(channel, ts, history)
+		}
+		blocks = blocks[n:]
+	}
+	return nil
+}
+
+func (sa *SlackAgent) postError(client *slack.Client, channel, threadTs string, err error) error {
+	_, err = sa.postBlocks(client, channel, threadTs, err.Error(), sa.errorBlocks(err))
+	return err
+}
+
+// postBlocks posts a message and returns its timestamp.
+func (sa *SlackAgent) postBlocks(client *slack.Client, channel, threadTs, fallback string, blocks []slack.Block) (string, error) {
+	options := []slack.MsgOption{
+		slack.MsgOptionText(fallback, false),
+		slack.MsgOptionBlocks(blocks...),
+	}
+	if threadTs != "" {
+		options = append(options, slack.MsgOptionTS(threadTs))
+	}
+	_, ts, err := client.PostMessage(channel, options...)
+	if err != nil {
+		return "", fmt.Errorf("failed to post message: %w", err)
+	}
+	return ts, nil
+}
+
+// textBlocks splits a text into sections as slack limits the length of the text of a section.
+func (sa *SlackAgent) textBlocks(text string) []slack.Block {
+	blocks := make([]slack.Block, 0)
+	runes := []rune(text)
+	for len(runes) > 0 {
+		n := len(runes)
+		if n > SLACK_MAX_SECTION_TEXT {
+			n = SLACK_MAX_SECTION_TEXT
+		}
+		blocks = append(blocks, slack.NewSectionBlock(slack.NewTextBlockObject(slack.MarkdownType, string(runes[:n]), false, false), nil, nil))
+		runes = runes[n:]
+	}
+	return blocks
+}
+
+// answerBlocks combines text, link and image of an answer in a single message.
+func (sa *SlackAgent) answerBlocks(a *Answer) []slack.Block {
+	blocks := sa.textBlocks(a.Text)
+	if a.Link != "" {
+		blocks = append(blocks, slack.NewSectionBlock(slack.NewTextBlockObject(slack.MarkdownType, "<"+a.Link+">", false, false), nil, nil))
+	}
+	if a.ImageLink != "" {
+		blocks = append(blocks, slack.NewImageBlock(a.ImageLink, SLACK_IMAGE_TEXT, "", nil))
+	}
+	if len(a.Choices) > 0 {
+		buttons := make([]slack.BlockElement, 0)
+		for idx, c := range a.Choices {
+			label := []rune(c)
+			if len(label) > SLACK_MAX_BUTTON_TEXT {
+				label = append(label[:SLACK_MAX_BUTTON_TEXT-3], []rune("...")...)
+			}
+			buttons = append(buttons, slack.NewButtonBlockElement(fmt.Sprintf("%s_%d", SLACK_ACTION_CHOICE, idx), c, slack.NewTextBlockObject(slack.PlainTextType, string(label), false, false)))
+		}
+		blocks = append(blocks, slack.NewActionBlock("", buttons...))
+	}
+	return blocks
+}
+
+func (sa *SlackAgent) errorBlocks(err error) []slack.Block {
+	return sa.textBlocks(":warning: " + err.Error())
+}
+
 func (sa *SlackAgent) postAttachment(pretext, text string) error {
 	attachment := slack.Attachment{
 		Pretext: pretext,
@@ -0,0 +1,421 @@
+/**
+ * Copyright 2024 Boris Wolf
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/slackevents"
+)
+
+const SLACK_UNKNOWN_USER = "UNKNOWN"
+
+type testSlackAnswerProvider struct {
+	sessions []*UserSession
+}
+
+func (tap *testSlackAnswerProvider) GetAnswers(session *UserSession, question *Question) ([]*Answer, error) {
+	tap.sessions = append(tap.sessions, session)
+	if question.Text == "fail" {
+		return nil, errors.New("knowledge base unavailable")
+	}
+	answer := NewAnswer("answer to " + question.Text).WithLink("https://example.com").WithImageLink("https://example.com/img.png")
+	answer.FactName = "TEST"
+	session.AddHistory(question, []*Answer{answer}, nil).KnowledgeBase = "startrek"
+	return []*Answer{answer}, nil
+}
+
+// mockSlackServer mocks the slack web api and the socket mode websocket, recording the form values of
+// posted messages and opened views.
+type mockSlackServer struct {
+	*httptest.Server
+	sync.Mutex
+	posted    []url.Values
+	envelopes chan interface{} // sent to the connected socket mode client
+	acks      chan string      // envelope ids acknowledged by the client
+}
+
+func newMockSlackServer(t *testing.T) *mockSlackServer {
+	ms := mockSlackServer{
+		posted:    make([]url.Values, 0),
+		envelopes: make(chan interface{}, 10),
+		acks:      make(chan string, 10),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users.info", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.FormValue("user") == SLACK_UNKNOWN_USER {
+			json.NewEncoder(w).Encode(map[string]interface{}{"ok": false, "error": "user_not_found"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"ok":   true,
+			"user": map[string]interface{}{"id": r.FormValue("user"), "name": "kirk", "real_name": "James Kirk"},
+		})
+	})
+	mux.HandleFunc("/chat.postMessage", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		ms.Lock()
+		ms.posted = append(ms.posted, r.Form)
+		ts := fmt.Sprintf("%d.1", len(ms.posted))
+		ms.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "channel": r.FormValue("channel"), "ts": ts})
+	})
+	mux.HandleFunc("/views.open", func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&req)
+		view, _ := json.Marshal(req["view"])
+		ms.Lock()
+		ms.posted = append(ms.posted, url.Values{"trigger_id": {fmt.Sprint(req["trigger_id"])}, "view": {string(view)}})
+		ms.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true})
+	})
+	mux.HandleFunc("/apps.connections.open", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "url": "ws" + strings.TrimPrefix(ms.URL, "http") + "/socket"})
+	})
+	mux.HandleFunc("/socket", ms.handleSocket)
+	ms.Server = httptest.NewServer(mux)
+	t.Cleanup(ms.Close)
+	return &ms
+}
+
+func (ms *mockSlackServer) handleSocket(w http.ResponseWriter, r *http.Request) {
+	// the socket mode client connects with the origin of the slack api
+	upgrader := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	err = conn.WriteJSON(map[string]interface{}{"type": "hello", "num_connections": 1})
+	if err != nil {
+		return
+	}
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			var ack struct {
+				EnvelopeId string `json:"envelope_id"`
+			}
+			if err := conn.ReadJSON(&ack); err != nil {
+				return
+			}
+			ms.acks <- ack.EnvelopeId
+		}
+	}()
+	for {
+		select {
+		case envelope := <-ms.envelopes:
+			if err := conn.WriteJSON(envelope); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+// sendEvent sends an events api envelope over the socket and waits for the client to acknowledge it.
+func (ms *mockSlackServer) sendEvent(t *testing.T, id string, event map[string]interface{}) {
+	ms.envelopes <- map[string]interface{}{
+		"envelope_id":              id,
+		"type":                     "events_api",
+		"accepts_response_payload": false,
+		"payload":                  map[string]interface{}{"type": "event_callback", "team_id": "T1", "api_app_id": "A1", "event": event},
+	}
+	select {
+	case ack := <-ms.acks:
+		if ack != id {
+			t.Fatalf("expected ack for envelope %s, got %s", id, ack)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("envelope %s was not acknowledged", id)
+	}
+}
+
+// waitForPosts waits until n messages have been posted and returns them.
+func (ms *mockSlackServer) waitForPosts(t *testing.T, n int) []url.Values {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		ms.Lock()
+		posted := append([]url.Values{}, ms.posted...)
+		ms.Unlock()
+		if len(posted) >= n {
+			return posted
+		}
+	}
+	t.Fatalf("expected %d messages to be posted", n)
+	return nil
+}
+
+func newTestSlackServer(t *testing.T) (*httptest.Server, *[]url.Values) {
+	ms := newMockSlackServer(t)
+	return ms.Server, &ms.posted
+}
+
+func TestSlackThreadsAndDirectMessages(t *testing.T) {
+	server, posted := newTestSlackServer(t)
+	client := slack.New("token", slack.OptionAPIURL(server.URL+"/"))
+	tap := new(testSlackAnswerProvider)
+	sa := NewSlackAgent(testSecretProvider{}, tap, NewSimpleSessionManager(time.Minute, 10), nil).(*SlackAgent)
+	events := []struct {
+		data     interface{}
+		channel  string
+		threadTs string
+	}{
+		{&slackevents.AppMentionEvent{User: "U1", Channel: "C1", Text: "hello", TimeStamp: "100.1"}, "C1", "100.1"},
+		{&slackevents.AppMentionEvent{User: "U1", Channel: "C1", Text: "again", TimeStamp: "100.2", ThreadTimeStamp: "100.1"}, "C1", "100.1"},
+		{&slackevents.MessageEvent{User: "U1", Channel: "D1", ChannelType: SLACK_CHANNEL_TYPE_IM, Text: "direct"}, "D1", ""},
+		{&slackevents.MessageEvent{User: "U1", Channel: "D1", ChannelType: SLACK_CHANNEL_TYPE_IM, Text: "edited", SubType: "message_changed"}, "", ""},
+		{&slackevents.MessageEvent{Channel: "D1", ChannelType: SLACK_CHANNEL_TYPE_IM, Text: "from bot", BotID: "B1"}, "", ""},
+		{&slackevents.MessageEvent{User: "U1", Channel: "C1", ChannelType: "channel", Text: "chatter"}, "", ""},
+	}
+	expected := 0
+	for _, e := range events {
+		err := sa.handleEventMessage(slackevents.EventsAPIEvent{Type: slackevents.CallbackEvent, InnerEvent: slackevents.EventsAPIInnerEvent{Data: e.data}}, client)
+		if err != nil {
+			t.Fatalf("failed to handle event %+v: %v", e.data, err)
+		}
+		if e.channel == "" {
+			if len(*posted) != expected {
+				t.Errorf("expected event to be ignored: %+v", e.data)
+			}
+			continue
+		}
+		expected++
+		if len(*posted) != expected {
+			t.Fatalf("expected %d messages, got %d", expected, len(*posted))
+		}
+		msg := (*posted)[expected-1]
+		if msg.Get("channel") != e.channel || msg.Get("thread_ts") != e.threadTs {
+			t.Errorf("unexpected channel or thread: %v", msg)
+		}
+		var blocks []map[string]interface{}
+		if err := json.Unmarshal([]byte(msg.Get("blocks")), &blocks); err != nil || len(blocks) != 3 {
+			t.Fatalf("expected text, link and image blocks: %s %v", msg.Get("blocks"), err)
+		}
+		if blocks[0]["type"] != "section" || blocks[2]["type"] != "image" {
+			t.Errorf("unexpected blocks: %s", msg.Get("blocks"))
+		}
+	}
+	if len(tap.sessions) != 3 || tap.sessions[0] != tap.sessions[1] || tap.sessions[0] == tap.sessions[2] {
+		t.Errorf("expected one session per thread")
+	}
+	if tap.sessions[0].User.GetLogin() != "U1" || tap.sessions[0].User.Agent != AGENT_SLACK {
+		t.Errorf("unexpected user: %+v", tap.sessions[0].User)
+	}
+}
+
+func TestSlackCombinedAnswers(t *testing.T) {
+	server, posted := newTestSlackServer(t)
+	client := slack.New("token", slack.OptionAPIURL(server.URL+"/"))
+	sa := NewSlackAgent(testSecretProvider{}, new(testSlackAnswerProvider), NewSimpleSessionManager(time.Minute, 10), nil).(*SlackAgent)
+	answers := []*Answer{NewAnswer("a logical species"), NewAnswer("from the planet Vulcan"), NewAnswer("").WithLink("https://memory-alpha.fandom.com/wiki/Vulcan")}
+	err := sa.postAnswers(client, "C1", "100.1", answers, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var blocks []map[string]interface{}
+	if len(*posted) != 1 || json.Unmarshal([]byte((*posted)[0].Get("blocks")), &blocks) != nil || len(blocks) != 3 {
+		t.Fatalf("expected all answers in one message: %v", *posted)
+	}
+	if (*posted)[0].Get("text") != "a logical species\nfrom the planet Vulcan\nhttps://memory-alpha.fandom.com/wiki/Vulcan" {
+		t.Errorf("unexpected fallback text: %s", (*posted)[0].Get("text"))
+	}
+	answers = make([]*Answer, 0)
+	for i := 0; i < SLACK_MAX_BLOCKS+1; i++ {
+		answers = append(answers, NewAnswer(fmt.Sprintf("answer %d", i)))
+	}
+	err = sa.postAnswers(client, "C1", "100.1", answers, nil)
+	if err != nil || len(*posted) != 3 {
+		t.Errorf("expected answers to be split where slack limits the number of blocks: %d %v", len(*posted), err)
+	}
+}
+
+func TestSlackFactFormAndChoices(t *testing.T) {
+	args := `{}`
+	openai := newTestOpenAIServer(t, &args)
+	t.Cleanup(openai.Close)
+	oai := NewOpenAIHandler(testSecretProvider{OPEN_AI_TOKEN: "test"}).WithBaseUrl(openai.URL)
+	kbm := newTestKnowledgeBaseManager(t, *oai, map[string][]*Fact{DEFAULT_KNOWLEDGE_BASE_NAME: {}})
+	server, posted := newTestSlackServer(t)
+	client := slack.New("token", slack.OptionAPIURL(server.URL+"/"))
+	commandProvider := NewCommandAnswerProvider(kbm, newTestAccessProvider(ROLE_EDITOR), nil, nil, nil)
+	sa := NewSlackAgent(testSecretProvider{}, commandProvider, NewSimpleSessionManager(time.Minute, 10), nil).(*SlackAgent)
+	lastPosted := func() url.Values {
+		return (*posted)[len(*posted)-1]
+	}
+	submit := func(metadata string, values map[string]string) {
+		state := &slack.ViewState{Values: make(map[string]map[string]slack.BlockAction)}
+		for k, v := range values {
+			state.Values[k] = map[string]slack.BlockAction{k: {Value: v}}
+		}
+		callback := slack.InteractionCallback{Type: slack.InteractionTypeViewSubmission, User: slack.User{ID: "U1"}}
+		callback.View = slack.View{CallbackID: SLACK_FACT_VIEW, PrivateMetadata: metadata, State: state}
+		err := sa.handleInteraction(callback, client)
+		if err != nil {
+			t.Fatalf("failed to submit view: %v", err)
+		}
+	}
+	err := sa.handleSlashCommand(slack.SlashCommand{Command: "/agentsmith", Text: "raddfact warp", UserID: "U1", ChannelID: "C1", TriggerID: "T1"}, client)
+	if err != nil {
+		t.Fatalf("failed to handle slash command: %v", err)
+	}
+	var view slack.View
+	json.Unmarshal([]byte(lastPosted().Get("view")), &view)
+	if lastPosted().Get("trigger_id") != "T1" || view.CallbackID != SLACK_FACT_VIEW || !strings.Contains(view.PrivateMetadata, "WARP") {
+		t.Fatalf("expected fact form to be opened: %v", lastPosted())
+	}
+	submit(view.PrivateMetadata, map[string]string{SLACK_FACT_NAME: "warp", SLACK_FACT_QUESTION: "What is warp speed?", SLACK_FACT_ANSWERS: "very fast\n\nfaster than light", SLACK_FACT_LABELS: "warp, speed"})
+	fact := kbm.GetKnowledgeBase(DEFAULT_KNOWLEDGE_BASE_NAME).GetFact("WARP")
+	if fact == nil || len(fact.Answers) != 2 || len(fact.Labels) != 2 || fact.CreatedBy != "kirk" {
+		t.Fatalf("expected fact to be added: %+v", fact)
+	}
+	if lastPosted().Get("channel") != "C1" || !strings.Contains(lastPosted().Get("text"), "added fact WARP") {
+		t.Errorf("unexpected message: %v", lastPosted())
+	}
+	sa.handleSlashCommand(slack.SlashCommand{Text: "reditfact warp", UserID: "U1", ChannelID: "C1", TriggerID: "T2"}, client)
+	json.Unmarshal([]byte(lastPosted().Get("view")), &view)
+	if !strings.Contains(lastPosted().Get("view"), "What is warp speed?") {
+		t.Fatalf("expected edit form with current values: %v", lastPosted())
+	}
+	submit(view.PrivateMetadata, map[string]string{SLACK_FACT_QUESTION: "How fast is warp?", SLACK_FACT_ANSWERS: "very fast"})
+	fact = kbm.GetKnowledgeBase(DEFAULT_KNOWLEDGE_BASE_NAME).GetFact("WARP")
+	if fact.Question != "How fast is warp?" || len(fact.Answers) != 1 || fact.CreatedBy != "kirk" {
+		t.Errorf("expected fact to be updated: %+v", fact)
+	}
+	sa.handleSlashCommand(slack.SlashCommand{Text: "reditfact unknown", UserID: "U1", ChannelID: "C1", TriggerID: "T3"}, client)
+	if !strings.Contains(lastPosted().Get("text"), "no fact by that name") {
+		t.Errorf("expected error message: %v", lastPosted())
+	}
+	sa.handleSlashCommand(slack.SlashCommand{Text: "rnumfacts", UserID: "U1", ChannelID: "C1"}, client)
+	if lastPosted().Get("text") != "1" {
+		t.Errorf("expected command answer: %v", lastPosted())
+	}
+	blocks := sa.answerBlocks(NewAnswer("did you mean").WithChoices([]string{"rnumfacts", "rlistfacts"}))
+	actions, ok := blocks[len(blocks)-1].(*slack.ActionBlock)
+	if !ok || len(actions.Elements.ElementSet) != 2 {
+		t.Fatalf("expected choice buttons: %+v", blocks)
+	}
+	callback := slack.InteractionCallback{Type: slack.InteractionTypeBlockActions, User: slack.User{ID: "U1"}}
+	callback.Channel.ID = "C1"
+	callback.Message.ThreadTimestamp = "100.1"
+	callback.ActionCallback.BlockActions = []*slack.BlockAction{{ActionID: actions.Elements.ElementSet[1].(*slack.ButtonBlockElement).ActionID, Value: "rlistfacts"}}
+	err = sa.handleInteraction(callback, client)
+	if err != nil || lastPosted().Get("thread_ts") != "100.1" || !strings.Contains(lastPosted().Get("text"), "WARP") {
+		t.Errorf("expected picked choice to be answered in thread: %v %v", lastPosted(), err)
+	}
+}
+
+func TestSlackReactionFeedback(t *testing.T) {
+	server, _ := newTestSlackServer(t)
+	client := slack.New("token", slack.OptionAPIURL(server.URL+"/"))
+	feedback, err := NewJSONLFeedbackStore(filepath.Join(t.TempDir(), "feedback.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer feedback.Close()
+	sa := NewSlackAgent(testSecretProvider{}, new(testSlackAnswerProvider), NewSimpleSessionManager(time.Minute, 10), feedback).(*SlackAgent)
+	mention := &slackevents.AppMentionEvent{User: "U1", Channel: "C1", Text: "who are the vulcans?", TimeStamp: "100.1"}
+	err = sa.handleEventMessage(slackevents.EventsAPIEvent{Type: slackevents.CallbackEvent, InnerEvent: slackevents.EventsAPIInnerEvent{Data: mention}}, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reactions := []*slackevents.ReactionAddedEvent{
+		{User: "U2", Reaction: "-1::skin-tone-2", Item: slackevents.Item{Type: "message", Channel: "C1", Timestamp: "1.1"}},
+		{User: "U2", Reaction: "tada", Item: slackevents.Item{Type: "message", Channel: "C1", Timestamp: "1.1"}},
+		{User: "U2", Reaction: "+1", Item: slackevents.Item{Type: "message", Channel: "C1", Timestamp: "9.1"}},
+	}
+	for _, r := range reactions {
+		err = sa.handleEventMessage(slackevents.EventsAPIEvent{Type: slackevents.CallbackEvent, InnerEvent: slackevents.EventsAPIInnerEvent{Data: r}}, client)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := feedback.Query(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Rating != FEEDBACK_DOWN || entries[0].User != "U2" || entries[0].FactName != "TEST" || entries[0].KnowledgeBase != "startrek" || entries[0].Question != "who are the vulcans?" {
+		t.Errorf("unexpected feedback: %+v", entries)
+	}
+}
+
+func TestSlackSocketMode(t *testing.T) {
+	ms := newMockSlackServer(t)
+	secrets := testSecretProvider{SLACK_OAUTH_TOKEN: "xoxb-test", SLACK_APP_TOKEN: "xapp-test", SLACK_CHANNEL_ID: "C0", SLACK_API_URL: ms.URL}
+	tap := new(testSlackAnswerProvider)
+	sa := NewSlackAgent(secrets, tap, NewSimpleSessionManager(time.Minute, 10), nil).(*SlackAgent)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- sa.run(ctx)
+	}()
+	posted := ms.waitForPosts(t, 1)
+	var attachments []slack.Attachment
+	json.Unmarshal([]byte(posted[0].Get("attachments")), &attachments)
+	if posted[0].Get("channel") != "C0" || len(attachments) != 1 || attachments[0].Text != "agent launched" {
+		t.Fatalf("expected launch attachment: %v", posted[0])
+	}
+	ms.sendEvent(t, "1", map[string]interface{}{"type": "app_mention", "user": "U1", "text": "<@B1> who is spock?", "ts": "100.1", "channel": "C1", "event_ts": "100.1"})
+	posted = ms.waitForPosts(t, 2)
+	if posted[1].Get("channel") != "C1" || posted[1].Get("thread_ts") != "100.1" || posted[1].Get("text") != "answer to <@B1> who is spock?" {
+		t.Errorf("expected answer in thread of the mention: %v", posted[1])
+	}
+	ms.sendEvent(t, "2", map[string]interface{}{"type": "message", "channel_type": "channel", "user": "U1", "text": "chatter", "ts": "100.2", "channel": "C1"})
+	// a user who cannot be looked up gets no answer
+	ms.sendEvent(t, "3", map[string]interface{}{"type": "app_mention", "user": SLACK_UNKNOWN_USER, "text": "hello", "ts": "100.3", "channel": "C1", "event_ts": "100.3"})
+	ms.sendEvent(t, "4", map[string]interface{}{"type": "message", "channel_type": "im", "user": "U1", "text": "fail", "ts": "100.4", "channel": "D1"})
+	posted = ms.waitForPosts(t, 3)
+	if len(posted) != 3 || posted[2].Get("channel") != "D1" || posted[2].Get("text") != "knowledge base unavailable" || !strings.Contains(posted[2].Get("blocks"), ":warning: knowledge base unavailable") {
+		t.Errorf("expected error message in direct message channel: %v", posted)
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected agent to stop cleanly: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not stop")
+	}
+	if len(tap.sessions) != 2 || tap.sessions[0].User.Name != "kirk" || tap.sessions[0].User.Agent != AGENT_SLACK || tap.sessions[0] == tap.sessions[1] {
+		t.Errorf("unexpected sessions: %+v", tap.sessions)
+	}
+	posted = ms.waitForPosts(t, 4)
+	json.Unmarshal([]byte(posted[3].Get("attachments")), &attachments)
+	if len(attachments) != 1 || attachments[0].Text != "agent stopped" {
+		t.Errorf("expected stop attachment: %v", posted[3])
+	}
+	err := NewSlackAgent(testSecretProvider{}, tap, NewSimpleSessionManager(time.Minute, 10), nil).(*SlackAgent).run(context.Background())
+	if err == nil || err.Error() != "missing secret slackOauthToken" {
+		t.Errorf("expected missing secret error: %v", err)
+	}
+}
@@ -16,61 +16,195 @@
 
 package main
 
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+const (
+	S_DONE                = "done"
+	S_CANCEL              = "cancel"
+	S_BACK                = "back"
+	S_UNDO                = "undo"
+	S_PREVIEW             = "preview"
+	DEFAULT_DRAFT_TIMEOUT = 15 * time.Minute
+	DRAFT_TIMEOUT_CONFIG  = "drafttimeout"
+	DRAFT_COMMANDS_HINT   = "(type 'undo' to remove the last answer, 'back' to change the question, 'preview' to review the fact or 'cancel' to discard it)"
+)
+
+// ErrDraftTimedOut signals that the draft was discarded and the message still needs to be answered.
+var ErrDraftTimedOut = errors.New("draft timed out")
+
 type StateAnswerProvider struct {
-	kbm *KnowledeBaseManager
+	kbm          *KnowledeBaseManager
+	pm           *PluginManager
+	draftTimeout time.Duration
+	ap           AccessProvider
+	audit        AuditLog
 }
 
-func NewStateAnswerProvider(kbm *KnowledeBaseManager) AnswerProvider {
+func NewStateAnswerProvider(kbm *KnowledeBaseManager, pm *PluginManager, draftTimeout time.Duration, ap AccessProvider, audit AuditLog) AnswerProvider {
+	if draftTimeout <= 0 {
+		draftTimeout = DEFAULT_DRAFT_TIMEOUT
+	}
 	answerProvider := StateAnswerProvider{
 		kbm,
+		pm,
+		draftTimeout,
+		ap,
+		audit,
 	}
 	return &answerProvider
 }
 
+// GetAnswers handles the draft commands and records them in the audit log.
 func (sap *StateAnswerProvider) GetAnswers(session *UserSession, question *Question) ([]*Answer, error) {
+	command := strings.ToLower(strings.TrimSpace(question.Text))
+	if !isDraftCommand(command) {
+		return sap.getAnswers(session, question, nil)
+	}
+	baseName := ""
+	if sap.kbm != nil {
+		baseName = sap.kbm.GetSessionBaseName(session)
+	}
+	entry := NewAuditEntry(session.User, baseName, command)
+	if fact := sap.getDraftFact(session); fact != nil {
+		entry.FactName = fact.Name
+	}
+	answers, err := sap.getAnswers(session, question, entry)
+	if err != nil {
+		entry.WithOutcome(err)
+	}
+	RecordAudit(sap.audit, entry)
+	return answers, err
+}
+
+func (sap *StateAnswerProvider) getAnswers(session *UserSession, question *Question, entry *AuditEntry) ([]*Answer, error) {
 	answers := make([]*Answer, 0)
 	answer := new(Answer)
-	if session.State == STATE_ADD_QUESTION {
-		session.NewFact.Question = question.Text
-		answer.Text += "please provide an answer to this question!\n"
+	command := strings.ToLower(strings.TrimSpace(question.Text))
+	if !session.DraftUpdatedAt.IsZero() && time.Since(session.DraftUpdatedAt) > sap.draftTimeout {
+		answer.Text += "your unfinished " + sap.getDraftName(session) + " timed out and was discarded, reverting to default question/answer state\n"
 		answers = append(answers, answer)
-		session.State = STATE_ADD_ANSWER
+		sap.resetDraft(session)
+		if !isDraftCommand(command) {
+			return answers, ErrDraftTimedOut
+		}
+	} else if command == S_CANCEL {
+		answer.Text += "discarded " + sap.getDraftName(session) + "\n"
+		answers = append(answers, answer)
+		sap.resetDraft(session)
+	} else if session.State == STATE_ADD_PARAMS {
+		session.DraftUpdatedAt = time.Now()
+		return sap.pm.ContinueAnswers(session, question)
+	} else if session.State == STATE_DIALOG {
+		return sap.pm.ContinueDialog(session, question)
+	} else if session.NewFact == nil && (session.State == STATE_ADD_QUESTION || session.State == STATE_ADD_ANSWER) {
+		answer.Text += "no fact to add, reverting to default question/answer state\n"
+		answers = append(answers, answer)
+		sap.resetDraft(session)
+	} else if command == S_PREVIEW && (session.State == STATE_ADD_QUESTION || session.State == STATE_ADD_ANSWER) {
+		buf, _ := json.MarshalIndent(session.NewFact, "", "\t")
+		answer.Text = string(buf)
+		answers = append(answers, answer)
+		session.DraftUpdatedAt = time.Now()
+	} else if session.State == STATE_ADD_QUESTION {
+		if command == S_BACK || command == S_UNDO || command == S_DONE {
+			answer.Text += "please state a question for fact " + session.NewFact.Name + " first or type 'cancel' to discard it!\n"
+		} else {
+			session.NewFact.Question = question.Text
+			answer.Text += "please provide an answer to this question!\n"
+			session.State = STATE_ADD_ANSWER
+		}
+		answers = append(answers, answer)
+		session.DraftUpdatedAt = time.Now()
 	} else if session.State == STATE_ADD_ANSWER {
-		if question.Text == "done" {
-			err := sap.kbm.GetCurrentKnowledgeBase().AddFact(session.NewFact)
+		if command == S_DONE && len(session.NewFact.Answers) == 0 {
+			answer.Text += "please provide at least one answer for fact " + session.NewFact.Name + " first or type 'cancel' to discard it!\n"
+			answers = append(answers, answer)
+			session.DraftUpdatedAt = time.Now()
+		} else if command == S_DONE {
+			baseName := sap.kbm.GetSessionBaseName(session)
+			err := CheckRole(sap.ap, session.User, baseName, ROLE_EDITOR)
+			if err == nil {
+				err = sap.kbm.AddFact(baseName, session.NewFact)
+			}
+			entry.WithFact(session.NewFact.Name, nil, session.NewFact).WithOutcome(err)
 			if err != nil {
+				entry.After = nil
 				answer.Text += "failed to add new fact " + session.NewFact.Name + " to knowledge base: " + err.Error() + "\n"
-				answers = append(answers, answer)
 			} else {
-				err = sap.kbm.GetCurrentEmbeddingsBase().SyncEmbeddings(sap.kbm.GetCurrentKnowledgeBase())
-				if err != nil {
-					answer.Text += "failed to sync embeddings for new fact " + session.NewFact.Name + " for knowledge base: " + err.Error() + "\n"
-					answers = append(answers, answer)
-				}
-				err = sap.kbm.GetCurrentKnowledgeBase().Save()
-				if err != nil {
-					answer.Text += "failed to save knwoledge base for new fact " + session.NewFact.Name + " for knowledge base: " + err.Error() + "\n"
-					answers = append(answers, answer)
-				} else {
-					answer.Text += "added new fact " + session.NewFact.Name + " to knowledge base!\n"
-					answers = append(answers, answer)
-				}
+				answer.Text += "added new fact " + session.NewFact.Name + " to knowledge base!\n"
 			}
-			session.State = STATE_QA
+			answers = append(answers, answer)
+			sap.resetDraft(session)
+		} else if command == S_BACK {
+			answer.Text += "please state a new question for fact " + session.NewFact.Name + ", the current one is: " + session.NewFact.Question + "\n"
+			answers = append(answers, answer)
+			session.State = STATE_ADD_QUESTION
+			session.DraftUpdatedAt = time.Now()
+		} else if command == S_UNDO {
+			if len(session.NewFact.Answers) == 0 {
+				answer.Text += "there is no answer to remove yet, please provide an answer to this question!\n"
+			} else {
+				last := session.NewFact.Answers[len(session.NewFact.Answers)-1]
+				session.NewFact.Answers = session.NewFact.Answers[:len(session.NewFact.Answers)-1]
+				answer.Text += "removed answer: " + last + "\n"
+			}
+			answers = append(answers, answer)
+			session.DraftUpdatedAt = time.Now()
 		} else {
 			if session.NewFact.Answers == nil {
 				session.NewFact.Answers = []string{}
 			}
 			session.NewFact.Answers = append(session.NewFact.Answers, question.Text)
-			answer.Text += "please provide another answer to this question or type 'done' to finish and add fact!\n"
+			answer.Text += "please provide another answer to this question or type 'done' to finish and add fact " + DRAFT_COMMANDS_HINT + "!\n"
 			answers = append(answers, answer)
+			session.DraftUpdatedAt = time.Now()
 		}
 	} else {
 		answer.Text += "unknown state " + session.State + ", reverting to default question/answer state\n"
 		answers = append(answers, answer)
-		session.State = STATE_QA
+		sap.resetDraft(session)
 	}
 	session.LastQuestion = question
 	session.LastAnswer = answers
 	return answers, nil
 }
+
+func isDraftCommand(command string) bool {
+	return command == S_DONE || command == S_CANCEL || command == S_BACK || command == S_UNDO || command == S_PREVIEW
+}
+
+func (sap *StateAnswerProvider) getDraftFact(session *UserSession) *Fact {
+	if session.State == STATE_ADD_PARAMS && session.PluginCall != nil {
+		return session.PluginCall.Fact
+	}
+	if session.State == STATE_DIALOG && session.Dialog != nil {
+		return session.Dialog.Fact
+	}
+	return session.NewFact
+}
+
+func (sap *StateAnswerProvider) getDraftName(session *UserSession) string {
+	if session.State == STATE_ADD_PARAMS && session.PluginCall != nil && session.PluginCall.Fact != nil {
+		return "request " + session.PluginCall.Fact.Name
+	}
+	if session.State == STATE_DIALOG && session.Dialog != nil && session.Dialog.Fact != nil {
+		return "dialog " + session.Dialog.Fact.Name
+	}
+	if session.NewFact != nil {
+		return "fact " + session.NewFact.Name
+	}
+	return "draft"
+}
+
+func (sap *StateAnswerProvider) resetDraft(session *UserSession) {
+	session.State = STATE_QA
+	session.NewFact = nil
+	session.PluginCall = nil
+	session.Dialog = nil
+	session.DraftUpdatedAt = time.Time{}
+}
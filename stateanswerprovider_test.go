@@ -0,0 +1,171 @@
+/**
+ * Copyright 2024 Boris Wolf
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestDraftSession() *UserSession {
+	return &UserSession{
+		User:           NewUser("1", "test", "test"),
+		State:          STATE_ADD_QUESTION,
+		NewFact:        &Fact{Name: "WARP"},
+		DraftUpdatedAt: time.Now(),
+	}
+}
+
+func TestStateDraftCommands(t *testing.T) {
+	sap := NewStateAnswerProvider(nil, nil, time.Minute, newTestAccessProvider(ROLE_ADMIN), nil)
+	session := newTestDraftSession()
+	steps := []struct {
+		text     string
+		state    string
+		contains string
+	}{
+		{"back", STATE_ADD_QUESTION, "first"},
+		{"What is warp speed?", STATE_ADD_ANSWER, "answer"},
+		{"done", STATE_ADD_ANSWER, "at least one answer"},
+		{"very fast", STATE_ADD_ANSWER, "another answer"},
+		{"very slow", STATE_ADD_ANSWER, "another answer"},
+		{"undo", STATE_ADD_ANSWER, "removed answer: very slow"},
+		{"preview", STATE_ADD_ANSWER, "very fast"},
+		{"back", STATE_ADD_QUESTION, "What is warp speed?"},
+		{"How fast is warp?", STATE_ADD_ANSWER, "answer"},
+		{"Cancel", STATE_QA, "discarded fact WARP"},
+	}
+	for _, step := range steps {
+		answers, err := sap.GetAnswers(session, NewQuestion(step.text))
+		if err != nil {
+			t.Fatalf("failed to get answers for %s: %v", step.text, err)
+		}
+		if session.State != step.state {
+			t.Errorf("unexpected state after %s: %s", step.text, session.State)
+		}
+		if len(answers) != 1 || !strings.Contains(answers[0].Text, step.contains) {
+			t.Errorf("unexpected answers after %s: %+v", step.text, answers)
+		}
+		if step.text == "How fast is warp?" && (session.NewFact.Question != step.text || len(session.NewFact.Answers) != 1) {
+			t.Errorf("unexpected draft: %+v", session.NewFact)
+		}
+	}
+	if session.NewFact != nil {
+		t.Errorf("expected draft to be discarded")
+	}
+}
+
+func TestStateDraftTimeout(t *testing.T) {
+	sap := NewStateAnswerProvider(nil, nil, time.Minute, newTestAccessProvider(ROLE_ADMIN), nil)
+	session := newTestDraftSession()
+	session.DraftUpdatedAt = time.Now().Add(-2 * time.Minute)
+	answers, err := sap.GetAnswers(session, NewQuestion("What is warp speed?"))
+	if err != ErrDraftTimedOut {
+		t.Fatalf("expected message to be left for answering: %v", err)
+	}
+	if session.State != STATE_QA || session.NewFact != nil || !strings.Contains(answers[0].Text, "timed out") {
+		t.Errorf("expected draft to time out, state %s: %+v", session.State, answers)
+	}
+	session = newTestDraftSession()
+	session.DraftUpdatedAt = time.Now().Add(-2 * time.Minute)
+	answers, err = sap.GetAnswers(session, NewQuestion("done"))
+	if err != nil || session.State != STATE_QA || !strings.Contains(answers[0].Text, "timed out") {
+		t.Errorf("expected draft command to time out: %+v %v", answers, err)
+	}
+}
+
+func TestUberDraftTimeout(t *testing.T) {
+	args := `{}`
+	openai := newTestOpenAIServer(t, &args)
+	t.Cleanup(openai.Close)
+	secretProvider := testSecretProvider{OPEN_AI_TOKEN: "test"}
+	oai := NewOpenAIHandler(secretProvider).WithBaseUrl(openai.URL)
+	kbm := newTestKnowledgeBaseManager(t, *oai, map[string][]*Fact{DEFAULT_KNOWLEDGE_BASE_NAME: {
+		{Name: "PASSWORD", Question: "How do I reset my password?", Answers: []string{"use the reset link"}},
+	}})
+	uap := NewUberAnswerProvider(kbm, *oai, testConfigProvider{DRAFT_TIMEOUT_CONFIG: "1m"}, secretProvider, newTestAccessProvider(ROLE_EDITOR), nil, nil, nil)
+	session := newTestDraftSession()
+	session.DraftUpdatedAt = time.Now().Add(-2 * time.Minute)
+	answers, err := uap.GetAnswers(session, NewQuestion("How do I reset my password?"))
+	if err != nil {
+		t.Fatalf("failed to get answers: %v", err)
+	}
+	if session.State != STATE_QA || len(answers) != 2 || !strings.Contains(answers[0].Text, "timed out") || answers[1].Text != "use the reset link" {
+		t.Errorf("expected message to be answered after draft timed out: %+v", answers)
+	}
+}
+
+func TestStateDialog(t *testing.T) {
+	args := `{}`
+	pm, _, stop := newTestPluginManager(t, &args)
+	defer stop()
+	tpap := new(testPluginAnswerProvider)
+	pm.RegisterPlugin("INCIDENT_PLUGIN", tpap)
+	sap := NewStateAnswerProvider(nil, pm, time.Minute, newTestAccessProvider(ROLE_ADMIN), nil)
+	fact := &Fact{
+		Name:   "FILE_INCIDENT",
+		Plugin: "INCIDENT_PLUGIN",
+		Dialog: &Dialog{
+			Steps: []DialogStep{
+				{Name: "service", Prompt: "which service is affected?", Param: Parameter{Required: true}, Next: "severity"},
+				{Name: "severity", Prompt: "how severe is the {{.Params.service}} incident?", Param: Parameter{DataType: PARAM_DATA_TYPE_ENUM, Enum: []string{"low", "high"}, Required: true},
+					Next: "notes", Branches: []DialogBranch{{Value: "high", Next: "pager"}}},
+				{Name: "pager", Prompt: "who is on call?", Param: Parameter{Required: true}, Next: "notes"},
+				{Name: "notes", Prompt: "any notes?", Param: Parameter{Default: "none"}},
+			},
+		},
+	}
+	session := &UserSession{User: NewUser("1", "test", "test"), State: STATE_QA}
+	answers, err := pm.StartDialog(session, NewQuestion("file an incident"), fact)
+	if err != nil || session.State != STATE_DIALOG || !strings.Contains(answers[0].Text, "which service") {
+		t.Fatalf("failed to start dialog: %+v %v", answers, err)
+	}
+	steps := []struct {
+		text     string
+		contains string
+	}{
+		{"billing", "how severe is the billing incident?"},
+		{"urgent", "invalid severity"},
+		{"back", "which service"},
+		{"payments", "how severe is the payments incident?"},
+		{"HIGH", "who is on call?"},
+		{"alice", "any notes?"},
+		{"skip", "ok"},
+	}
+	for _, step := range steps {
+		answers, err = sap.GetAnswers(session, NewQuestion(step.text))
+		if err != nil {
+			t.Fatalf("failed to get answers for %s: %v", step.text, err)
+		}
+		if len(answers) != 1 || !strings.Contains(answers[0].Text, step.contains) {
+			t.Errorf("unexpected answers after %s: %q", step.text, answers[0].Text)
+		}
+	}
+	if session.State != STATE_QA || session.Dialog != nil {
+		t.Errorf("expected dialog to be finished, state %s", session.State)
+	}
+	expected := map[string]interface{}{"service": "payments", "severity": "high", "pager": "alice", "notes": "none"}
+	if len(tpap.params) != 1 || len(tpap.params[0]) != len(expected) {
+		t.Fatalf("unexpected plugin params: %v", tpap.params)
+	}
+	for k, v := range expected {
+		if tpap.params[0][k] != v {
+			t.Errorf("unexpected value for %s: %v", k, tpap.params[0][k])
+		}
+	}
+}
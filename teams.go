@@ -0,0 +1,652 @@
+/**
+ * Copyright 2024 Boris Wolf
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	TEAMS_APP_ID         = "teamsAppId"
+	TEAMS_APP_PASSWORD   = "teamsAppPassword"
+	TEAMS_WEBHOOK_SECRET = "teamsWebhookSecret"
+	TEAMS_TOKEN_URL      = "teamsTokenUrl"
+	TEAMS_OPENID_URL     = "teamsOpenIdUrl"
+)
+
+const (
+	TEAMS_PORT_CONFIG        = "teamsport"
+	TEAMS_DEV_MODE_CONFIG    = "teamsdevmode"
+	DEFAULT_TEAMS_PORT       = ":3978"
+	TEAMS_MESSAGES_PATH      = "/api/messages"
+	TEAMS_DEFAULT_TOKEN_URL  = "https://login.microsoftonline.com/botframework.com/oauth2/v2.0/token"
+	TEAMS_DEFAULT_OPENID_URL = "https://login.botframework.com/v1/.well-known/openidconfiguration"
+	TEAMS_TOKEN_SCOPE        = "https://api.botframework.com/.default"
+	TEAMS_TOKEN_ISSUER       = "https://api.botframework.com"
+	TEAMS_KEYS_TTL           = 24 * time.Hour
+	TEAMS_CLOCK_SKEW         = 5 * time.Minute
+	TEAMS_MAX_BODY           = 1 << 20
+	TEAMS_ACTIVITY_MESSAGE   = "message"
+	TEAMS_CARD_CONTENT_TYPE  = "application/vnd.microsoft.card.adaptive"
+	TEAMS_CARD_SCHEMA        = "http://adaptivecards.io/schemas/adaptive-card.json"
+	TEAMS_CARD_VERSION       = "1.4"
+	TEAMS_SESSION_PREFIX     = "teams-"
+	TEAMS_WARNING            = "\u26a0\ufe0f "
+)
+
+var teamsMentionRegexp = regexp.MustCompile(`<at>[^<]*</at>`)
+
+type (
+	teamsActivity struct {
+		Type             string             `json:"type"`
+		Id               string             `json:"id,omitempty"`
+		ServiceUrl       string             `json:"serviceUrl,omitempty"`
+		ChannelId        string             `json:"channelId,omitempty"`
+		From             *teamsAccount      `json:"from,omitempty"`
+		Recipient        *teamsAccount      `json:"recipient,omitempty"`
+		Conversation     *teamsConversation `json:"conversation,omitempty"`
+		ReplyToId        string             `json:"replyToId,omitempty"`
+		Text             string             `json:"text,omitempty"`
+		TextFormat       string             `json:"textFormat,omitempty"`
+		AttachmentLayout string             `json:"attachmentLayout,omitempty"`
+		Attachments      []*teamsAttachment `json:"attachments,omitempty"`
+		Value            json.RawMessage    `json:"value,omitempty"`
+	}
+	teamsAccount struct {
+		Id          string `json:"id"`
+		Name        string `json:"name,omitempty"`
+		AadObjectId string `json:"aadObjectId,omitempty"`
+	}
+	teamsConversation struct {
+		Id               string `json:"id"`
+		IsGroup          bool   `json:"isGroup,omitempty"`
+		ConversationType string `json:"conversationType,omitempty"`
+	}
+	teamsAttachment struct {
+		ContentType string      `json:"contentType"`
+		Content     interface{} `json:"content"`
+	}
+	teamsCard struct {
+		Type    string              `json:"type"`
+		Schema  string              `json:"$schema"`
+		Version string              `json:"version"`
+		Body    []*teamsCardElement `json:"body"`
+		Actions []*teamsCardAction  `json:"actions,omitempty"`
+	}
+	teamsCardElement struct {
+		Type    string `json:"type"`
+		Text    string `json:"text,omitempty"`
+		Wrap    bool   `json:"wrap,omitempty"`
+		Url     string `json:"url,omitempty"`
+		AltText string `json:"altText,omitempty"`
+	}
+	teamsCardAction struct {
+		Type  string         `json:"type"`
+		Title string         `json:"title"`
+		Url   string         `json:"url,omitempty"`
+		Data  *teamsFeedback `json:"data,omitempty"`
+	}
+	// teamsFeedback is submitted by the feedback buttons of an answer card.
+	teamsFeedback struct {
+		Rating  string `json:"rating"`
+		History int    `json:"history"`
+	}
+	teamsResourceResponse struct {
+		Id string `json:"id"`
+	}
+	teamsToken struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	teamsJwk struct {
+		Kid string `json:"kid"`
+		Kty string `json:"kty"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	}
+	teamsClaims struct {
+		Issuer     string      `json:"iss"`
+		Audience   interface{} `json:"aud"`
+		Expires    int64       `json:"exp"`
+		NotBefore  int64       `json:"nbf"`
+		ServiceUrl string      `json:"serviceurl"`
+	}
+)
+
+// TeamsAgent serves the Bot Framework messaging endpoint, replying to activities through the connector
+// of the channel, or Teams outgoing webhooks, replying in the http response.
+type TeamsAgent struct {
+	sync.Mutex
+	configProvider ConfigProvider
+	secretProvider SecretProvider
+	answerProvider AnswerProvider
+	sessionMgr     SessionManager
+	feedback       FeedbackStore
+	client         *http.Client
+	token          string
+	tokenExpires   time.Time
+	keys           map[string]*rsa.PublicKey
+	keysExpire     time.Time
+}
+
+func NewTeamsAgent(configProvider ConfigProvider, secretProvider SecretProvider, answerProvider AnswerProvider, sessionManager SessionManager, feedback FeedbackStore) Agent {
+	ta := TeamsAgent{
+		configProvider: configProvider,
+		secretProvider: secretProvider,
+		answerProvider: answerProvider,
+		sessionMgr:     sessionManager,
+		feedback:       feedback,
+		client:         &http.Client{Timeout: 30 * time.Second},
+	}
+	return &ta
+}
+
+func (ta *TeamsAgent) LaunchAgent(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	err := ta.run(ctx, nil)
+	if err != nil {
+		log.Error().Err(err).Msg("teams agent failed")
+	}
+}
+
+// run serves the messaging endpoint until the context is cancelled, the address of the listener is
+// sent to ready if given.
+func (ta *TeamsAgent) run(ctx context.Context, ready chan<- string) error {
+	port := ta.configProvider.GetConfig(TEAMS_PORT_CONFIG)
+	if port == "" {
+		port = DEFAULT_TEAMS_PORT
+	}
+	if !ta.hasCredentials() {
+		if !ta.isDevMode() {
+			return errors.New("missing secret teamsAppId or teamsWebhookSecret")
+		}
+		log.Warn().Msg("teams agent in dev mode, accepting unauthenticated activities of local channels")
+	}
+	if ta.secretProvider.GetSecret(TEAMS_APP_ID) != "" && ta.secretProvider.GetSecret(TEAMS_APP_PASSWORD) == "" {
+		return errors.New("missing secret teamsAppPassword")
+	}
+	listener, err := net.Listen("tcp", port)
+	if err != nil {
+		return err
+	}
+	log.Info().Str("addr", listener.Addr().String()).Msg("launching teams agent")
+	if ready != nil {
+		ready <- listener.Addr().String()
+	}
+	server := &http.Server{Handler: ta.newRouter()}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+	err = server.Serve(listener)
+	if err == http.ErrServerClosed {
+		log.Info().Msg("stopping teams agent")
+		return nil
+	}
+	return err
+}
+
+func (ta *TeamsAgent) newRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc(TEAMS_MESSAGES_PATH, ta.messagesHandler).Methods("POST")
+	return r
+}
+
+func (ta *TeamsAgent) messagesHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, TEAMS_MAX_BODY))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var activity teamsActivity
+	err = json.Unmarshal(body, &activity)
+	if err != nil {
+		http.Error(w, "invalid activity: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	webhook := ta.secretProvider.GetSecret(TEAMS_WEBHOOK_SECRET) != ""
+	if webhook {
+		err = ta.verifySignature(r.Header.Get("Authorization"), body)
+	} else if ta.secretProvider.GetSecret(TEAMS_APP_ID) != "" {
+		err = ta.verifyToken(r.Context(), r.Header.Get("Authorization"), &activity)
+	} else if !ta.isDevMode() {
+		err = errors.New("no credentials configured")
+	} else if !ta.isLocalServiceUrl(activity.ServiceUrl) {
+		err = errors.New("service url of unauthenticated activity is not local")
+	}
+	if err != nil {
+		log.Warn().Err(err).Msg("rejected teams activity")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if activity.Type != TEAMS_ACTIVITY_MESSAGE || activity.Conversation == nil || activity.From == nil {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	reply := ta.handleMessage(&activity, !webhook)
+	if webhook {
+		if reply == nil {
+			reply = &teamsActivity{Type: TEAMS_ACTIVITY_MESSAGE}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(reply)
+		return
+	}
+	if reply != nil {
+		err = ta.sendReply(r.Context(), &activity, reply)
+		if err != nil {
+			log.Error().Err(err).Str("conversation", activity.Conversation.Id).Msg("failed to send teams reply")
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (ta *TeamsAgent) hasCredentials() bool {
+	return ta.secretProvider.GetSecret(TEAMS_APP_ID) != "" || ta.secretProvider.GetSecret(TEAMS_WEBHOOK_SECRET) != ""
+}
+
+// isDevMode tells whether unauthenticated activities of a local emulator are accepted, only for development.
+func (ta *TeamsAgent) isDevMode() bool {
+	return ta.configProvider.GetConfig(TEAMS_DEV_MODE_CONFIG) == "yes"
+}
+
+// isLocalServiceUrl tells whether replies go to this host, unauthenticated activities must not make the agent
+// post to other hosts.
+func (ta *TeamsAgent) isLocalServiceUrl(serviceUrl string) bool {
+	if serviceUrl == "" {
+		return true
+	}
+	u, err := url.Parse(serviceUrl)
+	if err != nil {
+		return false
+	}
+	if u.Hostname() == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(u.Hostname())
+	return ip != nil && ip.IsLoopback()
+}
+
+// verifySignature checks the hmac of an outgoing webhook, signed with the base64 encoded security token of the webhook.
+func (ta *TeamsAgent) verifySignature(auth string, body []byte) error {
+	if !strings.HasPrefix(auth, "HMAC ") {
+		return errors.New("missing hmac signature")
+	}
+	key, err := base64.StdEncoding.DecodeString(ta.secretProvider.GetSecret(TEAMS_WEBHOOK_SECRET))
+	if err != nil {
+		return err
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "HMAC "))
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return errors.New("invalid hmac signature")
+	}
+	return nil
+}
+
+// verifyToken checks the jwt the bot framework sends with activities, signed with one of the keys of its
+// openid configuration.
+func (ta *TeamsAgent) verifyToken(ctx context.Context, auth string, activity *teamsActivity) error {
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return errors.New("missing bearer token")
+	}
+	parts := strings.Split(strings.TrimPrefix(auth, "Bearer "), ".")
+	if len(parts) != 3 {
+		return errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err := ta.decodeTokenPart(parts[0], &header)
+	if err != nil {
+		return err
+	}
+	if header.Alg != "RS256" {
+		return errors.New("unsupported token algorithm " + header.Alg)
+	}
+	key, err := ta.getSigningKey(ctx, header.Kid)
+	if err != nil {
+		return err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	err = rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature)
+	if err != nil {
+		return errors.New("invalid token signature")
+	}
+	var claims teamsClaims
+	err = ta.decodeTokenPart(parts[1], &claims)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if claims.Issuer != TEAMS_TOKEN_ISSUER {
+		return errors.New("invalid token issuer " + claims.Issuer)
+	}
+	if !ta.hasAudience(claims.Audience, ta.secretProvider.GetSecret(TEAMS_APP_ID)) {
+		return errors.New("invalid token audience")
+	}
+	if now.After(time.Unix(claims.Expires, 0).Add(TEAMS_CLOCK_SKEW)) {
+		return errors.New("token expired")
+	}
+	if claims.NotBefore != 0 && now.Add(TEAMS_CLOCK_SKEW).Before(time.Unix(claims.NotBefore, 0)) {
+		return errors.New("token not yet valid")
+	}
+	if claims.ServiceUrl != "" && claims.ServiceUrl != activity.ServiceUrl {
+		return errors.New("service url does not match token")
+	}
+	return nil
+}
+
+func (ta *TeamsAgent) decodeTokenPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (ta *TeamsAgent) hasAudience(aud interface{}, appId string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == appId
+	case []interface{}:
+		for _, a := range v {
+			if a == appId {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// getSigningKey returns the key with the given id, keys are fetched from the openid configuration once a day
+// or when there is an unknown key id.
+func (ta *TeamsAgent) getSigningKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	ta.Lock()
+	key := ta.keys[kid]
+	expired := time.Now().After(ta.keysExpire)
+	ta.Unlock()
+	if key != nil && !expired {
+		return key, nil
+	}
+	openIdUrl := ta.secretProvider.GetSecret(TEAMS_OPENID_URL)
+	if openIdUrl == "" {
+		openIdUrl = TEAMS_DEFAULT_OPENID_URL
+	}
+	var config struct {
+		JwksUri string `json:"jwks_uri"`
+	}
+	err := ta.getJson(ctx, openIdUrl, &config)
+	if err != nil {
+		return nil, err
+	}
+	var jwks struct {
+		Keys []*teamsJwk `json:"keys"`
+	}
+	err = ta.getJson(ctx, config.JwksUri, &jwks)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	ta.Lock()
+	ta.keys = keys
+	ta.keysExpire = time.Now().Add(TEAMS_KEYS_TTL)
+	ta.Unlock()
+	if keys[kid] == nil {
+		return nil, errors.New("unknown signing key " + kid)
+	}
+	return keys[kid], nil
+}
+
+func (ta *TeamsAgent) getJson(ctx context.Context, u string, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := ta.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("request %s failed with %d", u, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// getUser returns the sender of the activity with the id of its session, each sender has a session of
+// their own in group conversations.
+func (ta *TeamsAgent) getUser(activity *teamsActivity) *User {
+	user := NewUser(TEAMS_SESSION_PREFIX+activity.Conversation.Id+"-"+activity.From.Id, activity.From.Name, activity.From.Name).WithAgent(AGENT_TEAMS)
+	// roles are granted to the teams user rather than to the conversation
+	user.Login = activity.From.Id
+	if activity.From.AadObjectId != "" {
+		user.Login = activity.From.AadObjectId
+	}
+	return user
+}
+
+// handleMessage answers the question of a message activity or records the feedback submitted by an answer
+// card, feedback buttons are only offered if the reply is not sent to an outgoing webhook.
+func (ta *TeamsAgent) handleMessage(activity *teamsActivity, withFeedback bool) *teamsActivity {
+	session := ta.sessionMgr.GetSession(ta.getUser(activity))
+	if len(activity.Value) > 0 {
+		var feedback teamsFeedback
+		err := json.Unmarshal(activity.Value, &feedback)
+		if err != nil {
+			return nil
+		}
+		rating, err := ParseRating(feedback.Rating)
+		if err != nil {
+			return nil
+		}
+		session.Lock()
+		history := session.GetHistory(feedback.History)
+		session.Unlock()
+		if history != nil {
+			RecordFeedback(ta.feedback, NewFeedbackEntry(session.User, history, rating))
+		}
+		return nil
+	}
+	// mentions of the agent are part of the text in channels
+	text := strings.TrimSpace(teamsMentionRegexp.ReplaceAllString(activity.Text, ""))
+	if text == "" {
+		return nil
+	}
+	question := NewQuestion(text)
+	answers, err := ta.answerProvider.GetAnswers(session, question)
+	if err != nil {
+		return &teamsActivity{Type: TEAMS_ACTIVITY_MESSAGE, Text: TEAMS_WARNING + err.Error()}
+	}
+	if len(answers) == 0 {
+		return nil
+	}
+	var history *HistoryEntry
+	if withFeedback {
+		history = session.GetQuestionHistory(question)
+	}
+	return &teamsActivity{
+		Type:        TEAMS_ACTIVITY_MESSAGE,
+		Attachments: []*teamsAttachment{{ContentType: TEAMS_CARD_CONTENT_TYPE, Content: ta.answerCard(answers, history)}},
+	}
+}
+
+// answerCard renders answers as an adaptive card with links, images and buttons for rating the answers.
+func (ta *TeamsAgent) answerCard(answers []*Answer, history *HistoryEntry) *teamsCard {
+	card := &teamsCard{Type: "AdaptiveCard", Schema: TEAMS_CARD_SCHEMA, Version: TEAMS_CARD_VERSION, Body: make([]*teamsCardElement, 0)}
+	for _, a := range answers {
+		if a.Text != "" {
+			card.Body = append(card.Body, &teamsCardElement{Type: "TextBlock", Text: a.Text, Wrap: true})
+		}
+		if len(a.Choices) > 0 {
+			items := make([]string, 0)
+			for _, c := range a.Choices {
+				items = append(items, "- "+c)
+			}
+			card.Body = append(card.Body, &teamsCardElement{Type: "TextBlock", Text: strings.Join(items, "\n"), Wrap: true})
+		}
+		if a.ImageLink != "" {
+			card.Body = append(card.Body, &teamsCardElement{Type: "Image", Url: a.ImageLink, AltText: a.Text})
+		}
+		if a.Link != "" {
+			card.Actions = append(card.Actions, &teamsCardAction{Type: "Action.OpenUrl", Title: ta.linkTitle(a.Link), Url: a.Link})
+		}
+	}
+	if history != nil {
+		card.Actions = append(card.Actions,
+			&teamsCardAction{Type: "Action.Submit", Title: "\U0001F44D", Data: &teamsFeedback{Rating: FEEDBACK_UP, History: history.Id}},
+			&teamsCardAction{Type: "Action.Submit", Title: "\U0001F44E", Data: &teamsFeedback{Rating: FEEDBACK_DOWN, History: history.Id}})
+	}
+	return card
+}
+
+func (ta *TeamsAgent) linkTitle(link string) string {
+	u, err := url.Parse(link)
+	if err != nil || u.Host == "" {
+		return link
+	}
+	return u.Host
+}
+
+// sendReply posts the reply to the conversation through the connector of the channel the activity came from.
+func (ta *TeamsAgent) sendReply(ctx context.Context, activity, reply *teamsActivity) error {
+	if activity.ServiceUrl == "" {
+		return errors.New("activity without service url")
+	}
+	reply.From = activity.Recipient
+	reply.Recipient = activity.From
+	reply.Conversation = activity.Conversation
+	reply.ReplyToId = activity.Id
+	u := strings.TrimSuffix(activity.ServiceUrl, "/") + "/v3/conversations/" + url.PathEscape(activity.Conversation.Id) + "/activities"
+	if activity.Id != "" {
+		u += "/" + url.PathEscape(activity.Id)
+	}
+	var body bytes.Buffer
+	err := json.NewEncoder(&body).Encode(reply)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if ta.secretProvider.GetSecret(TEAMS_APP_ID) != "" {
+		token, err := ta.getToken(ctx)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := ta.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("connector failed with %d", resp.StatusCode)
+	}
+	var rr teamsResourceResponse
+	json.NewDecoder(resp.Body).Decode(&rr)
+	log.Debug().Str("conversation", activity.Conversation.Id).Str("activity", rr.Id).Msg("sent teams reply")
+	return nil
+}
+
+// getToken returns the access token of the app for calling the connector, it is renewed shortly before it expires.
+func (ta *TeamsAgent) getToken(ctx context.Context) (string, error) {
+	ta.Lock()
+	defer ta.Unlock()
+	if ta.token != "" && time.Now().Before(ta.tokenExpires) {
+		return ta.token, nil
+	}
+	tokenUrl := ta.secretProvider.GetSecret(TEAMS_TOKEN_URL)
+	if tokenUrl == "" {
+		tokenUrl = TEAMS_DEFAULT_TOKEN_URL
+	}
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", ta.secretProvider.GetSecret(TEAMS_APP_ID))
+	form.Set("client_secret", ta.secretProvider.GetSecret(TEAMS_APP_PASSWORD))
+	form.Set("scope", TEAMS_TOKEN_SCOPE)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := ta.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request failed with %d", resp.StatusCode)
+	}
+	var token teamsToken
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	if err != nil {
+		return "", err
+	}
+	ta.token = token.AccessToken
+	ta.tokenExpires = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - TEAMS_CLOCK_SKEW)
+	return ta.token, nil
+}
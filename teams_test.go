@@ -0,0 +1,334 @@
+/**
+ * Copyright 2024 Boris Wolf
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type (
+	// emulatorActivity is a reply activity as seen by the channel, with the adaptive card decoded.
+	emulatorActivity struct {
+		teamsActivity
+		Attachments []struct {
+			ContentType string    `json:"contentType"`
+			Content     teamsCard `json:"content"`
+		} `json:"attachments"`
+		Path  string `json:"-"`
+		Token string `json:"-"`
+	}
+	// mockConnector plays the channel the activities come from like the bot framework emulator, it records the
+	// replies and serves the openid configuration and tokens for authenticated bots.
+	mockConnector struct {
+		*httptest.Server
+		sync.Mutex
+		key     *rsa.PrivateKey
+		replies []*emulatorActivity
+		tokens  int
+	}
+)
+
+func newMockConnector(t *testing.T) *mockConnector {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc := &mockConnector{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v3/conversations/{conv}/activities/{id}", func(w http.ResponseWriter, r *http.Request) {
+		var reply emulatorActivity
+		err := json.NewDecoder(r.Body).Decode(&reply)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		reply.Path = r.PathValue("conv") + "/" + r.PathValue("id")
+		reply.Token = r.Header.Get("Authorization")
+		mc.Lock()
+		mc.replies = append(mc.replies, &reply)
+		id := len(mc.replies)
+		mc.Unlock()
+		json.NewEncoder(w).Encode(&teamsResourceResponse{fmt.Sprintf("reply-%d", id)})
+	})
+	mux.HandleFunc("GET /openid", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"jwks_uri": mc.URL + "/keys"})
+	})
+	mux.HandleFunc("GET /keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string][]*teamsJwk{"keys": {{
+			Kid: "key-1",
+			Kty: "RSA",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.FormValue("client_id") != "app-id" || r.FormValue("client_secret") != "app-password" || r.FormValue("scope") != TEAMS_TOKEN_SCOPE {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mc.Lock()
+		mc.tokens++
+		mc.Unlock()
+		json.NewEncoder(w).Encode(&teamsToken{AccessToken: "connector-token", ExpiresIn: 3600})
+	})
+	mc.Server = httptest.NewServer(mux)
+	t.Cleanup(mc.Close)
+	return mc
+}
+
+// sign returns a bearer token like the bot framework sends with activities.
+func (mc *mockConnector) sign(t *testing.T, kid string, claims map[string]interface{}) string {
+	encode := func(v interface{}) string {
+		data, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	unsigned := encode(map[string]string{"alg": "RS256", "kid": kid, "typ": "JWT"}) + "." + encode(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, mc.key, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "Bearer " + unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (mc *mockConnector) getReplies() []*emulatorActivity {
+	mc.Lock()
+	defer mc.Unlock()
+	return append([]*emulatorActivity{}, mc.replies...)
+}
+
+func (mc *mockConnector) activity(id, conversation, text string) *teamsActivity {
+	return &teamsActivity{
+		Type:         TEAMS_ACTIVITY_MESSAGE,
+		Id:           id,
+		ServiceUrl:   mc.URL + "/",
+		ChannelId:    "emulator",
+		From:         &teamsAccount{Id: "user-1", Name: "Kirk", AadObjectId: "aad-kirk"},
+		Recipient:    &teamsAccount{Id: "bot-1", Name: "Smith"},
+		Conversation: &teamsConversation{Id: conversation},
+		Text:         text,
+	}
+}
+
+func postActivity(t *testing.T, endpoint string, activity *teamsActivity, auth string) *http.Response {
+	data, _ := json.Marshal(activity)
+	req, _ := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestTeamsAgent(t *testing.T) {
+	mc := newMockConnector(t)
+	feedback, err := NewJSONLFeedbackStore(filepath.Join(t.TempDir(), "feedback.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer feedback.Close()
+	tap := new(testSlackAnswerProvider)
+	if err := NewTeamsAgent(testConfigProvider{}, testSecretProvider{}, tap, nil, nil).(*TeamsAgent).run(context.Background(), nil); err == nil {
+		t.Error("expected agent without credentials not to start outside of dev mode")
+	}
+	ta := NewTeamsAgent(testConfigProvider{TEAMS_PORT_CONFIG: "127.0.0.1:0", TEAMS_DEV_MODE_CONFIG: "yes"}, testSecretProvider{}, tap, NewSimpleSessionManager(time.Minute, 10), feedback).(*TeamsAgent)
+	ctx, cancel := context.WithCancel(context.Background())
+	ready := make(chan string, 1)
+	done := make(chan error)
+	go func() {
+		done <- ta.run(ctx, ready)
+	}()
+	endpoint := "http://" + <-ready + TEAMS_MESSAGES_PATH
+	postActivity(t, endpoint, mc.activity("act-1", "conv-1", "who is spock?"), "")
+	group := mc.activity("act-2", "19:channel;messageid=7", "<at>Smith</at> what is warp?")
+	group.Conversation.IsGroup = true
+	postActivity(t, endpoint, group, "")
+	postActivity(t, endpoint, mc.activity("act-3", "conv-1", "fail"), "")
+	spock := mc.activity("act-6", "19:channel;messageid=7", "<at>Smith</at> what is logic?")
+	spock.From = &teamsAccount{Id: "user-2", Name: "Spock"}
+	postActivity(t, endpoint, spock, "")
+	remote := mc.activity("act-7", "conv-1", "who is spock?")
+	remote.ServiceUrl = "http://169.254.169.254/"
+	if resp := postActivity(t, endpoint, remote, ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected unauthenticated activity with remote service url to be rejected: %d", resp.StatusCode)
+	}
+	update := mc.activity("act-4", "conv-1", "")
+	update.Type = "conversationUpdate"
+	if resp := postActivity(t, endpoint, update, ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected other activities to be accepted: %d", resp.StatusCode)
+	}
+	if resp := postActivity(t, endpoint, &teamsActivity{Type: "message"}, "garbage"); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected incomplete activities to be ignored: %d", resp.StatusCode)
+	}
+	replies := mc.getReplies()
+	if len(replies) != 4 {
+		t.Fatalf("expected 4 replies: %d", len(replies))
+	}
+	reply := replies[0]
+	if reply.Path != "conv-1/act-1" || reply.ReplyToId != "act-1" || reply.From.Id != "bot-1" || reply.Recipient.Id != "user-1" || reply.Conversation.Id != "conv-1" || reply.Token != "" {
+		t.Errorf("unexpected reply: %+v", reply)
+	}
+	if len(reply.Attachments) != 1 || reply.Attachments[0].ContentType != TEAMS_CARD_CONTENT_TYPE {
+		t.Fatalf("expected adaptive card: %+v", reply.Attachments)
+	}
+	card := reply.Attachments[0].Content
+	if card.Type != "AdaptiveCard" || len(card.Body) != 2 || card.Body[0].Text != "answer to who is spock?" || card.Body[1].Type != "Image" || card.Body[1].Url != "https://example.com/img.png" {
+		t.Errorf("unexpected card body: %+v", card.Body)
+	}
+	if len(card.Actions) != 3 || card.Actions[0].Type != "Action.OpenUrl" || card.Actions[0].Url != "https://example.com" || card.Actions[0].Title != "example.com" ||
+		card.Actions[1].Data == nil || *card.Actions[1].Data != (teamsFeedback{FEEDBACK_UP, 1}) || *card.Actions[2].Data != (teamsFeedback{FEEDBACK_DOWN, 1}) {
+		t.Errorf("unexpected card actions: %+v", card.Actions)
+	}
+	if replies[1].Path != "19:channel;messageid=7/act-2" || replies[1].Attachments[0].Content.Body[0].Text != "answer to what is warp?" {
+		t.Errorf("expected answer to mention in channel: %+v", replies[1])
+	}
+	if replies[2].Text != TEAMS_WARNING+"knowledge base unavailable" || len(replies[2].Attachments) != 0 {
+		t.Errorf("expected error reply: %+v", replies[2])
+	}
+	// the emulator submits the data of the feedback button
+	submit := mc.activity("act-5", "conv-1", "")
+	submit.Value = json.RawMessage(`{"rating":"up","history":1}`)
+	postActivity(t, endpoint, submit, "")
+	entries, _ := feedback.Query(nil)
+	if len(entries) != 1 || entries[0].Rating != FEEDBACK_UP || entries[0].User != "aad-kirk" || entries[0].Question != "who is spock?" {
+		t.Errorf("unexpected feedback: %+v", entries)
+	}
+	if len(mc.getReplies()) != 4 {
+		t.Error("expected no reply to feedback")
+	}
+	if len(tap.sessions) != 4 || tap.sessions[0] != tap.sessions[2] || tap.sessions[0].User.Id != "teams-conv-1-user-1" || tap.sessions[1].User.Id != "teams-19:channel;messageid=7-user-1" ||
+		tap.sessions[0].User.Agent != AGENT_TEAMS || tap.sessions[0].User.GetLogin() != "aad-kirk" {
+		t.Errorf("expected sessions per conversation and user: %+v", tap.sessions)
+	}
+	if tap.sessions[3] == tap.sessions[1] || tap.sessions[3].User.GetLogin() != "user-2" {
+		t.Errorf("expected session of other user in group conversation: %+v", tap.sessions[3].User)
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected agent to stop cleanly: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not stop")
+	}
+}
+
+func TestTeamsAgentAuthentication(t *testing.T) {
+	mc := newMockConnector(t)
+	secrets := testSecretProvider{TEAMS_APP_ID: "app-id", TEAMS_APP_PASSWORD: "app-password", TEAMS_OPENID_URL: mc.URL + "/openid", TEAMS_TOKEN_URL: mc.URL + "/token"}
+	ta := NewTeamsAgent(testConfigProvider{}, secrets, new(testSlackAnswerProvider), NewSimpleSessionManager(time.Minute, 10), nil).(*TeamsAgent)
+	server := httptest.NewServer(ta.newRouter())
+	defer server.Close()
+	endpoint := server.URL + TEAMS_MESSAGES_PATH
+	claims := func(mod func(map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{"iss": TEAMS_TOKEN_ISSUER, "aud": "app-id", "exp": time.Now().Add(time.Hour).Unix(), "nbf": time.Now().Unix(), "serviceurl": mc.URL + "/"}
+		if mod != nil {
+			mod(c)
+		}
+		return c
+	}
+	rejected := map[string]string{
+		"no token":           "",
+		"malformed token":    "Bearer abc",
+		"unknown key":        mc.sign(t, "key-2", claims(nil)),
+		"wrong audience":     mc.sign(t, "key-1", claims(func(c map[string]interface{}) { c["aud"] = "other-app" })),
+		"wrong issuer":       mc.sign(t, "key-1", claims(func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" })),
+		"expired":            mc.sign(t, "key-1", claims(func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() })),
+		"other service url":  mc.sign(t, "key-1", claims(func(c map[string]interface{}) { c["serviceurl"] = "https://evil.example.com/" })),
+		"tampered signature": mc.sign(t, "key-1", claims(nil)) + "x",
+	}
+	for name, auth := range rejected {
+		if resp := postActivity(t, endpoint, mc.activity("act-1", "conv-1", "who is spock?"), auth); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("expected %s to be rejected: %d", name, resp.StatusCode)
+		}
+	}
+	if len(mc.getReplies()) != 0 {
+		t.Fatal("expected no replies to rejected activities")
+	}
+	auth := mc.sign(t, "key-1", claims(func(c map[string]interface{}) { c["aud"] = []string{"app-id"} }))
+	for _, id := range []string{"act-1", "act-2"} {
+		if resp := postActivity(t, endpoint, mc.activity(id, "conv-1", "who is spock?"), auth); resp.StatusCode != http.StatusOK {
+			t.Errorf("expected activity to be accepted: %d", resp.StatusCode)
+		}
+	}
+	replies := mc.getReplies()
+	if len(replies) != 2 || replies[0].Token != "Bearer connector-token" || replies[1].Token != "Bearer connector-token" || mc.tokens != 1 {
+		t.Errorf("expected replies with cached connector token: %d %d", len(replies), mc.tokens)
+	}
+	ta.secretProvider = testSecretProvider{TEAMS_APP_ID: "app-id"}
+	if err := ta.run(context.Background(), nil); err == nil || err.Error() != "missing secret teamsAppPassword" {
+		t.Errorf("expected missing secret: %v", err)
+	}
+}
+
+func TestTeamsOutgoingWebhook(t *testing.T) {
+	secret := base64.StdEncoding.EncodeToString([]byte("webhook-secret"))
+	ta := NewTeamsAgent(testConfigProvider{}, testSecretProvider{TEAMS_WEBHOOK_SECRET: secret}, new(testSlackAnswerProvider), NewSimpleSessionManager(time.Minute, 10), nil).(*TeamsAgent)
+	server := httptest.NewServer(ta.newRouter())
+	defer server.Close()
+	activity := &teamsActivity{
+		Type:         TEAMS_ACTIVITY_MESSAGE,
+		Id:           "act-1",
+		From:         &teamsAccount{Id: "user-1", Name: "Kirk"},
+		Conversation: &teamsConversation{Id: "19:channel;messageid=1", IsGroup: true},
+		Text:         "<at>Smith</at> who is spock?",
+	}
+	body, _ := json.Marshal(activity)
+	sign := func(key string) string {
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write(body)
+		return "HMAC " + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	}
+	for _, auth := range []string{"", sign("wrong-secret")} {
+		if resp := postActivity(t, server.URL+TEAMS_MESSAGES_PATH, activity, auth); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("expected unsigned activity to be rejected: %d", resp.StatusCode)
+		}
+	}
+	resp := postActivity(t, server.URL+TEAMS_MESSAGES_PATH, activity, sign("webhook-secret"))
+	var reply emulatorActivity
+	json.NewDecoder(resp.Body).Decode(&reply)
+	if resp.StatusCode != http.StatusOK || reply.Type != TEAMS_ACTIVITY_MESSAGE || len(reply.Attachments) != 1 {
+		t.Fatalf("expected reply in response: %d %+v", resp.StatusCode, reply)
+	}
+	card := reply.Attachments[0].Content
+	if card.Body[0].Text != "answer to who is spock?" || len(card.Actions) != 1 || card.Actions[0].Type != "Action.OpenUrl" {
+		t.Errorf("expected card without feedback buttons: %+v %+v", card.Body, card.Actions)
+	}
+}
@@ -16,12 +16,22 @@
 
 package main
 
-import "sync"
+import (
+	"context"
+	"sync"
+	"time"
+)
 
 const (
 	STATE_QA           = "STATE_QA"
 	STATE_ADD_QUESTION = "STATE_ADD_QUESTION"
 	STATE_ADD_ANSWER   = "STATE_ADD_ANSWER"
+	STATE_ADD_PARAMS   = "STATE_ADD_PARAMS"
+	STATE_DIALOG       = "STATE_DIALOG"
+)
+
+const (
+	MAX_SESSION_HISTORY = 100
 )
 
 type (
@@ -29,12 +39,20 @@ type (
 		Id       string `json:"id"`
 		Name     string `json:"name"`
 		RealName string `json:"realName"`
+		Agent    string `json:"agent"`           // agent the user talks to, e.g. slack or web
+		Login    string `json:"login,omitempty"` // name the user logged in with, if any
 	}
 	Parameter struct {
-		Name             string `json:"name"`
-		Value            string `json:"value"`
-		Type             string `json:"type"`
-		ExtractionPrompt string `json:"prompt"`
+		Name             string   `json:"name"`
+		Value            string   `json:"value"`
+		Type             string   `json:"type"`
+		ExtractionPrompt string   `json:"prompt"`
+		Required         bool     `json:"required"`
+		DataType         string   `json:"dataType,omitempty"`    // string, int, float, enum or date, defaults to string
+		Description      string   `json:"description,omitempty"` // shown when asking the user for the parameter
+		Default          string   `json:"default,omitempty"`     // used when the parameter is not stated
+		Enum             []string `json:"enum,omitempty"`        // allowed values for enum parameters
+		Pattern          string   `json:"pattern,omitempty"`     // optional regular expression the value must match
 	}
 	Fact struct {
 		Name      string      `json:"name"`
@@ -47,23 +65,88 @@ type (
 		IsSystem  bool        `json:"isSystem"` // if true referring to a built in system command
 		CreatedBy string      `json:"createdBy"`
 		CreatedAt string      `json:"createdAt"`
+		Webhook   *Webhook    `json:"webhook,omitempty"` // optional webhook plugin config
+		Script    *Script     `json:"script,omitempty"`  // optional script plugin config
+		Dialog    *Dialog     `json:"dialog,omitempty"`  // optional multi-step dialog collecting the plugin params
+	}
+	Webhook struct {
+		Url          string            `json:"url"`          // url template, question and params are url escaped
+		Method       string            `json:"method"`       // defaults to GET
+		Headers      map[string]string `json:"headers"`      // header templates, may refer to the secrets configured for the host
+		Body         string            `json:"body"`         // optional body template
+		Response     string            `json:"response"`     // optional answer template applied to the json response
+		ResponsePath string            `json:"responsePath"` // optional json path into the response, e.g. $.status.state
+		Timeout      int               `json:"timeout"`      // timeout in seconds
+	}
+	Script struct {
+		Command   string            `json:"command"`   // allow-listed executable relative to the script dir
+		Args      []string          `json:"args"`      // argument templates
+		Env       map[string]string `json:"env"`       // environment variable templates, reserved names like PATH or LD_* are rejected
+		Dir       string            `json:"dir"`       // working directory relative to the script dir
+		Timeout   int               `json:"timeout"`   // timeout in seconds
+		MaxOutput int               `json:"maxOutput"` // max number of bytes of stdout to return
+	}
+	Dialog struct {
+		Steps []DialogStep `json:"steps"`
+		Start string       `json:"start"` // first step, defaults to the first in the list
+	}
+	DialogStep struct {
+		Name     string         `json:"name"`     // name of the step and of the collected value
+		Prompt   string         `json:"prompt"`   // prompt template, may refer to previously collected values
+		Param    Parameter      `json:"param"`    // data type, constraints and default of the collected value
+		Next     string         `json:"next"`     // next step, blank to finish the dialog
+		Branches []DialogBranch `json:"branches"` // optional value dependent next steps
+	}
+	DialogBranch struct {
+		Value string `json:"value"`
+		Next  string `json:"next"`
 	}
 	Question struct {
-		Text string
+		Text      string     `json:"text"`
+		Embedding *Embedding `json:"-"` // embedding of the text once computed while answering
 	}
 	Answer struct {
-		Text      string
-		Link      string
-		ImageLink string
-		Score     float64
-		Rank      int
+		Text      string   `json:"text"`
+		Link      string   `json:"link"`
+		ImageLink string   `json:"imageLink"`
+		Score     float64  `json:"score"`
+		Rank      int      `json:"rank"`
+		FactName  string   `json:"factName"`          // fact the answer was taken from, if any
+		Choices   []string `json:"choices,omitempty"` // questions to pick from if the question was ambiguous
 	}
 	UserSession struct {
-		User         *User
-		State        string
-		LastQuestion *Question
-		LastAnswer   []*Answer
-		NewFact      *Fact
+		User           *User           `json:"user"`
+		State          string          `json:"state"`
+		LastQuestion   *Question       `json:"lastQuestion"`
+		LastAnswer     []*Answer       `json:"lastAnswer"`
+		NewFact        *Fact           `json:"newFact"`
+		PluginCall     *PluginCall     `json:"pluginCall"`
+		BaseName       string          `json:"baseName"`       // knowledge base selected for this session, blank for the default
+		DraftUpdatedAt time.Time       `json:"draftUpdatedAt"` // last step of an unfinished dialog, zero if none
+		Dialog         *DialogState    `json:"dialog"`
+		History        []*HistoryEntry `json:"history"`
+		mu             sync.Mutex
+	}
+	PluginCall struct {
+		Fact     *Fact                  `json:"fact"`
+		Question *Question              `json:"question"`
+		Params   map[string]interface{} `json:"params"`
+		Errors   map[string]string      `json:"errors"`
+	}
+	DialogState struct {
+		Fact     *Fact                  `json:"fact"`
+		Question *Question              `json:"question"`
+		Step     string                 `json:"step"`
+		Values   map[string]interface{} `json:"values"`
+		Visited  []string               `json:"visited"`
+	}
+	HistoryEntry struct {
+		Id            int       `json:"id"` // sequence number within the session, used for referring to answers
+		Question      *Question `json:"question"`
+		Answers       []*Answer `json:"answers"`
+		Error         string    `json:"error"`
+		Time          time.Time `json:"time"`
+		KnowledgeBase string    `json:"knowledgeBase,omitempty"`
 	}
 )
 
@@ -91,6 +174,62 @@ func (a *Answer) WithImageLink(link string) *Answer {
 	return a
 }
 
+func (a *Answer) WithChoices(choices []string) *Answer {
+	a.Choices = choices
+	return a
+}
+
+// Lock guards the session against answering questions of the same session concurrently and against
+// the session store writing it while it changes.
+func (s *UserSession) Lock() {
+	s.mu.Lock()
+}
+
+func (s *UserSession) Unlock() {
+	s.mu.Unlock()
+}
+
+// AddHistory remembers a question and its answers, keeping only the most recent entries.
+func (s *UserSession) AddHistory(question *Question, answers []*Answer, err error) *HistoryEntry {
+	entry := &HistoryEntry{
+		Id:       1,
+		Question: question,
+		Answers:  answers,
+		Time:     time.Now(),
+	}
+	if len(s.History) > 0 {
+		entry.Id = s.History[len(s.History)-1].Id + 1
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	s.History = append(s.History, entry)
+	if len(s.History) > MAX_SESSION_HISTORY {
+		s.History = s.History[len(s.History)-MAX_SESSION_HISTORY:]
+	}
+	return entry
+}
+
+// GetQuestionHistory returns the history entry of the question if it is the latest one.
+func (s *UserSession) GetQuestionHistory(question *Question) *HistoryEntry {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.History) > 0 && s.History[len(s.History)-1].Question == question {
+		return s.History[len(s.History)-1]
+	}
+	return nil
+}
+
+// GetHistory returns the history entry with the given id, nil if it is unknown or no longer kept.
+func (s *UserSession) GetHistory(id int) *HistoryEntry {
+	for _, entry := range s.History {
+		if entry.Id == id {
+			return entry
+		}
+	}
+	return nil
+}
+
 func NewUser(id, name, realname string) *User {
 	u := User{
 		Id:       id,
@@ -100,14 +239,46 @@ func NewUser(id, name, realname string) *User {
 	return &u
 }
 
+func (u *User) WithAgent(agent string) *User {
+	u.Agent = agent
+	return u
+}
+
+// GetLogin returns the name the user is known by to the access provider.
+func (u *User) GetLogin() string {
+	if u.Login != "" {
+		return u.Login
+	}
+	return u.Id
+}
+
+// Agent answers questions of users until the context is cancelled, it calls Done on the wait group when it has stopped.
 type Agent interface {
-	LaunchAgent(wg sync.WaitGroup)
+	LaunchAgent(ctx context.Context, wg *sync.WaitGroup)
 }
 
 type AnswerProvider interface {
 	GetAnswers(session *UserSession, question *Question) ([]*Answer, error)
 }
 
+// PluginAnswerProvider is implemented by plugins which need the matched fact and the extracted
+// parameters rather than a rewritten question.
+type PluginAnswerProvider interface {
+	GetPluginAnswers(session *UserSession, question *Question, fact *Fact, params map[string]interface{}) ([]*Answer, error)
+}
+
+// FactEditor is implemented by answer providers which let agents with forms edit facts of the
+// knowledge base of a session.
+type FactEditor interface {
+	GetFact(session *UserSession, name string) (*Fact, error)
+	SaveFact(session *UserSession, fact *Fact, isNew bool) ([]*Answer, error)
+}
+
+// PluginParamsProvider is implemented by plugins which declare the parameters they expect.
+type PluginParamsProvider interface {
+	GetParams() []Parameter
+}
+
 type KnowledeBaseProvider interface {
 	Load() error
 	Save() error
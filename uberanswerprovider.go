@@ -16,40 +16,118 @@
 
 package main
 
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
 type UberAnswerProvider struct {
 	kbm                 *KnowledeBaseManager
 	oai                 OpenAIHandler
+	pm                  *PluginManager
 	answerChain         []AnswerProvider
 	stateAnswerProvider AnswerProvider
+	misses              MissQueue
 }
 
-func NewUberAnswerProvider(kbm *KnowledeBaseManager, oai OpenAIHandler) AnswerProvider {
+func NewUberAnswerProvider(kbm *KnowledeBaseManager, oai OpenAIHandler, configProvider ConfigProvider, secretProvider SecretProvider, ap AccessProvider, audit AuditLog, feedback FeedbackStore, misses MissQueue) AnswerProvider {
+	pm := NewPluginManger(kbm, oai, configProvider, secretProvider, ap, audit, feedback, misses)
+	draftTimeout, err := time.ParseDuration(configProvider.GetConfig(DRAFT_TIMEOUT_CONFIG))
+	if err != nil {
+		draftTimeout = DEFAULT_DRAFT_TIMEOUT
+	}
+	margin, err := strconv.ParseFloat(configProvider.GetConfig(DISAMBIGUATION_MARGIN_CONFIG), 64)
+	if err != nil {
+		margin = 0
+	}
 	answerProvider := UberAnswerProvider{
 		kbm,
 		oai,
+		pm,
 		[]AnswerProvider{},
-		NewStateAnswerProvider(kbm),
+		NewStateAnswerProvider(kbm, pm, draftTimeout, ap, audit),
+		misses,
 	}
-	answerProvider.answerChain = append(answerProvider.answerChain, NewCommandAnswerProvider(kbm))
-	answerProvider.answerChain = append(answerProvider.answerChain, NewEmbeddingAnswerProvider(kbm, oai))
+	answerProvider.answerChain = append(answerProvider.answerChain, NewCommandAnswerProvider(kbm, ap, audit, feedback, misses))
+	answerProvider.answerChain = append(answerProvider.answerChain, NewEmbeddingAnswerProvider(kbm, oai, pm, ap, margin))
 	answerProvider.answerChain = append(answerProvider.answerChain, NewSimpleAnswerProvider())
 	return &answerProvider
 }
 
+// GetPluginManager gives access to the plugin manager for registering additional plugins.
+func (sap *UberAnswerProvider) GetPluginManager() *PluginManager {
+	return sap.pm
+}
+
+// getFactEditor returns the answer provider of the chain which edits facts.
+func (sap *UberAnswerProvider) getFactEditor() (FactEditor, error) {
+	for _, ap := range sap.answerChain {
+		fe, ok := ap.(FactEditor)
+		if ok {
+			return fe, nil
+		}
+	}
+	return nil, errors.New("no fact editor")
+}
+
+func (sap *UberAnswerProvider) GetFact(session *UserSession, name string) (*Fact, error) {
+	fe, err := sap.getFactEditor()
+	if err != nil {
+		return nil, err
+	}
+	return fe.GetFact(session, name)
+}
+
+func (sap *UberAnswerProvider) SaveFact(session *UserSession, fact *Fact, isNew bool) ([]*Answer, error) {
+	fe, err := sap.getFactEditor()
+	if err != nil {
+		return nil, err
+	}
+	return fe.SaveFact(session, fact, isNew)
+}
+
 func (sap *UberAnswerProvider) GetAnswers(session *UserSession, question *Question) ([]*Answer, error) {
+	session.Lock()
+	defer session.Unlock()
+	answers, err := sap.getAnswers(session, question)
+	// the embedding is only needed while answering, it is not kept in the history
+	question.Embedding = nil
+	session.AddHistory(question, answers, err).KnowledgeBase = sap.kbm.GetSessionBaseName(session)
+	return answers, err
+}
+
+func (sap *UberAnswerProvider) getAnswers(session *UserSession, question *Question) ([]*Answer, error) {
 	session.LastQuestion = question
 	if session.State == STATE_QA {
-		for _, ap := range sap.answerChain {
+		reason := MISS_UNANSWERED
+		for idx, ap := range sap.answerChain {
 			answers, err := ap.GetAnswers(session, question)
+			if errors.Is(err, ErrNoMatchingFact) {
+				RecordMiss(sap.misses, sap.kbm.GetSessionBaseName(session), question, MISS_UNANSWERED)
+			}
 			if err != nil {
 				return nil, err
 			}
 			if len(answers) > 0 {
+				// the last provider of the chain answers whatever the others could not
+				if idx == len(sap.answerChain)-1 && !IsSmallTalk(question) {
+					RecordMiss(sap.misses, sap.kbm.GetSessionBaseName(session), question, reason)
+				}
 				return answers, nil
 			}
+			_, ok := ap.(*EmbeddingAnswerProvider)
+			if ok {
+				reason = MISS_IMPLAUSIBLE
+			}
 		}
 	} else {
 		answers, err := sap.stateAnswerProvider.GetAnswers(session, question)
+		if errors.Is(err, ErrDraftTimedOut) {
+			// the draft was discarded, the message is answered like any other question
+			more, err := sap.getAnswers(session, question)
+			return append(answers, more...), err
+		}
 		if err != nil {
 			return nil, err
 		}
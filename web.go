@@ -17,43 +17,92 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"html/template"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/zerolog/log"
 )
 
+const (
+	WEB_CHAT_TEMPLATE  = "web/chat.html"
+	WEB_LOGIN_TEMPLATE = "web/login.html"
+	WEB_SESSION_COOKIE = "agentsmith_session"
+	WEB_SESSION_IDLEN  = 16
+	WEB_SESSION_PREFIX = "web-"
+	WEB_USER_NAME      = "WebUser"
+	WEB_EVENT_DELTA    = "delta"
+	WEB_EVENT_ANSWER   = "answer"
+	WEB_EVENT_ERROR    = "error"
+	WEB_EVENT_DONE     = "done"
+)
+
 type WebAgent struct {
 	secretProvider SecretProvider
 	configProvider ConfigProvider
 	answerProvider AnswerProvider
 	sessionMgr     SessionManager
+	kbm            *KnowledeBaseManager
+	ap             AccessProvider
+	audit          AuditLog
+	feedback       FeedbackStore
+	misses         MissQueue
 }
 
-func NewWebAgent(configProvider ConfigProvider, secretProvider SecretProvider, answerProvider AnswerProvider, sessionManager SessionManager) Agent {
+func NewWebAgent(configProvider ConfigProvider, secretProvider SecretProvider, answerProvider AnswerProvider, sessionManager SessionManager, kbm *KnowledeBaseManager, ap AccessProvider, audit AuditLog, feedback FeedbackStore, misses MissQueue) Agent {
 	wa := WebAgent{
 		configProvider: configProvider,
 		secretProvider: secretProvider,
 		answerProvider: answerProvider,
 		sessionMgr:     sessionManager,
+		kbm:            kbm,
+		ap:             ap,
+		audit:          audit,
+		feedback:       feedback,
+		misses:         misses,
 	}
 	return &wa
 }
 
-func (wa *WebAgent) LaunchAgent(wg sync.WaitGroup) {
+func (wa *WebAgent) LaunchAgent(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	log.Info().Msg("launching web agent")
+	server := &http.Server{Addr: wa.configProvider.GetConfig("webport"), Handler: wa.newRouter()}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+	err := server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		log.Error().Err(err).Msg("web agent failed")
+	}
+	log.Info().Msg("stopping web agent")
+}
+
+func (wa *WebAgent) newRouter() *mux.Router {
 	r := mux.NewRouter().StrictSlash(true)
 	fs := http.FileServer(http.Dir("./web"))
 	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", fs))
 	r.HandleFunc("/agentsmith", wa.getHandler).Methods("GET")
-	r.HandleFunc("/agentsmith", wa.postHandler).Methods("POST")
-	log.Info().Msg("launching web agent")
-	http.ListenAndServe(wa.configProvider.GetConfig("webport"), r)
-	log.Info().Msg("stopping web agent")
-	wg.Done()
+	r.HandleFunc("/agentsmith", wa.sameOriginOnly(wa.postHandler)).Methods("POST")
+	r.HandleFunc("/agentsmith/stream", wa.sameOriginOnly(wa.streamHandler)).Methods("POST")
+	r.HandleFunc("/agentsmith/feedback", wa.sameOriginOnly(wa.feedbackHandler)).Methods("POST")
+	r.HandleFunc("/login", wa.loginFormHandler).Methods("GET")
+	r.HandleFunc("/login", wa.sameOriginOnly(wa.loginHandler)).Methods("POST")
+	r.HandleFunc("/logout", wa.sameOriginOnly(wa.logoutHandler)).Methods("POST")
+	wa.addApiRoutes(r)
+	wa.addChatRoutes(r)
+	wa.addAdminRoutes(r)
+	return r
 }
 
 func (wa *WebAgent) generateRandomString(n int) string {
@@ -62,79 +111,235 @@ func (wa *WebAgent) generateRandomString(n int) string {
 	return base64.URLEncoding.EncodeToString(b)[:n]
 }
 
+// isSameOrigin tells whether a request was sent by a page of this site, browsers send the origin with posts.
+func (wa *WebAgent) isSameOrigin(r *http.Request) bool {
+	if r.Header.Get("Sec-Fetch-Site") == "cross-site" {
+		return false
+	}
+	if r.Header.Get("Origin") == "" {
+		return true
+	}
+	origin, err := url.Parse(r.Header.Get("Origin"))
+	return err == nil && origin.Host == r.Host
+}
+
+// sameOriginOnly rejects requests from other sites, which would run with the session cookie of the user.
+func (wa *WebAgent) sameOriginOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !wa.isSameOrigin(r) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// getSession returns the session of the browser identified by the session cookie, browsers without
+// a cookie of a session issued by this agent get a new session.
+func (wa *WebAgent) getSession(w http.ResponseWriter, r *http.Request) *UserSession {
+	cookie, err := r.Cookie(WEB_SESSION_COOKIE)
+	if err == nil && len(cookie.Value) == WEB_SESSION_IDLEN && wa.sessionMgr.FindSession(WEB_SESSION_PREFIX+cookie.Value) != nil {
+		return wa.sessionMgr.GetSession(NewUser(WEB_SESSION_PREFIX+cookie.Value, WEB_USER_NAME, WEB_USER_NAME).WithAgent(AGENT_WEB))
+	}
+	return wa.newSession(w)
+}
+
+// newSession creates a session with a new id and sets the cookie for it.
+func (wa *WebAgent) newSession(w http.ResponseWriter) *UserSession {
+	sessionId := wa.generateRandomString(WEB_SESSION_IDLEN)
+	http.SetCookie(w, &http.Cookie{
+		Name:     WEB_SESSION_COOKIE,
+		Value:    sessionId,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return wa.sessionMgr.GetSession(NewUser(WEB_SESSION_PREFIX+sessionId, WEB_USER_NAME, WEB_USER_NAME).WithAgent(AGENT_WEB))
+}
+
+// login starts a new session for the authenticated user, a session id known before the login is of
+// no use after it.
+func (wa *WebAgent) login(w http.ResponseWriter, r *http.Request, user *User) *UserSession {
+	wa.endSession(r)
+	session := wa.newSession(w)
+	session.User.Agent = user.Agent
+	session.User.Login = user.Login
+	session.User.Name = user.Name
+	return session
+}
+
+// endSession removes the session of the browser with its history and unfinished dialogs.
+func (wa *WebAgent) endSession(r *http.Request) {
+	cookie, err := r.Cookie(WEB_SESSION_COOKIE)
+	if err == nil {
+		wa.sessionMgr.DeleteSession(WEB_SESSION_PREFIX + cookie.Value)
+	}
+}
+
+func (wa *WebAgent) renderLogin(w http.ResponseWriter, next, errMsg string) {
+	tmpl, err := template.ParseFiles(WEB_LOGIN_TEMPLATE)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to parse login template")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = tmpl.Execute(w, map[string]string{"Next": next, "Error": errMsg})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to render login template")
+	}
+}
+
+// safeRedirect only allows redirects within this site.
+func (wa *WebAgent) safeRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/agentsmith"
+	}
+	return next
+}
+
+func (wa *WebAgent) loginFormHandler(w http.ResponseWriter, r *http.Request) {
+	wa.renderLogin(w, wa.safeRedirect(r.URL.Query().Get("next")), "")
+}
+
+func (wa *WebAgent) loginHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	next := wa.safeRedirect(r.FormValue("next"))
+	user, err := wa.ap.Authenticate(AGENT_WEB, r.FormValue("name"), r.FormValue("password"))
+	if err != nil {
+		log.Warn().Str("name", r.FormValue("name")).Msg("failed web login")
+		w.WriteHeader(http.StatusUnauthorized)
+		wa.renderLogin(w, next, err.Error())
+		return
+	}
+	wa.login(w, r, user)
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+func (wa *WebAgent) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	wa.endSession(r)
+	wa.newSession(w)
+	http.Redirect(w, r, "/agentsmith", http.StatusSeeOther)
+}
+
 func (wa *WebAgent) getHandler(w http.ResponseWriter, r *http.Request) {
-	sessionId := wa.generateRandomString(12)
-	data := map[string]string{
-		"Question":     "",
-		"LastQuestion": "",
-		"Answer":       "",
-		"AnswerTitle":  "",
-		"AnswerLink":   "",
-		"AnswerImage":  "",
-		"SessionId":    sessionId,
-		"Error":        "",
-	}
-	tmpl, err := template.ParseFiles("web/form.html")
+	session := wa.getSession(w, r)
+	session.Lock()
+	defer session.Unlock()
+	data := map[string]interface{}{
+		"History":       session.History,
+		"KnowledgeBase": wa.kbm.GetSessionBaseName(session),
+		"Login":         session.User.Login,
+	}
+	tmpl, err := template.ParseFiles(WEB_CHAT_TEMPLATE)
 	if err != nil {
-		log.Error().Err(err)
-		w.Write([]byte(err.Error()))
+		log.Error().Err(err).Msg("failed to parse chat template")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	err = tmpl.Execute(w, data)
 	if err != nil {
-		log.Error().Err(err)
-		w.Write([]byte(err.Error()))
-		return
+		log.Error().Err(err).Msg("failed to render chat template")
 	}
 }
 
+// postHandler answers questions of browsers without javascript, the answer shows up in the history.
 func (wa *WebAgent) postHandler(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
-		log.Error().Err(err)
-		w.Write([]byte(err.Error()))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	session := wa.getSession(w, r)
+	question := strings.TrimSpace(r.FormValue("question"))
+	if question != "" {
+		wa.answerProvider.GetAnswers(session, NewQuestion(question))
+	}
+	http.Redirect(w, r, "/agentsmith", http.StatusSeeOther)
+}
+
+// streamHandler answers a question posted by the chat page as server sent events. The answers are
+// complete before the text of each one is replayed word by word as delta events, followed by the
+// complete answer, done ends the reply.
+func (wa *WebAgent) streamHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
 		return
 	}
-	question := r.FormValue("question")
-	sessionId := r.FormValue("sessionId")
-	if sessionId == "" {
-		sessionId = wa.generateRandomString(12)
-	}
-	user := NewUser(sessionId, "WebUser", "WebUser")
-	session := wa.sessionMgr.GetSession(user)
-	data := map[string]string{
-		"Question":     "",
-		"Answer":       "",
-		"AnswerLink":   "",
-		"AnswerImage":  "",
-		"AnswerTitle":  "Answer",
-		"SessionId":    sessionId,
-		"LastQuestion": "",
-		"Error":        "",
-	}
-	answers, err := wa.answerProvider.GetAnswers(session, &Question{question})
+	question := strings.TrimSpace(r.FormValue("question"))
+	if question == "" {
+		http.Error(w, "missing question", http.StatusBadRequest)
+		return
+	}
+	session := wa.getSession(w, r)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	send := func(event string, v interface{}) {
+		data, err := json.Marshal(v)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to marshal event")
+			return
+		}
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+		flusher.Flush()
+	}
+	answers, err := wa.answerProvider.GetAnswers(session, NewQuestion(question))
 	if err != nil {
-		data["Error"] = err.Error()
-	} else {
-		for _, a := range answers {
-			data["Answer"] += a.Text
-			data["AnswerLink"] += a.Link
-			data["AnswerImage"] += a.ImageLink
+		send(WEB_EVENT_ERROR, &ApiError{err.Error()})
+	}
+	for idx, a := range answers {
+		for _, word := range strings.SplitAfter(a.Text, " ") {
+			if word != "" {
+				send(WEB_EVENT_DELTA, map[string]interface{}{"index": idx, "text": word})
+			}
 		}
+		send(WEB_EVENT_ANSWER, map[string]interface{}{"index": idx, "answer": a})
 	}
-	if session.LastQuestion != nil {
-		data["LastQuestion"] = session.LastQuestion.Text
+	session.Lock()
+	done := map[string]interface{}{"state": session.State}
+	if len(answers) > 0 && len(session.History) > 0 {
+		done["history"] = session.History[len(session.History)-1].Id
+	}
+	session.Unlock()
+	send(WEB_EVENT_DONE, done)
+}
+
+// feedbackHandler rates the answers to a question of the session history, scripts asking for json
+// get no content rather than a redirect.
+func (wa *WebAgent) feedbackHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	tmpl, err := template.ParseFiles("web/form.html")
+	session := wa.getSession(w, r)
+	rating, err := ParseRating(r.FormValue("rating"))
 	if err != nil {
-		log.Error().Err(err)
-		w.Write([]byte(err.Error()))
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	err = tmpl.Execute(w, data)
+	id, err := strconv.Atoi(r.FormValue("history"))
 	if err != nil {
-		log.Error().Err(err)
-		w.Write([]byte(err.Error()))
+		http.Error(w, "invalid history id", http.StatusBadRequest)
+		return
+	}
+	session.Lock()
+	history := session.GetHistory(id)
+	session.Unlock()
+	if history == nil {
+		http.Error(w, "no answer to give feedback on", http.StatusNotFound)
+		return
+	}
+	RecordFeedback(wa.feedback, NewFeedbackEntry(session.User, history, rating))
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.WriteHeader(http.StatusNoContent)
 		return
 	}
+	http.Redirect(w, r, "/agentsmith", http.StatusSeeOther)
 }
@@ -0,0 +1,168 @@
+(function () {
+    const conversation = document.getElementById("conversation");
+    const form = document.getElementById("chat");
+    const input = document.getElementById("question");
+    const ask = document.getElementById("ask");
+
+    function scroll() {
+        window.scrollTo(0, document.body.scrollHeight);
+    }
+
+    function addMessage(cls, text) {
+        const div = document.createElement("div");
+        div.className = "message " + cls;
+        if (text) {
+            div.textContent = text;
+        }
+        conversation.appendChild(div);
+        scroll();
+        return div;
+    }
+
+    function safeUrl(url) {
+        return /^(https?:|data:image\/)/i.test(url) ? url : "";
+    }
+
+    function renderAnswer(div, answer) {
+        div.textContent = "";
+        if (answer.text) {
+            const p = document.createElement("p");
+            p.textContent = answer.text;
+            div.appendChild(p);
+        }
+        if (safeUrl(answer.link)) {
+            const p = document.createElement("p");
+            const a = document.createElement("a");
+            a.href = answer.link;
+            a.target = "_blank";
+            a.textContent = answer.link;
+            p.appendChild(a);
+            div.appendChild(p);
+        }
+        if (safeUrl(answer.imageLink)) {
+            const p = document.createElement("p");
+            const img = document.createElement("img");
+            img.src = answer.imageLink;
+            p.appendChild(img);
+            div.appendChild(p);
+        }
+        scroll();
+    }
+
+    function addFeedback(history) {
+        const form = document.createElement("form");
+        form.action = "/agentsmith/feedback";
+        form.method = "post";
+        form.className = "feedback";
+        const input = document.createElement("input");
+        input.type = "hidden";
+        input.name = "history";
+        input.value = history;
+        form.appendChild(input);
+        [["up", "helpful", "\u{1F44D}"], ["down", "not helpful", "\u{1F44E}"]].forEach(function (b) {
+            const button = document.createElement("button");
+            button.type = "submit";
+            button.name = "rating";
+            button.value = b[0];
+            button.title = b[1];
+            button.textContent = b[2];
+            form.appendChild(button);
+        });
+        conversation.appendChild(form);
+        scroll();
+    }
+
+    conversation.addEventListener("submit", function (event) {
+        const form = event.target;
+        if (!form.classList.contains("feedback")) {
+            return;
+        }
+        event.preventDefault();
+        const body = new URLSearchParams(new FormData(form, event.submitter));
+        fetch(form.action, {method: "POST", body: body, headers: {"Accept": "application/json"}}).then(function (resp) {
+            form.textContent = resp.ok ? "thanks for your feedback" : "failed to send feedback";
+        });
+    });
+
+    function done() {
+        input.disabled = false;
+        ask.disabled = false;
+        input.focus();
+    }
+
+    form.addEventListener("submit", function (event) {
+        event.preventDefault();
+        const question = input.value.trim();
+        if (!question) {
+            return;
+        }
+        addMessage("question", question);
+        input.value = "";
+        input.disabled = true;
+        ask.disabled = true;
+        const answers = {};
+        const answerDiv = function (index) {
+            if (!answers[index]) {
+                answers[index] = addMessage("answer");
+            }
+            return answers[index];
+        };
+        const handlers = {
+            delta: function (data) {
+                answerDiv(data.index).textContent += data.text;
+                scroll();
+            },
+            answer: function (data) {
+                renderAnswer(answerDiv(data.index), data.answer);
+            },
+            error: function (data) {
+                addMessage("error", data.error);
+            },
+            done: function (data) {
+                if (data.history) {
+                    addFeedback(data.history);
+                }
+            }
+        };
+        // server sent events are read from the response of the post, EventSource can only get
+        function dispatch(block) {
+            let event = "message";
+            let data = "";
+            block.split("\n").forEach(function (line) {
+                if (line.startsWith("event: ")) {
+                    event = line.substring(7);
+                } else if (line.startsWith("data: ")) {
+                    data += line.substring(6);
+                }
+            });
+            if (handlers[event] && data) {
+                handlers[event](JSON.parse(data));
+            }
+        }
+        fetch("/agentsmith/stream", {method: "POST", body: new URLSearchParams({question: question})}).then(function (resp) {
+            if (!resp.ok) {
+                throw new Error("failed to ask question");
+            }
+            const reader = resp.body.getReader();
+            const decoder = new TextDecoder();
+            let buffer = "";
+            function read() {
+                return reader.read().then(function (result) {
+                    buffer += decoder.decode(result.value || new Uint8Array(), {stream: !result.done});
+                    let end;
+                    while ((end = buffer.indexOf("\n\n")) >= 0) {
+                        dispatch(buffer.substring(0, end));
+                        buffer = buffer.substring(end + 2);
+                    }
+                    if (!result.done) {
+                        return read();
+                    }
+                });
+            }
+            return read();
+        }).catch(function () {
+            addMessage("error", "connection lost");
+        }).finally(done);
+    });
+    scroll();
+})();
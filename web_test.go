@@ -0,0 +1,155 @@
+/**
+ * Copyright 2024 Boris Wolf
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestWebChat(t *testing.T) {
+	_, server := newTestWebAgent(t)
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+	resp, err := client.Get(server.URL + "/agentsmith")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	u, _ := url.Parse(server.URL)
+	cookies := jar.Cookies(u)
+	if len(cookies) != 1 || cookies[0].Name != WEB_SESSION_COOKIE {
+		t.Fatalf("expected session cookie: %+v", cookies)
+	}
+	resp, err = client.PostForm(server.URL+"/agentsmith/stream", url.Values{"question": {"How do I say hello?"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make([]string, 0)
+	text := ""
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "event: ") {
+			events = append(events, strings.TrimPrefix(line, "event: "))
+		} else if strings.HasPrefix(line, "data: ") && events[len(events)-1] == WEB_EVENT_DELTA {
+			text += line
+		}
+	}
+	resp.Body.Close()
+	if len(events) != 5 || events[0] != WEB_EVENT_DELTA || events[3] != WEB_EVENT_ANSWER || events[4] != WEB_EVENT_DONE {
+		t.Errorf("unexpected events: %v", events)
+	}
+	if !strings.Contains(text, "hello") {
+		t.Errorf("expected streamed text: %s", text)
+	}
+	if len(jar.Cookies(u)) != 1 || jar.Cookies(u)[0].Value != cookies[0].Value {
+		t.Errorf("expected session cookie to be kept")
+	}
+	resp, err = client.PostForm(server.URL+"/agentsmith", url.Values{"question": {"Who are the Vulcans?"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	page := string(body)
+	// the redirected page shows the whole conversation
+	if !strings.Contains(page, "How do I say hello?") || !strings.Contains(page, "just say hello") || !strings.Contains(page, "Who are the Vulcans?") {
+		t.Errorf("expected conversation in page: %s", page)
+	}
+}
+
+func TestWebChatForgery(t *testing.T) {
+	wa, server := newTestWebAgent(t)
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+	resp, err := client.Get(server.URL + "/agentsmith/stream?question=" + url.QueryEscape("rnumfacts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected questions not to be asked by get: %d", resp.StatusCode)
+	}
+	for _, header := range [][2]string{{"Origin", "https://evil.example.com"}, {"Sec-Fetch-Site", "cross-site"}} {
+		req, _ := http.NewRequest("POST", server.URL+"/agentsmith/stream", strings.NewReader("question=rnumfacts"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set(header[0], header[1])
+		resp, err = client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("expected cross site post to be rejected: %s %d", header[0], resp.StatusCode)
+		}
+	}
+	// session ids not issued by the agent are replaced
+	u, _ := url.Parse(server.URL)
+	jar.SetCookies(u, []*http.Cookie{{Name: WEB_SESSION_COOKIE, Value: "AAAAAAAAAAAAAAAA"}})
+	resp, err = client.Get(server.URL + "/agentsmith")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if jar.Cookies(u)[0].Value == "AAAAAAAAAAAAAAAA" || wa.sessionMgr.FindSession(WEB_SESSION_PREFIX+"AAAAAAAAAAAAAAAA") != nil {
+		t.Errorf("expected chosen session id to be rejected: %+v", jar.Cookies(u))
+	}
+}
+
+func TestWebLoginSession(t *testing.T) {
+	wa, server := newTestWebAgent(t)
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+	resp, err := client.PostForm(server.URL+"/agentsmith", url.Values{"question": {"How do I say hello?"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	u, _ := url.Parse(server.URL)
+	before := jar.Cookies(u)[0].Value
+	resp, err = client.PostForm(server.URL+"/login", url.Values{"name": {"admin"}, "password": {"secret"}, "next": {"/agentsmith"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	loggedIn := jar.Cookies(u)[0].Value
+	session := wa.sessionMgr.FindSession(WEB_SESSION_PREFIX + loggedIn)
+	if loggedIn == before || wa.sessionMgr.FindSession(WEB_SESSION_PREFIX+before) != nil || session == nil || session.User.Login != "admin" || len(session.History) != 0 {
+		t.Fatalf("expected new session on login: %s %s %+v", before, loggedIn, session)
+	}
+	resp, err = client.PostForm(server.URL+"/agentsmith", url.Values{"question": {"How do I say hello?"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	resp, err = client.PostForm(server.URL+"/logout", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	after := jar.Cookies(u)[0].Value
+	session = wa.sessionMgr.FindSession(WEB_SESSION_PREFIX + after)
+	if after == loggedIn || wa.sessionMgr.FindSession(WEB_SESSION_PREFIX+loggedIn) != nil || session == nil || session.User.Login != "" || len(session.History) != 0 {
+		t.Errorf("expected session to be reset on logout: %+v", session)
+	}
+}
@@ -0,0 +1,565 @@
+/**
+ * Copyright 2024 Boris Wolf
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	ADMIN_PREFIX          = "/admin"
+	ADMIN_TEMPLATES       = "web/admin/"
+	ADMIN_LAYOUT_TEMPLATE = "layout.html"
+)
+
+type (
+	AdminFactRow struct {
+		Fact            *Fact
+		EmbeddingStatus string
+	}
+	AdminRankRow struct {
+		Rank      int
+		FactName  string
+		Question  string
+		Relevance float64
+	}
+)
+
+// addAdminRoutes mounts the admin console for logged in users with editor role.
+func (wa *WebAgent) addAdminRoutes(r *mux.Router) {
+	admin := r.PathPrefix(ADMIN_PREFIX).Subrouter()
+	admin.Use(wa.adminAuthMiddleware)
+	admin.HandleFunc("", wa.adminIndexHandler).Methods("GET")
+	admin.HandleFunc("/kb/{kb}", wa.adminFactsHandler).Methods("GET")
+	admin.HandleFunc("/kb/{kb}/sync", wa.adminSyncHandler).Methods("POST")
+	admin.HandleFunc("/kb/{kb}/rank", wa.adminRankHandler).Methods("GET")
+	admin.HandleFunc("/kb/{kb}/feedback", wa.adminFeedbackHandler).Methods("GET")
+	admin.HandleFunc("/kb/{kb}/misses", wa.adminMissesHandler).Methods("GET")
+	admin.HandleFunc("/kb/{kb}/misses/{id}/resolve", wa.adminResolveMissHandler).Methods("POST")
+	admin.HandleFunc("/kb/{kb}/misses/{id}/dismiss", wa.adminDismissMissHandler).Methods("POST")
+	admin.HandleFunc("/kb/{kb}/facts", wa.adminSaveFactHandler).Methods("POST")
+	admin.HandleFunc("/kb/{kb}/facts/new", wa.adminEditFactHandler).Methods("GET")
+	admin.HandleFunc("/kb/{kb}/facts/{name}", wa.adminEditFactHandler).Methods("GET")
+	admin.HandleFunc("/kb/{kb}/facts/{name}/delete", wa.adminDeleteFactHandler).Methods("POST")
+}
+
+func (wa *WebAgent) adminAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if wa.getSession(w, r).User.Login == "" {
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+			return
+		}
+		// forms must not be posted from other sites
+		if r.Method == "POST" && !wa.isSameOrigin(r) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminBaseNames returns the knowledge bases the user of the request may edit.
+func (wa *WebAgent) adminBaseNames(w http.ResponseWriter, r *http.Request) []string {
+	user := wa.getSession(w, r).User
+	names := make([]string, 0)
+	for _, name := range wa.kbm.ListBaseNames() {
+		if HasRole(wa.ap, user, name, ROLE_EDITOR) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (wa *WebAgent) renderAdmin(w http.ResponseWriter, r *http.Request, page string, data map[string]interface{}) {
+	funcs := template.FuncMap{
+		"join": strings.Join,
+		"mul100": func(v float64) float64 {
+			return v * 100
+		},
+		"json": func(v interface{}) string {
+			if v == nil {
+				return ""
+			}
+			data, _ := json.MarshalIndent(v, "", "  ")
+			return string(data)
+		},
+	}
+	tmpl, err := template.New(ADMIN_LAYOUT_TEMPLATE).Funcs(funcs).ParseFiles(ADMIN_TEMPLATES+ADMIN_LAYOUT_TEMPLATE, ADMIN_TEMPLATES+page)
+	if err != nil {
+		log.Error().Err(err).Str("page", page).Msg("failed to parse admin template")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data["KnowledgeBases"] = wa.adminBaseNames(w, r)
+	data["Login"] = wa.getSession(w, r).User.Login
+	err = tmpl.Execute(w, data)
+	if err != nil {
+		log.Error().Err(err).Str("page", page).Msg("failed to render admin template")
+	}
+}
+
+func (wa *WebAgent) getAdminKnowledgeBase(w http.ResponseWriter, r *http.Request) (string, KnowledeBaseProvider) {
+	name := mux.Vars(r)["kb"]
+	kb := wa.kbm.GetKnowledgeBase(name)
+	if kb == nil {
+		http.Error(w, "no knowledge base for "+name, http.StatusNotFound)
+		return name, nil
+	}
+	err := CheckRole(wa.ap, wa.getSession(w, r).User, name, ROLE_EDITOR)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return name, nil
+	}
+	return name, kb
+}
+
+func (wa *WebAgent) adminIndexHandler(w http.ResponseWriter, r *http.Request) {
+	names := wa.adminBaseNames(w, r)
+	if len(names) == 0 {
+		http.Error(w, "permission denied, editor role required", http.StatusForbidden)
+		return
+	}
+	name := wa.kbm.GetCurrentBaseName()
+	if !HasRole(wa.ap, wa.getSession(w, r).User, name, ROLE_EDITOR) {
+		name = names[0]
+	}
+	http.Redirect(w, r, ADMIN_PREFIX+"/kb/"+url.PathEscape(name), http.StatusSeeOther)
+}
+
+// matchesFact tells whether a fact contains the search text and passes the plugin and label filters.
+func (wa *WebAgent) matchesFact(fact *Fact, search, plugin, label string) bool {
+	if plugin != "" && fact.Plugin != plugin {
+		return false
+	}
+	if label != "" {
+		found := false
+		for _, l := range fact.Labels {
+			if strings.EqualFold(l, label) {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if search == "" {
+		return true
+	}
+	search = strings.ToLower(search)
+	texts := append([]string{fact.Name, fact.Question}, fact.Answers...)
+	for _, text := range texts {
+		if strings.Contains(strings.ToLower(text), search) {
+			return true
+		}
+	}
+	return false
+}
+
+func (wa *WebAgent) adminFactsHandler(w http.ResponseWriter, r *http.Request) {
+	name, kb := wa.getAdminKnowledgeBase(w, r)
+	if kb == nil {
+		return
+	}
+	search := r.URL.Query().Get("q")
+	plugin := r.URL.Query().Get("plugin")
+	label := r.URL.Query().Get("label")
+	rows := make([]*AdminFactRow, 0)
+	plugins := make(map[string]bool)
+	labels := make(map[string]bool)
+	numMissing := 0
+	for _, fact := range kb.ListFacts() {
+		if fact.Plugin != "" {
+			plugins[fact.Plugin] = true
+		}
+		for _, l := range fact.Labels {
+			labels[l] = true
+		}
+		status := wa.kbm.GetEmbeddingStatus(name, fact)
+		if status != EMBEDDING_STATUS_OK {
+			numMissing++
+		}
+		if wa.matchesFact(fact, search, plugin, label) {
+			rows = append(rows, &AdminFactRow{fact, status})
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].Fact.Name < rows[j].Fact.Name
+	})
+	wa.renderAdmin(w, r, "facts.html", map[string]interface{}{
+		"Base":       name,
+		"Facts":      rows,
+		"NumFacts":   kb.GetNumFacts(),
+		"NumMissing": numMissing,
+		"Search":     search,
+		"Plugin":     plugin,
+		"Label":      label,
+		"Plugins":    sortedKeys(plugins),
+		"Labels":     sortedKeys(labels),
+		"Message":    r.URL.Query().Get("msg"),
+	})
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0)
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (wa *WebAgent) adminSyncHandler(w http.ResponseWriter, r *http.Request) {
+	name, kb := wa.getAdminKnowledgeBase(w, r)
+	if kb == nil {
+		return
+	}
+	msg := "synchronized embeddings"
+	err := wa.kbm.SyncBase(name)
+	RecordAudit(wa.audit, NewAuditEntry(wa.getSession(w, r).User, name, AUDIT_SYNC).WithOutcome(err))
+	if err != nil {
+		msg = "failed to synchronize embeddings: " + err.Error()
+	}
+	http.Redirect(w, r, ADMIN_PREFIX+"/kb/"+url.PathEscape(name)+"?msg="+url.QueryEscape(msg), http.StatusSeeOther)
+}
+
+func (wa *WebAgent) adminRankHandler(w http.ResponseWriter, r *http.Request) {
+	name, kb := wa.getAdminKnowledgeBase(w, r)
+	if kb == nil {
+		return
+	}
+	question := strings.TrimSpace(r.URL.Query().Get("question"))
+	data := map[string]interface{}{
+		"Base":     name,
+		"Question": question,
+		"Ranking":  []*AdminRankRow{},
+		"Error":    "",
+	}
+	if question != "" {
+		ranking, err := wa.kbm.RankQuestion(name, NewQuestion(question))
+		if err != nil {
+			data["Error"] = err.Error()
+		} else {
+			rows := make([]*AdminRankRow, 0)
+			for idx, e := range ranking.Embeddings {
+				row := &AdminRankRow{idx + 1, e.FactName, e.Source, e.Relevance}
+				if fact := kb.GetFact(e.FactName); fact != nil {
+					row.Question = fact.Question
+				}
+				rows = append(rows, row)
+			}
+			data["Ranking"] = rows
+		}
+	}
+	wa.renderAdmin(w, r, "rank.html", data)
+}
+
+func (wa *WebAgent) adminFeedbackHandler(w http.ResponseWriter, r *http.Request) {
+	name, kb := wa.getAdminKnowledgeBase(w, r)
+	if kb == nil {
+		return
+	}
+	data := map[string]interface{}{
+		"Base":   name,
+		"Report": &FeedbackReport{KnowledgeBase: name},
+		"Error":  "",
+	}
+	if wa.feedback == nil {
+		data["Error"] = "no feedback store"
+	} else {
+		report, err := wa.feedback.Report(name, DEFAULT_REPORT_LIMIT)
+		if err != nil {
+			data["Error"] = err.Error()
+		} else {
+			data["Report"] = report
+		}
+	}
+	wa.renderAdmin(w, r, "feedback.html", data)
+}
+
+func (wa *WebAgent) adminEditFactHandler(w http.ResponseWriter, r *http.Request) {
+	name, kb := wa.getAdminKnowledgeBase(w, r)
+	if kb == nil {
+		return
+	}
+	fact := &Fact{}
+	isNew := true
+	if factName, ok := mux.Vars(r)["name"]; ok {
+		fact = kb.GetFact(factName)
+		if fact == nil {
+			http.Error(w, "no fact with name "+factName, http.StatusNotFound)
+			return
+		}
+		isNew = false
+	}
+	wa.renderFactForm(w, r, name, fact, isNew, "")
+}
+
+func (wa *WebAgent) renderFactForm(w http.ResponseWriter, r *http.Request, name string, fact *Fact, isNew bool, errMsg string) {
+	// one empty row for adding another parameter
+	params := append(append([]Parameter{}, fact.Params...), Parameter{})
+	status := ""
+	if !isNew {
+		status = wa.kbm.GetEmbeddingStatus(name, fact)
+	}
+	wa.renderAdmin(w, r, "fact.html", map[string]interface{}{
+		"Base":            name,
+		"Fact":            fact,
+		"Params":          params,
+		"IsNew":           isNew,
+		"EmbeddingStatus": status,
+		"Error":           errMsg,
+		"ParamTypes":      []string{PARAM_TYPE_PROMPT, PARAM_TYPE_CONSTANT},
+		"DataTypes":       []string{"", PARAM_DATA_TYPE_STRING, PARAM_DATA_TYPE_INT, PARAM_DATA_TYPE_FLOAT, PARAM_DATA_TYPE_ENUM, PARAM_DATA_TYPE_DATE},
+	})
+}
+
+// splitLines returns the non blank lines of a text area.
+func splitLines(text string) []string {
+	lines := make([]string, 0)
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func splitList(text string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(text, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseFactForm builds a fact from the posted edit form, parameters are posted as parallel lists
+// of which rows without a name are skipped.
+func (wa *WebAgent) parseFactForm(r *http.Request) (*Fact, error) {
+	fact := &Fact{
+		Name:      strings.TrimSpace(r.FormValue("name")),
+		Question:  strings.TrimSpace(r.FormValue("question")),
+		Labels:    splitList(r.FormValue("labels")),
+		Answers:   splitLines(r.FormValue("answers")),
+		Links:     splitLines(r.FormValue("links")),
+		Plugin:    strings.TrimSpace(r.FormValue("plugin")),
+		IsSystem:  r.FormValue("isSystem") == "yes",
+		CreatedBy: r.FormValue("createdBy"),
+		CreatedAt: r.FormValue("createdAt"),
+	}
+	names := r.Form["paramName"]
+	for idx, paramName := range names {
+		paramName = strings.TrimSpace(paramName)
+		if paramName == "" {
+			continue
+		}
+		value := func(field string) string {
+			if idx < len(r.Form[field]) {
+				return strings.TrimSpace(r.Form[field][idx])
+			}
+			return ""
+		}
+		fact.Params = append(fact.Params, Parameter{
+			Name:             paramName,
+			Value:            value("paramValue"),
+			Type:             value("paramType"),
+			ExtractionPrompt: value("paramPrompt"),
+			Required:         value("paramRequired") == "yes",
+			DataType:         value("paramDataType"),
+			Description:      value("paramDescription"),
+			Default:          value("paramDefault"),
+			Enum:             splitList(value("paramEnum")),
+			Pattern:          value("paramPattern"),
+		})
+	}
+	if len(fact.Labels) == 0 {
+		fact.Labels = nil
+	}
+	if len(fact.Links) == 0 {
+		fact.Links = nil
+	}
+	for field, target := range map[string]interface{}{"webhook": &fact.Webhook, "script": &fact.Script, "dialog": &fact.Dialog} {
+		text := strings.TrimSpace(r.FormValue(field))
+		if text == "" {
+			continue
+		}
+		err := json.Unmarshal([]byte(text), target)
+		if err != nil {
+			return fact, errors.New("invalid " + field + ": " + err.Error())
+		}
+	}
+	return fact, nil
+}
+
+func (wa *WebAgent) adminSaveFactHandler(w http.ResponseWriter, r *http.Request) {
+	name, kb := wa.getAdminKnowledgeBase(w, r)
+	if kb == nil {
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	isNew := r.FormValue("isNew") == "yes"
+	fact, err := wa.parseFactForm(r)
+	if err == nil {
+		_, err = wa.kbm.SaveFact(wa.ap, wa.audit, wa.getSession(w, r).User, name, fact, isNew)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		wa.renderFactForm(w, r, name, fact, isNew, err.Error())
+		return
+	}
+	http.Redirect(w, r, ADMIN_PREFIX+"/kb/"+url.PathEscape(name)+"?msg="+url.QueryEscape("saved fact "+fact.Name), http.StatusSeeOther)
+}
+
+func (wa *WebAgent) adminDeleteFactHandler(w http.ResponseWriter, r *http.Request) {
+	name, kb := wa.getAdminKnowledgeBase(w, r)
+	if kb == nil {
+		return
+	}
+	factName := mux.Vars(r)["name"]
+	msg := "deleted fact " + factName
+	existing := kb.GetFact(factName)
+	err := wa.kbm.DeleteFact(name, factName)
+	RecordAudit(wa.audit, NewAuditEntry(wa.getSession(w, r).User, name, AUDIT_DELETE_FACT).WithFact(factName, existing, nil).WithOutcome(err))
+	if err != nil {
+		msg = "failed to delete fact: " + err.Error()
+	}
+	http.Redirect(w, r, ADMIN_PREFIX+"/kb/"+url.PathEscape(name)+"?msg="+url.QueryEscape(msg), http.StatusSeeOther)
+}
+
+func (wa *WebAgent) adminMissesHandler(w http.ResponseWriter, r *http.Request) {
+	name, kb := wa.getAdminKnowledgeBase(w, r)
+	if kb == nil {
+		return
+	}
+	data := map[string]interface{}{
+		"Base":     name,
+		"Message":  r.URL.Query().Get("msg"),
+		"Clusters": []*MissCluster{},
+		"Error":    "",
+	}
+	if wa.misses == nil {
+		data["Error"] = "no miss queue"
+	} else {
+		clusters, err := wa.misses.ListClusters(name)
+		if err != nil {
+			data["Error"] = err.Error()
+		} else {
+			data["Clusters"] = clusters
+		}
+	}
+	wa.renderAdmin(w, r, "misses.html", data)
+}
+
+// getAdminMissCluster returns the cluster of unanswered questions given by the path.
+func (wa *WebAgent) getAdminMissCluster(w http.ResponseWriter, r *http.Request) (string, *MissCluster) {
+	name, kb := wa.getAdminKnowledgeBase(w, r)
+	if kb == nil {
+		return name, nil
+	}
+	if wa.misses == nil {
+		http.Error(w, "no miss queue", http.StatusNotFound)
+		return name, nil
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "invalid cluster id", http.StatusBadRequest)
+		return name, nil
+	}
+	cluster, err := wa.misses.GetCluster(name, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return name, nil
+	}
+	// only act on the questions shown in the page, others may have joined the cluster since
+	err = r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return name, nil
+	}
+	ids := make([]int, 0)
+	for _, value := range r.Form["miss"] {
+		missId, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "invalid miss id", http.StatusBadRequest)
+			return name, nil
+		}
+		ids = append(ids, missId)
+	}
+	cluster = cluster.Select(ids)
+	if len(cluster.Misses) == 0 {
+		http.Error(w, "the unanswered questions have changed, please reload", http.StatusConflict)
+		return name, nil
+	}
+	return name, cluster
+}
+
+// adminResolveMissHandler turns a cluster of unanswered questions into a new fact and opens it for
+// further editing.
+func (wa *WebAgent) adminResolveMissHandler(w http.ResponseWriter, r *http.Request) {
+	name, cluster := wa.getAdminMissCluster(w, r)
+	if cluster == nil {
+		return
+	}
+	answers := make([]string, 0)
+	for _, a := range strings.Split(r.FormValue("answers"), "\n") {
+		if strings.TrimSpace(a) != "" {
+			answers = append(answers, strings.TrimSpace(a))
+		}
+	}
+	fact := NewFactFromCluster(cluster, strings.TrimSpace(r.FormValue("name")), answers)
+	_, err := wa.kbm.SaveFact(wa.ap, wa.audit, wa.getSession(w, r).User, name, fact, true)
+	if err == nil {
+		err = wa.misses.Remove(name, cluster.GetMissIds())
+	}
+	if err != nil {
+		http.Redirect(w, r, ADMIN_PREFIX+"/kb/"+url.PathEscape(name)+"/misses?msg="+url.QueryEscape("failed to create fact: "+err.Error()), http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, ADMIN_PREFIX+"/kb/"+url.PathEscape(name)+"/facts/"+url.PathEscape(fact.Name), http.StatusSeeOther)
+}
+
+func (wa *WebAgent) adminDismissMissHandler(w http.ResponseWriter, r *http.Request) {
+	name, cluster := wa.getAdminMissCluster(w, r)
+	if cluster == nil {
+		return
+	}
+	msg := fmt.Sprintf("dismissed %d unanswered questions", len(cluster.Misses))
+	err := wa.misses.Remove(name, cluster.GetMissIds())
+	if err != nil {
+		msg = "failed to dismiss unanswered questions: " + err.Error()
+	}
+	http.Redirect(w, r, ADMIN_PREFIX+"/kb/"+url.PathEscape(name)+"/misses?msg="+url.QueryEscape(msg), http.StatusSeeOther)
+}
@@ -0,0 +1,144 @@
+/**
+ * Copyright 2024 Boris Wolf
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// newTestLoginClient returns a client keeping the session cookie of the given web login.
+func newTestLoginClient(t *testing.T, server string, name, password string) *http.Client {
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+	resp, err := client.PostForm(server+"/login", url.Values{"name": {name}, "password": {password}, "next": {"/agentsmith"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("login of %s failed with status %d", name, resp.StatusCode)
+	}
+	return client
+}
+
+func doAdminRequest(t *testing.T, client *http.Client, method, u string, form url.Values, status int) string {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, _ := http.NewRequest(method, u, body)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, u, err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != status {
+		t.Fatalf("%s %s returned status %d, expected %d: %s", method, u, resp.StatusCode, status, data)
+	}
+	return string(data)
+}
+
+func TestWebAdmin(t *testing.T) {
+	wa, server := newTestWebAgent(t)
+	page := doAdminRequest(t, http.DefaultClient, "GET", server.URL+"/admin/kb/startrek", nil, http.StatusOK)
+	if !strings.Contains(page, "Agent Smith Login") {
+		t.Errorf("expected admin console to require login: %s", page)
+	}
+	resp, err := http.PostForm(server.URL+"/login", url.Values{"name": {"admin"}, "password": {"wrong"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected wrong password to be rejected, got %d", resp.StatusCode)
+	}
+	reader := newTestLoginClient(t, server.URL, "bob", "secret")
+	doAdminRequest(t, reader, "GET", server.URL+"/admin/kb/system", nil, http.StatusForbidden)
+	client := newTestLoginClient(t, server.URL, "admin", "secret")
+	page = doAdminRequest(t, client, "GET", server.URL+"/admin/kb/startrek", nil, http.StatusOK)
+	if !strings.Contains(page, "VULCANS") || !strings.Contains(page, "status-ok") {
+		t.Errorf("expected fact with embedding status in list: %s", page)
+	}
+	page = doAdminRequest(t, client, "GET", server.URL+"/admin/kb/startrek?q=klingon", nil, http.StatusOK)
+	if strings.Contains(page, "VULCANS") {
+		t.Errorf("expected fact to be filtered out")
+	}
+	form := url.Values{
+		"isNew":         {"yes"},
+		"name":          {"SHIP"},
+		"question":      {"Show me a starship"},
+		"labels":        {"ships, fleet"},
+		"answers":       {"Enterprise\nVoyager\n"},
+		"plugin":        {WEBHOOK_PLUGIN},
+		"webhook":       {`{"url": "https://example.com/ships/{{.Params.class}}"}`},
+		"paramName":     {"class", ""},
+		"paramType":     {PARAM_TYPE_PROMPT, PARAM_TYPE_PROMPT},
+		"paramRequired": {"yes", "no"},
+		"paramDataType": {PARAM_DATA_TYPE_ENUM, ""},
+		"paramEnum":     {"constitution, galaxy", ""},
+	}
+	doAdminRequest(t, client, "POST", server.URL+"/admin/kb/startrek/facts", form, http.StatusOK)
+	fact := wa.kbm.GetKnowledgeBase("startrek").GetFact("SHIP")
+	if fact == nil || len(fact.Answers) != 2 || len(fact.Labels) != 2 || fact.Webhook == nil || fact.CreatedBy != "admin" {
+		t.Fatalf("unexpected fact: %+v", fact)
+	}
+	if len(fact.Params) != 1 || !fact.Params[0].Required || len(fact.Params[0].Enum) != 2 {
+		t.Errorf("unexpected params: %+v", fact.Params)
+	}
+	if wa.kbm.GetEmbeddingStatus("startrek", fact) != EMBEDDING_STATUS_OK {
+		t.Errorf("expected embedding for new fact")
+	}
+	page = doAdminRequest(t, client, "POST", server.URL+"/admin/kb/startrek/facts", form, http.StatusBadRequest)
+	if !strings.Contains(page, "already have fact") {
+		t.Errorf("expected duplicate error: %s", page)
+	}
+	page = doAdminRequest(t, client, "GET", server.URL+"/admin/kb/startrek/facts/SHIP", nil, http.StatusOK)
+	if !strings.Contains(page, "constitution, galaxy") || !strings.Contains(page, "example.com/ships") {
+		t.Errorf("expected params and webhook in edit form: %s", page)
+	}
+	form.Set("isNew", "no")
+	form.Set("question", "Which starships are there?")
+	form.Set("webhook", "")
+	form.Set("plugin", "")
+	doAdminRequest(t, client, "POST", server.URL+"/admin/kb/startrek/facts", form, http.StatusOK)
+	fact = wa.kbm.GetKnowledgeBase("startrek").GetFact("SHIP")
+	if fact.Question != "Which starships are there?" || fact.Webhook != nil || fact.CreatedBy != "admin" {
+		t.Errorf("unexpected updated fact: %+v", fact)
+	}
+	if wa.kbm.GetEmbeddingsBase("startrek").GetEmbedding("SHIP").Source != fact.Question {
+		t.Errorf("expected embedding to be updated")
+	}
+	page = doAdminRequest(t, client, "GET", server.URL+"/admin/kb/startrek/rank?question="+url.QueryEscape("Who are the Vulcans?"), nil, http.StatusOK)
+	if strings.Index(page, "VULCANS") < 0 || strings.Index(page, "VULCANS") > strings.Index(page, "SHIP") {
+		t.Errorf("expected VULCANS to rank first: %s", page)
+	}
+	page = doAdminRequest(t, client, "POST", server.URL+"/admin/kb/startrek/sync", url.Values{}, http.StatusOK)
+	if !strings.Contains(page, "synchronized embeddings") {
+		t.Errorf("expected sync message: %s", page)
+	}
+	doAdminRequest(t, client, "POST", server.URL+"/admin/kb/startrek/facts/SHIP/delete", url.Values{}, http.StatusOK)
+	if wa.kbm.GetKnowledgeBase("startrek").HasFact("SHIP") {
+		t.Errorf("expected fact to be deleted")
+	}
+}
@@ -0,0 +1,444 @@
+/**
+ * Copyright 2024 Boris Wolf
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	API_PREFIX         = "/api/v1"
+	API_OPENAPI_SPEC   = "web/openapi.json"
+	API_SESSION_IDLEN  = 12
+	API_SESSION_PREFIX = "api-"
+	API_USER_NAME      = "ApiUser"
+)
+
+type (
+	ApiError struct {
+		Error string `json:"error"`
+	}
+	ApiAskRequest struct {
+		Question      string `json:"question"`
+		SessionId     string `json:"sessionId"`
+		KnowledgeBase string `json:"knowledgeBase"`
+	}
+	ApiAskResponse struct {
+		SessionId     string    `json:"sessionId"`
+		Question      string    `json:"question"`
+		Answers       []*Answer `json:"answers"`
+		State         string    `json:"state"`
+		KnowledgeBase string    `json:"knowledgeBase"`
+	}
+	ApiKnowledgeBase struct {
+		Name     string `json:"name"`
+		NumFacts int    `json:"numFacts"`
+		Default  bool   `json:"default"`
+	}
+	ApiSelectKnowledgeBaseRequest struct {
+		Name string `json:"name"`
+	}
+	ApiSession struct {
+		Id string `json:"id"`
+		*UserSession
+	}
+)
+
+func (wa *WebAgent) addApiRoutes(r *mux.Router) {
+	api := r.PathPrefix(API_PREFIX).Subrouter()
+	api.HandleFunc("/openapi.json", wa.apiSpecHandler).Methods("GET")
+	api.HandleFunc("/ask", wa.apiAskHandler).Methods("POST")
+	api.HandleFunc("/knowledgebases", wa.apiListKnowledgeBasesHandler).Methods("GET")
+	api.HandleFunc("/knowledgebases/{kb}/facts", wa.apiListFactsHandler).Methods("GET")
+	api.HandleFunc("/knowledgebases/{kb}/facts", wa.apiAddFactHandler).Methods("POST")
+	api.HandleFunc("/knowledgebases/{kb}/facts/{name}", wa.apiGetFactHandler).Methods("GET")
+	api.HandleFunc("/knowledgebases/{kb}/facts/{name}", wa.apiUpdateFactHandler).Methods("PUT")
+	api.HandleFunc("/knowledgebases/{kb}/facts/{name}", wa.apiDeleteFactHandler).Methods("DELETE")
+	api.HandleFunc("/sessions/{id}", wa.apiGetSessionHandler).Methods("GET")
+	api.HandleFunc("/sessions/{id}/knowledgebase", wa.apiSelectKnowledgeBaseHandler).Methods("PUT")
+	api.HandleFunc("/audit", wa.apiAuditHandler).Methods("GET")
+}
+
+func (wa *WebAgent) writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to write json response")
+	}
+}
+
+func (wa *WebAgent) writeError(w http.ResponseWriter, status int, err error) {
+	wa.writeJson(w, status, &ApiError{err.Error()})
+}
+
+func (wa *WebAgent) readJson(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err != nil {
+		wa.writeError(w, http.StatusBadRequest, errors.New("invalid json: "+err.Error()))
+		return false
+	}
+	return true
+}
+
+// getApiUser returns the user authenticated by basic auth or an anonymous api user.
+func (wa *WebAgent) getApiUser(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	name, password, ok := r.BasicAuth()
+	if ok {
+		user, err := wa.ap.Authenticate(AGENT_WEB, name, password)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="agentsmith"`)
+			wa.writeError(w, http.StatusUnauthorized, err)
+			return nil, false
+		}
+		return user, true
+	}
+	return NewUser(API_USER_NAME, API_USER_NAME, API_USER_NAME).WithAgent(AGENT_API), true
+}
+
+// getApiSession returns the api session with the given id for the user, api sessions are kept apart from
+// the sessions of other agents and belong to the user who created them.
+func (wa *WebAgent) getApiSession(w http.ResponseWriter, id string, user *User) (*UserSession, bool) {
+	sessionUser := NewUser(API_SESSION_PREFIX+id, user.Name, user.RealName).WithAgent(user.Agent)
+	sessionUser.Login = user.GetLogin()
+	session := wa.sessionMgr.GetSession(sessionUser)
+	if !wa.isApiSessionOwner(session, user) {
+		wa.writeError(w, http.StatusForbidden, errors.New("session belongs to another user"))
+		return nil, false
+	}
+	return session, true
+}
+
+func (wa *WebAgent) isApiSessionOwner(session *UserSession, user *User) bool {
+	return session.User.Agent == user.Agent && session.User.GetLogin() == user.GetLogin()
+}
+
+func (wa *WebAgent) checkApiRole(w http.ResponseWriter, user *User, baseName, role string) bool {
+	err := CheckRole(wa.ap, user, baseName, role)
+	if err != nil {
+		wa.writeError(w, http.StatusForbidden, err)
+		return false
+	}
+	return true
+}
+
+func (wa *WebAgent) apiSpecHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	http.ServeFile(w, r, API_OPENAPI_SPEC)
+}
+
+func (wa *WebAgent) apiAskHandler(w http.ResponseWriter, r *http.Request) {
+	var req ApiAskRequest
+	if !wa.readJson(w, r, &req) {
+		return
+	}
+	if req.Question == "" {
+		wa.writeError(w, http.StatusBadRequest, errors.New("missing question"))
+		return
+	}
+	if req.SessionId == "" {
+		req.SessionId = wa.generateRandomString(API_SESSION_IDLEN)
+	}
+	user, ok := wa.getApiUser(w, r)
+	if !ok {
+		return
+	}
+	session, ok := wa.getApiSession(w, req.SessionId, user)
+	if !ok {
+		return
+	}
+	if req.KnowledgeBase != "" {
+		if !wa.checkApiRole(w, user, req.KnowledgeBase, ROLE_READER) {
+			return
+		}
+		session.Lock()
+		err := wa.kbm.SetSessionBaseName(session, req.KnowledgeBase)
+		session.Unlock()
+		if err != nil {
+			wa.writeError(w, http.StatusNotFound, err)
+			return
+		}
+	}
+	answers, err := wa.answerProvider.GetAnswers(session, NewQuestion(req.Question))
+	if err != nil {
+		wa.writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	if answers == nil {
+		answers = []*Answer{}
+	}
+	wa.writeJson(w, http.StatusOK, &ApiAskResponse{
+		SessionId:     req.SessionId,
+		Question:      req.Question,
+		Answers:       answers,
+		State:         session.State,
+		KnowledgeBase: wa.kbm.GetSessionBaseName(session),
+	})
+}
+
+func (wa *WebAgent) apiListKnowledgeBasesHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := wa.getApiUser(w, r)
+	if !ok {
+		return
+	}
+	kbs := make([]*ApiKnowledgeBase, 0)
+	for _, name := range wa.kbm.ListBaseNames() {
+		if !HasRole(wa.ap, user, name, ROLE_READER) {
+			continue
+		}
+		kbs = append(kbs, &ApiKnowledgeBase{
+			Name:     name,
+			NumFacts: wa.kbm.GetKnowledgeBase(name).GetNumFacts(),
+			Default:  name == wa.kbm.GetCurrentBaseName(),
+		})
+	}
+	sort.Slice(kbs, func(i, j int) bool {
+		return kbs[i].Name < kbs[j].Name
+	})
+	wa.writeJson(w, http.StatusOK, kbs)
+}
+
+// getApiKnowledgeBase returns the knowledge base of the request if the user has the given role for it.
+func (wa *WebAgent) getApiKnowledgeBase(w http.ResponseWriter, r *http.Request, role string) (string, KnowledeBaseProvider, *User) {
+	name := mux.Vars(r)["kb"]
+	user, ok := wa.getApiUser(w, r)
+	if !ok {
+		return name, nil, user
+	}
+	kb := wa.kbm.GetKnowledgeBase(name)
+	if kb == nil {
+		wa.writeError(w, http.StatusNotFound, errors.New("no knowledge base for "+name))
+		return name, nil, user
+	}
+	if !wa.checkApiRole(w, user, name, role) {
+		return name, nil, user
+	}
+	return name, kb, user
+}
+
+func (wa *WebAgent) apiListFactsHandler(w http.ResponseWriter, r *http.Request) {
+	_, kb, _ := wa.getApiKnowledgeBase(w, r, ROLE_READER)
+	if kb == nil {
+		return
+	}
+	facts := kb.ListFacts()
+	sort.Slice(facts, func(i, j int) bool {
+		return facts[i].Name < facts[j].Name
+	})
+	wa.writeJson(w, http.StatusOK, facts)
+}
+
+func (wa *WebAgent) apiGetFactHandler(w http.ResponseWriter, r *http.Request) {
+	_, kb, _ := wa.getApiKnowledgeBase(w, r, ROLE_READER)
+	if kb == nil {
+		return
+	}
+	fact := kb.GetFact(NormalizeFactName(mux.Vars(r)["name"]))
+	if fact == nil {
+		wa.writeError(w, http.StatusNotFound, errors.New("no fact with name "+mux.Vars(r)["name"]))
+		return
+	}
+	wa.writeJson(w, http.StatusOK, fact)
+}
+
+// factErrorStatus maps an error of saving a fact to the http status of the response.
+func factErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrPermissionDenied):
+		return http.StatusForbidden
+	case errors.Is(err, ErrInvalidFact):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrFactExists):
+		return http.StatusConflict
+	case errors.Is(err, ErrNoFact):
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+func (wa *WebAgent) apiAddFactHandler(w http.ResponseWriter, r *http.Request) {
+	name, kb, user := wa.getApiKnowledgeBase(w, r, ROLE_EDITOR)
+	if kb == nil {
+		return
+	}
+	var fact Fact
+	if !wa.readJson(w, r, &fact) {
+		return
+	}
+	_, err := wa.kbm.SaveFact(wa.ap, wa.audit, user, name, &fact, true)
+	if err != nil {
+		wa.writeError(w, factErrorStatus(err), err)
+		return
+	}
+	wa.writeJson(w, http.StatusCreated, &fact)
+}
+
+func (wa *WebAgent) apiUpdateFactHandler(w http.ResponseWriter, r *http.Request) {
+	name, kb, user := wa.getApiKnowledgeBase(w, r, ROLE_EDITOR)
+	if kb == nil {
+		return
+	}
+	var fact Fact
+	if !wa.readJson(w, r, &fact) {
+		return
+	}
+	if fact.Name == "" {
+		fact.Name = mux.Vars(r)["name"]
+	}
+	if NormalizeFactName(fact.Name) != NormalizeFactName(mux.Vars(r)["name"]) {
+		wa.writeError(w, http.StatusBadRequest, errors.New("fact name does not match path"))
+		return
+	}
+	_, err := wa.kbm.SaveFact(wa.ap, wa.audit, user, name, &fact, false)
+	if err != nil {
+		wa.writeError(w, factErrorStatus(err), err)
+		return
+	}
+	wa.writeJson(w, http.StatusOK, &fact)
+}
+
+func (wa *WebAgent) apiDeleteFactHandler(w http.ResponseWriter, r *http.Request) {
+	name, kb, user := wa.getApiKnowledgeBase(w, r, ROLE_EDITOR)
+	if kb == nil {
+		return
+	}
+	factName := NormalizeFactName(mux.Vars(r)["name"])
+	existing := kb.GetFact(factName)
+	if existing == nil {
+		wa.writeError(w, http.StatusNotFound, errors.New("no fact with name "+factName))
+		return
+	}
+	err := wa.kbm.DeleteFact(name, factName)
+	RecordAudit(wa.audit, NewAuditEntry(user, name, AUDIT_DELETE_FACT).WithFact(factName, existing, nil).WithOutcome(err))
+	if err != nil {
+		wa.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiGetSessionHandler returns an api session to the authenticated user who owns it or to admins.
+func (wa *WebAgent) apiGetSessionHandler(w http.ResponseWriter, r *http.Request) {
+	if _, _, ok := r.BasicAuth(); !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="agentsmith"`)
+		wa.writeError(w, http.StatusUnauthorized, errors.New("authentication required"))
+		return
+	}
+	user, ok := wa.getApiUser(w, r)
+	if !ok {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	session := wa.sessionMgr.FindSession(API_SESSION_PREFIX + id)
+	if session == nil {
+		wa.writeError(w, http.StatusNotFound, errors.New("no session with id "+id))
+		return
+	}
+	if !wa.isApiSessionOwner(session, user) && !HasRole(wa.ap, user, "", ROLE_ADMIN) {
+		wa.writeError(w, http.StatusForbidden, errors.New("session belongs to another user"))
+		return
+	}
+	session.Lock()
+	defer session.Unlock()
+	wa.writeJson(w, http.StatusOK, &ApiSession{id, session})
+}
+
+func (wa *WebAgent) apiSelectKnowledgeBaseHandler(w http.ResponseWriter, r *http.Request) {
+	var req ApiSelectKnowledgeBaseRequest
+	if !wa.readJson(w, r, &req) {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	user, ok := wa.getApiUser(w, r)
+	if !ok || !wa.checkApiRole(w, user, req.Name, ROLE_READER) {
+		return
+	}
+	session, ok := wa.getApiSession(w, id, user)
+	if !ok {
+		return
+	}
+	session.Lock()
+	defer session.Unlock()
+	err := wa.kbm.SetSessionBaseName(session, req.Name)
+	if err != nil {
+		wa.writeError(w, http.StatusNotFound, err)
+		return
+	}
+	wa.writeJson(w, http.StatusOK, &ApiSession{id, session})
+}
+
+// apiAuditHandler returns the most recent audit entries of the knowledge bases the user is admin of.
+func (wa *WebAgent) apiAuditHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := wa.getApiUser(w, r)
+	if !ok {
+		return
+	}
+	if wa.audit == nil {
+		wa.writeError(w, http.StatusNotFound, errors.New("no audit log"))
+		return
+	}
+	query := r.URL.Query()
+	filter := &AuditFilter{
+		KnowledgeBase: query.Get("knowledgeBase"),
+		User:          query.Get("user"),
+		FactName:      query.Get("factName"),
+		Command:       query.Get("command"),
+	}
+	if filter.KnowledgeBase != "" && !wa.checkApiRole(w, user, filter.KnowledgeBase, ROLE_ADMIN) {
+		return
+	}
+	if query.Get("since") != "" {
+		since, err := time.Parse(time.RFC3339, query.Get("since"))
+		if err != nil {
+			wa.writeError(w, http.StatusBadRequest, errors.New("invalid since: "+err.Error()))
+			return
+		}
+		filter.Since = since
+	}
+	limit := DEFAULT_AUDIT_LIMIT
+	if query.Get("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || limit <= 0 {
+			wa.writeError(w, http.StatusBadRequest, errors.New("invalid limit"))
+			return
+		}
+	}
+	// entries of knowledge bases the user is not admin of are filtered out afterwards
+	filter.Limit = math.MaxInt32
+	entries, err := wa.audit.Query(filter)
+	if err != nil {
+		wa.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	result := make([]*AuditEntry, 0)
+	for _, e := range entries {
+		if len(result) < limit && HasRole(wa.ap, user, e.KnowledgeBase, ROLE_ADMIN) {
+			result = append(result, e)
+		}
+	}
+	wa.writeJson(w, http.StatusOK, result)
+}
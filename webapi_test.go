@@ -0,0 +1,228 @@
+/**
+ * Copyright 2024 Boris Wolf
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// newTestKnowledgeBaseManager creates a knowledge base manager with file stores in a temp dir.
+func newTestKnowledgeBaseManager(t *testing.T, oai OpenAIHandler, bases map[string][]*Fact) *KnowledeBaseManager {
+	dir := t.TempDir()
+	kbm := &KnowledeBaseManager{
+		currentBaseName: DEFAULT_KNOWLEDGE_BASE_NAME,
+		secretProvider:  testSecretProvider{},
+		oai:             oai,
+		factsStores:     make(map[string]KnowledeBaseProvider),
+		embeddingStores: make(map[string]EmbeddingsBaseProvider),
+	}
+	for name, facts := range bases {
+		kb := NewFileKnowledgeBase(name).(*FileKnowledgeBase)
+		kb.filePath = filepath.Join(dir, "facts-"+name+".json")
+		for _, fact := range facts {
+			kb.AddFact(fact)
+		}
+		eb := NewFileEmbeddingBase(kbm.secretProvider, oai, name).(*FileEmbeddingsBase)
+		eb.filePath = filepath.Join(dir, "embeddings-"+name+".json")
+		err := eb.SyncEmbeddings(kb)
+		if err != nil {
+			t.Fatalf("failed to sync embeddings: %v", err)
+		}
+		kbm.factsStores[name] = kb
+		kbm.embeddingStores[name] = eb
+	}
+	return kbm
+}
+
+func newTestWebAgent(t *testing.T) (*WebAgent, *httptest.Server) {
+	args := `{}`
+	openai := newTestOpenAIServer(t, &args)
+	t.Cleanup(openai.Close)
+	secretProvider := testSecretProvider{OPEN_AI_TOKEN: "test", WEB_API_KEY: "test-key"}
+	configProvider := testConfigProvider{"pluginsdir": t.TempDir()}
+	oai := NewOpenAIHandler(secretProvider).WithBaseUrl(openai.URL)
+	kbm := newTestKnowledgeBaseManager(t, *oai, map[string][]*Fact{
+		"system": {
+			{Name: "GREETING", Question: "How do I say hello?", Answers: []string{"just say hello"}},
+		},
+		"startrek": {
+			{Name: "VULCANS", Question: "Who are the Vulcans?", Answers: []string{"a logical species"}, Links: []string{"https://memory-alpha.fandom.com/wiki/Vulcan"}},
+		},
+	})
+	sessionMgr := NewSimpleSessionManager(0, 0)
+	t.Cleanup(func() { sessionMgr.Close() })
+	// anonymous users may edit so that the api can be tested without logging in
+	ap := newTestAccessProvider(ROLE_EDITOR,
+		&AccessUser{Agent: AGENT_WEB, Id: "admin", Role: ROLE_ADMIN, Password: HashPassword("secret")},
+		&AccessUser{Agent: AGENT_WEB, Id: "bob", Role: ROLE_READER, Bases: map[string]string{"startrek": ROLE_NONE}, Password: HashPassword("secret")},
+	)
+	audit, err := NewJSONLAuditLog(filepath.Join(t.TempDir(), "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { audit.Close() })
+	feedback, err := NewJSONLFeedbackStore(filepath.Join(t.TempDir(), "feedback.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { feedback.Close() })
+	misses, err := NewJSONMissQueue(filepath.Join(t.TempDir(), "misses.json"), *oai)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { misses.Close() })
+	answerProvider := NewUberAnswerProvider(kbm, *oai, configProvider, secretProvider, ap, audit, feedback, misses)
+	wa := NewWebAgent(configProvider, secretProvider, answerProvider, sessionMgr, kbm, ap, audit, feedback, misses).(*WebAgent)
+	server := httptest.NewServer(wa.newRouter())
+	t.Cleanup(server.Close)
+	return wa, server
+}
+
+func doTestRequest(t *testing.T, method, url string, body interface{}, status int, resp interface{}) {
+	doTestRequestAs(t, "", method, url, body, status, resp)
+}
+
+// doTestRequestAs sends the request with basic auth of the given user, who has the password secret.
+func doTestRequestAs(t *testing.T, user, method, url string, body interface{}, status int, resp interface{}) {
+	doTestRequestWith(t, func(req *http.Request) {
+		if user != "" {
+			req.SetBasicAuth(user, "secret")
+		}
+	}, method, url, body, status, resp)
+}
+
+func doTestRequestWith(t *testing.T, auth func(req *http.Request), method, url string, body interface{}, status int, resp interface{}) {
+	var buf bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&buf).Encode(body)
+	}
+	req, _ := http.NewRequest(method, url, &buf)
+	req.Header.Set("Content-Type", "application/json")
+	auth(req)
+	httpResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, url, err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != status {
+		var apiErr ApiError
+		json.NewDecoder(httpResp.Body).Decode(&apiErr)
+		t.Fatalf("%s %s returned status %d, expected %d: %s", method, url, httpResp.StatusCode, status, apiErr.Error)
+	}
+	if resp != nil {
+		err = json.NewDecoder(httpResp.Body).Decode(resp)
+		if err != nil {
+			t.Fatalf("failed to decode response of %s %s: %v", method, url, err)
+		}
+	}
+}
+
+func TestApiAsk(t *testing.T) {
+	_, server := newTestWebAgent(t)
+	var resp ApiAskResponse
+	doTestRequest(t, "POST", server.URL+"/api/v1/ask", &ApiAskRequest{Question: "Who are the Vulcans?", KnowledgeBase: "startrek"}, http.StatusOK, &resp)
+	if resp.SessionId == "" || resp.KnowledgeBase != "startrek" || len(resp.Answers) != 2 {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+	if resp.Answers[0].Text != "a logical species" || resp.Answers[0].FactName != "VULCANS" || resp.Answers[0].Score <= 0 || resp.Answers[0].Rank != 1 {
+		t.Errorf("unexpected answer: %+v", resp.Answers[0])
+	}
+	if resp.Answers[1].Link == "" {
+		t.Errorf("expected link answer: %+v", resp.Answers[1])
+	}
+	var session ApiSession
+	doTestRequest(t, "GET", server.URL+"/api/v1/sessions/"+resp.SessionId, nil, http.StatusUnauthorized, nil)
+	doTestRequestAs(t, "bob", "GET", server.URL+"/api/v1/sessions/"+resp.SessionId, nil, http.StatusForbidden, nil)
+	doTestRequestAs(t, "admin", "GET", server.URL+"/api/v1/sessions/"+resp.SessionId, nil, http.StatusOK, &session)
+	if session.Id != resp.SessionId || session.BaseName != "startrek" || len(session.History) != 1 {
+		t.Errorf("unexpected session: %+v", session)
+	}
+	doTestRequestAs(t, "admin", "GET", server.URL+"/api/v1/sessions/unknown", nil, http.StatusNotFound, nil)
+	doTestRequest(t, "PUT", server.URL+"/api/v1/sessions/"+resp.SessionId+"/knowledgebase", &ApiSelectKnowledgeBaseRequest{"system"}, http.StatusOK, &session)
+	if session.BaseName != "system" {
+		t.Errorf("expected knowledge base to be selected: %+v", session)
+	}
+	doTestRequest(t, "PUT", server.URL+"/api/v1/sessions/"+resp.SessionId+"/knowledgebase", &ApiSelectKnowledgeBaseRequest{"unknown"}, http.StatusNotFound, nil)
+}
+
+func TestApiSessionOwnership(t *testing.T) {
+	wa, server := newTestWebAgent(t)
+	admin := NewUser("slack-C1-U1", "admin", "admin").WithAgent(AGENT_WEB)
+	admin.Login = "admin"
+	wa.sessionMgr.GetSession(admin).AddHistory(NewQuestion("secret question"), nil, nil)
+	var resp ApiAskResponse
+	doTestRequest(t, "POST", server.URL+"/api/v1/ask", &ApiAskRequest{Question: "Who are the Vulcans?", SessionId: "slack-C1-U1"}, http.StatusOK, &resp)
+	var session ApiSession
+	doTestRequestAs(t, "admin", "GET", server.URL+"/api/v1/sessions/slack-C1-U1", nil, http.StatusOK, &session)
+	if session.User.GetLogin() != API_USER_NAME || len(session.History) != 1 || session.History[0].Question.Text != "Who are the Vulcans?" {
+		t.Errorf("expected api session apart from the slack session: %+v", session.UserSession)
+	}
+	doTestRequestAs(t, "admin", "POST", server.URL+"/api/v1/ask", &ApiAskRequest{Question: "rnumfacts", SessionId: "admin-session"}, http.StatusOK, nil)
+	doTestRequest(t, "POST", server.URL+"/api/v1/ask", &ApiAskRequest{Question: "rdeletefact GREETING", SessionId: "admin-session"}, http.StatusForbidden, nil)
+	doTestRequestAs(t, "bob", "POST", server.URL+"/api/v1/ask", &ApiAskRequest{Question: "rnumfacts", SessionId: "admin-session"}, http.StatusForbidden, nil)
+	doTestRequest(t, "PUT", server.URL+"/api/v1/sessions/admin-session/knowledgebase", &ApiSelectKnowledgeBaseRequest{"system"}, http.StatusForbidden, nil)
+	doTestRequestAs(t, "admin", "GET", server.URL+"/api/v1/sessions/admin-session", nil, http.StatusOK, &session)
+	if len(session.History) != 1 || wa.kbm.GetKnowledgeBase("system").GetFact("GREETING") == nil {
+		t.Errorf("expected session of admin not to be used by others: %+v", session.History)
+	}
+}
+
+func TestApiFacts(t *testing.T) {
+	wa, server := newTestWebAgent(t)
+	var kbs []*ApiKnowledgeBase
+	doTestRequest(t, "GET", server.URL+"/api/v1/knowledgebases", nil, http.StatusOK, &kbs)
+	if len(kbs) != 2 || kbs[0].Name != "startrek" || kbs[1].Name != "system" || !kbs[1].Default {
+		t.Errorf("unexpected knowledge bases: %+v", kbs)
+	}
+	url := server.URL + "/api/v1/knowledgebases/startrek/facts"
+	fact := &Fact{Name: "WARP", Question: "What is warp speed?", Answers: []string{"faster than light"}}
+	var added Fact
+	doTestRequest(t, "POST", url, fact, http.StatusCreated, &added)
+	if added.CreatedBy == "" || added.CreatedAt == "" {
+		t.Errorf("expected creation info: %+v", added)
+	}
+	doTestRequest(t, "POST", url, fact, http.StatusConflict, nil)
+	doTestRequest(t, "POST", url, &Fact{Name: "warp", Question: "What is warp?"}, http.StatusConflict, nil)
+	doTestRequest(t, "POST", url, &Fact{Name: "EMPTY"}, http.StatusBadRequest, nil)
+	doTestRequest(t, "PUT", url+"/unknown", &Fact{Question: "?"}, http.StatusNotFound, nil)
+	if !wa.kbm.GetEmbeddingsBase("startrek").HasEmbedding("WARP") {
+		t.Errorf("expected embedding for new fact")
+	}
+	fact.Answers = []string{"very fast"}
+	doTestRequest(t, "PUT", url+"/WARP", fact, http.StatusOK, nil)
+	var got Fact
+	doTestRequest(t, "GET", url+"/warp", nil, http.StatusOK, &got)
+	if len(got.Answers) != 1 || got.Answers[0] != "very fast" || got.CreatedAt != added.CreatedAt {
+		t.Errorf("unexpected updated fact: %+v", got)
+	}
+	var facts []*Fact
+	doTestRequest(t, "GET", url, nil, http.StatusOK, &facts)
+	if len(facts) != 2 || facts[0].Name != "VULCANS" || facts[1].Name != "WARP" {
+		t.Errorf("unexpected facts: %+v", facts)
+	}
+	doTestRequest(t, "DELETE", url+"/WARP", nil, http.StatusNoContent, nil)
+	doTestRequest(t, "GET", url+"/WARP", nil, http.StatusNotFound, nil)
+	doTestRequest(t, "GET", server.URL+"/api/v1/knowledgebases/unknown/facts", nil, http.StatusNotFound, nil)
+	if wa.kbm.GetEmbeddingsBase("startrek").HasEmbedding("WARP") {
+		t.Errorf("expected embedding of deleted fact to be removed")
+	}
+}
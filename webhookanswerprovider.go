@@ -0,0 +1,279 @@
+/**
+ * Copyright 2024 Boris Wolf
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	WEBHOOK_DEFAULT_TIMEOUT  = 10
+	WEBHOOK_MAX_RESPONSE_LEN = 1 << 20
+	WEBHOOK_SECRETS_CONFIG   = "webhooksecrets" // comma separated host=secret pairs
+)
+
+type WebhookAnswerProvider struct {
+	configProvider ConfigProvider
+	secretProvider SecretProvider
+}
+
+type PluginData struct {
+	Question string
+	User     *User
+	Params   map[string]interface{}
+	Response interface{}
+}
+
+func NewWebhookAnswerProvider(configProvider ConfigProvider, secretProvider SecretProvider) AnswerProvider {
+	answerProvider := WebhookAnswerProvider{
+		configProvider,
+		secretProvider,
+	}
+	return &answerProvider
+}
+
+func (wap *WebhookAnswerProvider) GetAnswers(session *UserSession, question *Question) ([]*Answer, error) {
+	return nil, errors.New("webhook plugin requires a fact")
+}
+
+func (wap *WebhookAnswerProvider) GetPluginAnswers(session *UserSession, question *Question, fact *Fact, params map[string]interface{}) ([]*Answer, error) {
+	hook := fact.Webhook
+	if hook == nil || hook.Url == "" {
+		return nil, errors.New("missing webhook config for fact " + fact.Name)
+	}
+	data := &PluginData{
+		Question: question.Text,
+		User:     session.User,
+		Params:   params,
+	}
+	// secrets may not be part of the url, they are only sent to the hosts they are configured for
+	hookUrl, err := renderPluginTemplate("webhook url", hook.Url, template.FuncMap{"secret": noUrlSecret}, escapeUrlData(data))
+	if err != nil {
+		return nil, err
+	}
+	parsedUrl, err := url.Parse(hookUrl)
+	if err != nil {
+		return nil, err
+	}
+	host := parsedUrl.Hostname()
+	method := strings.ToUpper(hook.Method)
+	if method == "" {
+		method = http.MethodGet
+	}
+	var body io.Reader
+	if hook.Body != "" {
+		b, err := wap.render(host, "body", hook.Body, data)
+		if err != nil {
+			return nil, err
+		}
+		body = strings.NewReader(b)
+	}
+	req, err := http.NewRequest(method, hookUrl, body)
+	if err != nil {
+		return nil, err
+	}
+	if hook.Body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	for name, value := range hook.Headers {
+		v, err := wap.render(host, "header "+name, value, data)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set(name, v)
+	}
+	timeout := hook.Timeout
+	if timeout <= 0 {
+		timeout = WEBHOOK_DEFAULT_TIMEOUT
+	}
+	client := http.Client{Timeout: time.Duration(timeout) * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, WEBHOOK_MAX_RESPONSE_LEN))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("webhook for fact %s failed with status %d", fact.Name, resp.StatusCode)
+	}
+	text := string(respBody)
+	if hook.Response != "" || hook.ResponsePath != "" {
+		err = json.Unmarshal(respBody, &data.Response)
+		if err != nil {
+			return nil, fmt.Errorf("webhook for fact %s returned invalid json: %w", fact.Name, err)
+		}
+		if hook.ResponsePath != "" {
+			data.Response, err = JSONPath(data.Response, hook.ResponsePath)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if hook.Response != "" {
+			text, err = wap.render(host, "response", hook.Response, data)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			text = jsonString(data.Response)
+		}
+	}
+	answers := []*Answer{NewAnswer(text)}
+	for _, link := range fact.Links {
+		answers = append(answers, NewAnswer("").WithLink(link))
+	}
+	session.LastQuestion = question
+	session.LastAnswer = answers
+	return answers, nil
+}
+
+func (wap *WebhookAnswerProvider) render(host, name, text string, data *PluginData) (string, error) {
+	funcs := template.FuncMap{
+		"secret": func(secret string) (string, error) {
+			if !wap.isSecretAllowed(host, secret) {
+				return "", fmt.Errorf("secret %s is not allowed for host %s", secret, host)
+			}
+			return wap.secretProvider.GetSecret(secret), nil
+		},
+	}
+	return renderPluginTemplate("webhook "+name, text, funcs, data)
+}
+
+// isSecretAllowed checks the operator configured list of host=secret pairs, facts can be changed by
+// editors and must not decide which secrets are sent where.
+func (wap *WebhookAnswerProvider) isSecretAllowed(host, secret string) bool {
+	for _, entry := range strings.Split(wap.configProvider.GetConfig(WEBHOOK_SECRETS_CONFIG), ",") {
+		h, s, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if ok && host != "" && strings.EqualFold(strings.TrimSpace(h), host) && strings.TrimSpace(s) == secret {
+			return true
+		}
+	}
+	return false
+}
+
+func noUrlSecret(secret string) (string, error) {
+	return "", fmt.Errorf("secret %s may not be used in the webhook url", secret)
+}
+
+// escapeUrlData returns a copy of the plugin data with the question and all params escaped, so that
+// user input can neither leave the path segment nor add query parameters when rendered into an url.
+func escapeUrlData(data *PluginData) *PluginData {
+	escaped := &PluginData{
+		Question: escapeUrlValue(data.Question),
+		User:     data.User,
+		Params:   make(map[string]interface{}, len(data.Params)),
+	}
+	for k, v := range data.Params {
+		escaped.Params[k] = escapeUrlValue(fmt.Sprint(v))
+	}
+	return escaped
+}
+
+// escapeUrlValue escapes a value for use in a path segment as well as in a query.
+func escapeUrlValue(value string) string {
+	return strings.ReplaceAll(url.QueryEscape(value), "+", "%20")
+}
+
+func renderPluginTemplate(name, text string, funcs template.FuncMap, data *PluginData) (string, error) {
+	allFuncs := template.FuncMap{
+		"json": jsonValue,
+		"text": jsonString,
+		"path": JSONPath,
+	}
+	for k, f := range funcs {
+		allFuncs[k] = f
+	}
+	tmpl, err := template.New(name).Funcs(allFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s template: %w", name, err)
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data)
+	if err != nil {
+		return "", fmt.Errorf("failed to render %s template: %w", name, err)
+	}
+	return buf.String(), nil
+}
+
+// jsonValue encodes a value as json, strings are quoted so that they cannot change the structure of the
+// surrounding json.
+func jsonValue(v interface{}) (string, error) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// jsonString returns strings as they are and encodes anything else as json.
+func jsonString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(buf)
+}
+
+// JSONPath resolves a simple json path of the form $.items[0].name against decoded json.
+func JSONPath(v interface{}, path string) (interface{}, error) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if path == "" {
+		return v, nil
+	}
+	for _, segment := range strings.Split(strings.ReplaceAll(path, "[", ".["), ".") {
+		if segment == "" {
+			continue
+		}
+		if strings.HasPrefix(segment, "[") && strings.HasSuffix(segment, "]") {
+			idx, err := strconv.Atoi(segment[1 : len(segment)-1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid index %s in json path %s", segment, path)
+			}
+			a, ok := v.([]interface{})
+			if !ok || idx < 0 || idx >= len(a) {
+				return nil, fmt.Errorf("no element %s in json path %s", segment, path)
+			}
+			v = a[idx]
+		} else {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("no field %s in json path %s", segment, path)
+			}
+			v, ok = m[segment]
+			if !ok {
+				return nil, fmt.Errorf("no field %s in json path %s", segment, path)
+			}
+		}
+	}
+	return v, nil
+}